@@ -49,6 +49,15 @@ const (
 	// an error while generating a data secret; those kind of errors are usually due to misconfigurations
 	// and user intervention is required to get them fixed.
 	DataSecretGenerationFailedReason = "DataSecretGenerationFailed"
+
+	// WaitingForTokenRotationReason (Severity=Info) documents a worker KThreesConfig waiting for the server token
+	// rotation in progress to switch the cluster to the new token, the current one is about to be invalidated.
+	WaitingForTokenRotationReason = "WaitingForTokenRotation"
+
+	// RegistryConfigUnavailableReason (Severity=Warning) documents a KThreesConfig controller failing to read
+	// the registry configuration referenced by the KThreesConfig; the data secret is not generated until
+	// the referenced object exists and holds the expected key.
+	RegistryConfigUnavailableReason = "RegistryConfigUnavailable"
 )
 
 const (
@@ -69,3 +78,27 @@ const (
 	// an error while retrieving certificates for a joining node.
 	CertificatesCorruptedReason = "CertificatesCorrupted"
 )
+
+const (
+	// ExternalCNIRequiredCondition is informational, it documents that flannel is disabled and the pod network
+	// only becomes available once a CNI has been installed separately in the workload cluster.
+	ExternalCNIRequiredCondition clusterv1.ConditionType = "ExternalCNIRequired"
+
+	// FlannelBackendNoneReason documents flannelBackend being set to none.
+	FlannelBackendNoneReason = "FlannelBackendNone"
+)
+
+const (
+	// NodeRegisteredCondition documents a Machine bootstrapped by a KThreesConfig with a JoinTimeout having
+	// registered its node with the cluster.
+	NodeRegisteredCondition clusterv1.ConditionType = "NodeRegistered"
+
+	// WaitingForNodeRegistrationReason (Severity=Info) documents a KThreesConfig waiting for the node of the Machine
+	// to register, within the JoinTimeout.
+	WaitingForNodeRegistrationReason = "WaitingForNodeRegistration"
+
+	// JoinTimeoutReason (Severity=Warning) documents a Machine without a node past the JoinTimeout of its
+	// KThreesConfig, e.g. because of a wrong token or an unreachable server; the reason is written to
+	// /run/cluster-api/bootstrap-failure.log on the machine.
+	JoinTimeoutReason = "JoinTimeout"
+)
@@ -0,0 +1,1005 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1beta1
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template/parse"
+	"time"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+	"sigs.k8s.io/yaml"
+
+	"github.com/cluster-api-provider-k3s/cluster-api-k3s/pkg/cis"
+)
+
+var channelRegex = regexp.MustCompile(`^[a-zA-Z0-9.+-]+$`)
+
+var envVarNameRegex = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+var fileModeRegex = regexp.MustCompile(`^0?[0-7]{3}$`)
+
+// dataDirRegex matches absolute paths safe to use unquoted in the bootstrap commands.
+var dataDirRegex = regexp.MustCompile(`^/[a-zA-Z0-9._/-]*$`)
+
+// kthreesConfigValidatePath is the path of the KThreesConfig validating webhook, see the kubebuilder marker below.
+const kthreesConfigValidatePath = "/validate-bootstrap-cluster-x-k8s-io-v1beta1-kthreesconfig"
+
+// SetupWebhookWithManager sets up the KThreesConfig webhooks with the manager.
+func (c *KThreesConfig) SetupWebhookWithManager(mgr ctrl.Manager) error {
+	// The validating webhook is registered ahead of the builder, which then skips its own for the path.
+	mgr.GetWebhookServer().Register(kthreesConfigValidatePath, &webhook.Admission{
+		Handler: &warningHandler{validator: admission.ValidatingWebhookFor(c).Handler},
+	})
+
+	return ctrl.NewWebhookManagedBy(mgr).
+		For(c).
+		Complete()
+}
+
+// +kubebuilder:webhook:verbs=create;update,path=/validate-bootstrap-cluster-x-k8s-io-v1beta1-kthreesconfig,mutating=false,failurePolicy=fail,sideEffects=None,groups=bootstrap.cluster.x-k8s.io,resources=kthreesconfigs,versions=v1beta1,name=validation.kthreesconfig.bootstrap.cluster.x-k8s.io,admissionReviewVersions=v1;v1beta1
+
+var _ webhook.Validator = &KThreesConfig{}
+
+// ValidateCreate implements webhook.Validator so a webhook will be registered for the type.
+func (c *KThreesConfig) ValidateCreate() error {
+	return c.validate()
+}
+
+// ValidateUpdate implements webhook.Validator so a webhook will be registered for the type.
+func (c *KThreesConfig) ValidateUpdate(_ runtime.Object) error {
+	return c.validate()
+}
+
+// ValidateDelete implements webhook.Validator so a webhook will be registered for the type.
+func (c *KThreesConfig) ValidateDelete() error {
+	return nil
+}
+
+func (c *KThreesConfig) validate() error {
+	allErrs := c.Spec.Validate(field.NewPath("spec"))
+	allErrs = append(allErrs, c.Spec.ValidateInstallScriptURL(field.NewPath("spec"), c.Annotations)...)
+	if len(allErrs) == 0 {
+		return nil
+	}
+
+	return apierrors.NewInvalid(GroupVersion.WithKind("KThreesConfig").GroupKind(), c.Name, allErrs)
+}
+
+// warningHandler runs the KThreesConfig validation and adds admission warnings to the requests it allows,
+// which webhook.Validator has no way to return.
+type warningHandler struct {
+	validator admission.Handler
+	decoder   *admission.Decoder
+}
+
+var _ admission.DecoderInjector = &warningHandler{}
+
+// InjectDecoder injects the decoder into the handler and the validation it runs.
+func (h *warningHandler) InjectDecoder(d *admission.Decoder) error {
+	h.decoder = d
+	_, err := admission.InjectDecoderInto(d, h.validator)
+	return err
+}
+
+// Handle validates the KThreesConfig of the request, and warns about its deprecated settings if it is allowed.
+func (h *warningHandler) Handle(ctx context.Context, req admission.Request) admission.Response {
+	resp := h.validator.Handle(ctx, req)
+	if !resp.Allowed || req.Operation == admissionv1.Delete {
+		return resp
+	}
+
+	config := &KThreesConfig{}
+	if err := h.decoder.Decode(req, config); err != nil {
+		return resp
+	}
+	return resp.WithWarnings(config.Spec.Warnings(field.NewPath("spec"))...)
+}
+
+// typedArgs maps the component arguments k3s gets a typed field for to the path of that field.
+var typedArgs = map[string]map[string]string{
+	"kubeAPIServerArg": {
+		"advertise-address":          "serverConfig.advertiseAddress",
+		"bind-address":               "serverConfig.bindAddress",
+		"encryption-provider-config": "serverConfig.secretsEncryption",
+		"secure-port":                "serverConfig.httpsListenPort",
+		"service-cluster-ip-range":   "serverConfig.serviceCidr",
+	},
+	"kubeControllerManagerArgs": {
+		"cluster-cidr":             "serverConfig.clusterCidr",
+		"service-cluster-ip-range": "serverConfig.serviceCidr",
+	},
+	"kubeletArgs": {
+		"cluster-dns":          "serverConfig.clusterDNS",
+		"cluster-domain":       "serverConfig.clusterDomain",
+		"hostname-override":    "agentConfig.nodeName",
+		"node-ip":              "agentConfig.nodeIP",
+		"node-labels":          "agentConfig.nodeLabels",
+		"register-with-taints": "agentConfig.nodeTaints",
+	},
+	"kubeProxyArgs": {
+		"cluster-cidr":      "serverConfig.clusterCidr",
+		"hostname-override": "agentConfig.nodeName",
+	},
+}
+
+// Warnings returns the settings of the KThreesConfigSpec that are accepted but discouraged: component arguments
+// duplicating a typed field, which k3s already turns into the argument and may conflict with it.
+func (c *KThreesConfigSpec) Warnings(pathPrefix *field.Path) []string {
+	var warnings []string
+
+	warn := func(args []string, configPath *field.Path, component string) {
+		for i, arg := range args {
+			key, _, _ := strings.Cut(arg, "=")
+			key = strings.TrimLeft(key, "-")
+			if typed, ok := typedArgs[component][key]; ok {
+				warnings = append(warnings, fmt.Sprintf("%s: %s duplicates %s.%s, set it there instead",
+					configPath.Child(component).Index(i), key, pathPrefix, typed))
+			}
+		}
+	}
+	warn(c.ServerConfig.KubeAPIServerArgs, pathPrefix.Child("serverConfig"), "kubeAPIServerArg")
+	warn(c.ServerConfig.KubeControllerManagerArgs, pathPrefix.Child("serverConfig"), "kubeControllerManagerArgs")
+	warn(c.AgentConfig.KubeletArgs, pathPrefix.Child("agentConfig"), "kubeletArgs")
+	warn(c.AgentConfig.KubeProxyArgs, pathPrefix.Child("agentConfig"), "kubeProxyArgs")
+
+	return warnings
+}
+
+// Validate ensures the KThreesConfigSpec is valid.
+// The pathPrefix allows embedding objects such as KThreesControlPlane to report errors against their own paths.
+func (c *KThreesConfigSpec) Validate(pathPrefix *field.Path) field.ErrorList {
+	var allErrs field.ErrorList
+
+	allErrs = append(allErrs, c.ServerConfig.validate(pathPrefix.Child("serverConfig"))...)
+	allErrs = append(allErrs, c.AgentConfig.validate(pathPrefix.Child("agentConfig"))...)
+	allErrs = append(allErrs, c.validateCloudProvider(pathPrefix)...)
+	allErrs = append(allErrs, c.validateCISProfile(pathPrefix)...)
+
+	if c.Role == NodeRoleAgent && c.ServerConfig.HasServerOnlySettings() {
+		allErrs = append(allErrs, field.Forbidden(pathPrefix.Child("serverConfig"),
+			"only disableExternalCloudProvider, clusterCidr and serviceCidr can be set with the agent role"))
+	}
+
+	for i := range c.Files {
+		allErrs = append(allErrs, c.Files[i].validate(pathPrefix.Child("files").Index(i))...)
+	}
+
+	if c.RegistrationAddress != "" {
+		fldPath := pathPrefix.Child("registrationAddress")
+		host, port, err := net.SplitHostPort(c.RegistrationAddress)
+		if err != nil || host == "" {
+			allErrs = append(allErrs, field.Invalid(fldPath, c.RegistrationAddress, "must be in the form host:port"))
+		} else {
+			allErrs = append(allErrs, validatePort(port, fldPath)...)
+		}
+	}
+
+	if c.DataDir != "" && !dataDirRegex.MatchString(c.DataDir) {
+		allErrs = append(allErrs, field.Invalid(pathPrefix.Child("dataDir"), c.DataDir,
+			"must be an absolute path consisting of alphanumeric characters, '.', '_', '-' or '/'"))
+	}
+
+	if c.Channel != "" && !channelRegex.MatchString(c.Channel) {
+		allErrs = append(allErrs, field.Invalid(pathPrefix.Child("channel"), c.Channel,
+			"must consist of alphanumeric characters, '.', '-' or '+'"))
+	}
+
+	// The embedded registry mirror manages registry configuration on its own and can't be combined
+	// with an explicit private registry file.
+	if c.ServerConfig.EmbeddedRegistryEnabled() && c.AgentConfig.PrivateRegistry != "" {
+		allErrs = append(allErrs, field.Forbidden(pathPrefix.Child("serverConfig", "embeddedRegistry"),
+			"cannot be enabled together with agentConfig.privateRegistry"))
+	}
+	if c.ServerConfig.EmbeddedRegistryEnabled() && c.RegistryConfigRef != nil {
+		allErrs = append(allErrs, field.Forbidden(pathPrefix.Child("serverConfig", "embeddedRegistry"),
+			"cannot be enabled together with registryConfigRef"))
+	}
+
+	if c.SystemProxy != nil {
+		allErrs = append(allErrs, c.SystemProxy.validate(pathPrefix.Child("systemProxy"))...)
+	}
+
+	allErrs = append(allErrs, validateEnvironment(c.ServerEnvironment, pathPrefix.Child("serverEnvironment"))...)
+	allErrs = append(allErrs, validateEnvironment(c.AgentEnvironment, pathPrefix.Child("agentEnvironment"))...)
+	if c.Role == NodeRoleAgent && len(c.ServerEnvironment) > 0 {
+		allErrs = append(allErrs, field.Forbidden(pathPrefix.Child("serverEnvironment"), "cannot be set with the agent role"))
+	}
+	if c.Role == NodeRoleServer && len(c.AgentEnvironment) > 0 {
+		allErrs = append(allErrs, field.Forbidden(pathPrefix.Child("agentEnvironment"), "cannot be set with the server role"))
+	}
+
+	allErrs = append(allErrs, c.validateAirgapImages(pathPrefix)...)
+
+	for name, content := range c.ConfigDropIns {
+		allErrs = append(allErrs, validateConfigDropIn(name, content, pathPrefix.Child("configDropIns").Key(name))...)
+	}
+
+	if c.NetworkConfig != "" {
+		var networkConfig map[string]interface{}
+		if err := yaml.Unmarshal([]byte(c.NetworkConfig), &networkConfig); err != nil {
+			allErrs = append(allErrs, field.Invalid(pathPrefix.Child("networkConfig"), c.NetworkConfig, fmt.Sprintf("must be a YAML mapping: %v", err)))
+		}
+	}
+
+	switch c.InitSystem {
+	case "", InitSystemSystemd:
+	case InitSystemOpenRC:
+		// Ignition is meant for Flatcar Container Linux, which runs systemd.
+		if c.Format == Ignition {
+			allErrs = append(allErrs, field.Forbidden(pathPrefix.Child("initSystem"), "cannot be openrc with the ignition format"))
+		}
+	default:
+		allErrs = append(allErrs, field.NotSupported(pathPrefix.Child("initSystem"), c.InitSystem,
+			[]string{string(InitSystemSystemd), string(InitSystemOpenRC)}))
+	}
+
+	// Compressed user-data is a MIME multipart message only understood by cloud-init.
+	if c.Format == Ignition && c.CompressUserData != nil && *c.CompressUserData {
+		allErrs = append(allErrs, field.Forbidden(pathPrefix.Child("compressUserData"), "cannot be enabled with the ignition format"))
+	}
+
+	if c.RegistryConfigRef != nil && c.RegistryConfigRef.Name == "" {
+		allErrs = append(allErrs, field.Required(pathPrefix.Child("registryConfigRef", "name"), ""))
+	}
+
+	if c.JoinTimeout != nil && c.JoinTimeout.Duration <= 0 {
+		allErrs = append(allErrs, field.Invalid(pathPrefix.Child("joinTimeout"), c.JoinTimeout.Duration.String(), "must be positive"))
+	}
+
+	return allErrs
+}
+
+// ValidateInstallScriptURL ensures the install script is fetched over https, unless the owning object
+// carries the AllowInsecureInstallScriptAnnotation.
+func (c *KThreesConfigSpec) ValidateInstallScriptURL(pathPrefix *field.Path, annotations map[string]string) field.ErrorList {
+	if c.InstallScriptURL == "" {
+		return nil
+	}
+
+	fldPath := pathPrefix.Child("installScriptURL")
+
+	// The URL is passed unquoted to curl in the bootstrap command.
+	u, err := url.ParseRequestURI(c.InstallScriptURL)
+	if err != nil || u.Host == "" || strings.ContainsAny(c.InstallScriptURL, urlShellMetacharacters) {
+		return field.ErrorList{field.Invalid(fldPath, c.InstallScriptURL, "must be a valid absolute URL without quotes or shell metacharacters")}
+	}
+
+	switch u.Scheme {
+	case "https":
+	case "http":
+		if _, ok := annotations[AllowInsecureInstallScriptAnnotation]; !ok {
+			return field.ErrorList{field.Forbidden(fldPath,
+				fmt.Sprintf("must use https unless the %s annotation is set", AllowInsecureInstallScriptAnnotation))}
+		}
+	default:
+		return field.ErrorList{field.NotSupported(fldPath, u.Scheme, []string{"https", "http"})}
+	}
+
+	return nil
+}
+
+// urlShellMetacharacters are rejected in the URLs curl is given by the bootstrap commands, which don't quote them.
+const urlShellMetacharacters = " '\"`$;&|"
+
+// airgapImagesExtensions are the images tarball formats k3s imports from its agent images directory.
+var airgapImagesExtensions = []string{".tar", ".tar.gz", ".tgz", ".tar.bz2", ".tbz", ".tar.lz4", ".tar.zst", ".tzst"}
+
+var sha256Regex = regexp.MustCompile(`^[a-fA-F0-9]{64}$`)
+
+// validateAirgapImages ensures the airgap images tarball is an http(s) URL that can be safely passed to curl,
+// to a file k3s knows how to import, and that its checksum is a SHA-256 one.
+func (c *KThreesConfigSpec) validateAirgapImages(pathPrefix *field.Path) field.ErrorList {
+	var allErrs field.ErrorList
+
+	if c.AirgapImagesURL != "" {
+		fldPath := pathPrefix.Child("airgapImagesURL")
+		u, err := url.Parse(c.AirgapImagesURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || strings.ContainsAny(c.AirgapImagesURL, urlShellMetacharacters) {
+			allErrs = append(allErrs, field.Invalid(fldPath, c.AirgapImagesURL, "must be an absolute http or https URL"))
+		} else {
+			supported := false
+			for _, ext := range airgapImagesExtensions {
+				supported = supported || strings.HasSuffix(u.Path, ext)
+			}
+			if !supported {
+				allErrs = append(allErrs, field.Invalid(fldPath, c.AirgapImagesURL,
+					fmt.Sprintf("must point at an images tarball ending with one of %s", strings.Join(airgapImagesExtensions, ", "))))
+			}
+		}
+	}
+
+	if c.AirgapImagesChecksum != "" {
+		fldPath := pathPrefix.Child("airgapImagesChecksum")
+		if c.AirgapImagesURL == "" {
+			allErrs = append(allErrs, field.Forbidden(fldPath, "can only be set together with airgapImagesURL"))
+		}
+		if !sha256Regex.MatchString(c.AirgapImagesChecksum) {
+			allErrs = append(allErrs, field.Invalid(fldPath, c.AirgapImagesChecksum, "must be a hex encoded SHA-256 checksum"))
+		}
+	}
+
+	return allErrs
+}
+
+// validateConfigDropIn ensures a config drop-in is a .yaml file directly in the drop-in directory, which is the only
+// kind k3s picks up, holding a YAML mapping of k3s flags.
+func validateConfigDropIn(name, content string, fldPath *field.Path) field.ErrorList {
+	if !strings.HasSuffix(name, ".yaml") || name == ".yaml" || strings.ContainsAny(name, "/\\ \t\n'\"`$;&|") {
+		return field.ErrorList{field.Invalid(fldPath, name, "must be a file name ending with .yaml, without path separators, whitespace, quotes or shell metacharacters")}
+	}
+
+	var config map[string]interface{}
+	if err := yaml.Unmarshal([]byte(content), &config); err != nil {
+		return field.ErrorList{field.Invalid(fldPath, content, fmt.Sprintf("must be a YAML mapping of k3s flags: %v", err))}
+	}
+
+	return nil
+}
+
+// validateEnvironment ensures the environment variables can be written to a systemd environment file: names made of
+// letters, digits and underscores not starting with a digit, values on a single line.
+func validateEnvironment(env map[string]string, fldPath *field.Path) field.ErrorList {
+	var allErrs field.ErrorList
+
+	for name, value := range env {
+		if !envVarNameRegex.MatchString(name) {
+			allErrs = append(allErrs, field.Invalid(fldPath.Key(name), name,
+				"must consist of letters, digits and '_', and not start with a digit"))
+		}
+		if strings.ContainsAny(value, "\r\n") {
+			allErrs = append(allErrs, field.Invalid(fldPath.Key(name), value, "must be a single line"))
+		}
+	}
+
+	return allErrs
+}
+
+// validate ensures the file has a path and takes its content from a single source.
+func (f *File) validate(pathPrefix *field.Path) field.ErrorList {
+	var allErrs field.ErrorList
+
+	if f.Path == "" {
+		allErrs = append(allErrs, field.Required(pathPrefix.Child("path"), ""))
+	}
+
+	if f.ContentFrom == nil {
+		return allErrs
+	}
+
+	if f.Content != "" {
+		allErrs = append(allErrs, field.Invalid(pathPrefix, f, "only one of content or contentFrom may be specified"))
+	}
+	if f.ContentFrom.Secret.Name == "" {
+		allErrs = append(allErrs, field.Required(pathPrefix.Child("contentFrom", "secret", "name"), ""))
+	}
+	if f.ContentFrom.Secret.Key == "" {
+		allErrs = append(allErrs, field.Required(pathPrefix.Child("contentFrom", "secret", "key"), ""))
+	}
+
+	return allErrs
+}
+
+func (p *SystemProxy) validate(pathPrefix *field.Path) field.ErrorList {
+	var allErrs field.ErrorList
+
+	allErrs = append(allErrs, validateProxyURL(p.HTTPProxy, pathPrefix.Child("httpProxy"))...)
+	allErrs = append(allErrs, validateProxyURL(p.HTTPSProxy, pathPrefix.Child("httpsProxy"))...)
+
+	for i, entry := range p.NoProxy {
+		if entry == "" || strings.ContainsAny(entry, " \t\n'\"`$;&|,") {
+			allErrs = append(allErrs, field.Invalid(pathPrefix.Child("noProxy").Index(i), entry,
+				"must be a non-empty host, domain or CIDR without whitespace, quotes, commas or shell metacharacters"))
+		}
+	}
+
+	return allErrs
+}
+
+// validateProxyURL ensures a proxy is an absolute http(s) URL that can be safely passed to the install script.
+func validateProxyURL(proxy string, fldPath *field.Path) field.ErrorList {
+	if proxy == "" {
+		return nil
+	}
+
+	u, err := url.Parse(proxy)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || strings.ContainsAny(proxy, urlShellMetacharacters) {
+		return field.ErrorList{field.Invalid(fldPath, proxy, "must be an absolute http or https URL")}
+	}
+
+	return nil
+}
+
+// validateCloudProvider rejects explicit cloud-provider arguments while the external cloud provider is enabled,
+// since the generated config already passes cloud-provider=external to the kubelet and controller manager.
+func (c *KThreesConfigSpec) validateCloudProvider(pathPrefix *field.Path) field.ErrorList {
+	if c.ServerConfig.DisableExternalCloudProvider {
+		return nil
+	}
+
+	var allErrs field.ErrorList
+
+	conflicting := func(args []string, fldPath *field.Path) {
+		for i, arg := range args {
+			if strings.HasPrefix(strings.TrimLeft(arg, "-"), "cloud-provider=") {
+				allErrs = append(allErrs, field.Forbidden(fldPath.Index(i),
+					"cloud-provider cannot be set unless serverConfig.disableExternalCloudProvider is true"))
+			}
+		}
+	}
+	conflicting(c.AgentConfig.KubeletArgs, pathPrefix.Child("agentConfig", "kubeletArgs"))
+	conflicting(c.ServerConfig.KubeControllerManagerArgs, pathPrefix.Child("serverConfig", "kubeControllerManagerArgs"))
+
+	return allErrs
+}
+
+// validateCISProfile rejects the settings the CIS profile would otherwise override: the component arguments and
+// files it sets, and secrets encryption explicitly disabled.
+func (c *KThreesConfigSpec) validateCISProfile(pathPrefix *field.Path) field.ErrorList {
+	if c.CISProfile == "" {
+		return nil
+	}
+
+	var allErrs field.ErrorList
+
+	conflicting := func(args []string, profileArgs []string, fldPath *field.Path) {
+		profileKeys := map[string]bool{}
+		for _, arg := range profileArgs {
+			key, _, _ := strings.Cut(arg, "=")
+			profileKeys[key] = true
+		}
+		for i, arg := range args {
+			key, _, _ := strings.Cut(arg, "=")
+			key = strings.TrimLeft(key, "-")
+			if profileKeys[key] {
+				allErrs = append(allErrs, field.Forbidden(fldPath.Index(i), fmt.Sprintf("%s is set by cisProfile", key)))
+			}
+		}
+	}
+	conflicting(c.ServerConfig.KubeAPIServerArgs, cis.KubeAPIServerArgs(c.K3sDataDir()), pathPrefix.Child("serverConfig", "kubeAPIServerArg"))
+	conflicting(c.ServerConfig.KubeControllerManagerArgs, cis.KubeControllerManagerArgs, pathPrefix.Child("serverConfig", "kubeControllerManagerArgs"))
+	conflicting(c.AgentConfig.KubeletArgs, append([]string{"protect-kernel-defaults"}, cis.KubeletArgs...), pathPrefix.Child("agentConfig", "kubeletArgs"))
+
+	profilePaths := map[string]bool{}
+	for _, f := range cis.ServerFiles(c.K3sDataDir()) {
+		profilePaths[f.Path] = true
+	}
+	for i, f := range c.Files {
+		if profilePaths[f.Path] {
+			allErrs = append(allErrs, field.Forbidden(pathPrefix.Child("files").Index(i).Child("path"), fmt.Sprintf("%s is written by cisProfile", f.Path)))
+		}
+	}
+
+	if c.ServerConfig.SecretsEncryption != nil && !*c.ServerConfig.SecretsEncryption {
+		allErrs = append(allErrs, field.Forbidden(pathPrefix.Child("serverConfig", "secretsEncryption"), "cannot be disabled with cisProfile"))
+	}
+
+	return allErrs
+}
+
+func (c *KThreesServerConfig) validate(pathPrefix *field.Path) field.ErrorList {
+	var allErrs field.ErrorList
+
+	known := map[DisabledComponent]bool{}
+	supported := make([]string, 0, len(DisabledComponents))
+	for _, component := range DisabledComponents {
+		known[component] = true
+		supported = append(supported, string(component))
+	}
+
+	seen := map[DisabledComponent]bool{}
+	for i, component := range c.DisableComponents {
+		fldPath := pathPrefix.Child("disableComponents").Index(i)
+		if !known[component] {
+			allErrs = append(allErrs, field.NotSupported(fldPath, component, supported))
+		}
+		if seen[component] {
+			allErrs = append(allErrs, field.Duplicate(fldPath, component))
+		}
+		seen[component] = true
+	}
+
+	if c.FlannelBackend != "" {
+		backends := make([]string, 0, len(FlannelBackends))
+		supported := false
+		for _, backend := range FlannelBackends {
+			backends = append(backends, string(backend))
+			supported = supported || backend == c.FlannelBackend
+		}
+		if !supported {
+			allErrs = append(allErrs, field.NotSupported(pathPrefix.Child("flannelBackend"), c.FlannelBackend, backends))
+		}
+	}
+
+	// Without kube-proxy, services are only reachable through a CNI replacing it, which can't run next to flannel.
+	if c.KubeProxyDisabled() && c.FlannelBackend != FlannelBackendNone {
+		allErrs = append(allErrs, field.Forbidden(pathPrefix.Child("disableKubeProxy"),
+			fmt.Sprintf("requires flannelBackend %s, so that a CNI replacing kube-proxy can be installed", FlannelBackendNone)))
+	}
+
+	for i, san := range c.TLSSan {
+		if net.ParseIP(san) == nil && len(validation.IsDNS1123Subdomain(san)) > 0 && len(validation.IsWildcardDNS1123Subdomain(san)) > 0 {
+			allErrs = append(allErrs, field.Invalid(pathPrefix.Child("tlsSan").Index(i), san, "must be a valid hostname or IP address"))
+		}
+	}
+
+	allErrs = append(allErrs, validateArgs(c.KubeAPIServerArgs, pathPrefix.Child("kubeAPIServerArg"))...)
+	allErrs = append(allErrs, validateArgs(c.KubeControllerManagerArgs, pathPrefix.Child("kubeControllerManagerArgs"))...)
+	allErrs = append(allErrs, validateArgs(c.KubeSchedulerArgs, pathPrefix.Child("kubeSchedulerArgs"))...)
+	allErrs = append(allErrs, validateArgs(c.EtcdArgs, pathPrefix.Child("etcdArgs"))...)
+
+	allErrs = append(allErrs, validateCIDRs(c.ClusterCidr, pathPrefix.Child("clusterCidr"))...)
+	allErrs = append(allErrs, validateCIDRs(c.ServiceCidr, pathPrefix.Child("serviceCidr"))...)
+	allErrs = append(allErrs, c.validateNetworks(pathPrefix)...)
+
+	allErrs = append(allErrs, validatePort(c.HTTPSListenPort, pathPrefix.Child("httpsListenPort"))...)
+	allErrs = append(allErrs, validatePort(c.AdvertisePort, pathPrefix.Child("advertisePort"))...)
+
+	if c.WriteKubeconfigMode != "" && !fileModeRegex.MatchString(c.WriteKubeconfigMode) {
+		allErrs = append(allErrs, field.Invalid(pathPrefix.Child("writeKubeconfigMode"), c.WriteKubeconfigMode,
+			"must be an octal file mode, e.g. 0644"))
+	}
+
+	// The listen port is the single source of truth for the apiserver port, the advertised port must agree with it.
+	if c.HTTPSListenPort != "" && c.AdvertisePort != "" && c.HTTPSListenPort != c.AdvertisePort {
+		allErrs = append(allErrs, field.Invalid(pathPrefix.Child("advertisePort"), c.AdvertisePort,
+			"must match httpsListenPort when both are set"))
+	}
+
+	if c.EtcdSnapshot != nil {
+		allErrs = append(allErrs, c.EtcdSnapshot.validate(pathPrefix.Child("etcdSnapshot"))...)
+	}
+
+	if c.ClusterResetRestorePath != "" {
+		allErrs = append(allErrs, ValidateSnapshotPath(c.ClusterResetRestorePath, pathPrefix.Child("clusterResetRestorePath"))...)
+	}
+
+	if c.Datastore != nil {
+		allErrs = append(allErrs, c.Datastore.validate(pathPrefix.Child("datastore"))...)
+	}
+
+	// Snapshots, restores and etcd arguments operate on the embedded etcd, they have no effect with an external datastore.
+	if c.Datastore.IsExternal() {
+		datastorePath := pathPrefix.Child("datastore", "type")
+		if c.EtcdSnapshot != nil {
+			allErrs = append(allErrs, ExternalDatastoreConflict(pathPrefix.Child("etcdSnapshot"), datastorePath))
+		}
+		if c.ClusterResetRestorePath != "" {
+			allErrs = append(allErrs, ExternalDatastoreConflict(pathPrefix.Child("clusterResetRestorePath"), datastorePath))
+		}
+		if len(c.EtcdArgs) > 0 {
+			allErrs = append(allErrs, ExternalDatastoreConflict(pathPrefix.Child("etcdArgs"), datastorePath))
+		}
+	}
+
+	return allErrs
+}
+
+func (c *DatastoreConfig) validate(pathPrefix *field.Path) field.ErrorList {
+	var allErrs field.ErrorList
+
+	hasEndpointSecret := c.EndpointSecret != nil && c.EndpointSecret.Name != ""
+	switch {
+	case c.IsExternal() && !hasEndpointSecret:
+		allErrs = append(allErrs, field.Required(pathPrefix.Child("endpointSecret", "name"), "is required for an external datastore"))
+	case !c.IsExternal() && c.EndpointSecret != nil:
+		allErrs = append(allErrs, field.Forbidden(pathPrefix.Child("endpointSecret"), "can only be set for an external datastore"))
+	}
+
+	return allErrs
+}
+
+func (c *EtcdSnapshotConfig) validate(pathPrefix *field.Path) field.ErrorList {
+	var allErrs field.ErrorList
+
+	if c.ScheduleCron != "" {
+		if err := validateCron(c.ScheduleCron); err != nil {
+			allErrs = append(allErrs, field.Invalid(pathPrefix.Child("scheduleCron"), c.ScheduleCron, err.Error()))
+		}
+	}
+
+	if c.Retention != nil && *c.Retention < 1 {
+		allErrs = append(allErrs, field.Invalid(pathPrefix.Child("retention"), *c.Retention, "must be greater than 0"))
+	}
+
+	if c.S3 != nil {
+		if c.S3.Bucket == "" {
+			allErrs = append(allErrs, field.Required(pathPrefix.Child("s3", "bucket"), "is required when s3 is enabled"))
+		}
+		if c.S3.CredentialsSecret == nil || c.S3.CredentialsSecret.Name == "" {
+			allErrs = append(allErrs, field.Required(pathPrefix.Child("s3", "credentialsSecret"), "is required when s3 is enabled"))
+		}
+	}
+
+	return allErrs
+}
+
+func (c *KThreesAgentConfig) validate(pathPrefix *field.Path) field.ErrorList {
+	var allErrs field.ErrorList
+
+	for i, taint := range c.NodeTaints {
+		allErrs = append(allErrs, validateTaint(taint, pathPrefix.Child("nodeTaints").Index(i))...)
+	}
+
+	// Templates are resolved again once the Machine is known, placeholders catch most mistakes up front.
+	for i, label := range c.NodeLabels {
+		fldPath := pathPrefix.Child("nodeLabels").Index(i)
+		resolved, err := resolveTemplate("node label", label, templateValidationInput)
+		if err != nil {
+			allErrs = append(allErrs, field.Invalid(fldPath, label, err.Error()))
+			continue
+		}
+		for _, labelErr := range validateLabel(resolved, fldPath) {
+			labelErr.BadValue = label
+			allErrs = append(allErrs, labelErr)
+		}
+	}
+
+	allErrs = append(allErrs, validateArgs(c.KubeletArgs, pathPrefix.Child("kubeletArgs"))...)
+
+	if _, err := c.ResolveNodeName(templateValidationInput); err != nil {
+		allErrs = append(allErrs, field.Invalid(pathPrefix.Child("nodeName"), c.NodeName, err.Error()))
+	}
+
+	allErrs = append(allErrs, validateIPs(c.NodeIP, pathPrefix.Child("nodeIP"))...)
+	allErrs = append(allErrs, validateIPs(c.NodeExternalIP, pathPrefix.Child("nodeExternalIP"))...)
+
+	if err := validateContainerdConfigTemplate(c.ContainerdConfigTemplate); err != nil {
+		allErrs = append(allErrs, field.Invalid(pathPrefix.Child("containerdConfigTemplate"), c.ContainerdConfigTemplate, err.Error()))
+	}
+
+	return allErrs
+}
+
+// validateContainerdConfigTemplate ensures the containerd config template is a well formed Go template. The functions
+// it calls are not checked as k3s provides its own, and the TOML is only known once k3s renders the template.
+func validateContainerdConfigTemplate(tmpl string) error {
+	if tmpl == "" {
+		return nil
+	}
+
+	tree := parse.New("containerdConfigTemplate")
+	tree.Mode = parse.SkipFuncCheck
+	if _, err := tree.Parse(tmpl, "", "", map[string]*parse.Tree{}); err != nil {
+		return fmt.Errorf("must be a valid Go template: %w", err)
+	}
+	return nil
+}
+
+// validateArgs ensures each component argument is in the key=value form k3s expects, the key may be prefixed with dashes.
+func validateArgs(args []string, fldPath *field.Path) field.ErrorList {
+	var allErrs field.ErrorList
+
+	for i, arg := range args {
+		if key, _, found := strings.Cut(arg, "="); !found || strings.TrimLeft(key, "-") == "" {
+			allErrs = append(allErrs, field.Invalid(fldPath.Index(i), arg, "must be in the form key=value"))
+		}
+	}
+
+	return allErrs
+}
+
+// validateLabel ensures a label is in the key=value format expected by k3s --node-label, with a valid Kubernetes
+// label key and value.
+func validateLabel(label string, fldPath *field.Path) field.ErrorList {
+	key, value, found := strings.Cut(label, "=")
+	if !found {
+		return field.ErrorList{field.Invalid(fldPath, label, "must be in the form key=value")}
+	}
+
+	// The parts left to cloud-init are only known once it renders them on the machine.
+	var allErrs field.ErrorList
+	if !hasCloudInitTemplate(key) {
+		for _, msg := range validation.IsQualifiedName(key) {
+			allErrs = append(allErrs, field.Invalid(fldPath, label, msg))
+		}
+	}
+	if !hasCloudInitTemplate(value) {
+		for _, msg := range validation.IsValidLabelValue(value) {
+			allErrs = append(allErrs, field.Invalid(fldPath, label, msg))
+		}
+	}
+
+	return allErrs
+}
+
+// validateTaint ensures a taint is in the key[=value]:effect format expected by k3s --node-taint.
+func validateTaint(taint string, fldPath *field.Path) field.ErrorList {
+	keyValue, effect, found := strings.Cut(taint, ":")
+	if !found || keyValue == "" {
+		return field.ErrorList{field.Invalid(fldPath, taint, "must be in the form key[=value]:effect")}
+	}
+
+	switch corev1.TaintEffect(effect) {
+	case corev1.TaintEffectNoSchedule, corev1.TaintEffectPreferNoSchedule, corev1.TaintEffectNoExecute:
+	default:
+		return field.ErrorList{field.NotSupported(fldPath, effect, []string{
+			string(corev1.TaintEffectNoSchedule),
+			string(corev1.TaintEffectPreferNoSchedule),
+			string(corev1.TaintEffectNoExecute),
+		})}
+	}
+
+	if key, _, _ := strings.Cut(keyValue, "="); key == "" {
+		return field.ErrorList{field.Invalid(fldPath, taint, "taint key must not be empty")}
+	}
+
+	return nil
+}
+
+var cronDescriptors = map[string]bool{
+	"@yearly": true, "@annually": true, "@monthly": true, "@weekly": true,
+	"@daily": true, "@midnight": true, "@hourly": true,
+}
+
+// cronFields describes the bounds and names accepted by each field of the standard cron spec used by k3s.
+var cronFields = []struct {
+	name     string
+	min, max int
+	names    []string
+}{
+	{name: "minute", min: 0, max: 59},
+	{name: "hour", min: 0, max: 23},
+	{name: "day of month", min: 1, max: 31},
+	{name: "month", min: 1, max: 12, names: []string{"jan", "feb", "mar", "apr", "may", "jun", "jul", "aug", "sep", "oct", "nov", "dec"}},
+	{name: "day of week", min: 0, max: 6, names: []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}},
+}
+
+// validateCron ensures spec is a standard five field cron expression or descriptor, as accepted by k3s.
+func validateCron(spec string) error {
+	if strings.HasPrefix(spec, "@every ") {
+		if d, err := time.ParseDuration(strings.TrimPrefix(spec, "@every ")); err != nil || d <= 0 {
+			return fmt.Errorf("invalid duration in %q", spec)
+		}
+		return nil
+	}
+	if strings.HasPrefix(spec, "@") {
+		if !cronDescriptors[spec] {
+			return fmt.Errorf("unrecognized descriptor %q", spec)
+		}
+		return nil
+	}
+
+	fields := strings.Fields(spec)
+	if len(fields) != len(cronFields) {
+		return fmt.Errorf("expected %d fields, found %d", len(cronFields), len(fields))
+	}
+
+	for i, f := range cronFields {
+		for _, part := range strings.Split(fields[i], ",") {
+			if err := validateCronRange(part, f.min, f.max, f.names); err != nil {
+				return fmt.Errorf("invalid %s: %w", f.name, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+func validateCronRange(expr string, min, max int, names []string) error {
+	rangeExpr, step, hasStep := strings.Cut(expr, "/")
+	if hasStep {
+		if s, err := strconv.Atoi(step); err != nil || s < 1 {
+			return fmt.Errorf("invalid step %q", step)
+		}
+	}
+
+	if rangeExpr == "*" || rangeExpr == "?" {
+		return nil
+	}
+
+	parse := func(v string) (int, error) {
+		for i, name := range names {
+			if strings.EqualFold(v, name) {
+				return i + min, nil
+			}
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil || n < min || n > max {
+			return 0, fmt.Errorf("value %q out of range [%d, %d]", v, min, max)
+		}
+		return n, nil
+	}
+
+	low, high, isRange := strings.Cut(rangeExpr, "-")
+	start, err := parse(low)
+	if err != nil {
+		return err
+	}
+	if !isRange {
+		return nil
+	}
+
+	end, err := parse(high)
+	if err != nil {
+		return err
+	}
+	if end < start {
+		return fmt.Errorf("range %q ends before it starts", rangeExpr)
+	}
+
+	return nil
+}
+
+// ExternalDatastoreConflict returns the error for a setting of the embedded etcd used along with an external
+// datastore, naming the datastore type field it conflicts with.
+func ExternalDatastoreConflict(fldPath, datastorePath *field.Path) *field.Error {
+	return field.Forbidden(fldPath, fmt.Sprintf("only applies to the embedded etcd, cannot be used with %s %s", datastorePath, DatastoreTypeExternal))
+}
+
+// ValidateSnapshotPath ensures an etcd snapshot path can be safely passed to k3s on the command line.
+func ValidateSnapshotPath(path string, fldPath *field.Path) field.ErrorList {
+	if path == "" || strings.ContainsAny(path, " \t\n'\"`$;&|") {
+		return field.ErrorList{field.Invalid(fldPath, path, "must be a non-empty path without whitespace, quotes or shell metacharacters")}
+	}
+
+	return nil
+}
+
+// k3s networks used when the server config leaves them unset.
+const (
+	defaultClusterCidr = "10.42.0.0/16"
+	defaultServiceCidr = "10.43.0.0/16"
+)
+
+// validateCIDRs ensures a comma-separated CIDR list holds valid CIDRs with at most one per IP family,
+// which is what k3s accepts for single and dual-stack clusters.
+func validateCIDRs(cidrs string, fldPath *field.Path) field.ErrorList {
+	if cidrs == "" {
+		return nil
+	}
+
+	var ipv4, ipv6 int
+	for _, cidr := range strings.Split(cidrs, ",") {
+		ip, _, err := net.ParseCIDR(strings.TrimSpace(cidr))
+		if err != nil {
+			return field.ErrorList{field.Invalid(fldPath, cidrs, fmt.Sprintf("%q is not a valid CIDR", cidr))}
+		}
+		if ip.To4() != nil {
+			ipv4++
+		} else {
+			ipv6++
+		}
+	}
+
+	if ipv4 > 1 || ipv6 > 1 {
+		return field.ErrorList{field.Invalid(fldPath, cidrs, "must contain at most one IPv4 and one IPv6 CIDR")}
+	}
+
+	return nil
+}
+
+// validateNetworks ensures the pod and service networks don't overlap, and the cluster DNS addresses are in the
+// service network of their IP family. Unset networks are the k3s defaults.
+func (c *KThreesServerConfig) validateNetworks(pathPrefix *field.Path) field.ErrorList {
+	clusterCidr, serviceCidr := c.ClusterCidr, c.ServiceCidr
+	if clusterCidr == "" {
+		clusterCidr = defaultClusterCidr
+	}
+	if serviceCidr == "" {
+		serviceCidr = defaultServiceCidr
+	}
+
+	// Invalid CIDRs are reported by validateCIDRs.
+	clusterNets, err := parseCIDRs(clusterCidr)
+	if err != nil {
+		return nil
+	}
+	serviceNets, err := parseCIDRs(serviceCidr)
+	if err != nil {
+		return nil
+	}
+
+	var allErrs field.ErrorList
+	for _, clusterNet := range clusterNets {
+		for _, serviceNet := range serviceNets {
+			if clusterNet.Contains(serviceNet.IP) || serviceNet.Contains(clusterNet.IP) {
+				allErrs = append(allErrs, field.Invalid(pathPrefix.Child("serviceCidr"), serviceCidr,
+					fmt.Sprintf("%s overlaps clusterCidr %s", serviceNet, clusterNet)))
+			}
+		}
+	}
+
+	if c.ClusterDNS == "" {
+		return allErrs
+	}
+
+	fldPath := pathPrefix.Child("clusterDNS")
+	for _, entry := range strings.Split(c.ClusterDNS, ",") {
+		ip := net.ParseIP(strings.TrimSpace(entry))
+		if ip == nil {
+			allErrs = append(allErrs, field.Invalid(fldPath, c.ClusterDNS, fmt.Sprintf("%q is not a valid IP address", entry)))
+			continue
+		}
+
+		inServiceNet := false
+		for _, serviceNet := range serviceNets {
+			inServiceNet = inServiceNet || serviceNet.Contains(ip)
+		}
+		if !inServiceNet {
+			allErrs = append(allErrs, field.Invalid(fldPath, c.ClusterDNS, fmt.Sprintf("%s must be within serviceCidr %s", ip, serviceCidr)))
+		}
+	}
+
+	return allErrs
+}
+
+func parseCIDRs(cidrs string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, cidr := range strings.Split(cidrs, ",") {
+		_, ipNet, err := net.ParseCIDR(strings.TrimSpace(cidr))
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+// validateIPs ensures a comma-separated IP list holds valid IPs with at most one per IP family,
+// which is what k3s accepts for single and dual-stack nodes.
+func validateIPs(ips string, fldPath *field.Path) field.ErrorList {
+	if ips == "" {
+		return nil
+	}
+
+	var ipv4, ipv6 int
+	for _, entry := range strings.Split(ips, ",") {
+		ip := net.ParseIP(strings.TrimSpace(entry))
+		if ip == nil {
+			return field.ErrorList{field.Invalid(fldPath, ips, fmt.Sprintf("%q is not a valid IP address", entry))}
+		}
+		if ip.To4() != nil {
+			ipv4++
+		} else {
+			ipv6++
+		}
+	}
+
+	if ipv4 > 1 || ipv6 > 1 {
+		return field.ErrorList{field.Invalid(fldPath, ips, "must contain at most one IPv4 and one IPv6 address")}
+	}
+
+	return nil
+}
+
+func validatePort(port string, fldPath *field.Path) field.ErrorList {
+	if port == "" {
+		return nil
+	}
+
+	p, err := strconv.Atoi(port)
+	if err != nil || p < 1 || p > 65535 {
+		return field.ErrorList{field.Invalid(fldPath, port, "must be a port number between 1 and 65535")}
+	}
+
+	return nil
+}
@@ -0,0 +1,1620 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1beta1
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"k8s.io/utils/pointer"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+func TestKThreesConfigValidatePorts(t *testing.T) {
+	tests := []struct {
+		name         string
+		serverConfig KThreesServerConfig
+		expectErr    bool
+	}{
+		{
+			name:         "no ports set",
+			serverConfig: KThreesServerConfig{},
+		},
+		{
+			name:         "custom listen port",
+			serverConfig: KThreesServerConfig{HTTPSListenPort: "7443"},
+		},
+		{
+			name:         "listen and advertise ports agree",
+			serverConfig: KThreesServerConfig{HTTPSListenPort: "7443", AdvertisePort: "7443"},
+		},
+		{
+			name:         "valid tls-san entries",
+			serverConfig: KThreesServerConfig{TLSSan: []string{"k3s.example.com", "*.k3s.example.com", "10.0.0.10", "fd00::10"}},
+		},
+		{
+			name:         "invalid tls-san entry",
+			serverConfig: KThreesServerConfig{TLSSan: []string{"k3s.example.com", "https://k3s.example.com"}},
+			expectErr:    true,
+		},
+		{
+			name:         "listen and advertise ports disagree",
+			serverConfig: KThreesServerConfig{HTTPSListenPort: "7443", AdvertisePort: "6443"},
+			expectErr:    true,
+		},
+		{
+			name:         "listen port is not a number",
+			serverConfig: KThreesServerConfig{HTTPSListenPort: "https"},
+			expectErr:    true,
+		},
+		{
+			name:         "advertise port out of range",
+			serverConfig: KThreesServerConfig{AdvertisePort: "70000"},
+			expectErr:    true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			config := &KThreesConfig{Spec: KThreesConfigSpec{ServerConfig: tt.serverConfig}}
+			template := &KThreesConfigTemplate{Spec: KThreesConfigTemplateSpec{
+				Template: KThreesConfigTemplateResource{Spec: KThreesConfigSpec{ServerConfig: tt.serverConfig}},
+			}}
+
+			if tt.expectErr {
+				g.Expect(config.ValidateCreate()).NotTo(Succeed())
+				g.Expect(config.ValidateUpdate(config)).NotTo(Succeed())
+				g.Expect(template.ValidateCreate()).NotTo(Succeed())
+			} else {
+				g.Expect(config.ValidateCreate()).To(Succeed())
+				g.Expect(config.ValidateUpdate(config)).To(Succeed())
+				g.Expect(template.ValidateCreate()).To(Succeed())
+			}
+		})
+	}
+}
+
+func TestKThreesConfigValidateEmbeddedRegistry(t *testing.T) {
+	g := NewWithT(t)
+
+	config := &KThreesConfig{Spec: KThreesConfigSpec{
+		ServerConfig: KThreesServerConfig{EmbeddedRegistry: pointer.Bool(true)},
+	}}
+	g.Expect(config.ValidateCreate()).To(Succeed())
+
+	config.Spec.AgentConfig.PrivateRegistry = "/etc/rancher/k3s/registries.yaml"
+	g.Expect(config.ValidateCreate()).NotTo(Succeed())
+
+	// Explicitly disabled, the registry mirror does not conflict with a private registry.
+	config.Spec.ServerConfig.EmbeddedRegistry = pointer.Bool(false)
+	g.Expect(config.ValidateCreate()).To(Succeed())
+}
+
+func TestKThreesConfigValidateRegistryConfigRef(t *testing.T) {
+	g := NewWithT(t)
+
+	config := &KThreesConfig{Spec: KThreesConfigSpec{
+		RegistryConfigRef: &RegistryConfigReference{Kind: "Secret", Name: "registries"},
+	}}
+	g.Expect(config.ValidateCreate()).To(Succeed())
+
+	config.Spec.ServerConfig.EmbeddedRegistry = pointer.Bool(true)
+	g.Expect(config.ValidateCreate()).NotTo(Succeed())
+
+	config.Spec.ServerConfig.EmbeddedRegistry = nil
+	config.Spec.RegistryConfigRef.Name = ""
+	g.Expect(config.ValidateCreate()).NotTo(Succeed())
+}
+
+func TestKThreesConfigValidateNodeTaints(t *testing.T) {
+	tests := []struct {
+		name      string
+		taints    []string
+		expectErr bool
+	}{
+		{
+			name:   "valid taints",
+			taints: []string{"dedicated=gpu:NoSchedule", "node-role.kubernetes.io/control-plane:NoExecute", "spot=true:PreferNoSchedule"},
+		},
+		{
+			name:      "invalid effect",
+			taints:    []string{"dedicated=gpu:NoSchedule", "dedicated=gpu:Sometimes"},
+			expectErr: true,
+		},
+		{
+			name:      "missing effect",
+			taints:    []string{"dedicated=gpu"},
+			expectErr: true,
+		},
+		{
+			name:      "empty key",
+			taints:    []string{"=gpu:NoSchedule"},
+			expectErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			config := &KThreesConfig{Spec: KThreesConfigSpec{
+				AgentConfig: KThreesAgentConfig{NodeTaints: tt.taints},
+			}}
+
+			if tt.expectErr {
+				g.Expect(config.ValidateCreate()).NotTo(Succeed())
+			} else {
+				g.Expect(config.ValidateCreate()).To(Succeed())
+			}
+		})
+	}
+}
+
+func TestKThreesConfigValidateNodeLabels(t *testing.T) {
+	tests := []struct {
+		name      string
+		labels    []string
+		expectErr bool
+	}{
+		{
+			name:   "valid labels",
+			labels: []string{"topology.kubernetes.io/zone=eu-west-1a", "node.example.com/pool=gpu", "empty-value="},
+		},
+		{
+			name:      "missing value separator",
+			labels:    []string{"topology.kubernetes.io/zone"},
+			expectErr: true,
+		},
+		{
+			name:      "invalid key",
+			labels:    []string{"-invalid-key=value"},
+			expectErr: true,
+		},
+		{
+			name:      "invalid value",
+			labels:    []string{"pool=gpu nodes"},
+			expectErr: true,
+		},
+		{
+			name:   "templated labels",
+			labels: []string{"topology.kubernetes.io/zone={{ .FailureDomain }}", `pool={{ machineLabel "pool" }}-{{ .ClusterName }}`},
+		},
+		{
+			name:      "unterminated template",
+			labels:    []string{"topology.kubernetes.io/zone={{ .FailureDomain"},
+			expectErr: true,
+		},
+		{
+			name:      "unknown template variable",
+			labels:    []string{"topology.kubernetes.io/zone={{ .Zone }}"},
+			expectErr: true,
+		},
+		{
+			name:   "cloud-init expressions",
+			labels: []string{"node.kubernetes.io/instance-type={{ ds.meta_data.instance_type }}", "zone={{ v1.availability_zone }}"},
+		},
+		{
+			name:      "invalid key next to a cloud-init expression",
+			labels:    []string{"-invalid-key={{ v1.availability_zone }}"},
+			expectErr: true,
+		},
+		{
+			name:      "templated key is not a qualified name",
+			labels:    []string{"{{ .MachineName }}_{{ .ClusterName }}/zone=a"},
+			expectErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			config := &KThreesConfig{Spec: KThreesConfigSpec{
+				AgentConfig: KThreesAgentConfig{NodeLabels: tt.labels},
+			}}
+
+			if tt.expectErr {
+				g.Expect(config.ValidateCreate()).NotTo(Succeed())
+			} else {
+				g.Expect(config.ValidateCreate()).To(Succeed())
+			}
+		})
+	}
+}
+
+func TestKThreesConfigValidateFiles(t *testing.T) {
+	secretSource := &FileSource{Secret: SecretFileSource{Name: "files", Key: "motd"}}
+
+	tests := []struct {
+		name      string
+		files     []File
+		expectErr bool
+	}{
+		{
+			name: "inline and secret backed files",
+			files: []File{
+				{Path: "/etc/motd", Content: "hello", Owner: "root:root", Permissions: "0644"},
+				{Path: "/etc/issue", Content: "aGk=", Encoding: Base64},
+				{Path: "/etc/secret", ContentFrom: secretSource},
+			},
+		},
+		{
+			name:  "empty file",
+			files: []File{{Path: "/etc/cloud/cloud-init.disabled"}},
+		},
+		{
+			name:      "content and contentFrom",
+			files:     []File{{Path: "/etc/motd", Content: "hello", ContentFrom: secretSource}},
+			expectErr: true,
+		},
+		{
+			name:      "contentFrom without key",
+			files:     []File{{Path: "/etc/motd", ContentFrom: &FileSource{Secret: SecretFileSource{Name: "files"}}}},
+			expectErr: true,
+		},
+		{
+			name:      "missing path",
+			files:     []File{{Content: "hello"}},
+			expectErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			config := &KThreesConfig{Spec: KThreesConfigSpec{Files: tt.files}}
+
+			if tt.expectErr {
+				g.Expect(config.ValidateCreate()).NotTo(Succeed())
+			} else {
+				g.Expect(config.ValidateCreate()).To(Succeed())
+			}
+		})
+	}
+}
+
+func TestKThreesConfigValidateConflicts(t *testing.T) {
+	tests := []struct {
+		name      string
+		spec      KThreesConfigSpec
+		expectErr bool
+	}{
+		{
+			name: "unique disabled components",
+			spec: KThreesConfigSpec{ServerConfig: KThreesServerConfig{DisableComponents: []DisabledComponent{"traefik", "servicelb"}}},
+		},
+		{
+			name:      "duplicate disabled components",
+			spec:      KThreesConfigSpec{ServerConfig: KThreesServerConfig{DisableComponents: []DisabledComponent{"traefik", "servicelb", "traefik"}}},
+			expectErr: true,
+		},
+		{
+			name:      "unknown disabled component",
+			spec:      KThreesConfigSpec{ServerConfig: KThreesServerConfig{DisableComponents: []DisabledComponent{"traefik", "ingress-nginx"}}},
+			expectErr: true,
+		},
+		{
+			name:      "kubelet cloud-provider with external cloud provider",
+			spec:      KThreesConfigSpec{AgentConfig: KThreesAgentConfig{KubeletArgs: []string{"cloud-provider=aws"}}},
+			expectErr: true,
+		},
+		{
+			name:      "controller manager cloud-provider with external cloud provider",
+			spec:      KThreesConfigSpec{ServerConfig: KThreesServerConfig{KubeControllerManagerArgs: []string{"--cloud-provider=aws"}}},
+			expectErr: true,
+		},
+		{
+			name: "kubelet cloud-provider with external cloud provider disabled",
+			spec: KThreesConfigSpec{
+				ServerConfig: KThreesServerConfig{DisableExternalCloudProvider: true},
+				AgentConfig:  KThreesAgentConfig{KubeletArgs: []string{"cloud-provider=aws"}},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			config := &KThreesConfig{Spec: tt.spec}
+
+			if tt.expectErr {
+				g.Expect(config.ValidateCreate()).NotTo(Succeed())
+			} else {
+				g.Expect(config.ValidateCreate()).To(Succeed())
+			}
+		})
+	}
+}
+
+func TestKThreesConfigValidateComponentArgs(t *testing.T) {
+	tests := []struct {
+		name         string
+		serverConfig KThreesServerConfig
+		agentConfig  KThreesAgentConfig
+		expectErr    bool
+	}{
+		{
+			name: "key=value args",
+			serverConfig: KThreesServerConfig{
+				KubeAPIServerArgs:         []string{"audit-log-path=/var/log/audit.log", "--enable-admission-plugins=NodeRestriction"},
+				KubeControllerManagerArgs: []string{"feature-gates=SomeFeature=true"},
+				KubeSchedulerArgs:         []string{"bind-address=0.0.0.0"},
+			},
+		},
+		{
+			name:        "kubelet key=value args",
+			agentConfig: KThreesAgentConfig{KubeletArgs: []string{"max-pods=250", "eviction-hard=memory.available<500Mi", "system-reserved=cpu=500m,memory=1Gi"}},
+		},
+		{
+			name:        "kubelet arg without value",
+			agentConfig: KThreesAgentConfig{KubeletArgs: []string{"max-pods"}},
+			expectErr:   true,
+		},
+		{
+			name:         "kube-apiserver arg without value",
+			serverConfig: KThreesServerConfig{KubeAPIServerArgs: []string{"anonymous-auth"}},
+			expectErr:    true,
+		},
+		{
+			name:         "kube-controller-manager arg without key",
+			serverConfig: KThreesServerConfig{KubeControllerManagerArgs: []string{"=true"}},
+			expectErr:    true,
+		},
+		{
+			name:         "kube-scheduler arg without key",
+			serverConfig: KThreesServerConfig{KubeSchedulerArgs: []string{"--=0.0.0.0"}},
+			expectErr:    true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			config := &KThreesConfig{Spec: KThreesConfigSpec{ServerConfig: tt.serverConfig, AgentConfig: tt.agentConfig}}
+
+			if tt.expectErr {
+				g.Expect(config.ValidateCreate()).NotTo(Succeed())
+			} else {
+				g.Expect(config.ValidateCreate()).To(Succeed())
+			}
+		})
+	}
+}
+
+func TestKThreesConfigValidateInstallSettings(t *testing.T) {
+	tests := []struct {
+		name        string
+		spec        KThreesConfigSpec
+		annotations map[string]string
+		expectErr   bool
+	}{
+		{
+			name: "https install script and channel",
+			spec: KThreesConfigSpec{InstallScriptURL: "https://mirror.example.com/install.sh", Channel: "v1.29"},
+		},
+		{
+			name:      "http install script",
+			spec:      KThreesConfigSpec{InstallScriptURL: "http://mirror.example.com/install.sh"},
+			expectErr: true,
+		},
+		{
+			name:        "http install script with opt-out annotation",
+			spec:        KThreesConfigSpec{InstallScriptURL: "http://mirror.example.com/install.sh"},
+			annotations: map[string]string{AllowInsecureInstallScriptAnnotation: ""},
+		},
+		{
+			name:        "unsupported scheme",
+			spec:        KThreesConfigSpec{InstallScriptURL: "ftp://mirror.example.com/install.sh"},
+			annotations: map[string]string{AllowInsecureInstallScriptAnnotation: ""},
+			expectErr:   true,
+		},
+		{
+			name:      "relative install script",
+			spec:      KThreesConfigSpec{InstallScriptURL: "install.sh"},
+			expectErr: true,
+		},
+		{
+			name:      "install script with a query string",
+			spec:      KThreesConfigSpec{InstallScriptURL: "https://mirror.example.com/install.sh?a=1&b=2"},
+			expectErr: true,
+		},
+		{
+			name:      "install script with a command substitution",
+			spec:      KThreesConfigSpec{InstallScriptURL: "https://mirror.example.com/$(reboot)/install.sh"},
+			expectErr: true,
+		},
+		{
+			name:      "install script with a command separator",
+			spec:      KThreesConfigSpec{InstallScriptURL: "https://mirror.example.com/install.sh;reboot"},
+			expectErr: true,
+		},
+		{
+			name: "system proxy",
+			spec: KThreesConfigSpec{SystemProxy: &SystemProxy{
+				HTTPProxy:  "http://proxy.example.com:3128",
+				HTTPSProxy: "https://proxy.example.com:3129",
+				NoProxy:    []string{"localhost", ".example.com", "10.0.0.0/8"},
+			}},
+		},
+		{
+			name:      "system proxy without scheme",
+			spec:      KThreesConfigSpec{SystemProxy: &SystemProxy{HTTPProxy: "proxy.example.com:3128"}},
+			expectErr: true,
+		},
+		{
+			name:      "system proxy noProxy with shell metacharacters",
+			spec:      KThreesConfigSpec{SystemProxy: &SystemProxy{NoProxy: []string{"localhost; reboot"}}},
+			expectErr: true,
+		},
+		{
+			name: "ignition",
+			spec: KThreesConfigSpec{Format: Ignition},
+		},
+		{
+			name:      "compressed ignition",
+			spec:      KThreesConfigSpec{Format: Ignition, CompressUserData: pointer.Bool(true)},
+			expectErr: true,
+		},
+		{
+			name: "openrc",
+			spec: KThreesConfigSpec{InitSystem: InitSystemOpenRC},
+		},
+		{
+			name:      "unknown init system",
+			spec:      KThreesConfigSpec{InitSystem: "upstart"},
+			expectErr: true,
+		},
+		{
+			name:      "openrc with ignition",
+			spec:      KThreesConfigSpec{Format: Ignition, InitSystem: InitSystemOpenRC},
+			expectErr: true,
+		},
+		{
+			name: "registration address",
+			spec: KThreesConfigSpec{RegistrationAddress: "vip.example.com:6443"},
+		},
+		{
+			name:      "registration address without port",
+			spec:      KThreesConfigSpec{RegistrationAddress: "vip.example.com"},
+			expectErr: true,
+		},
+		{
+			name:      "invalid channel",
+			spec:      KThreesConfigSpec{Channel: "stable; rm -rf /"},
+			expectErr: true,
+		},
+		{
+			name: "airgap images with checksum",
+			spec: KThreesConfigSpec{
+				AirgapImagesURL:      "https://mirror.example.com/k3s-airgap-images-amd64.tar.zst",
+				AirgapImagesChecksum: "3c3e4ae5c6ef6e1e3d2e6f1b1a4dbd9b8b39ba83b2b3a9e4e4e5d8a0b7ae3f10",
+			},
+		},
+		{
+			name:      "airgap images not a tarball",
+			spec:      KThreesConfigSpec{AirgapImagesURL: "https://mirror.example.com/k3s-airgap-images-amd64.zip"},
+			expectErr: true,
+		},
+		{
+			name:      "airgap images with shell metacharacters",
+			spec:      KThreesConfigSpec{AirgapImagesURL: "https://mirror.example.com/images.tar;reboot"},
+			expectErr: true,
+		},
+		{
+			name:      "airgap images checksum not sha256",
+			spec:      KThreesConfigSpec{AirgapImagesURL: "https://mirror.example.com/images.tar", AirgapImagesChecksum: "d41d8cd98f00b204e9800998ecf8427e"},
+			expectErr: true,
+		},
+		{
+			name:      "airgap images checksum without url",
+			spec:      KThreesConfigSpec{AirgapImagesChecksum: "3c3e4ae5c6ef6e1e3d2e6f1b1a4dbd9b8b39ba83b2b3a9e4e4e5d8a0b7ae3f10"},
+			expectErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			config := &KThreesConfig{Spec: tt.spec}
+			config.SetAnnotations(tt.annotations)
+			template := &KThreesConfigTemplate{Spec: KThreesConfigTemplateSpec{
+				Template: KThreesConfigTemplateResource{Spec: tt.spec},
+			}}
+			template.SetAnnotations(tt.annotations)
+
+			if tt.expectErr {
+				g.Expect(config.ValidateCreate()).NotTo(Succeed())
+				g.Expect(template.ValidateCreate()).NotTo(Succeed())
+			} else {
+				g.Expect(config.ValidateCreate()).To(Succeed())
+				g.Expect(template.ValidateCreate()).To(Succeed())
+			}
+		})
+	}
+}
+
+func TestKThreesConfigValidateEtcdSnapshot(t *testing.T) {
+	credentials := &corev1.LocalObjectReference{Name: "s3-credentials"}
+	retention := int32(0)
+
+	tests := []struct {
+		name      string
+		snapshot  *EtcdSnapshotConfig
+		expectErr bool
+	}{
+		{
+			name:     "standard cron",
+			snapshot: &EtcdSnapshotConfig{ScheduleCron: "0 */5 * * *"},
+		},
+		{
+			name:     "cron with lists, ranges and names",
+			snapshot: &EtcdSnapshotConfig{ScheduleCron: "15,45 1-5 * jan-jun mon-fri"},
+		},
+		{
+			name:     "cron descriptor",
+			snapshot: &EtcdSnapshotConfig{ScheduleCron: "@daily"},
+		},
+		{
+			name:     "cron interval",
+			snapshot: &EtcdSnapshotConfig{ScheduleCron: "@every 6h"},
+		},
+		{
+			name:      "cron with too few fields",
+			snapshot:  &EtcdSnapshotConfig{ScheduleCron: "0 */5 * *"},
+			expectErr: true,
+		},
+		{
+			name:      "cron with out of range value",
+			snapshot:  &EtcdSnapshotConfig{ScheduleCron: "0 24 * * *"},
+			expectErr: true,
+		},
+		{
+			name:      "unknown cron descriptor",
+			snapshot:  &EtcdSnapshotConfig{ScheduleCron: "@fortnightly"},
+			expectErr: true,
+		},
+		{
+			name:      "zero retention",
+			snapshot:  &EtcdSnapshotConfig{Retention: &retention},
+			expectErr: true,
+		},
+		{
+			name:     "s3 with credentials",
+			snapshot: &EtcdSnapshotConfig{S3: &EtcdSnapshotS3Config{Bucket: "snapshots", CredentialsSecret: credentials}},
+		},
+		{
+			name:      "s3 without credentials",
+			snapshot:  &EtcdSnapshotConfig{S3: &EtcdSnapshotS3Config{Bucket: "snapshots"}},
+			expectErr: true,
+		},
+		{
+			name:      "s3 without bucket",
+			snapshot:  &EtcdSnapshotConfig{S3: &EtcdSnapshotS3Config{CredentialsSecret: credentials}},
+			expectErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			config := &KThreesConfig{Spec: KThreesConfigSpec{
+				ServerConfig: KThreesServerConfig{EtcdSnapshot: tt.snapshot},
+			}}
+
+			if tt.expectErr {
+				g.Expect(config.ValidateCreate()).NotTo(Succeed())
+			} else {
+				g.Expect(config.ValidateCreate()).To(Succeed())
+			}
+		})
+	}
+}
+
+func TestKThreesConfigValidateDatastore(t *testing.T) {
+	endpointSecret := &corev1.LocalObjectReference{Name: "datastore"}
+
+	tests := []struct {
+		name         string
+		serverConfig KThreesServerConfig
+		expectErr    bool
+	}{
+		{
+			name:         "embedded etcd",
+			serverConfig: KThreesServerConfig{Datastore: &DatastoreConfig{Type: DatastoreTypeEtcd}},
+		},
+		{
+			name:         "external with endpoint secret",
+			serverConfig: KThreesServerConfig{Datastore: &DatastoreConfig{Type: DatastoreTypeExternal, EndpointSecret: endpointSecret}},
+		},
+		{
+			name:         "external without endpoint secret",
+			serverConfig: KThreesServerConfig{Datastore: &DatastoreConfig{Type: DatastoreTypeExternal}},
+			expectErr:    true,
+		},
+		{
+			name:         "endpoint secret with embedded etcd",
+			serverConfig: KThreesServerConfig{Datastore: &DatastoreConfig{EndpointSecret: endpointSecret}},
+			expectErr:    true,
+		},
+		{
+			name: "external with etcd snapshots",
+			serverConfig: KThreesServerConfig{
+				Datastore:    &DatastoreConfig{Type: DatastoreTypeExternal, EndpointSecret: endpointSecret},
+				EtcdSnapshot: &EtcdSnapshotConfig{ScheduleCron: "0 */5 * * *"},
+			},
+			expectErr: true,
+		},
+		{
+			name: "external with cluster reset",
+			serverConfig: KThreesServerConfig{
+				Datastore:               &DatastoreConfig{Type: DatastoreTypeExternal, EndpointSecret: endpointSecret},
+				ClusterResetRestorePath: "/var/lib/rancher/k3s/server/db/snapshots/snap",
+			},
+			expectErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			config := &KThreesConfig{Spec: KThreesConfigSpec{ServerConfig: tt.serverConfig}}
+
+			if tt.expectErr {
+				g.Expect(config.ValidateCreate()).NotTo(Succeed())
+			} else {
+				g.Expect(config.ValidateCreate()).To(Succeed())
+			}
+		})
+	}
+}
+
+func TestKThreesConfigValidateCIDRs(t *testing.T) {
+	tests := []struct {
+		name         string
+		serverConfig KThreesServerConfig
+		expectErr    bool
+	}{
+		{
+			name:         "single stack",
+			serverConfig: KThreesServerConfig{ClusterCidr: "10.42.0.0/16", ServiceCidr: "10.43.0.0/16"},
+		},
+		{
+			name:         "dual stack",
+			serverConfig: KThreesServerConfig{ClusterCidr: "10.42.0.0/16,2001:cafe:42::/56", ServiceCidr: "10.43.0.0/16, 2001:cafe:43::/112"},
+		},
+		{
+			name:         "ipv6 only",
+			serverConfig: KThreesServerConfig{ClusterCidr: "2001:cafe:42::/56"},
+		},
+		{
+			name:         "invalid cidr",
+			serverConfig: KThreesServerConfig{ClusterCidr: "10.42.0.0"},
+			expectErr:    true,
+		},
+		{
+			name:         "empty entry",
+			serverConfig: KThreesServerConfig{ServiceCidr: "10.43.0.0/16,"},
+			expectErr:    true,
+		},
+		{
+			name:         "two cidrs of the same family",
+			serverConfig: KThreesServerConfig{ServiceCidr: "10.43.0.0/16,10.44.0.0/16"},
+			expectErr:    true,
+		},
+		{
+			name:         "overlapping cluster and service cidrs",
+			serverConfig: KThreesServerConfig{ClusterCidr: "10.42.0.0/15", ServiceCidr: "10.43.0.0/16"},
+			expectErr:    true,
+		},
+		{
+			name:         "cluster cidr overlapping the default service cidr",
+			serverConfig: KThreesServerConfig{ClusterCidr: "10.0.0.0/8"},
+			expectErr:    true,
+		},
+		{
+			name:         "overlapping ipv6 cidrs in a dual stack cluster",
+			serverConfig: KThreesServerConfig{ClusterCidr: "10.42.0.0/16,2001:cafe:42::/56", ServiceCidr: "10.43.0.0/16,2001:cafe:42::/112"},
+			expectErr:    true,
+		},
+		{
+			name:         "cluster dns in the service cidr",
+			serverConfig: KThreesServerConfig{ServiceCidr: "10.96.0.0/12", ClusterDNS: "10.96.0.10"},
+		},
+		{
+			name:         "cluster dns in the default service cidr",
+			serverConfig: KThreesServerConfig{ClusterDNS: "10.43.0.10"},
+		},
+		{
+			name:         "dual stack cluster dns",
+			serverConfig: KThreesServerConfig{ClusterCidr: "10.42.0.0/16,2001:cafe:42::/56", ServiceCidr: "10.43.0.0/16,2001:cafe:43::/112", ClusterDNS: "10.43.0.10,2001:cafe:43::a"},
+		},
+		{
+			name:         "cluster dns outside the service cidr",
+			serverConfig: KThreesServerConfig{ServiceCidr: "10.96.0.0/12", ClusterDNS: "10.43.0.10"},
+			expectErr:    true,
+		},
+		{
+			name:         "ipv6 cluster dns without an ipv6 service cidr",
+			serverConfig: KThreesServerConfig{ClusterDNS: "2001:cafe:43::a"},
+			expectErr:    true,
+		},
+		{
+			name:         "malformed cluster dns",
+			serverConfig: KThreesServerConfig{ClusterDNS: "10.43.0"},
+			expectErr:    true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			config := &KThreesConfig{Spec: KThreesConfigSpec{ServerConfig: tt.serverConfig}}
+
+			if tt.expectErr {
+				g.Expect(config.ValidateCreate()).NotTo(Succeed())
+			} else {
+				g.Expect(config.ValidateCreate()).To(Succeed())
+			}
+		})
+	}
+}
+
+func TestKThreesConfigValidateNodeIP(t *testing.T) {
+	tests := []struct {
+		name        string
+		agentConfig KThreesAgentConfig
+		expectErr   bool
+	}{
+		{
+			name:        "single stack",
+			agentConfig: KThreesAgentConfig{NodeIP: "10.0.0.10", NodeExternalIP: "203.0.113.10"},
+		},
+		{
+			name:        "dual stack",
+			agentConfig: KThreesAgentConfig{NodeIP: "10.0.0.10, 2001:db8::10", NodeExternalIP: "203.0.113.10,2001:db8:1::10"},
+		},
+		{
+			name:        "malformed ip",
+			agentConfig: KThreesAgentConfig{NodeIP: "10.0.0.256"},
+			expectErr:   true,
+		},
+		{
+			name:        "cidr instead of ip",
+			agentConfig: KThreesAgentConfig{NodeExternalIP: "203.0.113.0/24"},
+			expectErr:   true,
+		},
+		{
+			name:        "two ips of the same family",
+			agentConfig: KThreesAgentConfig{NodeIP: "10.0.0.10,10.0.0.11"},
+			expectErr:   true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			config := &KThreesConfig{Spec: KThreesConfigSpec{AgentConfig: tt.agentConfig}}
+
+			if tt.expectErr {
+				g.Expect(config.ValidateCreate()).NotTo(Succeed())
+			} else {
+				g.Expect(config.ValidateCreate()).To(Succeed())
+			}
+		})
+	}
+}
+
+func TestKThreesConfigValidateContainerdConfigTemplate(t *testing.T) {
+	tests := []struct {
+		name      string
+		template  string
+		expectErr bool
+	}{
+		{
+			name: "unset",
+		},
+		{
+			name:     "k3s base template with an extra runtime",
+			template: "{{ template \"base\" . }}\n\n[plugins.\"io.containerd.grpc.v1.cri\".containerd.runtimes.kata]\n  runtime_type = \"io.containerd.kata.v2\"\n",
+		},
+		{
+			name:     "k3s template functions",
+			template: "[plugins.cri]\n  sandbox_image = \"{{ .NodeConfig.AgentConfig.PauseImage }}\"\n{{ if .PrivateRegistryConfig }}{{ toJson .PrivateRegistryConfig }}{{ end }}\n",
+		},
+		{
+			name:      "unclosed action",
+			template:  "[plugins.cri]\n  sandbox_image = \"{{ .NodeConfig.AgentConfig.PauseImage \"\n",
+			expectErr: true,
+		},
+		{
+			name:      "unterminated if",
+			template:  "{{ if .PrivateRegistryConfig }}\n[plugins.cri.registry]\n",
+			expectErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			config := &KThreesConfig{Spec: KThreesConfigSpec{AgentConfig: KThreesAgentConfig{ContainerdConfigTemplate: tt.template}}}
+
+			if tt.expectErr {
+				g.Expect(config.ValidateCreate()).NotTo(Succeed())
+			} else {
+				g.Expect(config.ValidateCreate()).To(Succeed())
+			}
+		})
+	}
+}
+
+func TestKThreesAgentConfigResolveNodeName(t *testing.T) {
+	tests := []struct {
+		name       string
+		nodeName   string
+		expectName string
+		expectErr  bool
+	}{
+		{
+			name: "unset",
+		},
+		{
+			name:       "literal name",
+			nodeName:   "worker-0",
+			expectName: "worker-0",
+		},
+		{
+			name:       "machine name",
+			nodeName:   "{{ .MachineName }}",
+			expectName: "md-0-abcde",
+		},
+		{
+			name:       "machine name with a suffix",
+			nodeName:   "{{ .MachineName }}-k3s",
+			expectName: "md-0-abcde-k3s",
+		},
+		{
+			name:       "dotted hostname",
+			nodeName:   "ip-10-0-0-1.ec2.internal",
+			expectName: "ip-10-0-0-1.ec2.internal",
+		},
+		{
+			name:      "literal name that is not a dns subdomain",
+			nodeName:  "Worker_0",
+			expectErr: true,
+		},
+		{
+			name:       "cloud-init expression",
+			nodeName:   "{{ ds.meta_data.local_hostname }}",
+			expectName: "{{ ds.meta_data.local_hostname }}",
+		},
+		{
+			name:       "machine name next to a cloud-init expression",
+			nodeName:   "{{ .MachineName }}-{{ v1.instance_id }}",
+			expectName: "md-0-abcde-{{ v1.instance_id }}",
+		},
+		{
+			name:      "unknown template field",
+			nodeName:  "{{ .Hostname }}",
+			expectErr: true,
+		},
+		{
+			name:      "malformed template",
+			nodeName:  "{{ .MachineName",
+			expectErr: true,
+		},
+		{
+			name:      "resolved name too long",
+			nodeName:  "{{ .MachineName }}-" + strings.Repeat("a", 250),
+			expectErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			agentConfig := &KThreesAgentConfig{NodeName: tt.nodeName}
+			nodeName, err := agentConfig.ResolveNodeName(TemplateInput{MachineName: "md-0-abcde"})
+			if tt.expectErr {
+				g.Expect(err).To(HaveOccurred())
+				return
+			}
+			g.Expect(err).NotTo(HaveOccurred())
+			g.Expect(nodeName).To(Equal(tt.expectName))
+		})
+	}
+}
+
+func TestKThreesAgentConfigResolveNodeLabels(t *testing.T) {
+	input := TemplateInput{
+		MachineName:   "md-0-abcde",
+		ClusterName:   "prod",
+		FailureDomain: "eu-west-1a",
+		MachineLabels: map[string]string{"zone": "eu-west-1b"},
+		ClusterLabels: map[string]string{"env": "production"},
+	}
+
+	tests := []struct {
+		name         string
+		nodeLabels   []string
+		expectLabels []string
+		expectErr    bool
+	}{
+		{
+			name:       "no labels",
+			nodeLabels: nil,
+		},
+		{
+			name:         "literal label",
+			nodeLabels:   []string{"node.example.com/pool=default"},
+			expectLabels: []string{"node.example.com/pool=default"},
+		},
+		{
+			name:         "failure domain zone",
+			nodeLabels:   []string{"topology.kubernetes.io/zone={{ .FailureDomain }}"},
+			expectLabels: []string{"topology.kubernetes.io/zone=eu-west-1a"},
+		},
+		{
+			name:         "machine and cluster labels",
+			nodeLabels:   []string{`topology.kubernetes.io/zone={{ machineLabel "zone" }}`, `env={{ clusterLabel "env" }}`, "cluster={{ .ClusterName }}"},
+			expectLabels: []string{"topology.kubernetes.io/zone=eu-west-1b", "env=production", "cluster=prod"},
+		},
+		{
+			name:       "missing machine label",
+			nodeLabels: []string{`topology.kubernetes.io/zone={{ machineLabel "region" }}`},
+			expectErr:  true,
+		},
+		{
+			name:       "unknown variable",
+			nodeLabels: []string{"topology.kubernetes.io/zone={{ .Zone }}"},
+			expectErr:  true,
+		},
+		{
+			name:       "resolved value is not a valid label value",
+			nodeLabels: []string{"machine={{ .MachineName }}/{{ .ClusterName }}"},
+			expectErr:  true,
+		},
+		{
+			name:         "cloud-init expression",
+			nodeLabels:   []string{"cluster={{ .ClusterName }}", "zone={{ v1.availability_zone }}"},
+			expectLabels: []string{"cluster=prod", "zone={{ v1.availability_zone }}"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			agentConfig := &KThreesAgentConfig{NodeLabels: tt.nodeLabels}
+			labels, err := agentConfig.ResolveNodeLabels(input)
+			if tt.expectErr {
+				g.Expect(err).To(HaveOccurred())
+				return
+			}
+			g.Expect(err).NotTo(HaveOccurred())
+			g.Expect(labels).To(Equal(tt.expectLabels))
+		})
+	}
+}
+
+func TestKThreesConfigValidateNodeName(t *testing.T) {
+	g := NewWithT(t)
+
+	config := &KThreesConfig{Spec: KThreesConfigSpec{AgentConfig: KThreesAgentConfig{NodeName: "{{ .MachineName }}-k3s"}}}
+	g.Expect(config.ValidateCreate()).To(Succeed())
+
+	config.Spec.AgentConfig.NodeName = "Worker_0"
+	g.Expect(config.ValidateCreate()).NotTo(Succeed())
+
+	config.Spec.AgentConfig.NodeName = "{{ .MachineName"
+	g.Expect(config.ValidateCreate()).NotTo(Succeed())
+
+	// The samples leave the node name to cloud-init.
+	config.Spec.AgentConfig.NodeName = "{{ ds.meta_data.local_hostname }}"
+	g.Expect(config.ValidateCreate()).To(Succeed())
+
+	config.Spec.AgentConfig.NodeName = "ip-10-0-0-1.ec2.internal"
+	g.Expect(config.ValidateCreate()).To(Succeed())
+}
+
+func TestKThreesConfigValidateConfigDropIns(t *testing.T) {
+	tests := []struct {
+		name      string
+		dropIns   map[string]string
+		expectErr bool
+	}{
+		{
+			name:    "drop-ins",
+			dropIns: map[string]string{"10-base.yaml": "node-label:\n  - tier=base\n", "20-override.yaml": "kubelet-arg:\n  - max-pods=200\n"},
+		},
+		{
+			name:      "malformed yaml",
+			dropIns:   map[string]string{"10-base.yaml": "node-label: [tier=base\n"},
+			expectErr: true,
+		},
+		{
+			name:      "not a mapping",
+			dropIns:   map[string]string{"10-base.yaml": "- tier=base\n"},
+			expectErr: true,
+		},
+		{
+			name:      "not a yaml file",
+			dropIns:   map[string]string{"10-base.conf": "node-label: []\n"},
+			expectErr: true,
+		},
+		{
+			name:      "path separator",
+			dropIns:   map[string]string{"../config.yaml": "token: secret\n"},
+			expectErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			config := &KThreesConfig{Spec: KThreesConfigSpec{ConfigDropIns: tt.dropIns}}
+
+			if tt.expectErr {
+				g.Expect(config.ValidateCreate()).NotTo(Succeed())
+			} else {
+				g.Expect(config.ValidateCreate()).To(Succeed())
+			}
+		})
+	}
+}
+
+func TestKThreesConfigValidateNetworkConfig(t *testing.T) {
+	tests := []struct {
+		name          string
+		networkConfig string
+		expectErr     bool
+	}{
+		{
+			name: "unset",
+		},
+		{
+			name:          "netplan v2",
+			networkConfig: "version: 2\nethernets:\n  eth0:\n    dhcp4: true\n",
+		},
+		{
+			name:          "malformed yaml",
+			networkConfig: "version: [2\n",
+			expectErr:     true,
+		},
+		{
+			name:          "not a mapping",
+			networkConfig: "- eth0\n",
+			expectErr:     true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			config := &KThreesConfig{Spec: KThreesConfigSpec{NetworkConfig: tt.networkConfig}}
+
+			if tt.expectErr {
+				g.Expect(config.ValidateCreate()).NotTo(Succeed())
+			} else {
+				g.Expect(config.ValidateCreate()).To(Succeed())
+			}
+		})
+	}
+}
+
+func TestKThreesConfigValidateFlannelBackend(t *testing.T) {
+	tests := []struct {
+		name      string
+		backend   FlannelBackend
+		expectErr bool
+	}{
+		{name: "default"},
+		{name: "none", backend: FlannelBackendNone},
+		{name: "host-gw", backend: FlannelBackendHostGW},
+		{name: "unknown backend", backend: "ipsec", expectErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			config := &KThreesConfig{Spec: KThreesConfigSpec{ServerConfig: KThreesServerConfig{FlannelBackend: tt.backend}}}
+
+			if tt.expectErr {
+				g.Expect(config.ValidateCreate()).NotTo(Succeed())
+			} else {
+				g.Expect(config.ValidateCreate()).To(Succeed())
+			}
+		})
+	}
+}
+
+func TestKThreesConfigValidateDisableKubeProxy(t *testing.T) {
+	tests := []struct {
+		name         string
+		serverConfig KThreesServerConfig
+		expectErr    bool
+	}{
+		{
+			name:         "kube-proxy enabled",
+			serverConfig: KThreesServerConfig{DisableKubeProxy: pointer.Bool(false)},
+		},
+		{
+			name:         "kube-proxy disabled without flannel",
+			serverConfig: KThreesServerConfig{DisableKubeProxy: pointer.Bool(true), FlannelBackend: FlannelBackendNone},
+		},
+		{
+			name:         "kube-proxy disabled with the default flannel backend",
+			serverConfig: KThreesServerConfig{DisableKubeProxy: pointer.Bool(true)},
+			expectErr:    true,
+		},
+		{
+			name:         "kube-proxy disabled with another flannel backend",
+			serverConfig: KThreesServerConfig{DisableKubeProxy: pointer.Bool(true), FlannelBackend: FlannelBackendHostGW},
+			expectErr:    true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			config := &KThreesConfig{Spec: KThreesConfigSpec{ServerConfig: tt.serverConfig}}
+
+			if tt.expectErr {
+				g.Expect(config.ValidateCreate()).NotTo(Succeed())
+			} else {
+				g.Expect(config.ValidateCreate()).To(Succeed())
+			}
+		})
+	}
+}
+
+func TestKThreesConfigValidateCISProfile(t *testing.T) {
+	tests := []struct {
+		name      string
+		spec      KThreesConfigSpec
+		expectErr bool
+	}{
+		{
+			name: "profile with unrelated settings",
+			spec: KThreesConfigSpec{
+				CISProfile:   CISProfileCIS,
+				ServerConfig: KThreesServerConfig{KubeAPIServerArgs: []string{"audit-log-compress=true"}, SecretsEncryption: pointer.Bool(true)},
+				Files:        []File{{Path: "/etc/motd", Content: "hardened"}},
+			},
+		},
+		{
+			name: "arguments set by the profile without it",
+			spec: KThreesConfigSpec{
+				ServerConfig: KThreesServerConfig{KubeAPIServerArgs: []string{"audit-log-maxage=7"}},
+			},
+		},
+		{
+			name: "kube-apiserver argument set by the profile",
+			spec: KThreesConfigSpec{
+				CISProfile:   CISProfileCIS,
+				ServerConfig: KThreesServerConfig{KubeAPIServerArgs: []string{"--audit-log-maxage=7"}},
+			},
+			expectErr: true,
+		},
+		{
+			name: "kube-controller-manager argument set by the profile",
+			spec: KThreesConfigSpec{
+				CISProfile:   CISProfileCIS,
+				ServerConfig: KThreesServerConfig{KubeControllerManagerArgs: []string{"terminated-pod-gc-threshold=100"}},
+			},
+			expectErr: true,
+		},
+		{
+			name: "kernel defaults left unprotected",
+			spec: KThreesConfigSpec{
+				CISProfile:  CISProfileCIS,
+				AgentConfig: KThreesAgentConfig{KubeletArgs: []string{"protect-kernel-defaults=false"}},
+			},
+			expectErr: true,
+		},
+		{
+			name: "file written by the profile",
+			spec: KThreesConfigSpec{
+				CISProfile: CISProfileCIS,
+				Files:      []File{{Path: "/var/lib/rancher/k3s/server/audit.yaml", Content: "rules: []"}},
+			},
+			expectErr: true,
+		},
+		{
+			name: "file written by the profile under the data dir",
+			spec: KThreesConfigSpec{
+				CISProfile: CISProfileCIS,
+				DataDir:    "/data/k3s",
+				Files:      []File{{Path: "/data/k3s/server/psa.yaml", Content: "plugins: []"}},
+			},
+			expectErr: true,
+		},
+		{
+			name: "file at the default profile path with another data dir",
+			spec: KThreesConfigSpec{
+				CISProfile: CISProfileCIS,
+				DataDir:    "/data/k3s",
+				Files:      []File{{Path: "/var/lib/rancher/k3s/server/audit.yaml", Content: "rules: []"}},
+			},
+		},
+		{
+			name: "secrets encryption disabled",
+			spec: KThreesConfigSpec{
+				CISProfile:   CISProfileCIS,
+				ServerConfig: KThreesServerConfig{SecretsEncryption: pointer.Bool(false)},
+			},
+			expectErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			config := &KThreesConfig{Spec: tt.spec}
+
+			if tt.expectErr {
+				g.Expect(config.ValidateCreate()).NotTo(Succeed())
+			} else {
+				g.Expect(config.ValidateCreate()).To(Succeed())
+			}
+		})
+	}
+}
+
+func TestKThreesConfigValidateJoinTimeout(t *testing.T) {
+	g := NewWithT(t)
+
+	config := &KThreesConfig{}
+	g.Expect(config.ValidateCreate()).To(Succeed())
+
+	config.Spec.JoinTimeout = &metav1.Duration{Duration: 15 * time.Minute}
+	g.Expect(config.ValidateCreate()).To(Succeed())
+
+	config.Spec.JoinTimeout = &metav1.Duration{}
+	g.Expect(config.ValidateCreate()).NotTo(Succeed())
+}
+
+func TestKThreesConfigValidateEnvironment(t *testing.T) {
+	tests := []struct {
+		name      string
+		spec      KThreesConfigSpec
+		expectErr bool
+	}{
+		{
+			name: "server and agent environment",
+			spec: KThreesConfigSpec{
+				ServerEnvironment: map[string]string{"K3S_KUBECONFIG_MODE": "0644", "_private": ""},
+				AgentEnvironment:  map[string]string{"PATH": "/opt/bin:/usr/bin:/bin"},
+			},
+		},
+		{
+			name:      "name with a dash",
+			spec:      KThreesConfigSpec{ServerEnvironment: map[string]string{"K3S-KUBECONFIG-MODE": "0644"}},
+			expectErr: true,
+		},
+		{
+			name:      "name starting with a digit",
+			spec:      KThreesConfigSpec{AgentEnvironment: map[string]string{"1PATH": "/bin"}},
+			expectErr: true,
+		},
+		{
+			name:      "multi-line value",
+			spec:      KThreesConfigSpec{AgentEnvironment: map[string]string{"PATH": "/bin\nExecStart=/bin/sh"}},
+			expectErr: true,
+		},
+		{
+			name:      "server environment with the agent role",
+			spec:      KThreesConfigSpec{Role: NodeRoleAgent, ServerEnvironment: map[string]string{"K3S_KUBECONFIG_MODE": "0644"}},
+			expectErr: true,
+		},
+		{
+			name:      "agent environment with the server role",
+			spec:      KThreesConfigSpec{Role: NodeRoleServer, AgentEnvironment: map[string]string{"PATH": "/bin"}},
+			expectErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			config := &KThreesConfig{Spec: tt.spec}
+
+			if tt.expectErr {
+				g.Expect(config.ValidateCreate()).NotTo(Succeed())
+			} else {
+				g.Expect(config.ValidateCreate()).To(Succeed())
+			}
+		})
+	}
+}
+
+func TestKThreesConfigValidateWriteKubeconfigMode(t *testing.T) {
+	tests := []struct {
+		name      string
+		mode      string
+		expectErr bool
+	}{
+		{
+			name: "unset",
+		},
+		{
+			name: "group readable",
+			mode: "0640",
+		},
+		{
+			name: "without leading zero",
+			mode: "644",
+		},
+		{
+			name:      "not octal",
+			mode:      "0689",
+			expectErr: true,
+		},
+		{
+			name:      "symbolic mode",
+			mode:      "u=rw,g=r",
+			expectErr: true,
+		},
+		{
+			name:      "too many digits",
+			mode:      "10644",
+			expectErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			config := &KThreesConfig{Spec: KThreesConfigSpec{ServerConfig: KThreesServerConfig{WriteKubeconfigMode: tt.mode}}}
+
+			if tt.expectErr {
+				g.Expect(config.ValidateCreate()).NotTo(Succeed())
+			} else {
+				g.Expect(config.ValidateCreate()).To(Succeed())
+			}
+		})
+	}
+}
+
+func TestKThreesConfigValidateDataDir(t *testing.T) {
+	tests := []struct {
+		name      string
+		dataDir   string
+		expectErr bool
+	}{
+		{
+			name: "unset",
+		},
+		{
+			name:    "dedicated mount",
+			dataDir: "/data/k3s",
+		},
+		{
+			name:      "relative path",
+			dataDir:   "data/k3s",
+			expectErr: true,
+		},
+		{
+			name:      "path with a space",
+			dataDir:   "/data/k3s state",
+			expectErr: true,
+		},
+		{
+			name:      "path with a shell expansion",
+			dataDir:   "/data/$(hostname)",
+			expectErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			config := &KThreesConfig{Spec: KThreesConfigSpec{DataDir: tt.dataDir}}
+
+			if tt.expectErr {
+				g.Expect(config.ValidateCreate()).NotTo(Succeed())
+			} else {
+				g.Expect(config.ValidateCreate()).To(Succeed())
+			}
+		})
+	}
+}
+
+func TestKThreesConfigValidateRole(t *testing.T) {
+	tests := []struct {
+		name      string
+		spec      KThreesConfigSpec
+		expectErr bool
+	}{
+		{
+			name: "server settings without a role",
+			spec: KThreesConfigSpec{ServerConfig: KThreesServerConfig{TLSSan: []string{"k3s.example.com"}}},
+		},
+		{
+			name: "server settings with the server role",
+			spec: KThreesConfigSpec{Role: NodeRoleServer, ServerConfig: KThreesServerConfig{TLSSan: []string{"k3s.example.com"}}},
+		},
+		{
+			name: "agent role with the settings agents use",
+			spec: KThreesConfigSpec{Role: NodeRoleAgent, ServerConfig: KThreesServerConfig{
+				DisableExternalCloudProvider: true,
+				ClusterCidr:                  "10.42.0.0/16",
+				ServiceCidr:                  "10.43.0.0/16",
+			}},
+		},
+		{
+			name: "agent role with empty server lists",
+			spec: KThreesConfigSpec{Role: NodeRoleAgent, ServerConfig: KThreesServerConfig{TLSSan: []string{}}},
+		},
+		{
+			name:      "agent role with tls-san",
+			spec:      KThreesConfigSpec{Role: NodeRoleAgent, ServerConfig: KThreesServerConfig{TLSSan: []string{"k3s.example.com"}}},
+			expectErr: true,
+		},
+		{
+			name:      "agent role with kube-apiserver arguments",
+			spec:      KThreesConfigSpec{Role: NodeRoleAgent, ServerConfig: KThreesServerConfig{KubeAPIServerArgs: []string{"audit-log-maxage=30"}}},
+			expectErr: true,
+		},
+		{
+			name:      "agent role with secrets encryption",
+			spec:      KThreesConfigSpec{Role: NodeRoleAgent, ServerConfig: KThreesServerConfig{SecretsEncryption: pointer.Bool(true)}},
+			expectErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			config := &KThreesConfig{Spec: tt.spec}
+
+			if tt.expectErr {
+				g.Expect(config.ValidateCreate()).NotTo(Succeed())
+			} else {
+				g.Expect(config.ValidateCreate()).To(Succeed())
+			}
+		})
+	}
+}
+
+func TestKThreesConfigSpecWarnings(t *testing.T) {
+	tests := []struct {
+		name           string
+		spec           KThreesConfigSpec
+		expectWarnings []string
+	}{
+		{
+			name: "no component arguments",
+		},
+		{
+			name: "arguments without a typed field",
+			spec: KThreesConfigSpec{
+				ServerConfig: KThreesServerConfig{KubeAPIServerArgs: []string{"audit-log-maxage=30"}},
+				AgentConfig:  KThreesAgentConfig{KubeletArgs: []string{"max-pods=200"}},
+			},
+		},
+		{
+			name: "arguments duplicating typed fields",
+			spec: KThreesConfigSpec{
+				ServerConfig: KThreesServerConfig{
+					KubeAPIServerArgs:         []string{"audit-log-maxage=30", "--service-cluster-ip-range=10.96.0.0/12"},
+					KubeControllerManagerArgs: []string{"cluster-cidr=10.244.0.0/16"},
+				},
+				AgentConfig: KThreesAgentConfig{
+					KubeletArgs:   []string{"node-ip=10.0.0.10"},
+					KubeProxyArgs: []string{"hostname-override=node-0"},
+				},
+			},
+			expectWarnings: []string{
+				"spec.serverConfig.kubeAPIServerArg[1]: service-cluster-ip-range duplicates spec.serverConfig.serviceCidr, set it there instead",
+				"spec.serverConfig.kubeControllerManagerArgs[0]: cluster-cidr duplicates spec.serverConfig.clusterCidr, set it there instead",
+				"spec.agentConfig.kubeletArgs[0]: node-ip duplicates spec.agentConfig.nodeIP, set it there instead",
+				"spec.agentConfig.kubeProxyArgs[0]: hostname-override duplicates spec.agentConfig.nodeName, set it there instead",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			g.Expect(tt.spec.Warnings(field.NewPath("spec"))).To(Equal(tt.expectWarnings))
+		})
+	}
+}
+
+func TestKThreesConfigWebhookWarnings(t *testing.T) {
+	scheme := runtime.NewScheme()
+	NewWithT(t).Expect(AddToScheme(scheme)).To(Succeed())
+
+	handle := func(g *WithT, config *KThreesConfig) admission.Response {
+		decoder, err := admission.NewDecoder(scheme)
+		g.Expect(err).NotTo(HaveOccurred())
+		h := &warningHandler{validator: admission.ValidatingWebhookFor(&KThreesConfig{}).Handler}
+		g.Expect(h.InjectDecoder(decoder)).To(Succeed())
+
+		config.APIVersion = GroupVersion.String()
+		config.Kind = "KThreesConfig"
+		raw, err := json.Marshal(config)
+		g.Expect(err).NotTo(HaveOccurred())
+
+		return h.Handle(context.Background(), admission.Request{AdmissionRequest: admissionv1.AdmissionRequest{
+			Operation: admissionv1.Create,
+			Object:    runtime.RawExtension{Raw: raw},
+		}})
+	}
+
+	t.Run("duplicated argument is allowed with a warning", func(t *testing.T) {
+		g := NewWithT(t)
+
+		resp := handle(g, &KThreesConfig{Spec: KThreesConfigSpec{
+			AgentConfig: KThreesAgentConfig{KubeletArgs: []string{"node-labels=role=worker"}},
+		}})
+		g.Expect(resp.Allowed).To(BeTrue())
+		g.Expect(resp.Warnings).To(ConsistOf(
+			"spec.agentConfig.kubeletArgs[0]: node-labels duplicates spec.agentConfig.nodeLabels, set it there instead"))
+	})
+
+	t.Run("valid config without warnings", func(t *testing.T) {
+		g := NewWithT(t)
+
+		resp := handle(g, &KThreesConfig{Spec: KThreesConfigSpec{
+			AgentConfig: KThreesAgentConfig{NodeLabels: []string{"role=worker"}},
+		}})
+		g.Expect(resp.Allowed).To(BeTrue())
+		g.Expect(resp.Warnings).To(BeEmpty())
+	})
+
+	t.Run("invalid config is still denied", func(t *testing.T) {
+		g := NewWithT(t)
+
+		resp := handle(g, &KThreesConfig{Spec: KThreesConfigSpec{
+			AgentConfig: KThreesAgentConfig{KubeletArgs: []string{"node-ip"}},
+		}})
+		g.Expect(resp.Allowed).To(BeFalse())
+		g.Expect(resp.Warnings).To(BeEmpty())
+	})
+}
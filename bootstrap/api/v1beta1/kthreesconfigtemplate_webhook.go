@@ -0,0 +1,61 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1beta1
+
+import (
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
+)
+
+// SetupWebhookWithManager sets up the KThreesConfigTemplate webhooks with the manager.
+func (r *KThreesConfigTemplate) SetupWebhookWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewWebhookManagedBy(mgr).
+		For(r).
+		Complete()
+}
+
+// +kubebuilder:webhook:verbs=create;update,path=/validate-bootstrap-cluster-x-k8s-io-v1beta1-kthreesconfigtemplate,mutating=false,failurePolicy=fail,sideEffects=None,groups=bootstrap.cluster.x-k8s.io,resources=kthreesconfigtemplates,versions=v1beta1,name=validation.kthreesconfigtemplate.bootstrap.cluster.x-k8s.io,admissionReviewVersions=v1;v1beta1
+
+var _ webhook.Validator = &KThreesConfigTemplate{}
+
+// ValidateCreate implements webhook.Validator so a webhook will be registered for the type.
+func (r *KThreesConfigTemplate) ValidateCreate() error {
+	return r.validate()
+}
+
+// ValidateUpdate implements webhook.Validator so a webhook will be registered for the type.
+func (r *KThreesConfigTemplate) ValidateUpdate(_ runtime.Object) error {
+	return r.validate()
+}
+
+// ValidateDelete implements webhook.Validator so a webhook will be registered for the type.
+func (r *KThreesConfigTemplate) ValidateDelete() error {
+	return nil
+}
+
+func (r *KThreesConfigTemplate) validate() error {
+	allErrs := r.Spec.Template.Spec.Validate(field.NewPath("spec", "template", "spec"))
+	allErrs = append(allErrs, r.Spec.Template.Spec.ValidateInstallScriptURL(field.NewPath("spec", "template", "spec"), r.Annotations)...)
+	if len(allErrs) == 0 {
+		return nil
+	}
+
+	return apierrors.NewInvalid(GroupVersion.WithKind("KThreesConfigTemplate").GroupKind(), r.Name, allErrs)
+}
@@ -22,10 +22,77 @@ limitations under the License.
 package v1beta1
 
 import (
-	runtime "k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
 	apiv1beta1 "sigs.k8s.io/cluster-api/api/v1beta1"
 )
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *DatastoreConfig) DeepCopyInto(out *DatastoreConfig) {
+	*out = *in
+	if in.EndpointSecret != nil {
+		in, out := &in.EndpointSecret, &out.EndpointSecret
+		*out = new(v1.LocalObjectReference)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new DatastoreConfig.
+func (in *DatastoreConfig) DeepCopy() *DatastoreConfig {
+	if in == nil {
+		return nil
+	}
+	out := new(DatastoreConfig)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *EtcdSnapshotConfig) DeepCopyInto(out *EtcdSnapshotConfig) {
+	*out = *in
+	if in.Retention != nil {
+		in, out := &in.Retention, &out.Retention
+		*out = new(int32)
+		**out = **in
+	}
+	if in.S3 != nil {
+		in, out := &in.S3, &out.S3
+		*out = new(EtcdSnapshotS3Config)
+		(*in).DeepCopyInto(*out)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new EtcdSnapshotConfig.
+func (in *EtcdSnapshotConfig) DeepCopy() *EtcdSnapshotConfig {
+	if in == nil {
+		return nil
+	}
+	out := new(EtcdSnapshotConfig)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *EtcdSnapshotS3Config) DeepCopyInto(out *EtcdSnapshotS3Config) {
+	*out = *in
+	if in.CredentialsSecret != nil {
+		in, out := &in.CredentialsSecret, &out.CredentialsSecret
+		*out = new(v1.LocalObjectReference)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new EtcdSnapshotS3Config.
+func (in *EtcdSnapshotS3Config) DeepCopy() *EtcdSnapshotS3Config {
+	if in == nil {
+		return nil
+	}
+	out := new(EtcdSnapshotS3Config)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *File) DeepCopyInto(out *File) {
 	*out = *in
@@ -178,6 +245,47 @@ func (in *KThreesConfigSpec) DeepCopyInto(out *KThreesConfigSpec) {
 	}
 	in.AgentConfig.DeepCopyInto(&out.AgentConfig)
 	in.ServerConfig.DeepCopyInto(&out.ServerConfig)
+	if in.RegistryConfigRef != nil {
+		in, out := &in.RegistryConfigRef, &out.RegistryConfigRef
+		*out = new(RegistryConfigReference)
+		**out = **in
+	}
+	if in.SystemProxy != nil {
+		in, out := &in.SystemProxy, &out.SystemProxy
+		*out = new(SystemProxy)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.ServerEnvironment != nil {
+		in, out := &in.ServerEnvironment, &out.ServerEnvironment
+		*out = make(map[string]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+	if in.AgentEnvironment != nil {
+		in, out := &in.AgentEnvironment, &out.AgentEnvironment
+		*out = make(map[string]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+	if in.CompressUserData != nil {
+		in, out := &in.CompressUserData, &out.CompressUserData
+		*out = new(bool)
+		**out = **in
+	}
+	if in.ConfigDropIns != nil {
+		in, out := &in.ConfigDropIns, &out.ConfigDropIns
+		*out = make(map[string]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+	if in.JoinTimeout != nil {
+		in, out := &in.JoinTimeout, &out.JoinTimeout
+		*out = new(metav1.Duration)
+		**out = **in
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new KThreesConfigSpec.
@@ -330,6 +438,11 @@ func (in *KThreesServerConfig) DeepCopyInto(out *KThreesServerConfig) {
 		*out = make([]string, len(*in))
 		copy(*out, *in)
 	}
+	if in.EtcdArgs != nil {
+		in, out := &in.EtcdArgs, &out.EtcdArgs
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
 	if in.TLSSan != nil {
 		in, out := &in.TLSSan, &out.TLSSan
 		*out = make([]string, len(*in))
@@ -337,9 +450,39 @@ func (in *KThreesServerConfig) DeepCopyInto(out *KThreesServerConfig) {
 	}
 	if in.DisableComponents != nil {
 		in, out := &in.DisableComponents, &out.DisableComponents
-		*out = make([]string, len(*in))
+		*out = make([]DisabledComponent, len(*in))
 		copy(*out, *in)
 	}
+	if in.DisableNetworkPolicy != nil {
+		in, out := &in.DisableNetworkPolicy, &out.DisableNetworkPolicy
+		*out = new(bool)
+		**out = **in
+	}
+	if in.DisableKubeProxy != nil {
+		in, out := &in.DisableKubeProxy, &out.DisableKubeProxy
+		*out = new(bool)
+		**out = **in
+	}
+	if in.EmbeddedRegistry != nil {
+		in, out := &in.EmbeddedRegistry, &out.EmbeddedRegistry
+		*out = new(bool)
+		**out = **in
+	}
+	if in.SecretsEncryption != nil {
+		in, out := &in.SecretsEncryption, &out.SecretsEncryption
+		*out = new(bool)
+		**out = **in
+	}
+	if in.EtcdSnapshot != nil {
+		in, out := &in.EtcdSnapshot, &out.EtcdSnapshot
+		*out = new(EtcdSnapshotConfig)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Datastore != nil {
+		in, out := &in.Datastore, &out.Datastore
+		*out = new(DatastoreConfig)
+		(*in).DeepCopyInto(*out)
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new KThreesServerConfig.
@@ -352,6 +495,21 @@ func (in *KThreesServerConfig) DeepCopy() *KThreesServerConfig {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *RegistryConfigReference) DeepCopyInto(out *RegistryConfigReference) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new RegistryConfigReference.
+func (in *RegistryConfigReference) DeepCopy() *RegistryConfigReference {
+	if in == nil {
+		return nil
+	}
+	out := new(RegistryConfigReference)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *SecretFileSource) DeepCopyInto(out *SecretFileSource) {
 	*out = *in
@@ -366,3 +524,23 @@ func (in *SecretFileSource) DeepCopy() *SecretFileSource {
 	in.DeepCopyInto(out)
 	return out
 }
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *SystemProxy) DeepCopyInto(out *SystemProxy) {
+	*out = *in
+	if in.NoProxy != nil {
+		in, out := &in.NoProxy, &out.NoProxy
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SystemProxy.
+func (in *SystemProxy) DeepCopy() *SystemProxy {
+	if in == nil {
+		return nil
+	}
+	out := new(SystemProxy)
+	in.DeepCopyInto(out)
+	return out
+}
@@ -20,12 +20,16 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"path"
+	"sort"
+	"strconv"
 	"time"
 
 	"github.com/go-logr/logr"
 	corev1 "k8s.io/api/core/v1"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
 	kerrors "k8s.io/apimachinery/pkg/util/errors"
@@ -39,7 +43,6 @@ import (
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/reconcile"
-	kubeyaml "sigs.k8s.io/yaml"
 
 	bootstrapv1 "github.com/cluster-api-provider-k3s/cluster-api-k3s/bootstrap/api/v1beta1"
 	"github.com/cluster-api-provider-k3s/cluster-api-k3s/pkg/cloudinit"
@@ -48,6 +51,7 @@ import (
 	"github.com/cluster-api-provider-k3s/cluster-api-k3s/pkg/locking"
 	"github.com/cluster-api-provider-k3s/cluster-api-k3s/pkg/secret"
 	"github.com/cluster-api-provider-k3s/cluster-api-k3s/pkg/token"
+	"github.com/cluster-api-provider-k3s/cluster-api-k3s/pkg/userdata"
 )
 
 // InitLocker is a lock that is used around k3s init.
@@ -71,9 +75,13 @@ type Scope struct {
 	Cluster     *clusterv1.Cluster
 }
 
+// nodeRegistrationRecheckAfter is how often a Machine whose node did not register within the join timeout is checked.
+const nodeRegistrationRecheckAfter = 1 * time.Minute
+
 var (
-	ErrInvalidRef   = errors.New("invalid reference")
-	ErrFailedUnlock = errors.New("failed to unlock the k3s init lock")
+	ErrInvalidRef                = errors.New("invalid reference")
+	ErrFailedUnlock              = errors.New("failed to unlock the k3s init lock")
+	ErrRegistryConfigUnavailable = errors.New("registry config unavailable")
 )
 
 // +kubebuilder:rbac:groups=bootstrap.cluster.x-k8s.io,resources=kthreesconfigs,verbs=get;list;watch;create;update;patch;delete
@@ -170,6 +178,8 @@ func (r *KThreesConfigReconciler) Reconcile(ctx context.Context, req ctrl.Reques
 		}
 	}()
 
+	reconcileExternalCNICondition(config)
+
 	switch {
 	// Wait for the infrastructure to be ready.
 	case !cluster.Status.InfrastructureReady:
@@ -188,8 +198,9 @@ func (r *KThreesConfigReconciler) Reconcile(ctx context.Context, req ctrl.Reques
 		return ctrl.Result{}, nil
 	// Status is ready means a config has been generated.
 	case config.Status.Ready:
-		// In any other case just return as the config is already generated and need not be generated again.
-		return ctrl.Result{}, nil
+		// In any other case the config is already generated and need not be generated again, only the node
+		// registration is tracked when the config has a join timeout.
+		return r.reconcileNodeRegistration(scope)
 	}
 
 	// Note: can't use IsFalse here because we need to handle the absence of the condition as well as false.
@@ -197,6 +208,12 @@ func (r *KThreesConfigReconciler) Reconcile(ctx context.Context, req ctrl.Reques
 		return r.handleClusterNotInitialized(ctx, scope)
 	}
 
+	// A server restoring etcd from a snapshot re-initializes a control plane that lost all its machines.
+	if config.Spec.ServerConfig.ClusterResetRestorePath != "" && configOwner.IsControlPlaneMachine() {
+		log.Info("Restoring control plane from etcd snapshot", "path", config.Spec.ServerConfig.ClusterResetRestorePath)
+		return r.handleClusterNotInitialized(ctx, scope)
+	}
+
 	// Every other case it's a join scenario
 	// Nb. in this case ClusterConfiguration and InitConfiguration should not be defined by users, but in case of misconfigurations, CABPK simply ignore them
 
@@ -208,6 +225,18 @@ func (r *KThreesConfigReconciler) Reconcile(ctx context.Context, req ctrl.Reques
 		return reconcile.Result{}, r.joinControlplane(ctx, scope)
 	}
 
+	// Workers wait for a token rotation in progress to switch the cluster to the new token, the current one
+	// is invalidated as soon as the first new server joins.
+	nextToken, err := token.LookupNext(ctx, r.Client, client.ObjectKeyFromObject(cluster))
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	if nextToken != nil {
+		conditions.MarkFalse(config, bootstrapv1.DataSecretAvailableCondition, bootstrapv1.WaitingForTokenRotationReason, clusterv1.ConditionSeverityInfo, "")
+		log.Info("Waiting for the server token rotation before joining the worker")
+		return ctrl.Result{RequeueAfter: 30 * time.Second}, nil
+	}
+
 	// It's a worker join
 	return reconcile.Result{}, r.joinWorker(ctx, scope)
 }
@@ -220,8 +249,12 @@ func (r *KThreesConfigReconciler) joinControlplane(ctx context.Context, scope *S
 
 	// injects into config.Version values from top level object
 	r.reconcileTopLevelObjectSettings(scope.Cluster, machine, scope.Config)
+	if err := validateAPIServerPort(scope.Cluster, scope.Config); err != nil {
+		conditions.MarkFalse(scope.Config, bootstrapv1.DataSecretAvailableCondition, bootstrapv1.DataSecretGenerationFailedReason, clusterv1.ConditionSeverityWarning, err.Error())
+		return err
+	}
 
-	serverURL := fmt.Sprintf("https://%s", scope.Cluster.Spec.ControlPlaneEndpoint.String())
+	serverURL := joinServerURL(scope.Cluster, scope.Config)
 
 	tokn, err := token.Lookup(ctx, r.Client, client.ObjectKeyFromObject(scope.Cluster))
 	if err != nil {
@@ -229,39 +262,42 @@ func (r *KThreesConfigReconciler) joinControlplane(ctx context.Context, scope *S
 		return err
 	}
 
-	configStruct := k3s.GenerateJoinControlPlaneConfig(serverURL, *tokn,
-		scope.Cluster.Spec.ControlPlaneEndpoint.Host,
-		scope.Config.Spec.ServerConfig,
-		scope.Config.Spec.AgentConfig)
-	b, err := kubeyaml.Marshal(configStruct)
+	// A token rotation is in progress, this server switches the cluster to the new token once it has joined.
+	nextToken, err := token.LookupNext(ctx, r.Client, client.ObjectKeyFromObject(scope.Cluster))
 	if err != nil {
+		conditions.MarkFalse(scope.Config, bootstrapv1.DataSecretAvailableCondition, bootstrapv1.DataSecretGenerationFailedReason, clusterv1.ConditionSeverityWarning, err.Error())
 		return err
 	}
 
-	workerConfigFile := bootstrapv1.File{
-		Path:        k3s.DefaultK3sConfigLocation,
-		Content:     string(b),
-		Owner:       "root:root",
-		Permissions: "0640",
+	joinInfo := userdata.JoinInfo{
+		Role:                 userdata.JoinControlPlane,
+		ServerURL:            serverURL,
+		ControlPlaneEndpoint: scope.Cluster.Spec.ControlPlaneEndpoint.Host,
+		Token:                *tokn,
+		SystemProxy:          systemProxy(scope.Cluster, scope.Config),
+		TemplateInput:        templateInput(scope.Cluster, scope.ConfigOwner),
+	}
+	if nextToken != nil {
+		joinInfo.NewToken = *nextToken
 	}
 
-	files, err := r.resolveFiles(ctx, scope.Config)
-	if err != nil {
+	if err := r.resolveEtcdS3Credentials(ctx, scope.Config, &joinInfo); err != nil {
 		conditions.MarkFalse(scope.Config, bootstrapv1.DataSecretAvailableCondition, bootstrapv1.DataSecretGenerationFailedReason, clusterv1.ConditionSeverityWarning, err.Error())
 		return err
 	}
 
-	cpInput := &cloudinit.ControlPlaneInput{
-		BaseUserData: cloudinit.BaseUserData{
-			PreK3sCommands:  scope.Config.Spec.PreK3sCommands,
-			PostK3sCommands: scope.Config.Spec.PostK3sCommands,
-			AdditionalFiles: files,
-			ConfigFile:      workerConfigFile,
-			K3sVersion:      scope.Config.Spec.Version,
-		},
+	if err := r.resolveDatastoreEndpoint(ctx, scope.Config, &joinInfo); err != nil {
+		conditions.MarkFalse(scope.Config, bootstrapv1.DataSecretAvailableCondition, bootstrapv1.DataSecretGenerationFailedReason, clusterv1.ConditionSeverityWarning, err.Error())
+		return err
 	}
 
-	cloudInitData, err := cloudinit.NewJoinControlPlane(cpInput)
+	joinInfo.Files, err = r.resolveFiles(ctx, scope.Config)
+	if err != nil {
+		conditions.MarkFalse(scope.Config, bootstrapv1.DataSecretAvailableCondition, resolveFilesFailureReason(err), clusterv1.ConditionSeverityWarning, err.Error())
+		return err
+	}
+
+	cloudInitData, err := userdata.RenderBootstrapData(&scope.Config.Spec, joinInfo)
 	if err != nil {
 		return err
 	}
@@ -273,6 +309,62 @@ func (r *KThreesConfigReconciler) joinControlplane(ctx context.Context, scope *S
 	return nil
 }
 
+// joinServerURL returns the URL nodes join the cluster through, honoring the RegistrationAddress override.
+func joinServerURL(cluster *clusterv1.Cluster, config *bootstrapv1.KThreesConfig) string {
+	if config.Spec.RegistrationAddress != "" {
+		return fmt.Sprintf("https://%s", config.Spec.RegistrationAddress)
+	}
+	return fmt.Sprintf("https://%s", cluster.Spec.ControlPlaneEndpoint.String())
+}
+
+// templateInput describes the Machine owning the config and its Cluster to the NodeName and NodeLabels templates.
+func templateInput(cluster *clusterv1.Cluster, owner *bsutil.ConfigOwner) bootstrapv1.TemplateInput {
+	// Only Machines are placed in a single failure domain, MachinePools leave it empty.
+	failureDomain, _, _ := unstructured.NestedString(owner.Object, "spec", "failureDomain")
+	return bootstrapv1.TemplateInput{
+		MachineName:   owner.GetName(),
+		ClusterName:   cluster.Name,
+		FailureDomain: failureDomain,
+		MachineLabels: owner.GetLabels(),
+		ClusterLabels: cluster.Labels,
+	}
+}
+
+// systemProxy returns the proxy settings of the config, with the pod and service CIDRs of the cluster added
+// to NoProxy so in-cluster traffic never goes through the proxy.
+func systemProxy(cluster *clusterv1.Cluster, config *bootstrapv1.KThreesConfig) *bootstrapv1.SystemProxy {
+	if config.Spec.SystemProxy == nil {
+		return nil
+	}
+
+	proxy := config.Spec.SystemProxy.DeepCopy()
+	noProxy := proxy.NoProxy
+	if config.Spec.ServerConfig.ClusterCidr != "" {
+		noProxy = append(noProxy, config.Spec.ServerConfig.ClusterCidr)
+	}
+	if config.Spec.ServerConfig.ServiceCidr != "" {
+		noProxy = append(noProxy, config.Spec.ServerConfig.ServiceCidr)
+	}
+	if network := cluster.Spec.ClusterNetwork; network != nil {
+		if network.Pods != nil {
+			noProxy = append(noProxy, network.Pods.CIDRBlocks...)
+		}
+		if network.Services != nil {
+			noProxy = append(noProxy, network.Services.CIDRBlocks...)
+		}
+	}
+
+	seen := map[string]bool{}
+	proxy.NoProxy = nil
+	for _, entry := range noProxy {
+		if !seen[entry] {
+			seen[entry] = true
+			proxy.NoProxy = append(proxy.NoProxy, entry)
+		}
+	}
+	return proxy
+}
+
 func (r *KThreesConfigReconciler) joinWorker(ctx context.Context, scope *Scope) error {
 	machine := &clusterv1.Machine{}
 	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(scope.ConfigOwner.Object, machine); err != nil {
@@ -282,7 +374,7 @@ func (r *KThreesConfigReconciler) joinWorker(ctx context.Context, scope *Scope)
 	// injects into config.Version values from top level object
 	r.reconcileTopLevelObjectSettings(scope.Cluster, machine, scope.Config)
 
-	serverURL := fmt.Sprintf("https://%s", scope.Cluster.Spec.ControlPlaneEndpoint.String())
+	serverURL := joinServerURL(scope.Cluster, scope.Config)
 
 	tokn, err := token.Lookup(ctx, r.Client, client.ObjectKeyFromObject(scope.Cluster))
 	if err != nil {
@@ -290,37 +382,21 @@ func (r *KThreesConfigReconciler) joinWorker(ctx context.Context, scope *Scope)
 		return err
 	}
 
-	configStruct := k3s.GenerateWorkerConfig(serverURL, *tokn, scope.Config.Spec.ServerConfig, scope.Config.Spec.AgentConfig)
-
-	b, err := kubeyaml.Marshal(configStruct)
-	if err != nil {
-		return err
+	joinInfo := userdata.JoinInfo{
+		Role:          userdata.Worker,
+		ServerURL:     serverURL,
+		Token:         *tokn,
+		SystemProxy:   systemProxy(scope.Cluster, scope.Config),
+		TemplateInput: templateInput(scope.Cluster, scope.ConfigOwner),
 	}
 
-	workerConfigFile := bootstrapv1.File{
-		Path:        k3s.DefaultK3sConfigLocation,
-		Content:     string(b),
-		Owner:       "root:root",
-		Permissions: "0640",
-	}
-
-	files, err := r.resolveFiles(ctx, scope.Config)
+	joinInfo.Files, err = r.resolveFiles(ctx, scope.Config)
 	if err != nil {
-		conditions.MarkFalse(scope.Config, bootstrapv1.DataSecretAvailableCondition, bootstrapv1.DataSecretGenerationFailedReason, clusterv1.ConditionSeverityWarning, err.Error())
+		conditions.MarkFalse(scope.Config, bootstrapv1.DataSecretAvailableCondition, resolveFilesFailureReason(err), clusterv1.ConditionSeverityWarning, err.Error())
 		return err
 	}
 
-	winput := &cloudinit.WorkerInput{
-		BaseUserData: cloudinit.BaseUserData{
-			PreK3sCommands:  scope.Config.Spec.PreK3sCommands,
-			PostK3sCommands: scope.Config.Spec.PostK3sCommands,
-			AdditionalFiles: files,
-			ConfigFile:      workerConfigFile,
-			K3sVersion:      scope.Config.Spec.Version,
-		},
-	}
-
-	cloudInitData, err := cloudinit.NewWorker(winput)
+	cloudInitData, err := userdata.RenderBootstrapData(&scope.Config.Spec, joinInfo)
 	if err != nil {
 		return err
 	}
@@ -333,6 +409,47 @@ func (r *KThreesConfigReconciler) joinWorker(ctx context.Context, scope *Scope)
 	return nil
 }
 
+// reconcileNodeRegistration tracks the node registration of the Machine bootstrapped by a config with a join timeout.
+func (r *KThreesConfigReconciler) reconcileNodeRegistration(scope *Scope) (ctrl.Result, error) {
+	if scope.Config.Spec.JoinTimeout == nil || scope.ConfigOwner.IsMachinePool() {
+		return ctrl.Result{}, nil
+	}
+
+	machine := &clusterv1.Machine{}
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(scope.ConfigOwner.Object, machine); err != nil {
+		return ctrl.Result{}, fmt.Errorf("cannot convert %s to Machine: %w", scope.ConfigOwner.GetKind(), err)
+	}
+
+	return ctrl.Result{RequeueAfter: reconcileNodeRegistrationCondition(scope.Config, machine, time.Now())}, nil
+}
+
+// reconcileNodeRegistrationCondition sets the NodeRegistered condition from the node of the Machine, which has
+// JoinTimeout from the moment the bootstrap data became available to register it. It returns how long to wait before
+// checking again, zero once the node is registered; the Machine is not watched, so a timed out node keeps being
+// checked for in case it registers late.
+func reconcileNodeRegistrationCondition(config *bootstrapv1.KThreesConfig, machine *clusterv1.Machine, now time.Time) time.Duration {
+	if machine.Status.NodeRef != nil {
+		conditions.MarkTrue(config, bootstrapv1.NodeRegisteredCondition)
+		return 0
+	}
+
+	timeout := config.Spec.JoinTimeout.Duration
+	since := now
+	if t := conditions.GetLastTransitionTime(config, bootstrapv1.DataSecretAvailableCondition); t != nil {
+		since = t.Time
+	}
+
+	if remaining := since.Add(timeout).Sub(now); remaining > 0 {
+		conditions.MarkFalse(config, bootstrapv1.NodeRegisteredCondition, bootstrapv1.WaitingForNodeRegistrationReason, clusterv1.ConditionSeverityInfo,
+			"Waiting for the node of Machine %s to register", machine.Name)
+		return remaining
+	}
+
+	conditions.MarkFalse(config, bootstrapv1.NodeRegisteredCondition, bootstrapv1.JoinTimeoutReason, clusterv1.ConditionSeverityWarning,
+		"The node of Machine %s did not register within %s, %s on the machine may tell why", machine.Name, timeout, cloudinit.JoinFailureFile)
+	return nodeRegistrationRecheckAfter
+}
+
 // resolveFiles maps .Spec.Files into cloudinit.Files, resolving any object references
 // along the way.
 func (r *KThreesConfigReconciler) resolveFiles(ctx context.Context, cfg *bootstrapv1.KThreesConfig) ([]bootstrapv1.File, error) {
@@ -351,9 +468,95 @@ func (r *KThreesConfigReconciler) resolveFiles(ctx context.Context, cfg *bootstr
 		collected = append(collected, in)
 	}
 
+	if cfg.Spec.RegistryConfigRef != nil {
+		registryFile, err := r.resolveRegistryConfig(ctx, cfg)
+		if err != nil {
+			return nil, err
+		}
+		collected = append(collected, registryFile)
+	}
+
+	collected = append(collected, configDropInFiles(cfg)...)
+
 	return collected, nil
 }
 
+// configDropInFiles returns the k3s config drop-in files of the config, sorted by name so the user data is stable.
+func configDropInFiles(cfg *bootstrapv1.KThreesConfig) []bootstrapv1.File {
+	names := make([]string, 0, len(cfg.Spec.ConfigDropIns))
+	for name := range cfg.Spec.ConfigDropIns {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	files := make([]bootstrapv1.File, 0, len(names))
+	for _, name := range names {
+		files = append(files, bootstrapv1.File{
+			Path:        path.Join(k3s.DefaultK3sConfigDropInDir, name),
+			Content:     cfg.Spec.ConfigDropIns[name],
+			Owner:       "root:root",
+			Permissions: "0640",
+		})
+	}
+	return files
+}
+
+// resolveFilesFailureReason returns the DataSecretAvailable condition reason for an error returned by resolveFiles.
+func resolveFilesFailureReason(err error) string {
+	if errors.Is(err, ErrRegistryConfigUnavailable) {
+		return bootstrapv1.RegistryConfigUnavailableReason
+	}
+	return bootstrapv1.DataSecretGenerationFailedReason
+}
+
+// resolveRegistryConfig returns the k3s registries.yaml file built from the ConfigMap or Secret referenced by the config.
+func (r *KThreesConfigReconciler) resolveRegistryConfig(ctx context.Context, cfg *bootstrapv1.KThreesConfig) (bootstrapv1.File, error) {
+	ref := cfg.Spec.RegistryConfigRef
+	dataKey := ref.Key
+	if dataKey == "" {
+		dataKey = bootstrapv1.DefaultRegistryConfigKey
+	}
+	key := types.NamespacedName{Namespace: cfg.Namespace, Name: ref.Name}
+
+	var (
+		content string
+		found   bool
+	)
+	switch ref.Kind {
+	case "ConfigMap":
+		configMap := &corev1.ConfigMap{}
+		if err := r.Client.Get(ctx, key, configMap); err != nil {
+			return bootstrapv1.File{}, fmt.Errorf("failed to retrieve registry config ConfigMap %s: %w: %v", key, ErrRegistryConfigUnavailable, err)
+		}
+		content, found = configMap.Data[dataKey]
+	case "Secret":
+		secret := &corev1.Secret{}
+		if err := r.Client.Get(ctx, key, secret); err != nil {
+			return bootstrapv1.File{}, fmt.Errorf("failed to retrieve registry config Secret %s: %w: %v", key, ErrRegistryConfigUnavailable, err)
+		}
+		var data []byte
+		data, found = secret.Data[dataKey]
+		content = string(data)
+	default:
+		return bootstrapv1.File{}, fmt.Errorf("registry config references unsupported kind %q: %w", ref.Kind, ErrInvalidRef)
+	}
+	if !found {
+		return bootstrapv1.File{}, fmt.Errorf("registry config %s %s has no key %q: %w", ref.Kind, key, dataKey, ErrRegistryConfigUnavailable)
+	}
+
+	path := cfg.Spec.AgentConfig.PrivateRegistry
+	if path == "" {
+		path = k3s.DefaultK3sRegistriesLocation
+	}
+
+	return bootstrapv1.File{
+		Path:        path,
+		Content:     content,
+		Owner:       "root:root",
+		Permissions: "0600",
+	}, nil
+}
+
 // resolveSecretFileContent returns file content fetched from a referenced secret object.
 func (r *KThreesConfigReconciler) resolveSecretFileContent(ctx context.Context, ns string, source bootstrapv1.File) ([]byte, error) {
 	secret := &corev1.Secret{}
@@ -371,6 +574,77 @@ func (r *KThreesConfigReconciler) resolveSecretFileContent(ctx context.Context,
 	return data, nil
 }
 
+// resolveEtcdS3Credentials fills in the etcd snapshot S3 credentials from the secret referenced by the config.
+func (r *KThreesConfigReconciler) resolveEtcdS3Credentials(ctx context.Context, cfg *bootstrapv1.KThreesConfig, joinInfo *userdata.JoinInfo) error {
+	snapshot := cfg.Spec.ServerConfig.EtcdSnapshot
+	if snapshot == nil || snapshot.S3 == nil || snapshot.S3.CredentialsSecret == nil {
+		return nil
+	}
+
+	secret := &corev1.Secret{}
+	key := types.NamespacedName{Namespace: cfg.Namespace, Name: snapshot.S3.CredentialsSecret.Name}
+	if err := r.Client.Get(ctx, key, secret); err != nil {
+		if apierrors.IsNotFound(err) {
+			return fmt.Errorf("secret not found %s: %w", key, err)
+		}
+		return fmt.Errorf("failed to retrieve Secret %q: %w", key, err)
+	}
+
+	accessKey, ok := secret.Data[bootstrapv1.EtcdSnapshotS3AccessKeyIDKey]
+	if !ok {
+		return fmt.Errorf("secret %s has no key %q: %w", key, bootstrapv1.EtcdSnapshotS3AccessKeyIDKey, ErrInvalidRef)
+	}
+	secretKey, ok := secret.Data[bootstrapv1.EtcdSnapshotS3SecretAccessKeyKey]
+	if !ok {
+		return fmt.Errorf("secret %s has no key %q: %w", key, bootstrapv1.EtcdSnapshotS3SecretAccessKeyKey, ErrInvalidRef)
+	}
+
+	joinInfo.EtcdS3AccessKey = string(accessKey)
+	joinInfo.EtcdS3SecretKey = string(secretKey)
+	return nil
+}
+
+// reconcileExternalCNICondition tells users that disabling flannel leaves the nodes without a pod network
+// until a CNI is installed separately.
+func reconcileExternalCNICondition(config *bootstrapv1.KThreesConfig) {
+	if config.Spec.ServerConfig.FlannelBackend != bootstrapv1.FlannelBackendNone {
+		conditions.Delete(config, bootstrapv1.ExternalCNIRequiredCondition)
+		return
+	}
+
+	conditions.Set(config, &clusterv1.Condition{
+		Type:    bootstrapv1.ExternalCNIRequiredCondition,
+		Status:  corev1.ConditionTrue,
+		Reason:  bootstrapv1.FlannelBackendNoneReason,
+		Message: "flannel is disabled, a CNI must be installed in the workload cluster separately",
+	})
+}
+
+// resolveDatastoreEndpoint fills in the external datastore endpoint from the secret referenced by the config.
+func (r *KThreesConfigReconciler) resolveDatastoreEndpoint(ctx context.Context, cfg *bootstrapv1.KThreesConfig, joinInfo *userdata.JoinInfo) error {
+	datastore := cfg.Spec.ServerConfig.Datastore
+	if !datastore.IsExternal() || datastore.EndpointSecret == nil {
+		return nil
+	}
+
+	secret := &corev1.Secret{}
+	key := types.NamespacedName{Namespace: cfg.Namespace, Name: datastore.EndpointSecret.Name}
+	if err := r.Client.Get(ctx, key, secret); err != nil {
+		if apierrors.IsNotFound(err) {
+			return fmt.Errorf("secret not found %s: %w", key, err)
+		}
+		return fmt.Errorf("failed to retrieve Secret %q: %w", key, err)
+	}
+
+	endpoint, ok := secret.Data[bootstrapv1.DatastoreEndpointKey]
+	if !ok {
+		return fmt.Errorf("secret %s has no key %q: %w", key, bootstrapv1.DatastoreEndpointKey, ErrInvalidRef)
+	}
+
+	joinInfo.DatastoreEndpoint = string(endpoint)
+	return nil
+}
+
 func (r *KThreesConfigReconciler) handleClusterNotInitialized(ctx context.Context, scope *Scope) (_ ctrl.Result, reterr error) {
 	// initialize the DataSecretAvailableCondition if missing.
 	// this is required in order to avoid the condition's LastTransitionTime to flicker in case of errors surfacing
@@ -410,6 +684,10 @@ func (r *KThreesConfigReconciler) handleClusterNotInitialized(ctx context.Contex
 
 	// injects into config.ClusterConfiguration values from top level object
 	r.reconcileTopLevelObjectSettings(scope.Cluster, machine, scope.Config)
+	if err := validateAPIServerPort(scope.Cluster, scope.Config); err != nil {
+		conditions.MarkFalse(scope.Config, bootstrapv1.DataSecretAvailableCondition, bootstrapv1.DataSecretGenerationFailedReason, clusterv1.ConditionSeverityWarning, err.Error())
+		return ctrl.Result{}, err
+	}
 
 	certificates := secret.NewCertificatesForInitialControlPlane(&scope.Config.Spec)
 	err := certificates.LookupOrGenerate(
@@ -429,44 +707,32 @@ func (r *KThreesConfigReconciler) handleClusterNotInitialized(ctx context.Contex
 		return ctrl.Result{}, err
 	}
 
-	// TODO support k3s great feature of external backends.
-	// For now just use the etcd option
-	configStruct := k3s.GenerateInitControlPlaneConfig(
-		scope.Cluster.Spec.ControlPlaneEndpoint.Host,
-		*token,
-		scope.Config.Spec.ServerConfig,
-		scope.Config.Spec.AgentConfig)
-
-	b, err := kubeyaml.Marshal(configStruct)
-	if err != nil {
-		return ctrl.Result{}, err
+	joinInfo := userdata.JoinInfo{
+		Role:                 userdata.InitControlPlane,
+		ControlPlaneEndpoint: scope.Cluster.Spec.ControlPlaneEndpoint.Host,
+		Token:                *token,
+		Certificates:         certificates,
+		SystemProxy:          systemProxy(scope.Cluster, scope.Config),
+		TemplateInput:        templateInput(scope.Cluster, scope.ConfigOwner),
 	}
 
-	initConfigFile := bootstrapv1.File{
-		Path:        k3s.DefaultK3sConfigLocation,
-		Content:     string(b),
-		Owner:       "root:root",
-		Permissions: "0640",
+	if err := r.resolveEtcdS3Credentials(ctx, scope.Config, &joinInfo); err != nil {
+		conditions.MarkFalse(scope.Config, bootstrapv1.DataSecretAvailableCondition, bootstrapv1.DataSecretGenerationFailedReason, clusterv1.ConditionSeverityWarning, err.Error())
+		return ctrl.Result{}, err
 	}
 
-	files, err := r.resolveFiles(ctx, scope.Config)
-	if err != nil {
+	if err := r.resolveDatastoreEndpoint(ctx, scope.Config, &joinInfo); err != nil {
 		conditions.MarkFalse(scope.Config, bootstrapv1.DataSecretAvailableCondition, bootstrapv1.DataSecretGenerationFailedReason, clusterv1.ConditionSeverityWarning, err.Error())
 		return ctrl.Result{}, err
 	}
 
-	cpinput := &cloudinit.ControlPlaneInput{
-		BaseUserData: cloudinit.BaseUserData{
-			PreK3sCommands:  scope.Config.Spec.PreK3sCommands,
-			PostK3sCommands: scope.Config.Spec.PostK3sCommands,
-			AdditionalFiles: files,
-			ConfigFile:      initConfigFile,
-			K3sVersion:      scope.Config.Spec.Version,
-		},
-		Certificates: certificates,
+	joinInfo.Files, err = r.resolveFiles(ctx, scope.Config)
+	if err != nil {
+		conditions.MarkFalse(scope.Config, bootstrapv1.DataSecretAvailableCondition, resolveFilesFailureReason(err), clusterv1.ConditionSeverityWarning, err.Error())
+		return ctrl.Result{}, err
 	}
 
-	cloudInitData, err := cloudinit.NewInitControlPlane(cpinput)
+	cloudInitData, err := userdata.RenderBootstrapData(&scope.Config.Spec, joinInfo)
 	if err != nil {
 		return ctrl.Result{}, err
 	}
@@ -492,7 +758,18 @@ func (r *KThreesConfigReconciler) SetupWithManager(mgr ctrl.Manager) error {
 
 // storeBootstrapData creates a new secret with the data passed in as input,
 // sets the reference in the configuration status and ready to true.
+// Infrastructure providers read the data under the value key and its format under the format key,
+// the optional network configuration is stored under the network-config key.
 func (r *KThreesConfigReconciler) storeBootstrapData(ctx context.Context, scope *Scope, data []byte) error {
+	data, compressed, err := encodeUserData(scope.Config, data)
+	if err != nil {
+		return err
+	}
+	format := bootstrapv1.CloudConfig
+	if scope.Config.Spec.Format == bootstrapv1.Ignition {
+		format = bootstrapv1.Ignition
+	}
+
 	secret := &corev1.Secret{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      scope.Config.Name,
@@ -511,10 +788,17 @@ func (r *KThreesConfigReconciler) storeBootstrapData(ctx context.Context, scope
 			},
 		},
 		Data: map[string][]byte{
-			"value": data,
+			"value":  data,
+			"format": []byte(format),
 		},
 		Type: clusterv1.ClusterSecretType,
 	}
+	if compressed {
+		secret.Annotations = map[string]string{bootstrapv1.CompressedUserDataAnnotation: "true"}
+	}
+	if scope.Config.Spec.NetworkConfig != "" {
+		secret.Data["network-config"] = []byte(scope.Config.Spec.NetworkConfig)
+	}
 
 	// as secret creation and scope.Config status patch are not atomic operations
 	// it is possible that secret creation happens but the config.Status patches are not applied
@@ -534,6 +818,28 @@ func (r *KThreesConfigReconciler) storeBootstrapData(ctx context.Context, scope
 	return nil
 }
 
+// encodeUserData compresses cloud-init user-data when asked to, or by default when it exceeds the size limit
+// of common cloud providers, and tells whether it did.
+func encodeUserData(config *bootstrapv1.KThreesConfig, data []byte) ([]byte, bool, error) {
+	if config.Spec.Format == bootstrapv1.Ignition {
+		return data, false, nil
+	}
+
+	compress := len(data) > cloudinit.UserDataSizeLimit
+	if config.Spec.CompressUserData != nil {
+		compress = *config.Spec.CompressUserData
+	}
+	if !compress {
+		return data, false, nil
+	}
+
+	compressed, err := cloudinit.GzipMultipart(data)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to compress bootstrap data for KThreesConfig %s/%s: %w", config.Namespace, config.Name, err)
+	}
+	return compressed, true, nil
+}
+
 func (r *KThreesConfigReconciler) reconcileKubeconfig(ctx context.Context, scope *Scope) (ctrl.Result, error) {
 	logger := r.Log.WithValues("cluster", scope.Cluster.Name, "namespace", scope.Cluster.Namespace)
 
@@ -554,7 +860,7 @@ func (r *KThreesConfigReconciler) reconcileKubeconfig(ctx context.Context, scope
 	return ctrl.Result{}, nil
 }
 
-func (r *KThreesConfigReconciler) reconcileTopLevelObjectSettings(_ *clusterv1.Cluster, machine *clusterv1.Machine, config *bootstrapv1.KThreesConfig) {
+func (r *KThreesConfigReconciler) reconcileTopLevelObjectSettings(cluster *clusterv1.Cluster, machine *clusterv1.Machine, config *bootstrapv1.KThreesConfig) {
 	log := r.Log.WithValues("kthreesconfig", fmt.Sprintf("%s/%s", config.Namespace, config.Name))
 
 	// If there are no Version settings defined in Config, use Version from machine, if defined
@@ -562,4 +868,36 @@ func (r *KThreesConfigReconciler) reconcileTopLevelObjectSettings(_ *clusterv1.C
 		config.Spec.Version = *machine.Spec.Version
 		log.Info("Altering Config", "Version", config.Spec.Version)
 	}
+
+	// If there is no HTTPSListenPort defined in Config, use the APIServerPort from the cluster network, if defined,
+	// so the port servers listen on agrees with the one the control plane endpoint was built from.
+	if util.IsControlPlaneMachine(machine) && config.Spec.ServerConfig.HTTPSListenPort == "" &&
+		cluster.Spec.ClusterNetwork != nil && cluster.Spec.ClusterNetwork.APIServerPort != nil {
+		config.Spec.ServerConfig.HTTPSListenPort = strconv.Itoa(int(*cluster.Spec.ClusterNetwork.APIServerPort))
+		log.Info("Altering Config", "HTTPSListenPort", config.Spec.ServerConfig.HTTPSListenPort)
+	}
+}
+
+// validateAPIServerPort ensures the port a server listens on agrees with the cluster: the APIServerPort of the cluster
+// network, or when it is unset the port of the control plane endpoint. An APIServerPort differing from the endpoint
+// port is the one to listen on, the endpoint is then typically a load balancer forwarding to it.
+func validateAPIServerPort(cluster *clusterv1.Cluster, config *bootstrapv1.KThreesConfig) error {
+	port := config.Spec.ServerConfig.HTTPSListenPort
+	if port == "" {
+		return nil
+	}
+
+	if network := cluster.Spec.ClusterNetwork; network != nil && network.APIServerPort != nil {
+		if expected := strconv.Itoa(int(*network.APIServerPort)); port != expected {
+			return fmt.Errorf("httpsListenPort %s does not match the APIServerPort %s of the cluster network", port, expected)
+		}
+		return nil
+	}
+
+	if endpointPort := cluster.Spec.ControlPlaneEndpoint.Port; endpointPort != 0 {
+		if expected := strconv.Itoa(int(endpointPort)); port != expected {
+			return fmt.Errorf("httpsListenPort %s does not match the port %s of the control plane endpoint", port, expected)
+		}
+	}
+	return nil
 }
@@ -83,6 +83,15 @@ func main() {
 		setupLog.Error(err, "unable to create controller", "controller", "KThreesConfig")
 		os.Exit(1)
 	}
+
+	if err = (&bootstrapv1beta1.KThreesConfig{}).SetupWebhookWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create webhook", "webhook", "KThreesConfig")
+		os.Exit(1)
+	}
+	if err = (&bootstrapv1beta1.KThreesConfigTemplate{}).SetupWebhookWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create webhook", "webhook", "KThreesConfigTemplate")
+		os.Exit(1)
+	}
 	// +kubebuilder:scaffold:builder
 
 	setupLog.Info("starting manager")
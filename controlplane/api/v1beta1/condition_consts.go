@@ -34,6 +34,22 @@ const (
 	// an error while generating certificates; those kind of errors are usually temporary and the controller
 	// automatically recover from them.
 	CertificatesGenerationFailedReason = "CertificatesGenerationFailed"
+
+	// CACertificatesUnavailableReason (Severity=Warning) documents that the CAs supplied through CACertificatesRef
+	// could not be read, are invalid, or differ from the CAs the cluster already uses.
+	CACertificatesUnavailableReason = "CACertificatesUnavailable"
+)
+
+const (
+	// CertificatesExpiringSoonCondition documents that the certificates served by the k3s servers expire within
+	// the KThreesControlPlane CertificatesExpiryThreshold.
+	CertificatesExpiringSoonCondition clusterv1.ConditionType = "CertificatesExpiringSoon"
+
+	// CertificatesValidReason (Severity=Info) documents certificates that don't expire within the threshold.
+	CertificatesValidReason = "CertificatesValid"
+
+	// CertificatesInspectionFailedReason documents a failure in reading the certificates served by the k3s servers.
+	CertificatesInspectionFailedReason = "CertificatesInspectionFailed"
 )
 
 const (
@@ -44,6 +60,10 @@ const (
 	// WaitingForKthreesServerReason (Severity=Info) documents a KThreesControlPlane object waiting for the first
 	// control plane instance to complete the k3s server operation.
 	WaitingForKthreesServerReason = "WaitingForKthreesServer"
+
+	// WaitingForControlPlaneEndpointReason (Severity=Info) documents a KThreesControlPlane object waiting for the
+	// Cluster control plane endpoint, e.g. from a load balancer being provisioned, before creating any machine.
+	WaitingForControlPlaneEndpointReason = "WaitingForControlPlaneEndpoint"
 )
 
 const (
@@ -65,6 +85,14 @@ const (
 
 	// ScalingDownReason (Severity=Info) documents a KThreesControlPlane that is decreasing the number of replicas.
 	ScalingDownReason = "ScalingDown"
+
+	// WaitingForEtcdMemberReason (Severity=Info) documents a KThreesControlPlane with all its machines provisioned,
+	// waiting for the etcd member of the new servers to be healthy.
+	WaitingForEtcdMemberReason = "WaitingForEtcdMember"
+
+	// NodeNotReadyReason (Severity=Info) documents a KThreesControlPlane with all its machines provisioned,
+	// waiting for the nodes of the machines to be Ready.
+	NodeNotReadyReason = "NodeNotReady"
 )
 
 const (
@@ -110,6 +138,9 @@ const (
 	// EtcdClusterUnhealthyReason (Severity=Error) is set when the etcd cluster is unhealthy.
 	EtcdClusterUnhealthyReason = "EtcdClusterUnhealthy"
 
+	// EtcdQuorumLostReason (Severity=Error) is set when not enough etcd members are healthy to preserve quorum.
+	EtcdQuorumLostReason = "EtcdQuorumLost"
+
 	// MachineEtcdMemberHealthyCondition report the machine's etcd member's health status.
 	// NOTE: This conditions exists only if a stacked etcd cluster is used.
 	MachineEtcdMemberHealthyCondition clusterv1.ConditionType = "EtcdMemberHealthy"
@@ -121,10 +152,47 @@ const (
 	EtcdMemberUnhealthyReason = "EtcdMemberUnhealthy"
 )
 
+const (
+	// HasRemediateMachineAnnotationReason (Severity=Warning) documents a control plane Machine that has been
+	// explicitly marked for remediation with the RemediateMachineAnnotation.
+	HasRemediateMachineAnnotationReason = "HasRemediateMachineAnnotation"
+)
+
 const (
 	// TokenAvailableCondition documents whether the token required for nodes to join the cluster is available.
 	TokenAvailableCondition clusterv1.ConditionType = "TokenAvailable"
 
 	// TokenGenerationFailedReason documents that the token required for nodes to join the cluster could not be generated.
 	TokenGenerationFailedReason = "TokenGenerationFailed"
+
+	// TokenSecretUnavailableReason documents that the token supplied through TokenRef could not be read
+	// or conflicts with the token the cluster already uses.
+	TokenSecretUnavailableReason = "TokenSecretUnavailable"
+)
+
+const (
+	// SecretsEncryptionCondition documents whether the k3s servers completed the last secrets encryption operation,
+	// e.g. a key rotation. It is only reported when ServerConfig.SecretsEncryption is enabled.
+	SecretsEncryptionCondition clusterv1.ConditionType = "SecretsEncryption"
+
+	// SecretsEncryptionInProgressReason (Severity=Info) documents servers that are going through the stages of a
+	// secrets encryption operation, or that disagree on the current stage.
+	SecretsEncryptionInProgressReason = "SecretsEncryptionInProgress"
+
+	// SecretsEncryptionInspectionFailedReason documents a failure in reading the secrets encryption stage of the servers.
+	SecretsEncryptionInspectionFailedReason = "SecretsEncryptionInspectionFailed"
+)
+
+const (
+	// PreUpgradeSnapshotCondition documents the etcd snapshot taken before the control plane is upgraded to a new
+	// version. It is only reported when SnapshotBeforeUpgrade is enabled.
+	PreUpgradeSnapshotCondition clusterv1.ConditionType = "PreUpgradeSnapshot"
+
+	// WaitingForPreUpgradeSnapshotReason (Severity=Info) documents a rollout to a new version held until the etcd
+	// snapshot is saved.
+	WaitingForPreUpgradeSnapshotReason = "WaitingForPreUpgradeSnapshot"
+
+	// PreUpgradeSnapshotFailedReason (Severity=Error) documents a failure in taking the etcd snapshot, the rollout
+	// to the new version is held until it succeeds.
+	PreUpgradeSnapshotFailedReason = "PreUpgradeSnapshotFailed"
 )
@@ -17,10 +17,13 @@ limitations under the License.
 package v1beta1
 
 import (
+	"fmt"
+	"path"
 	"time"
 
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
 	clusterv1 "sigs.k8s.io/cluster-api/api/v1beta1"
 
 	cabp3v1 "github.com/cluster-api-provider-k3s/cluster-api-k3s/bootstrap/api/v1beta1"
@@ -50,6 +53,45 @@ const (
 	// failures in updating remediation retry (the counter restarts from zero).
 	RemediationForAnnotation = "controlplane.cluster.x-k8s.io/remediation-for"
 
+	// RemediateMachineAnnotation can be set on a control plane Machine to request KThreesControlPlane to remediate it,
+	// the same way it would remediate a Machine reported as unhealthy by a MachineHealthCheck.
+	RemediateMachineAnnotation = "cluster.x-k8s.io/remediate-machine"
+
+	// RestoreSnapshotAnnotation requests the control plane to be restored from the given etcd snapshot, a local path
+	// on the new server or the name of a snapshot in the configured S3 bucket, once every control plane machine is lost.
+	// When an initialized control plane has no machines left, the first replacement machine resets the embedded etcd
+	// from the snapshot (k3s --cluster-reset --cluster-reset-restore-path) before it starts, the annotation is removed,
+	// and the control plane is then scaled back up by joining new servers to the restored one.
+	RestoreSnapshotAnnotation = "controlplane.cluster.x-k8s.io/restore-snapshot"
+
+	// RotateCertificatesAnnotation requests the control plane machines to be rolled out, so every server comes up with
+	// freshly issued certificates. Its value is the time of the request in RFC3339 format, an empty value is set to the
+	// time the request is first seen. Machines created before that time are replaced honoring the RolloutStrategy,
+	// and the annotation is removed once none of them is left.
+	RotateCertificatesAnnotation = "controlplane.cluster.x-k8s.io/rotate-certificates"
+
+	// RotateTokenAnnotation requests the server token to be rotated. Its value is the time of the request in RFC3339
+	// format, an empty value is set to the time the request is first seen. A new token is staged, workers wait for
+	// the rotation to join, and once no machine is joining with the current token the first server created
+	// afterwards switches the cluster to the new one with `k3s token rotate`. The new token is then handed to joining
+	// nodes, and the control plane machines created before the request and the MachineDeployments of the cluster are
+	// rolled out. The annotation is removed once none of the machines using the old token is left.
+	// It can't be used with TokenRef, a supplied token is rotated by its owner. The machines of a MachinePool can't be
+	// rolled out and would keep the old token, so the request is refused and removed while the cluster has MachinePools.
+	RotateTokenAnnotation = "controlplane.cluster.x-k8s.io/rotate-token"
+
+	// PreUpgradeSnapshotAnnotation records the version the last pre-upgrade etcd snapshot was taken for,
+	// see SnapshotBeforeUpgrade.
+	PreUpgradeSnapshotAnnotation = "controlplane.cluster.x-k8s.io/pre-upgrade-snapshot"
+
+	// ForceReplicasAnnotation allows spec.replicas to be changed to an even number, or to be reduced below the etcd
+	// quorum of the current members in a single edit, both of which are rejected otherwise with an embedded datastore.
+	ForceReplicasAnnotation = "controlplane.cluster.x-k8s.io/force-replicas"
+
+	// PreTerminateHookCleanupAnnotation is the pre-terminate hook KThreesControlPlane sets on its Machines, so it can
+	// remove the etcd member of a deleting Machine after the node has been drained and before its infrastructure is deleted.
+	PreTerminateHookCleanupAnnotation = clusterv1.PreTerminateDeleteHookAnnotationPrefix + "/kthrees-cleanup"
+
 	// DefaultMinHealthyPeriod defines the default minimum period before we consider a remediation on a
 	// machine unrelated from the previous remediation.
 	DefaultMinHealthyPeriod = 1 * time.Hour
@@ -86,6 +128,8 @@ type KThreesControlPlaneSpec struct {
 
 	// NodeDrainTimeout is the total amount of time that the controller will spend on draining a controlplane node
 	// The default value is 0, meaning that the node can be drained without any time limitations.
+	// The node is cordoned and its pods are evicted respecting PodDisruptionBudgets, DaemonSet pods are skipped.
+	// Changes are applied in place to the existing machines, including the ones being deleted.
 	// NOTE: NodeDrainTimeout is different from `kubectl drain --timeout`
 	// +optional
 	NodeDrainTimeout *metav1.Duration `json:"nodeDrainTimeout,omitempty"`
@@ -97,8 +141,69 @@ type KThreesControlPlaneSpec struct {
 	// The RemediationStrategy that controls how control plane machine remediation happens.
 	// +optional
 	RemediationStrategy *RemediationStrategy `json:"remediationStrategy,omitempty"`
+
+	// The RolloutStrategy to use to replace control plane machines with
+	// new ones.
+	// +optional
+	RolloutStrategy *RolloutStrategy `json:"rolloutStrategy,omitempty"`
+
+	// SnapshotBeforeUpgrade takes an on-demand etcd snapshot when Version changes, and holds the rollout until it
+	// is saved, so the cluster can be restored from it if the upgrade goes wrong. The snapshot is named
+	// pre-upgrade-<version> and stored like the scheduled ones, including in S3 when configured.
+	// It can only be used with the embedded etcd.
+	// +optional
+	SnapshotBeforeUpgrade bool `json:"snapshotBeforeUpgrade,omitempty"`
+
+	// EtcdQuotaBackendBytes raises the size limit of the embedded etcd database on every server, 2GiB by default.
+	// A database reaching it raises a NOSPACE alarm and etcd only serves reads and deletes until space is reclaimed.
+	// It must be at least 2GiB, etcd recommends not going above 8GiB. Setting or changing it rolls out the control
+	// plane machines.
+	// +optional
+	EtcdQuotaBackendBytes *int64 `json:"etcdQuotaBackendBytes,omitempty"`
+
+	// Manifests are written to the auto-deploy directory of the servers, server/manifests under the k3s data dir,
+	// where k3s applies them to the cluster, e.g. HelmChart and HelmChartConfig resources declaring addons.
+	// Changes roll out the control plane machines, so every server applies the same manifests.
+	// +optional
+	Manifests []Manifest `json:"manifests,omitempty"`
+
+	// KubeconfigServer is the server URL of the generated admin kubeconfig, e.g. https://k8s.example.com:6443,
+	// for clusters reached through an externally-facing name. It defaults to the control plane endpoint of the
+	// Cluster. The host must be listed in KThreesConfigSpec.ServerConfig.TLSSan, so the servers present a
+	// certificate valid for it. Changes are applied to the existing kubeconfig.
+	// +optional
+	KubeconfigServer string `json:"kubeconfigServer,omitempty"`
+
+	// CertificatesExpiryThreshold is how long before the k3s server certificates expire the
+	// CertificatesExpiringSoon condition is raised (default: 30 days).
+	// k3s renews certificates expiring within 90 days when it is restarted.
+	// +optional
+	CertificatesExpiryThreshold *metav1.Duration `json:"certificatesExpiryThreshold,omitempty"`
+
+	// TokenRef references a Secret in the same namespace holding the server token under the value key.
+	// When set the token is used instead of a generated one, by the servers and the workers alike.
+	// It can only be set when the KThreesControlPlane is created.
+	// +optional
+	TokenRef *corev1.LocalObjectReference `json:"tokenRef,omitempty"`
+
+	// CACertificatesRef references a Secret in the same namespace holding the cluster CAs to use instead of
+	// generated ones. Each CA is a certificate and key pair named after the files k3s reads from
+	// server/tls under its data dir: server-ca.crt and server-ca.key, client-ca.crt and client-ca.key,
+	// and with the embedded etcd etcd-server-ca.crt and etcd-server-ca.key.
+	// It can only be set when the KThreesControlPlane is created.
+	// +optional
+	CACertificatesRef *corev1.LocalObjectReference `json:"caCertificatesRef,omitempty"`
 }
 
+// EtcdQuotaBackendBytesKey is the etcd argument EtcdQuotaBackendBytes is rendered to.
+const EtcdQuotaBackendBytesKey = "quota-backend-bytes"
+
+// MinEtcdQuotaBackendBytes is the smallest EtcdQuotaBackendBytes accepted, the etcd default.
+const MinEtcdQuotaBackendBytes = 2 * 1024 * 1024 * 1024
+
+// DefaultCertificatesExpiryThreshold is the CertificatesExpiryThreshold used when none is set.
+const DefaultCertificatesExpiryThreshold = 30 * 24 * time.Hour
+
 // MachineTemplate contains information about how machines should be shaped
 // when creating or updating a control plane.
 // In the next API version we will move the InfrastructureTemplate field into
@@ -110,6 +215,120 @@ type KThreesControlPlaneMachineTemplate struct {
 	ObjectMeta clusterv1.ObjectMeta `json:"metadata,omitempty"`
 }
 
+// RolloutStrategyType defines the rollout strategies for a KThreesControlPlane.
+type RolloutStrategyType string
+
+const (
+	// RollingUpdateStrategyType replaces the old control planes by new one using rolling update
+	// i.e. gradually scale up or down the old control planes and scale up or down the new one.
+	RollingUpdateStrategyType RolloutStrategyType = "RollingUpdate"
+)
+
+// RolloutStrategy describes how to replace existing machines
+// with new ones.
+type RolloutStrategy struct {
+	// Type of rollout. Currently the only supported strategy is
+	// "RollingUpdate".
+	// Default is RollingUpdate.
+	// +optional
+	Type RolloutStrategyType `json:"type,omitempty"`
+
+	// Rolling update config params. Present only if
+	// RolloutStrategyType = RollingUpdate.
+	// +optional
+	RollingUpdate *RollingUpdate `json:"rollingUpdate,omitempty"`
+}
+
+// RollingUpdate is used to control the desired behavior of rolling update.
+type RollingUpdate struct {
+	// The maximum number of control planes that can be scheduled above or under the
+	// desired number of control planes.
+	// Value can be an absolute number 1 or 0.
+	// Defaults to 1.
+	// Example: when this is set to 1, the control plane can be scaled
+	// up immediately when the rolling update starts.
+	// +optional
+	MaxSurge *intstr.IntOrString `json:"maxSurge,omitempty"`
+}
+
+// RolloutMaxSurge returns the number of machines the rollout may create above the desired replicas, defaulting to 1.
+func (in *KThreesControlPlane) RolloutMaxSurge() int32 {
+	if in.Spec.RolloutStrategy == nil || in.Spec.RolloutStrategy.RollingUpdate == nil || in.Spec.RolloutStrategy.RollingUpdate.MaxSurge == nil {
+		return 1
+	}
+	return int32(in.Spec.RolloutStrategy.RollingUpdate.MaxSurge.IntValue())
+}
+
+// CertificatesRotationTime returns the time a certificates rotation was requested at through the
+// RotateCertificatesAnnotation, or nil if there is no such request yet.
+func (in *KThreesControlPlane) CertificatesRotationTime() *metav1.Time {
+	return in.annotationTime(RotateCertificatesAnnotation)
+}
+
+// TokenRotationTime returns the time a token rotation was requested at through the RotateTokenAnnotation,
+// or nil if there is no such request yet.
+func (in *KThreesControlPlane) TokenRotationTime() *metav1.Time {
+	return in.annotationTime(RotateTokenAnnotation)
+}
+
+func (in *KThreesControlPlane) annotationTime(annotation string) *metav1.Time {
+	value, ok := in.Annotations[annotation]
+	if !ok {
+		return nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return nil
+	}
+	return &metav1.Time{Time: t}
+}
+
+// CertificatesExpiryThreshold returns how long before expiry the certificates are reported as expiring soon,
+// defaulting to DefaultCertificatesExpiryThreshold.
+func (in *KThreesControlPlane) CertificatesExpiryThreshold() time.Duration {
+	if in.Spec.CertificatesExpiryThreshold == nil {
+		return DefaultCertificatesExpiryThreshold
+	}
+	return in.Spec.CertificatesExpiryThreshold.Duration
+}
+
+// Manifest is a manifest k3s applies to the cluster from the auto-deploy directory of the servers.
+type Manifest struct {
+	// Name is the file name of the manifest, ending with .yaml, .yml or .json.
+	Name string `json:"name"`
+
+	// Content holds the resources to apply, as one or more YAML documents.
+	Content string `json:"content"`
+}
+
+// ManifestsDir returns the auto-deploy directory of the servers, k3s applies the manifests it finds there to the
+// cluster.
+func (in *KThreesControlPlane) ManifestsDir() string {
+	return path.Join(in.Spec.KThreesConfigSpec.K3sDataDir(), "server", "manifests")
+}
+
+// ManifestFiles returns the files writing the Manifests to the servers.
+func (in *KThreesControlPlane) ManifestFiles() []cabp3v1.File {
+	files := make([]cabp3v1.File, 0, len(in.Spec.Manifests))
+	for _, manifest := range in.Spec.Manifests {
+		files = append(files, cabp3v1.File{
+			Path:        path.Join(in.ManifestsDir(), manifest.Name),
+			Content:     manifest.Content,
+			Owner:       "root:root",
+			Permissions: "0600",
+		})
+	}
+	return files
+}
+
+// EtcdQuotaBackendBytesArg returns the etcd argument setting EtcdQuotaBackendBytes, or an empty string if it is not set.
+func (in *KThreesControlPlane) EtcdQuotaBackendBytesArg() string {
+	if in.Spec.EtcdQuotaBackendBytes == nil {
+		return ""
+	}
+	return fmt.Sprintf("%s=%d", EtcdQuotaBackendBytesKey, *in.Spec.EtcdQuotaBackendBytes)
+}
+
 // RemediationStrategy allows to define how control plane machine remediation happens.
 type RemediationStrategy struct {
 	// MaxRetry is the Max number of retries while attempting to remediate an unhealthy machine.
@@ -214,9 +433,30 @@ type KThreesControlPlaneStatus struct {
 	// +optional
 	Conditions clusterv1.Conditions `json:"conditions,omitempty"`
 
+	// CertificatesExpiryDate is the earliest expiry of the certificates served by the k3s servers.
+	// +optional
+	CertificatesExpiryDate *metav1.Time `json:"certificatesExpiryDate,omitempty"`
+
 	// LastRemediation stores info about last remediation performed.
 	// +optional
 	LastRemediation *LastRemediationStatus `json:"lastRemediation,omitempty"`
+
+	// MachineVersions lists the k3s version observed on the node of each control plane machine,
+	// which shows the progress of an upgrade rollout.
+	// +optional
+	MachineVersions []MachineVersionStatus `json:"machineVersions,omitempty"`
+}
+
+// MachineVersionStatus is the k3s version observed on the node of a control plane machine.
+type MachineVersionStatus struct {
+	// Machine is the name of the control plane machine.
+	Machine string `json:"machine"`
+
+	// NodeName is the name of the node of the machine.
+	NodeName string `json:"nodeName"`
+
+	// Version is the kubelet version reported by the node, e.g. v1.28.5+k3s1.
+	Version string `json:"version"`
 }
 
 // LastRemediationStatus  stores info about last remediation performed.
@@ -0,0 +1,411 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1beta1
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	utilyaml "k8s.io/apimachinery/pkg/util/yaml"
+	"sigs.k8s.io/cluster-api/util/version"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
+
+	cabp3v1 "github.com/cluster-api-provider-k3s/cluster-api-k3s/bootstrap/api/v1beta1"
+)
+
+// SetupWebhookWithManager sets up the KThreesControlPlane webhooks with the manager.
+func (in *KThreesControlPlane) SetupWebhookWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewWebhookManagedBy(mgr).
+		For(in).
+		Complete()
+}
+
+// +kubebuilder:webhook:verbs=create;update,path=/validate-controlplane-cluster-x-k8s-io-v1beta1-kthreescontrolplane,mutating=false,failurePolicy=fail,sideEffects=None,groups=controlplane.cluster.x-k8s.io,resources=kthreescontrolplanes,versions=v1beta1,name=validation.kthreescontrolplane.controlplane.cluster.x-k8s.io,admissionReviewVersions=v1;v1beta1
+
+var _ webhook.Validator = &KThreesControlPlane{}
+
+// ValidateCreate implements webhook.Validator so a webhook will be registered for the type.
+func (in *KThreesControlPlane) ValidateCreate() error {
+	return in.invalid(in.validateSpec())
+}
+
+// ValidateUpdate implements webhook.Validator so a webhook will be registered for the type.
+func (in *KThreesControlPlane) ValidateUpdate(old runtime.Object) error {
+	oldKCP, ok := old.(*KThreesControlPlane)
+	if !ok {
+		return apierrors.NewBadRequest(fmt.Sprintf("expected a KThreesControlPlane but got a %T", old))
+	}
+
+	allErrs := in.validateImmutableFields(oldKCP)
+	allErrs = append(allErrs, in.validateVersionSkew(oldKCP)...)
+	allErrs = append(allErrs, in.validateReplicas(oldKCP)...)
+	allErrs = append(allErrs, in.validateSpec()...)
+
+	return in.invalid(allErrs)
+}
+
+// ValidateDelete implements webhook.Validator so a webhook will be registered for the type.
+func (in *KThreesControlPlane) ValidateDelete() error {
+	return nil
+}
+
+// invalid wraps the given field errors in a single Invalid error, or returns nil when there are none.
+func (in *KThreesControlPlane) invalid(allErrs field.ErrorList) error {
+	if len(allErrs) == 0 {
+		return nil
+	}
+
+	return apierrors.NewInvalid(GroupVersion.WithKind("KThreesControlPlane").GroupKind(), in.Name, allErrs)
+}
+
+// validateSpec validates the control plane on its own, on both creation and update.
+func (in *KThreesControlPlane) validateSpec() field.ErrorList {
+	allErrs := in.Spec.KThreesConfigSpec.Validate(field.NewPath("spec", "kthreesConfigSpec"))
+	allErrs = append(allErrs, in.Spec.KThreesConfigSpec.ValidateInstallScriptURL(field.NewPath("spec", "kthreesConfigSpec"), in.Annotations)...)
+
+	// The restore path is only set on the bootstrap config of a replacement machine, see RestoreSnapshotAnnotation.
+	if in.Spec.KThreesConfigSpec.ServerConfig.ClusterResetRestorePath != "" {
+		allErrs = append(allErrs, field.Forbidden(field.NewPath("spec", "kthreesConfigSpec", "serverConfig", "clusterResetRestorePath"),
+			fmt.Sprintf("cannot be set directly, use the %s annotation instead", RestoreSnapshotAnnotation)))
+	}
+
+	if in.Spec.KThreesConfigSpec.Role == cabp3v1.NodeRoleAgent {
+		allErrs = append(allErrs, field.Forbidden(field.NewPath("spec", "kthreesConfigSpec", "role"), "the control plane machines are servers"))
+	}
+	if len(in.Spec.KThreesConfigSpec.AgentEnvironment) > 0 {
+		allErrs = append(allErrs, field.Forbidden(field.NewPath("spec", "kthreesConfigSpec", "agentEnvironment"),
+			"the control plane machines are servers, use serverEnvironment instead"))
+	}
+
+	allErrs = append(allErrs, in.validateRolloutStrategy()...)
+
+	if in.Spec.TokenRef != nil && in.Spec.TokenRef.Name == "" {
+		allErrs = append(allErrs, field.Required(field.NewPath("spec", "tokenRef", "name"), ""))
+	}
+
+	if in.Spec.CACertificatesRef != nil && in.Spec.CACertificatesRef.Name == "" {
+		allErrs = append(allErrs, field.Required(field.NewPath("spec", "caCertificatesRef", "name"), ""))
+	}
+
+	allErrs = append(allErrs, in.validateEtcdQuotaBackendBytes()...)
+	allErrs = append(allErrs, in.validateExternalDatastore()...)
+	allErrs = append(allErrs, in.validateKubeconfigServer()...)
+	allErrs = append(allErrs, in.validateManifests()...)
+
+	if threshold := in.Spec.CertificatesExpiryThreshold; threshold != nil && threshold.Duration <= 0 {
+		allErrs = append(allErrs, field.Invalid(field.NewPath("spec", "certificatesExpiryThreshold"), threshold.Duration.String(), "must be greater than 0"))
+	}
+
+	if path, ok := in.Annotations[RestoreSnapshotAnnotation]; ok {
+		annotationPath := field.NewPath("metadata", "annotations").Key(RestoreSnapshotAnnotation)
+		allErrs = append(allErrs, cabp3v1.ValidateSnapshotPath(path, annotationPath)...)
+	}
+	for _, annotation := range []string{RotateCertificatesAnnotation, RotateTokenAnnotation} {
+		if value, ok := in.Annotations[annotation]; ok && value != "" {
+			if _, err := time.Parse(time.RFC3339, value); err != nil {
+				allErrs = append(allErrs, field.Invalid(field.NewPath("metadata", "annotations").Key(annotation), value, "must be empty or a RFC3339 time"))
+			}
+		}
+	}
+	if _, ok := in.Annotations[RotateTokenAnnotation]; ok && in.Spec.TokenRef != nil {
+		allErrs = append(allErrs, field.Forbidden(field.NewPath("metadata", "annotations").Key(RotateTokenAnnotation), "cannot be used with spec.tokenRef"))
+	}
+
+	return allErrs
+}
+
+// validateImmutableFields rejects changes to the fields that k3s only honors when the cluster is created,
+// changing them afterwards would make new servers diverge from the existing ones.
+//
+// This is a denylist rather than an allowlist: most of the config can be rolled out by replacing the machines,
+// which is how upgrades and certificate or config changes reach the servers, so only the fields the cluster
+// cannot be moved away from are listed here.
+func (in *KThreesControlPlane) validateImmutableFields(old *KThreesControlPlane) field.ErrorList {
+	var allErrs field.ErrorList
+
+	serverConfigPath := field.NewPath("spec", "kthreesConfigSpec", "serverConfig")
+	newServerConfig := in.Spec.KThreesConfigSpec.ServerConfig
+	oldServerConfig := old.Spec.KThreesConfigSpec.ServerConfig
+
+	immutable := []struct {
+		path     *field.Path
+		new, old string
+	}{
+		{serverConfigPath.Child("clusterCidr"), newServerConfig.ClusterCidr, oldServerConfig.ClusterCidr},
+		{serverConfigPath.Child("serviceCidr"), newServerConfig.ServiceCidr, oldServerConfig.ServiceCidr},
+		{serverConfigPath.Child("clusterDNS"), newServerConfig.ClusterDNS, oldServerConfig.ClusterDNS},
+		{serverConfigPath.Child("clusterDomain"), newServerConfig.ClusterDomain, oldServerConfig.ClusterDomain},
+		{serverConfigPath.Child("httpsListenPort"), newServerConfig.HTTPSListenPort, oldServerConfig.HTTPSListenPort},
+	}
+	for _, f := range immutable {
+		if f.new != f.old {
+			allErrs = append(allErrs, field.Forbidden(f.path, "cannot be modified"))
+		}
+	}
+
+	// The token secret read by joining nodes is only created once, see token.ReconcileSupplied.
+	if refName(in.Spec.TokenRef) != refName(old.Spec.TokenRef) {
+		allErrs = append(allErrs, field.Forbidden(field.NewPath("spec", "tokenRef"), "cannot be modified"))
+	}
+
+	// Replacing the CAs of a running cluster would invalidate every certificate they signed.
+	if refName(in.Spec.CACertificatesRef) != refName(old.Spec.CACertificatesRef) {
+		allErrs = append(allErrs, field.Forbidden(field.NewPath("spec", "caCertificatesRef"), "cannot be modified"))
+	}
+
+	// Moving the cluster state between datastores is not supported by k3s.
+	if in.Spec.KThreesConfigSpec.IsEtcdEmbedded() != old.Spec.KThreesConfigSpec.IsEtcdEmbedded() {
+		allErrs = append(allErrs, field.Forbidden(serverConfigPath.Child("datastore", "type"), "cannot be modified"))
+	}
+
+	return allErrs
+}
+
+func refName(ref *corev1.LocalObjectReference) string {
+	if ref == nil {
+		return ""
+	}
+	return ref.Name
+}
+
+// validateVersionSkew enforces the Kubernetes version skew policy on upgrades: the minor version can only be
+// increased by one at a time and never decreased, patch versions can change freely.
+func (in *KThreesControlPlane) validateVersionSkew(old *KThreesControlPlane) field.ErrorList {
+	if in.Spec.Version == old.Spec.Version {
+		return nil
+	}
+
+	fldPath := field.NewPath("spec", "version")
+	newVersion, err := version.ParseMajorMinorPatchTolerant(in.Spec.Version)
+	if err != nil {
+		return field.ErrorList{field.Invalid(fldPath, in.Spec.Version, fmt.Sprintf("must be a valid semantic version: %v", err))}
+	}
+	oldVersion, err := version.ParseMajorMinorPatchTolerant(old.Spec.Version)
+	if err != nil {
+		// The previous version can't be compared against, so any valid version is accepted.
+		return nil
+	}
+
+	switch {
+	case newVersion.Major != oldVersion.Major:
+		return field.ErrorList{field.Forbidden(fldPath, fmt.Sprintf("cannot change the major version from %s to %s", old.Spec.Version, in.Spec.Version))}
+	case newVersion.Minor < oldVersion.Minor:
+		return field.ErrorList{field.Forbidden(fldPath, fmt.Sprintf("cannot downgrade from %s to %s", old.Spec.Version, in.Spec.Version))}
+	case newVersion.Minor > oldVersion.Minor+1:
+		return field.ErrorList{field.Forbidden(fldPath, fmt.Sprintf("cannot skip minor versions when upgrading from %s to %s", old.Spec.Version, in.Spec.Version))}
+	}
+
+	return nil
+}
+
+// validateReplicas protects the etcd quorum when the replicas change: an even number of members tolerates no more
+// failures than one member less, and removing a majority of the members at once loses the quorum if anything goes
+// wrong while they are removed. Both can still be done with the ForceReplicasAnnotation.
+func (in *KThreesControlPlane) validateReplicas(old *KThreesControlPlane) field.ErrorList {
+	if in.Spec.Replicas == nil || old.Spec.Replicas == nil || *in.Spec.Replicas == *old.Spec.Replicas {
+		return nil
+	}
+	if !in.Spec.KThreesConfigSpec.IsEtcdEmbedded() {
+		return nil
+	}
+	if _, ok := in.Annotations[ForceReplicasAnnotation]; ok {
+		return nil
+	}
+
+	fldPath := field.NewPath("spec", "replicas")
+	replicas, oldReplicas := *in.Spec.Replicas, *old.Spec.Replicas
+
+	if replicas > 0 && replicas%2 == 0 {
+		return field.ErrorList{field.Forbidden(fldPath, fmt.Sprintf(
+			"cannot be an even number with the embedded etcd datastore unless the %s annotation is set", ForceReplicasAnnotation))}
+	}
+
+	if quorum := oldReplicas/2 + 1; replicas < quorum {
+		return field.ErrorList{field.Forbidden(fldPath, fmt.Sprintf(
+			"cannot be reduced from %d to %d at once, below the etcd quorum of %d, unless the %s annotation is set",
+			oldReplicas, replicas, quorum, ForceReplicasAnnotation))}
+	}
+
+	return nil
+}
+
+func (in *KThreesControlPlane) validateRolloutStrategy() field.ErrorList {
+	if in.Spec.RolloutStrategy == nil {
+		return nil
+	}
+
+	var allErrs field.ErrorList
+	fldPath := field.NewPath("spec", "rolloutStrategy")
+
+	if in.Spec.RolloutStrategy.Type != "" && in.Spec.RolloutStrategy.Type != RollingUpdateStrategyType {
+		allErrs = append(allErrs, field.NotSupported(fldPath.Child("type"), in.Spec.RolloutStrategy.Type,
+			[]string{string(RollingUpdateStrategyType)}))
+	}
+
+	if in.Spec.RolloutStrategy.RollingUpdate == nil || in.Spec.RolloutStrategy.RollingUpdate.MaxSurge == nil {
+		return allErrs
+	}
+
+	maxSurgePath := fldPath.Child("rollingUpdate", "maxSurge")
+	maxSurge := in.Spec.RolloutStrategy.RollingUpdate.MaxSurge
+	if maxSurge.Type != intstr.Int || (maxSurge.IntVal != 0 && maxSurge.IntVal != 1) {
+		allErrs = append(allErrs, field.Invalid(maxSurgePath, maxSurge.String(), "must be either 0 or 1"))
+		return allErrs
+	}
+
+	// Scaling in before scaling out removes an etcd member, which only preserves quorum with at least 3 replicas.
+	if maxSurge.IntVal == 0 && (in.Spec.Replicas == nil || *in.Spec.Replicas < 3) {
+		allErrs = append(allErrs, field.Forbidden(maxSurgePath, "maxSurge 0 requires at least 3 replicas to preserve etcd quorum"))
+	}
+
+	return allErrs
+}
+
+// validateEtcdQuotaBackendBytes keeps the etcd quota at or above the etcd default, lowering it only brings the
+// NOSPACE alarm closer, and rejects the same setting passed as a raw etcd argument.
+func (in *KThreesControlPlane) validateEtcdQuotaBackendBytes() field.ErrorList {
+	quota := in.Spec.EtcdQuotaBackendBytes
+	if quota == nil {
+		return nil
+	}
+
+	var allErrs field.ErrorList
+	fldPath := field.NewPath("spec", "etcdQuotaBackendBytes")
+	if *quota < MinEtcdQuotaBackendBytes {
+		allErrs = append(allErrs, field.Invalid(fldPath, *quota, fmt.Sprintf("must be at least %d (2GiB)", MinEtcdQuotaBackendBytes)))
+	}
+
+	argsPath := field.NewPath("spec", "kthreesConfigSpec", "serverConfig", "etcdArgs")
+	for i, arg := range in.Spec.KThreesConfigSpec.ServerConfig.EtcdArgs {
+		key, _, _ := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+		if key == EtcdQuotaBackendBytesKey {
+			allErrs = append(allErrs, field.Forbidden(argsPath.Index(i), "conflicts with spec.etcdQuotaBackendBytes"))
+		}
+	}
+	return allErrs
+}
+
+// validateExternalDatastore rejects the control plane settings that operate on the embedded etcd when the servers
+// use an external datastore. The settings of the server config itself are checked by KThreesConfigSpec.Validate.
+func (in *KThreesControlPlane) validateExternalDatastore() field.ErrorList {
+	if in.Spec.KThreesConfigSpec.IsEtcdEmbedded() {
+		return nil
+	}
+
+	var allErrs field.ErrorList
+	datastorePath := field.NewPath("spec", "kthreesConfigSpec", "serverConfig", "datastore", "type")
+	if in.Spec.EtcdQuotaBackendBytes != nil {
+		allErrs = append(allErrs, cabp3v1.ExternalDatastoreConflict(field.NewPath("spec", "etcdQuotaBackendBytes"), datastorePath))
+	}
+	if in.Spec.SnapshotBeforeUpgrade {
+		allErrs = append(allErrs, cabp3v1.ExternalDatastoreConflict(field.NewPath("spec", "snapshotBeforeUpgrade"), datastorePath))
+	}
+	if _, ok := in.Annotations[RestoreSnapshotAnnotation]; ok {
+		allErrs = append(allErrs, cabp3v1.ExternalDatastoreConflict(field.NewPath("metadata", "annotations").Key(RestoreSnapshotAnnotation), datastorePath))
+	}
+	return allErrs
+}
+
+// validateKubeconfigServer ensures KubeconfigServer is an https URL the servers present a valid certificate for.
+func (in *KThreesControlPlane) validateKubeconfigServer() field.ErrorList {
+	server := in.Spec.KubeconfigServer
+	if server == "" {
+		return nil
+	}
+
+	fldPath := field.NewPath("spec", "kubeconfigServer")
+	u, err := url.Parse(server)
+	if err != nil || u.Scheme != "https" || u.Hostname() == "" || (u.Path != "" && u.Path != "/") || u.RawQuery != "" {
+		return field.ErrorList{field.Invalid(fldPath, server, "must be an https URL without a path, e.g. https://k8s.example.com:6443")}
+	}
+	for _, san := range in.Spec.KThreesConfigSpec.ServerConfig.TLSSan {
+		if san == u.Hostname() {
+			return nil
+		}
+	}
+	return field.ErrorList{field.Invalid(fldPath, server, fmt.Sprintf("host %s must be listed in spec.kthreesConfigSpec.serverConfig.tlsSan", u.Hostname()))}
+}
+
+// packagedManifests are the manifests k3s writes to the auto-deploy directory itself, overwriting any file of the
+// same name when it starts.
+var packagedManifests = sets.NewString("ccm.yaml", "coredns.yaml", "local-storage.yaml", "rolebindings.yaml", "runtimes.yaml", "traefik.yaml")
+
+// validateManifests ensures each manifest is a file k3s picks up from the auto-deploy directory, with a unique
+// name, holding Kubernetes resources.
+func (in *KThreesControlPlane) validateManifests() field.ErrorList {
+	var allErrs field.ErrorList
+	names := sets.NewString()
+	for i, manifest := range in.Spec.Manifests {
+		fldPath := field.NewPath("spec", "manifests").Index(i)
+
+		switch ext := path.Ext(manifest.Name); {
+		case ext != ".yaml" && ext != ".yml" && ext != ".json", manifest.Name == ext, strings.ContainsAny(manifest.Name, "/\\ \t\n'\"`$;&|"):
+			allErrs = append(allErrs, field.Invalid(fldPath.Child("name"), manifest.Name, "must be a file name ending with .yaml, .yml or .json, without path separators, whitespace, quotes or shell metacharacters"))
+		case names.Has(manifest.Name):
+			allErrs = append(allErrs, field.Duplicate(fldPath.Child("name"), manifest.Name))
+		case packagedManifests.Has(manifest.Name):
+			allErrs = append(allErrs, field.Forbidden(fldPath.Child("name"), "is a manifest packaged with k3s, which overwrites it, disable the component and use another name instead"))
+		}
+		names.Insert(manifest.Name)
+
+		if err := validateManifestContent(manifest.Content); err != nil {
+			allErrs = append(allErrs, field.Invalid(fldPath.Child("content"), manifest.Content, err.Error()))
+		}
+	}
+	return allErrs
+}
+
+// validateManifestContent ensures every YAML document of a manifest is a Kubernetes resource.
+func validateManifestContent(content string) error {
+	decoder := utilyaml.NewYAMLOrJSONDecoder(strings.NewReader(content), 4096)
+	resources := 0
+	for {
+		var resource map[string]interface{}
+		if err := decoder.Decode(&resource); err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			return fmt.Errorf("must be YAML: %w", err)
+		}
+		if resource == nil {
+			continue
+		}
+		if apiVersion, _ := resource["apiVersion"].(string); apiVersion == "" {
+			return fmt.Errorf("document %d must set apiVersion", resources+1)
+		}
+		if kind, _ := resource["kind"].(string); kind == "" {
+			return fmt.Errorf("document %d must set kind", resources+1)
+		}
+		resources++
+	}
+	if resources == 0 {
+		return errors.New("must hold at least one resource")
+	}
+	return nil
+}
@@ -0,0 +1,848 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1beta1
+
+import (
+	"testing"
+
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/utils/pointer"
+
+	cabp3v1 "github.com/cluster-api-provider-k3s/cluster-api-k3s/bootstrap/api/v1beta1"
+)
+
+func TestKThreesControlPlaneValidateRestoreSnapshot(t *testing.T) {
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		serverCfg   cabp3v1.KThreesServerConfig
+		expectErr   bool
+	}{
+		{
+			name: "no restore requested",
+		},
+		{
+			name:        "restore annotation",
+			annotations: map[string]string{RestoreSnapshotAnnotation: "etcd-snapshot-1700000000"},
+		},
+		{
+			name:        "restore annotation with shell metacharacters",
+			annotations: map[string]string{RestoreSnapshotAnnotation: "snapshot; reboot"},
+			expectErr:   true,
+		},
+		{
+			name:      "restore path set directly",
+			serverCfg: cabp3v1.KThreesServerConfig{ClusterResetRestorePath: "etcd-snapshot-1700000000"},
+			expectErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			kcp := &KThreesControlPlane{Spec: KThreesControlPlaneSpec{
+				KThreesConfigSpec: cabp3v1.KThreesConfigSpec{ServerConfig: tt.serverCfg},
+			}}
+			kcp.SetAnnotations(tt.annotations)
+
+			if tt.expectErr {
+				g.Expect(kcp.ValidateCreate()).NotTo(Succeed())
+			} else {
+				g.Expect(kcp.ValidateCreate()).To(Succeed())
+			}
+		})
+	}
+}
+
+func TestKThreesControlPlaneValidateRolloutStrategy(t *testing.T) {
+	tests := []struct {
+		name      string
+		replicas  int32
+		strategy  *RolloutStrategy
+		expectErr bool
+	}{
+		{
+			name:     "no strategy",
+			replicas: 1,
+		},
+		{
+			name:     "maxSurge 1",
+			replicas: 1,
+			strategy: &RolloutStrategy{Type: RollingUpdateStrategyType, RollingUpdate: &RollingUpdate{MaxSurge: &intstr.IntOrString{Type: intstr.Int, IntVal: 1}}},
+		},
+		{
+			name:     "maxSurge 0 with enough replicas for quorum",
+			replicas: 3,
+			strategy: &RolloutStrategy{Type: RollingUpdateStrategyType, RollingUpdate: &RollingUpdate{MaxSurge: &intstr.IntOrString{Type: intstr.Int, IntVal: 0}}},
+		},
+		{
+			name:      "maxSurge 0 would lose quorum",
+			replicas:  1,
+			strategy:  &RolloutStrategy{Type: RollingUpdateStrategyType, RollingUpdate: &RollingUpdate{MaxSurge: &intstr.IntOrString{Type: intstr.Int, IntVal: 0}}},
+			expectErr: true,
+		},
+		{
+			name:      "maxSurge out of range",
+			replicas:  3,
+			strategy:  &RolloutStrategy{Type: RollingUpdateStrategyType, RollingUpdate: &RollingUpdate{MaxSurge: &intstr.IntOrString{Type: intstr.Int, IntVal: 2}}},
+			expectErr: true,
+		},
+		{
+			name:      "maxSurge as percentage",
+			replicas:  3,
+			strategy:  &RolloutStrategy{Type: RollingUpdateStrategyType, RollingUpdate: &RollingUpdate{MaxSurge: &intstr.IntOrString{Type: intstr.String, StrVal: "100%"}}},
+			expectErr: true,
+		},
+		{
+			name:      "unsupported type",
+			replicas:  3,
+			strategy:  &RolloutStrategy{Type: "Recreate"},
+			expectErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			kcp := &KThreesControlPlane{Spec: KThreesControlPlaneSpec{
+				Replicas:        &tt.replicas,
+				RolloutStrategy: tt.strategy,
+			}}
+
+			if tt.expectErr {
+				g.Expect(kcp.ValidateCreate()).NotTo(Succeed())
+			} else {
+				g.Expect(kcp.ValidateCreate()).To(Succeed())
+			}
+		})
+	}
+}
+
+func TestKThreesControlPlaneValidateUpdate(t *testing.T) {
+	newKCP := func() *KThreesControlPlane {
+		return &KThreesControlPlane{Spec: KThreesControlPlaneSpec{
+			Replicas: pointer.Int32(3),
+			Version:  "v1.28.5+k3s1",
+			KThreesConfigSpec: cabp3v1.KThreesConfigSpec{
+				ServerConfig: cabp3v1.KThreesServerConfig{
+					ClusterCidr:     "10.42.0.0/16",
+					ServiceCidr:     "10.43.0.0/16",
+					ClusterDNS:      "10.43.0.10",
+					ClusterDomain:   "cluster.local",
+					HTTPSListenPort: "6443",
+				},
+			},
+		}}
+	}
+
+	tests := []struct {
+		name      string
+		update    func(kcp *KThreesControlPlane)
+		expectErr bool
+	}{
+		{
+			name:   "replicas",
+			update: func(kcp *KThreesControlPlane) { kcp.Spec.Replicas = pointer.Int32(5) },
+		},
+		{
+			name:   "version",
+			update: func(kcp *KThreesControlPlane) { kcp.Spec.Version = "v1.28.6+k3s1" },
+		},
+		{
+			name: "rollout strategy",
+			update: func(kcp *KThreesControlPlane) {
+				kcp.Spec.RolloutStrategy = &RolloutStrategy{Type: RollingUpdateStrategyType}
+			},
+		},
+		{
+			name: "tls-san",
+			update: func(kcp *KThreesControlPlane) {
+				kcp.Spec.KThreesConfigSpec.ServerConfig.TLSSan = []string{"k3s.example.com"}
+			},
+		},
+		{
+			name:      "token ref",
+			update:    func(kcp *KThreesControlPlane) { kcp.Spec.TokenRef = &corev1.LocalObjectReference{Name: "join-token"} },
+			expectErr: true,
+		},
+		{
+			name: "ca certificates ref",
+			update: func(kcp *KThreesControlPlane) {
+				kcp.Spec.CACertificatesRef = &corev1.LocalObjectReference{Name: "cluster-cas"}
+			},
+			expectErr: true,
+		},
+		{
+			name:      "cluster cidr",
+			update:    func(kcp *KThreesControlPlane) { kcp.Spec.KThreesConfigSpec.ServerConfig.ClusterCidr = "10.52.0.0/16" },
+			expectErr: true,
+		},
+		{
+			name:      "service cidr",
+			update:    func(kcp *KThreesControlPlane) { kcp.Spec.KThreesConfigSpec.ServerConfig.ServiceCidr = "10.53.0.0/16" },
+			expectErr: true,
+		},
+		{
+			name:      "cluster dns",
+			update:    func(kcp *KThreesControlPlane) { kcp.Spec.KThreesConfigSpec.ServerConfig.ClusterDNS = "10.43.0.11" },
+			expectErr: true,
+		},
+		{
+			name: "cluster domain",
+			update: func(kcp *KThreesControlPlane) {
+				kcp.Spec.KThreesConfigSpec.ServerConfig.ClusterDomain = "example.local"
+			},
+			expectErr: true,
+		},
+		{
+			name:      "https listen port",
+			update:    func(kcp *KThreesControlPlane) { kcp.Spec.KThreesConfigSpec.ServerConfig.HTTPSListenPort = "7443" },
+			expectErr: true,
+		},
+		{
+			name: "datastore",
+			update: func(kcp *KThreesControlPlane) {
+				kcp.Spec.KThreesConfigSpec.ServerConfig.Datastore = &cabp3v1.DatastoreConfig{
+					Type:           cabp3v1.DatastoreTypeExternal,
+					EndpointSecret: &corev1.LocalObjectReference{Name: "datastore"},
+				}
+			},
+			expectErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			oldKCP := newKCP()
+			kcp := newKCP()
+			tt.update(kcp)
+
+			if tt.expectErr {
+				g.Expect(kcp.ValidateUpdate(oldKCP)).NotTo(Succeed())
+			} else {
+				g.Expect(kcp.ValidateUpdate(oldKCP)).To(Succeed())
+			}
+		})
+	}
+}
+
+func TestKThreesControlPlaneValidateUpdateReportsAllErrors(t *testing.T) {
+	g := NewWithT(t)
+
+	oldKCP := &KThreesControlPlane{Spec: KThreesControlPlaneSpec{Replicas: pointer.Int32(3), Version: "v1.28.5+k3s1"}}
+	kcp := oldKCP.DeepCopy()
+	kcp.Spec.KThreesConfigSpec.ServerConfig.ClusterCidr = "10.52.0.0/16"
+	kcp.Spec.KThreesConfigSpec.Role = cabp3v1.NodeRoleAgent
+
+	err := kcp.ValidateUpdate(oldKCP)
+	g.Expect(err).To(HaveOccurred())
+	g.Expect(err.Error()).To(ContainSubstring("spec.kthreesConfigSpec.serverConfig.clusterCidr"))
+	g.Expect(err.Error()).To(ContainSubstring("spec.kthreesConfigSpec.role"))
+}
+
+func TestKThreesControlPlaneValidateReplicas(t *testing.T) {
+	tests := []struct {
+		name        string
+		oldReplicas int32
+		newReplicas int32
+		datastore   *cabp3v1.DatastoreConfig
+		force       bool
+		expectErr   bool
+	}{
+		{
+			name:        "scale up to an odd number",
+			oldReplicas: 1,
+			newReplicas: 3,
+		},
+		{
+			name:        "scale down by two keeping quorum",
+			oldReplicas: 5,
+			newReplicas: 3,
+		},
+		{
+			name:        "scale up to an even number",
+			oldReplicas: 1,
+			newReplicas: 2,
+			expectErr:   true,
+		},
+		{
+			name:        "scale down to an even number",
+			oldReplicas: 3,
+			newReplicas: 2,
+			expectErr:   true,
+		},
+		{
+			name:        "scale down to an even number with the force annotation",
+			oldReplicas: 3,
+			newReplicas: 2,
+			force:       true,
+		},
+		{
+			name:        "scale down below quorum",
+			oldReplicas: 3,
+			newReplicas: 1,
+			expectErr:   true,
+		},
+		{
+			name:        "scale down below quorum with the force annotation",
+			oldReplicas: 3,
+			newReplicas: 1,
+			force:       true,
+		},
+		{
+			name:        "even number with an external datastore",
+			oldReplicas: 3,
+			newReplicas: 2,
+			datastore: &cabp3v1.DatastoreConfig{
+				Type:           cabp3v1.DatastoreTypeExternal,
+				EndpointSecret: &corev1.LocalObjectReference{Name: "datastore"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			newKCP := func(replicas int32) *KThreesControlPlane {
+				kcp := &KThreesControlPlane{Spec: KThreesControlPlaneSpec{Replicas: pointer.Int32(replicas)}}
+				kcp.Spec.KThreesConfigSpec.ServerConfig.Datastore = tt.datastore
+				return kcp
+			}
+			oldKCP := newKCP(tt.oldReplicas)
+			kcp := newKCP(tt.newReplicas)
+			if tt.force {
+				kcp.Annotations = map[string]string{ForceReplicasAnnotation: ""}
+			}
+
+			if tt.expectErr {
+				g.Expect(kcp.ValidateUpdate(oldKCP)).NotTo(Succeed())
+			} else {
+				g.Expect(kcp.ValidateUpdate(oldKCP)).To(Succeed())
+			}
+		})
+	}
+}
+
+func TestKThreesControlPlaneValidateVersionSkew(t *testing.T) {
+	tests := []struct {
+		name       string
+		oldVersion string
+		newVersion string
+		expectErr  bool
+	}{
+		{
+			name:       "patch upgrade",
+			oldVersion: "v1.28.5+k3s1",
+			newVersion: "v1.28.6+k3s1",
+		},
+		{
+			name:       "patch downgrade",
+			oldVersion: "v1.28.6+k3s1",
+			newVersion: "v1.28.5+k3s1",
+		},
+		{
+			name:       "k3s release bump",
+			oldVersion: "v1.28.5+k3s1",
+			newVersion: "v1.28.5+k3s2",
+		},
+		{
+			name:       "single minor upgrade",
+			oldVersion: "v1.28.5+k3s1",
+			newVersion: "v1.29.0+k3s1",
+		},
+		{
+			name:       "minor skip",
+			oldVersion: "v1.27.9+k3s1",
+			newVersion: "v1.29.0+k3s1",
+			expectErr:  true,
+		},
+		{
+			name:       "minor downgrade",
+			oldVersion: "v1.29.0+k3s1",
+			newVersion: "v1.28.5+k3s1",
+			expectErr:  true,
+		},
+		{
+			name:       "invalid version",
+			oldVersion: "v1.28.5+k3s1",
+			newVersion: "latest",
+			expectErr:  true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			oldKCP := &KThreesControlPlane{Spec: KThreesControlPlaneSpec{Version: tt.oldVersion}}
+			kcp := &KThreesControlPlane{Spec: KThreesControlPlaneSpec{Version: tt.newVersion}}
+
+			if tt.expectErr {
+				g.Expect(kcp.ValidateUpdate(oldKCP)).NotTo(Succeed())
+			} else {
+				g.Expect(kcp.ValidateUpdate(oldKCP)).To(Succeed())
+			}
+		})
+	}
+}
+
+func TestKThreesControlPlaneValidateRotateCertificatesAnnotation(t *testing.T) {
+	tests := []struct {
+		name      string
+		value     string
+		expectErr bool
+	}{
+		{
+			name:  "empty",
+			value: "",
+		},
+		{
+			name:  "RFC3339 time",
+			value: "2024-01-02T15:04:05Z",
+		},
+		{
+			name:      "not a time",
+			value:     "now",
+			expectErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			kcp := &KThreesControlPlane{}
+			kcp.Annotations = map[string]string{RotateCertificatesAnnotation: tt.value}
+
+			if tt.expectErr {
+				g.Expect(kcp.ValidateCreate()).NotTo(Succeed())
+			} else {
+				g.Expect(kcp.ValidateCreate()).To(Succeed())
+			}
+		})
+	}
+}
+
+func TestKThreesControlPlaneValidateRotateTokenAnnotation(t *testing.T) {
+	tests := []struct {
+		name      string
+		value     string
+		tokenRef  *corev1.LocalObjectReference
+		expectErr bool
+	}{
+		{
+			name:  "empty",
+			value: "",
+		},
+		{
+			name:  "RFC3339 time",
+			value: "2024-01-02T15:04:05Z",
+		},
+		{
+			name:      "not a time",
+			value:     "now",
+			expectErr: true,
+		},
+		{
+			name:      "supplied token",
+			tokenRef:  &corev1.LocalObjectReference{Name: "join-token"},
+			expectErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			kcp := &KThreesControlPlane{Spec: KThreesControlPlaneSpec{TokenRef: tt.tokenRef}}
+			kcp.Annotations = map[string]string{RotateTokenAnnotation: tt.value}
+
+			if tt.expectErr {
+				g.Expect(kcp.ValidateCreate()).NotTo(Succeed())
+			} else {
+				g.Expect(kcp.ValidateCreate()).To(Succeed())
+			}
+		})
+	}
+}
+
+func TestKThreesControlPlaneValidateCACertificatesRef(t *testing.T) {
+	tests := []struct {
+		name      string
+		ref       *corev1.LocalObjectReference
+		expectErr bool
+	}{
+		{
+			name: "generated CAs",
+		},
+		{
+			name: "supplied CAs",
+			ref:  &corev1.LocalObjectReference{Name: "cluster-cas"},
+		},
+		{
+			name:      "missing name",
+			ref:       &corev1.LocalObjectReference{},
+			expectErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			kcp := &KThreesControlPlane{Spec: KThreesControlPlaneSpec{CACertificatesRef: tt.ref}}
+
+			if tt.expectErr {
+				g.Expect(kcp.ValidateCreate()).NotTo(Succeed())
+			} else {
+				g.Expect(kcp.ValidateCreate()).To(Succeed())
+			}
+		})
+	}
+}
+
+func TestKThreesControlPlaneValidateRole(t *testing.T) {
+	tests := []struct {
+		name      string
+		role      cabp3v1.NodeRole
+		expectErr bool
+	}{
+		{
+			name: "role following the machines",
+		},
+		{
+			name: "server role",
+			role: cabp3v1.NodeRoleServer,
+		},
+		{
+			name:      "agent role",
+			role:      cabp3v1.NodeRoleAgent,
+			expectErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			kcp := &KThreesControlPlane{Spec: KThreesControlPlaneSpec{KThreesConfigSpec: cabp3v1.KThreesConfigSpec{Role: tt.role}}}
+
+			if tt.expectErr {
+				g.Expect(kcp.ValidateCreate()).NotTo(Succeed())
+			} else {
+				g.Expect(kcp.ValidateCreate()).To(Succeed())
+			}
+		})
+	}
+}
+
+func TestKThreesControlPlaneValidateEtcdQuotaBackendBytes(t *testing.T) {
+	tests := []struct {
+		name      string
+		quota     *int64
+		datastore *cabp3v1.DatastoreConfig
+		etcdArgs  []string
+		expectErr bool
+	}{
+		{
+			name: "etcd default quota",
+		},
+		{
+			name:  "raised quota",
+			quota: pointer.Int64(8 * 1024 * 1024 * 1024),
+		},
+		{
+			name:  "etcd default quota set explicitly",
+			quota: pointer.Int64(MinEtcdQuotaBackendBytes),
+		},
+		{
+			name:      "quota too small",
+			quota:     pointer.Int64(512 * 1024 * 1024),
+			expectErr: true,
+		},
+		{
+			name:      "quota with an external datastore",
+			quota:     pointer.Int64(4 * 1024 * 1024 * 1024),
+			datastore: &cabp3v1.DatastoreConfig{Type: cabp3v1.DatastoreTypeExternal},
+			expectErr: true,
+		},
+		{
+			name:      "quota also passed as an etcd argument",
+			quota:     pointer.Int64(4 * 1024 * 1024 * 1024),
+			etcdArgs:  []string{"--quota-backend-bytes=4294967296"},
+			expectErr: true,
+		},
+		{
+			name:     "quota passed as an etcd argument only",
+			etcdArgs: []string{"quota-backend-bytes=4294967296"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			kcp := &KThreesControlPlane{Spec: KThreesControlPlaneSpec{
+				EtcdQuotaBackendBytes: tt.quota,
+				KThreesConfigSpec: cabp3v1.KThreesConfigSpec{
+					ServerConfig: cabp3v1.KThreesServerConfig{Datastore: tt.datastore, EtcdArgs: tt.etcdArgs},
+				},
+			}}
+
+			if tt.expectErr {
+				g.Expect(kcp.ValidateCreate()).NotTo(Succeed())
+			} else {
+				g.Expect(kcp.ValidateCreate()).To(Succeed())
+			}
+		})
+	}
+}
+
+func TestKThreesControlPlaneValidateManifests(t *testing.T) {
+	helmChart := `apiVersion: helm.cattle.io/v1
+kind: HelmChart
+metadata:
+  name: cert-manager
+  namespace: kube-system
+spec:
+  repo: https://charts.jetstack.io
+  chart: cert-manager
+`
+	namespace := `apiVersion: v1
+kind: Namespace
+metadata:
+  name: cert-manager
+`
+
+	tests := []struct {
+		name      string
+		manifests []Manifest
+		expectErr bool
+	}{
+		{
+			name: "no manifests",
+		},
+		{
+			name:      "helm chart",
+			manifests: []Manifest{{Name: "cert-manager.yaml", Content: helmChart}},
+		},
+		{
+			name: "multiple documents and files",
+			manifests: []Manifest{
+				{Name: "cert-manager.yaml", Content: namespace + "---\n" + helmChart},
+				{Name: "namespace.json", Content: `{"apiVersion": "v1", "kind": "Namespace", "metadata": {"name": "apps"}}`},
+			},
+		},
+		{
+			name:      "name without a manifest extension",
+			manifests: []Manifest{{Name: "cert-manager.txt", Content: helmChart}},
+			expectErr: true,
+		},
+		{
+			name:      "name with a path separator",
+			manifests: []Manifest{{Name: "../cert-manager.yaml", Content: helmChart}},
+			expectErr: true,
+		},
+		{
+			name: "duplicate names",
+			manifests: []Manifest{
+				{Name: "cert-manager.yaml", Content: helmChart},
+				{Name: "cert-manager.yaml", Content: namespace},
+			},
+			expectErr: true,
+		},
+		{
+			name:      "name of a packaged manifest",
+			manifests: []Manifest{{Name: "traefik.yaml", Content: helmChart}},
+			expectErr: true,
+		},
+		{
+			name:      "invalid yaml",
+			manifests: []Manifest{{Name: "cert-manager.yaml", Content: "kind: HelmChart\n  spec: [\n"}},
+			expectErr: true,
+		},
+		{
+			name:      "resource without a kind",
+			manifests: []Manifest{{Name: "cert-manager.yaml", Content: "apiVersion: v1\nmetadata:\n  name: cert-manager\n"}},
+			expectErr: true,
+		},
+		{
+			name:      "no resources",
+			manifests: []Manifest{{Name: "cert-manager.yaml", Content: "---\n"}},
+			expectErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			kcp := &KThreesControlPlane{Spec: KThreesControlPlaneSpec{Manifests: tt.manifests}}
+
+			if tt.expectErr {
+				g.Expect(kcp.ValidateCreate()).NotTo(Succeed())
+			} else {
+				g.Expect(kcp.ValidateCreate()).To(Succeed())
+			}
+		})
+	}
+}
+
+func TestKThreesControlPlaneValidateKubeconfigServer(t *testing.T) {
+	tests := []struct {
+		name      string
+		server    string
+		tlsSan    []string
+		expectErr bool
+	}{
+		{
+			name: "control plane endpoint",
+		},
+		{
+			name:   "external name with a port",
+			server: "https://k8s.example.com:6443",
+			tlsSan: []string{"k8s.example.com"},
+		},
+		{
+			name:   "external name on the default port",
+			server: "https://k8s.example.com/",
+			tlsSan: []string{"k8s.example.com"},
+		},
+		{
+			name:      "host missing from the tls sans",
+			server:    "https://k8s.example.com:6443",
+			tlsSan:    []string{"other.example.com"},
+			expectErr: true,
+		},
+		{
+			name:      "plain http",
+			server:    "http://k8s.example.com:6443",
+			tlsSan:    []string{"k8s.example.com"},
+			expectErr: true,
+		},
+		{
+			name:      "host only",
+			server:    "k8s.example.com:6443",
+			tlsSan:    []string{"k8s.example.com"},
+			expectErr: true,
+		},
+		{
+			name:      "with a path",
+			server:    "https://k8s.example.com:6443/api",
+			tlsSan:    []string{"k8s.example.com"},
+			expectErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			kcp := &KThreesControlPlane{Spec: KThreesControlPlaneSpec{
+				KubeconfigServer: tt.server,
+				KThreesConfigSpec: cabp3v1.KThreesConfigSpec{
+					ServerConfig: cabp3v1.KThreesServerConfig{TLSSan: tt.tlsSan},
+				},
+			}}
+
+			if tt.expectErr {
+				g.Expect(kcp.ValidateCreate()).NotTo(Succeed())
+			} else {
+				g.Expect(kcp.ValidateCreate()).To(Succeed())
+			}
+		})
+	}
+}
+
+func TestKThreesControlPlaneValidateExternalDatastore(t *testing.T) {
+	tests := []struct {
+		name        string
+		mutate      func(kcp *KThreesControlPlane)
+		expectField string
+	}{
+		{
+			name:   "external datastore alone",
+			mutate: func(_ *KThreesControlPlane) {},
+		},
+		{
+			name: "etcd snapshots",
+			mutate: func(kcp *KThreesControlPlane) {
+				kcp.Spec.KThreesConfigSpec.ServerConfig.EtcdSnapshot = &cabp3v1.EtcdSnapshotConfig{ScheduleCron: "0 */6 * * *"}
+			},
+			expectField: "spec.kthreesConfigSpec.serverConfig.etcdSnapshot",
+		},
+		{
+			name: "etcd arguments",
+			mutate: func(kcp *KThreesControlPlane) {
+				kcp.Spec.KThreesConfigSpec.ServerConfig.EtcdArgs = []string{"auto-compaction-retention=1h"}
+			},
+			expectField: "spec.kthreesConfigSpec.serverConfig.etcdArgs",
+		},
+		{
+			name: "etcd quota",
+			mutate: func(kcp *KThreesControlPlane) {
+				kcp.Spec.EtcdQuotaBackendBytes = pointer.Int64(MinEtcdQuotaBackendBytes)
+			},
+			expectField: "spec.etcdQuotaBackendBytes",
+		},
+		{
+			name:        "snapshot before upgrade",
+			mutate:      func(kcp *KThreesControlPlane) { kcp.Spec.SnapshotBeforeUpgrade = true },
+			expectField: "spec.snapshotBeforeUpgrade",
+		},
+		{
+			name: "restore from a snapshot",
+			mutate: func(kcp *KThreesControlPlane) {
+				kcp.Annotations = map[string]string{RestoreSnapshotAnnotation: "etcd-snapshot-1700000000"}
+			},
+			expectField: "metadata.annotations[controlplane.cluster.x-k8s.io/restore-snapshot]",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			kcp := &KThreesControlPlane{Spec: KThreesControlPlaneSpec{
+				KThreesConfigSpec: cabp3v1.KThreesConfigSpec{
+					ServerConfig: cabp3v1.KThreesServerConfig{Datastore: &cabp3v1.DatastoreConfig{
+						Type:           cabp3v1.DatastoreTypeExternal,
+						EndpointSecret: &corev1.LocalObjectReference{Name: "datastore"},
+					}},
+				},
+			}}
+			tt.mutate(kcp)
+
+			err := kcp.ValidateCreate()
+			if tt.expectField == "" {
+				g.Expect(err).To(Succeed())
+				return
+			}
+			g.Expect(err).To(MatchError(And(
+				ContainSubstring(tt.expectField),
+				ContainSubstring("spec.kthreesConfigSpec.serverConfig.datastore.type external"),
+			)))
+		})
+	}
+}
@@ -22,8 +22,10 @@ limitations under the License.
 package v1beta1
 
 import (
+	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1"
-	runtime "k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/intstr"
 	apiv1beta1 "sigs.k8s.io/cluster-api/api/v1beta1"
 )
 
@@ -127,6 +129,36 @@ func (in *KThreesControlPlaneSpec) DeepCopyInto(out *KThreesControlPlaneSpec) {
 		*out = new(RemediationStrategy)
 		(*in).DeepCopyInto(*out)
 	}
+	if in.RolloutStrategy != nil {
+		in, out := &in.RolloutStrategy, &out.RolloutStrategy
+		*out = new(RolloutStrategy)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.EtcdQuotaBackendBytes != nil {
+		in, out := &in.EtcdQuotaBackendBytes, &out.EtcdQuotaBackendBytes
+		*out = new(int64)
+		**out = **in
+	}
+	if in.Manifests != nil {
+		in, out := &in.Manifests, &out.Manifests
+		*out = make([]Manifest, len(*in))
+		copy(*out, *in)
+	}
+	if in.CertificatesExpiryThreshold != nil {
+		in, out := &in.CertificatesExpiryThreshold, &out.CertificatesExpiryThreshold
+		*out = new(v1.Duration)
+		**out = **in
+	}
+	if in.TokenRef != nil {
+		in, out := &in.TokenRef, &out.TokenRef
+		*out = new(corev1.LocalObjectReference)
+		**out = **in
+	}
+	if in.CACertificatesRef != nil {
+		in, out := &in.CACertificatesRef, &out.CACertificatesRef
+		*out = new(corev1.LocalObjectReference)
+		**out = **in
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new KThreesControlPlaneSpec.
@@ -154,11 +186,20 @@ func (in *KThreesControlPlaneStatus) DeepCopyInto(out *KThreesControlPlaneStatus
 			(*in)[i].DeepCopyInto(&(*out)[i])
 		}
 	}
+	if in.CertificatesExpiryDate != nil {
+		in, out := &in.CertificatesExpiryDate, &out.CertificatesExpiryDate
+		*out = (*in).DeepCopy()
+	}
 	if in.LastRemediation != nil {
 		in, out := &in.LastRemediation, &out.LastRemediation
 		*out = new(LastRemediationStatus)
 		(*in).DeepCopyInto(*out)
 	}
+	if in.MachineVersions != nil {
+		in, out := &in.MachineVersions, &out.MachineVersions
+		*out = make([]MachineVersionStatus, len(*in))
+		copy(*out, *in)
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new KThreesControlPlaneStatus.
@@ -187,6 +228,36 @@ func (in *LastRemediationStatus) DeepCopy() *LastRemediationStatus {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *MachineVersionStatus) DeepCopyInto(out *MachineVersionStatus) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new MachineVersionStatus.
+func (in *MachineVersionStatus) DeepCopy() *MachineVersionStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(MachineVersionStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *Manifest) DeepCopyInto(out *Manifest) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new Manifest.
+func (in *Manifest) DeepCopy() *Manifest {
+	if in == nil {
+		return nil
+	}
+	out := new(Manifest)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *RemediationStrategy) DeepCopyInto(out *RemediationStrategy) {
 	*out = *in
@@ -212,3 +283,43 @@ func (in *RemediationStrategy) DeepCopy() *RemediationStrategy {
 	in.DeepCopyInto(out)
 	return out
 }
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *RollingUpdate) DeepCopyInto(out *RollingUpdate) {
+	*out = *in
+	if in.MaxSurge != nil {
+		in, out := &in.MaxSurge, &out.MaxSurge
+		*out = new(intstr.IntOrString)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new RollingUpdate.
+func (in *RollingUpdate) DeepCopy() *RollingUpdate {
+	if in == nil {
+		return nil
+	}
+	out := new(RollingUpdate)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *RolloutStrategy) DeepCopyInto(out *RolloutStrategy) {
+	*out = *in
+	if in.RollingUpdate != nil {
+		in, out := &in.RollingUpdate, &out.RollingUpdate
+		*out = new(RollingUpdate)
+		(*in).DeepCopyInto(*out)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new RolloutStrategy.
+func (in *RolloutStrategy) DeepCopy() *RolloutStrategy {
+	if in == nil {
+		return nil
+	}
+	out := new(RolloutStrategy)
+	in.DeepCopyInto(out)
+	return out
+}
@@ -27,7 +27,23 @@ const (
 	// up/down if some preflight check for those operation has failed.
 	preflightFailedRequeueAfter = 15 * time.Second
 
+	// etcdUnhealthyMaxRequeueAfter caps how long to wait before checking again when preflight checks keep
+	// failing because of unhealthy etcd members, the wait doubles from preflightFailedRequeueAfter on every failure.
+	etcdUnhealthyMaxRequeueAfter = 5 * time.Minute
+
 	// dependentCertRequeueAfter is how long to wait before checking again to see if
 	// dependent certificates have been created.
 	dependentCertRequeueAfter = 30 * time.Second
+
+	// etcdMemberRemovalRequeueAfter is how long to wait before checking again to see if
+	// the etcd member of a machine being scaled down has been removed.
+	etcdMemberRemovalRequeueAfter = 10 * time.Second
+
+	// preUpgradeSnapshotRequeueAfter is how long to wait before checking again to see if
+	// the etcd snapshot taken before an upgrade has been saved.
+	preUpgradeSnapshotRequeueAfter = 10 * time.Second
+
+	// controlPlaneEndpointRequeueAfter is how long to wait before checking again to see if
+	// the Cluster has got its control plane endpoint.
+	controlPlaneEndpointRequeueAfter = 20 * time.Second
 )
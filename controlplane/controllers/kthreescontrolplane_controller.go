@@ -20,6 +20,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"sort"
 	"strings"
 	"time"
 
@@ -29,9 +30,11 @@ import (
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	kerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/apimachinery/pkg/util/sets"
 	"k8s.io/client-go/tools/record"
 	clusterv1 "sigs.k8s.io/cluster-api/api/v1beta1"
 	"sigs.k8s.io/cluster-api/controllers/external"
+	expv1 "sigs.k8s.io/cluster-api/exp/api/v1beta1"
 	"sigs.k8s.io/cluster-api/util"
 	"sigs.k8s.io/cluster-api/util/annotations"
 	"sigs.k8s.io/cluster-api/util/conditions"
@@ -63,17 +66,21 @@ type KThreesControlPlaneReconciler struct {
 
 	managementCluster         k3s.ManagementCluster
 	managementClusterUncached k3s.ManagementCluster
+
+	etcdUnhealthyBackoff etcdUnhealthyBackoff
 }
 
 // +kubebuilder:rbac:groups=core,resources=events,verbs=get;list;watch;create;patch
-// +kubebuilder:rbac:groups=core,resources=secrets,verbs=get;list;watch;create;update;patch
+// +kubebuilder:rbac:groups=core,resources=secrets,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups=infrastructure.cluster.x-k8s.io;bootstrap.cluster.x-k8s.io;controlplane.cluster.x-k8s.io,resources=*,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups=cluster.x-k8s.io,resources=clusters;clusters/status,verbs=get;list;watch
 // +kubebuilder:rbac:groups=cluster.x-k8s.io,resources=machines;machines/status,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=cluster.x-k8s.io,resources=machinedeployments,verbs=get;list;watch;patch
+// +kubebuilder:rbac:groups=cluster.x-k8s.io,resources=machinepools,verbs=get;list;watch
 // +kubebuilder:rbac:groups=apiextensions.k8s.io,resources=customresourcedefinitions,verbs=get;list;watch
 
 func (r *KThreesControlPlaneReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
-	logger := r.Log.WithValues("namespace", req.Namespace, "kthreesControlPlane", req.Name)
+	logger := ctrl.LoggerFrom(ctx).WithValues("namespace", req.Namespace, "kthreesControlPlane", req.Name)
 
 	// Fetch the KThreesControlPlane instance.
 	kcp := &controlplanev1.KThreesControlPlane{}
@@ -95,6 +102,7 @@ func (r *KThreesControlPlaneReconciler) Reconcile(ctx context.Context, req ctrl.
 		return ctrl.Result{Requeue: true}, nil
 	}
 	logger = logger.WithValues("cluster", cluster.Name)
+	ctx = ctrl.LoggerInto(ctx, logger)
 
 	if annotations.IsPaused(cluster, kcp) {
 		logger.Info("Reconciliation is paused for this object")
@@ -174,7 +182,7 @@ func (r *KThreesControlPlaneReconciler) Reconcile(ctx context.Context, req ctrl.
 // The implementation does not take non-control plane workloads into consideration. This may or may not change in the future.
 // Please see https://github.com/kubernetes-sigs/cluster-api/issues/2064.
 func (r *KThreesControlPlaneReconciler) reconcileDelete(ctx context.Context, cluster *clusterv1.Cluster, kcp *controlplanev1.KThreesControlPlane) (ctrl.Result, error) {
-	logger := r.Log.WithValues("namespace", kcp.Namespace, "KThreesControlPlane", kcp.Name, "cluster", cluster.Name)
+	logger := ctrl.LoggerFrom(ctx)
 	logger.Info("Reconcile KThreesControlPlane deletion")
 
 	// Gets all machines, not just control plane machines.
@@ -184,8 +192,12 @@ func (r *KThreesControlPlaneReconciler) reconcileDelete(ctx context.Context, clu
 	}
 	ownedMachines := allMachines.Filter(machinefilters.OwnedMachines(kcp))
 
-	// If no control plane machines remain, remove the finalizer
+	// If no control plane machines remain, clean up the secrets and remove the finalizer
 	if len(ownedMachines) == 0 {
+		if err := r.deleteOwnedSecrets(ctx, cluster, kcp); err != nil {
+			return reconcile.Result{}, err
+		}
+		r.etcdUnhealthyBackoff.reset(kcp.UID)
 		controllerutil.RemoveFinalizer(kcp, controlplanev1.KThreesControlPlaneFinalizer)
 		return reconcile.Result{}, nil
 	}
@@ -215,6 +227,18 @@ func (r *KThreesControlPlaneReconciler) reconcileDelete(ctx context.Context, clu
 		return ctrl.Result{RequeueAfter: deleteRequeueAfter}, nil
 	}
 
+	// Make sure the machines being deleted are drained using the current node drain timeout.
+	if err := r.syncMachines(ctx, controlPlane); err != nil {
+		return reconcile.Result{}, err
+	}
+
+	// The whole control plane is going away, so there is no etcd member to clean up: release the pre-terminate hooks.
+	for _, m := range ownedMachines.Filter(machinefilters.HasDeletionTimestamp, machinefilters.HasAnnotationKey(controlplanev1.PreTerminateHookCleanupAnnotation)) {
+		if err := r.removePreTerminateHook(ctx, m); err != nil {
+			return reconcile.Result{}, err
+		}
+	}
+
 	// Delete control plane machines in parallel
 	machinesToDelete := ownedMachines.Filter(machinefilters.Not(machinefilters.HasDeletionTimestamp))
 	var errs []error
@@ -236,11 +260,43 @@ func (r *KThreesControlPlaneReconciler) reconcileDelete(ctx context.Context, clu
 	return ctrl.Result{RequeueAfter: deleteRequeueAfter}, nil
 }
 
+// deleteOwnedSecrets deletes the cluster secrets controlled by the control plane: the kubeconfig, the token and the
+// CAs. They would be garbage collected with the control plane eventually, deleting them before the finalizer is
+// removed makes sure no credentials of the cluster outlive it. The secrets referenced through TokenRef and
+// CACertificatesRef are supplied by the user, they are left untouched.
+func (r *KThreesControlPlaneReconciler) deleteOwnedSecrets(ctx context.Context, cluster *clusterv1.Cluster, kcp *controlplanev1.KThreesControlPlane) error {
+	secrets := &corev1.SecretList{}
+	if err := r.Client.List(ctx, secrets, client.InNamespace(cluster.Namespace), client.MatchingLabels{clusterv1.ClusterNameLabel: cluster.Name}); err != nil {
+		return fmt.Errorf("failed to list secrets of cluster %s: %w", cluster.Name, err)
+	}
+
+	referenced := map[string]bool{}
+	if kcp.Spec.TokenRef != nil {
+		referenced[kcp.Spec.TokenRef.Name] = true
+	}
+	if kcp.Spec.CACertificatesRef != nil {
+		referenced[kcp.Spec.CACertificatesRef.Name] = true
+	}
+
+	var errs []error
+	for i := range secrets.Items {
+		s := &secrets.Items[i]
+		if referenced[s.Name] || !metav1.IsControlledBy(s, kcp) {
+			continue
+		}
+		if err := r.Client.Delete(ctx, s); err != nil && !apierrors.IsNotFound(err) {
+			errs = append(errs, fmt.Errorf("failed to delete secret %s: %w", s.Name, err))
+		}
+	}
+	return kerrors.NewAggregate(errs)
+}
+
 func patchKThreesControlPlane(ctx context.Context, patchHelper *patch.Helper, kcp *controlplanev1.KThreesControlPlane) error {
 	// Always update the readyCondition by summarizing the state of other conditions.
 	conditions.SetSummary(kcp,
 		conditions.WithConditions(
 			controlplanev1.MachinesSpecUpToDateCondition,
+			controlplanev1.PreUpgradeSnapshotCondition,
 			controlplanev1.ResizedCondition,
 			controlplanev1.MachinesReadyCondition,
 			controlplanev1.AvailableCondition,
@@ -260,6 +316,8 @@ func patchKThreesControlPlane(ctx context.Context, patchHelper *patch.Helper, kc
 			controlplanev1.MachinesReadyCondition,
 			controlplanev1.AvailableCondition,
 			controlplanev1.CertificatesAvailableCondition,
+			controlplanev1.CertificatesExpiringSoonCondition,
+			controlplanev1.SecretsEncryptionCondition,
 			controlplanev1.TokenAvailableCondition,
 		}},
 	)
@@ -330,13 +388,18 @@ func (r *KThreesControlPlaneReconciler) updateStatus(ctx context.Context, kcp *c
 		return fmt.Errorf("failed to get list of owned machines: %w", err)
 	}
 
-	logger := r.Log.WithValues("namespace", kcp.Namespace, "KThreesControlPlane", kcp.Name, "cluster", cluster.Name)
+	logger := ctrl.LoggerFrom(ctx)
 	controlPlane, err := k3s.NewControlPlane(ctx, r.Client, cluster, kcp, ownedMachines)
 	if err != nil {
 		logger.Error(err, "failed to initialize control plane")
 		return err
 	}
-	kcp.Status.UpdatedReplicas = int32(len(controlPlane.UpToDateMachines()))
+	upToDateMachines := controlPlane.UpToDateMachines()
+	if controlPlane.IsEtcdManaged() {
+		// A new server only counts as updated once its etcd member is healthy.
+		upToDateMachines = upToDateMachines.Filter(machinefilters.IsEtcdMemberHealthy())
+	}
+	kcp.Status.UpdatedReplicas = int32(len(upToDateMachines))
 
 	replicas := int32(len(ownedMachines))
 	desiredReplicas := *kcp.Spec.Replicas
@@ -352,6 +415,7 @@ func (r *KThreesControlPlaneReconciler) updateStatus(ctx context.Context, kcp *c
 		return nil
 	}
 
+	resized := false
 	switch {
 	// We are scaling up
 	case replicas < desiredReplicas:
@@ -364,9 +428,20 @@ func (r *KThreesControlPlaneReconciler) updateStatus(ctx context.Context, kcp *c
 		// NOTE: we are checking the number of machines ready so we report resize completed only when the machines
 		// are actually provisioned (vs reporting completed immediately after the last machine object is created).
 		readyMachines := ownedMachines.Filter(machinefilters.IsReady())
-		if int32(len(readyMachines)) == replicas {
-			conditions.MarkTrue(kcp, controlplanev1.ResizedCondition)
+		if int32(len(readyMachines)) != replicas {
+			break
 		}
+		// With the embedded etcd, the resize is only completed once the members of the new servers are healthy.
+		if controlPlane.IsEtcdManaged() {
+			if waiting := ownedMachines.Filter(machinefilters.Not(machinefilters.IsEtcdMemberHealthy())).Names(); len(waiting) > 0 {
+				sort.Strings(waiting)
+				conditions.MarkFalse(kcp, controlplanev1.ResizedCondition, controlplanev1.WaitingForEtcdMemberReason, clusterv1.ConditionSeverityInfo,
+					"Waiting for the etcd member of %s to be healthy", strings.Join(waiting, ", "))
+				break
+			}
+		}
+		// The resize is completed once the nodes are Ready too, which is checked below against the workload cluster.
+		resized = true
 	}
 
 	workloadCluster, err := r.managementCluster.GetWorkloadCluster(ctx, util.ObjectKey(cluster))
@@ -380,8 +455,20 @@ func (r *KThreesControlPlaneReconciler) updateStatus(ctx context.Context, kcp *c
 
 	logger.Info("ClusterStatus", "workload", status)
 
-	kcp.Status.ReadyReplicas = status.ReadyNodes
-	kcp.Status.UnavailableReplicas = replicas - status.ReadyNodes
+	// A machine only counts as ready once its node is Ready, not as soon as it is provisioned.
+	ready, nodeNotReady := readyReplicas(ownedMachines, status.NodeReady)
+	kcp.Status.ReadyReplicas = ready
+	kcp.Status.UnavailableReplicas = replicas - ready
+	kcp.Status.MachineVersions = machineVersions(ownedMachines, status.NodeVersions)
+
+	if resized {
+		if len(nodeNotReady) > 0 {
+			conditions.MarkFalse(kcp, controlplanev1.ResizedCondition, controlplanev1.NodeNotReadyReason, clusterv1.ConditionSeverityInfo,
+				"Waiting for the node of %s to be Ready", strings.Join(nodeNotReady, ", "))
+		} else {
+			conditions.MarkTrue(kcp, controlplanev1.ResizedCondition)
+		}
+	}
 
 	if kcp.Status.ReadyReplicas > 0 {
 		kcp.Status.Ready = true
@@ -392,9 +479,99 @@ func (r *KThreesControlPlaneReconciler) updateStatus(ctx context.Context, kcp *c
 	return nil
 }
 
+// readyReplicas returns the number of machines with a Ready node, and the sorted names of the machines with a node
+// that is not Ready. Machines without a node yet are still provisioning and are in neither.
+func readyReplicas(machines k3s.FilterableMachineCollection, nodeReady map[string]bool) (int32, []string) {
+	var ready int32
+	var notReady []string
+	for _, machine := range machines {
+		if machine.Status.NodeRef == nil {
+			continue
+		}
+		if nodeReady[machine.Status.NodeRef.Name] {
+			ready++
+		} else {
+			notReady = append(notReady, machine.Name)
+		}
+	}
+	sort.Strings(notReady)
+	return ready, notReady
+}
+
+// machineVersions returns the k3s version observed on the node of each machine, sorted by machine name.
+// Machines without a node yet are left out.
+func machineVersions(machines k3s.FilterableMachineCollection, nodeVersions map[string]string) []controlplanev1.MachineVersionStatus {
+	var versions []controlplanev1.MachineVersionStatus
+	for _, machine := range machines {
+		if machine.Status.NodeRef == nil {
+			continue
+		}
+		version, ok := nodeVersions[machine.Status.NodeRef.Name]
+		if !ok {
+			continue
+		}
+		versions = append(versions, controlplanev1.MachineVersionStatus{
+			Machine:  machine.Name,
+			NodeName: machine.Status.NodeRef.Name,
+			Version:  version,
+		})
+	}
+	sort.Slice(versions, func(i, j int) bool { return versions[i].Machine < versions[j].Machine })
+	return versions
+}
+
+// reconcileCertificates ensures the cluster CA secrets read by the bootstrap provider exist, holding the CAs
+// supplied through CACertificatesRef or generated ones.
+func (r *KThreesControlPlaneReconciler) reconcileCertificates(ctx context.Context, cluster *clusterv1.Cluster, kcp *controlplanev1.KThreesControlPlane) error {
+	certificates := secret.NewCertificatesForInitialControlPlane(&kcp.Spec.KThreesConfigSpec)
+	controllerRef := metav1.NewControllerRef(kcp, controlplanev1.GroupVersion.WithKind("KThreesControlPlane"))
+
+	if kcp.Spec.CACertificatesRef == nil {
+		if err := certificates.LookupOrGenerate(ctx, r.Client, util.ObjectKey(cluster), *controllerRef); err != nil {
+			conditions.MarkFalse(kcp, controlplanev1.CertificatesAvailableCondition, controlplanev1.CertificatesGenerationFailedReason, clusterv1.ConditionSeverityWarning, err.Error())
+			return err
+		}
+		conditions.MarkTrue(kcp, controlplanev1.CertificatesAvailableCondition)
+		return nil
+	}
+
+	err := certificates.LookupSupplied(ctx, r.Client, client.ObjectKey{Namespace: kcp.Namespace, Name: kcp.Spec.CACertificatesRef.Name})
+	if err == nil {
+		err = certificates.SaveSupplied(ctx, r.Client, util.ObjectKey(cluster), *controllerRef)
+	}
+	if err != nil {
+		conditions.MarkFalse(kcp, controlplanev1.CertificatesAvailableCondition, controlplanev1.CACertificatesUnavailableReason, clusterv1.ConditionSeverityWarning, err.Error())
+		return err
+	}
+	conditions.MarkTrue(kcp, controlplanev1.CertificatesAvailableCondition)
+	return nil
+}
+
+// reconcileToken ensures the token secret read by joining nodes exists, holding the token supplied through
+// TokenRef or a generated one.
+func (r *KThreesControlPlaneReconciler) reconcileToken(ctx context.Context, cluster *clusterv1.Cluster, kcp *controlplanev1.KThreesControlPlane) error {
+	if kcp.Spec.TokenRef == nil {
+		if err := token.Reconcile(ctx, r.Client, client.ObjectKeyFromObject(cluster), kcp); err != nil {
+			conditions.MarkFalse(kcp, controlplanev1.TokenAvailableCondition, controlplanev1.TokenGenerationFailedReason, clusterv1.ConditionSeverityWarning, err.Error())
+			return err
+		}
+		return nil
+	}
+
+	supplied, err := token.LookupSupplied(ctx, r.Client, client.ObjectKey{Namespace: kcp.Namespace, Name: kcp.Spec.TokenRef.Name})
+	if err == nil {
+		err = token.ReconcileSupplied(ctx, r.Client, client.ObjectKeyFromObject(cluster), kcp, supplied)
+	}
+	if err != nil {
+		conditions.MarkFalse(kcp, controlplanev1.TokenAvailableCondition, controlplanev1.TokenSecretUnavailableReason, clusterv1.ConditionSeverityWarning, err.Error())
+		return err
+	}
+	return nil
+}
+
 // reconcile handles KThreesControlPlane reconciliation.
 func (r *KThreesControlPlaneReconciler) reconcile(ctx context.Context, cluster *clusterv1.Cluster, kcp *controlplanev1.KThreesControlPlane) (ctrl.Result, error) {
-	logger := r.Log.WithValues("namespace", kcp.Namespace, "KThreesControlPlane", kcp.Name, "cluster", cluster.Name)
+	logger := ctrl.LoggerFrom(ctx)
 	logger.Info("Reconcile KThreesControlPlane")
 
 	// Make sure to reconcile the external infrastructure reference.
@@ -402,25 +579,23 @@ func (r *KThreesControlPlaneReconciler) reconcile(ctx context.Context, cluster *
 		return reconcile.Result{}, err
 	}
 
-	certificates := secret.NewCertificatesForInitialControlPlane(&kcp.Spec.KThreesConfigSpec)
-	controllerRef := metav1.NewControllerRef(kcp, controlplanev1.GroupVersion.WithKind("KThreesControlPlane"))
-	if err := certificates.LookupOrGenerate(ctx, r.Client, util.ObjectKey(cluster), *controllerRef); err != nil {
+	if err := r.reconcileCertificates(ctx, cluster, kcp); err != nil {
 		logger.Error(err, "unable to lookup or create cluster certificates")
-		conditions.MarkFalse(kcp, controlplanev1.CertificatesAvailableCondition, controlplanev1.CertificatesGenerationFailedReason, clusterv1.ConditionSeverityWarning, err.Error())
 		return reconcile.Result{}, err
 	}
-	conditions.MarkTrue(kcp, controlplanev1.CertificatesAvailableCondition)
 
-	if err := token.Reconcile(ctx, r.Client, client.ObjectKeyFromObject(cluster), kcp); err != nil {
-		conditions.MarkFalse(kcp, controlplanev1.TokenAvailableCondition, controlplanev1.TokenGenerationFailedReason, clusterv1.ConditionSeverityWarning, err.Error())
+	if err := r.reconcileToken(ctx, cluster, kcp); err != nil {
 		return reconcile.Result{}, err
 	}
 	conditions.MarkTrue(kcp, controlplanev1.TokenAvailableCondition)
 
-	// If ControlPlaneEndpoint is not set, return early
+	// The servers are configured with the endpoint in their tls-san and join through it, wait for it to be set
+	// rather than creating broken servers.
 	if !cluster.Spec.ControlPlaneEndpoint.IsValid() {
 		logger.Info("Cluster does not yet have a ControlPlaneEndpoint defined")
-		return reconcile.Result{}, nil
+		conditions.MarkFalse(kcp, controlplanev1.AvailableCondition, controlplanev1.WaitingForControlPlaneEndpointReason, clusterv1.ConditionSeverityInfo,
+			"Waiting for the Cluster control plane endpoint")
+		return reconcile.Result{RequeueAfter: controlPlaneEndpointRequeueAfter}, nil
 	}
 
 	// Generate Cluster Kubeconfig if needed
@@ -464,6 +639,27 @@ func (r *KThreesControlPlaneReconciler) reconcile(ctx context.Context, cluster *
 		return reconcile.Result{}, err
 	}
 
+	// Reports the expiry of the certificates served by the k3s servers.
+	r.reconcileCertificatesExpiry(ctx, controlPlane)
+
+	// Reports the secrets encryption stage of the k3s servers.
+	r.reconcileSecretsEncryption(ctx, controlPlane)
+
+	// Propagates in-place changes to the node drain timeout to the existing machines.
+	if err := r.syncMachines(ctx, controlPlane); err != nil {
+		return reconcile.Result{}, err
+	}
+
+	// Ensures every control plane machine carries the pre-terminate hook, including the ones created before it was introduced.
+	if err := r.ensurePreTerminateHook(ctx, controlPlane); err != nil {
+		return reconcile.Result{}, err
+	}
+
+	// Removes the etcd member of a deleting machine once it has been drained, then lets its deletion complete.
+	if result, err := r.reconcilePreTerminateHook(ctx, controlPlane); err != nil || !result.IsZero() {
+		return result, err
+	}
+
 	// Ensures the number of etcd members is in sync with the number of machines/nodes.
 	// NOTE: This is usually required after a machine deletion.
 	// if result, err := r.reconcileEtcdMembers(ctx, controlPlane); err != nil || !result.IsZero() {
@@ -476,12 +672,25 @@ func (r *KThreesControlPlaneReconciler) reconcile(ctx context.Context, cluster *
 		return result, err
 	}
 
+	// Tracks certificates rotation requests, the machines created before the request are rolled out below.
+	if result := r.reconcileCertificatesRotation(controlPlane); !result.IsZero() {
+		return result, nil
+	}
+
+	// Tracks token rotation requests, the machines created before the request are rolled out below.
+	if result, err := r.reconcileTokenRotation(ctx, controlPlane); err != nil || !result.IsZero() {
+		return result, err
+	}
+
 	// Control plane machines rollout due to configuration changes (e.g. upgrades) takes precedence over other operations.
 	needRollout := controlPlane.MachinesNeedingRollout()
 	switch {
 	case len(needRollout) > 0:
 		logger.Info("Rolling out Control Plane machines", "needRollout", needRollout.Names())
 		conditions.MarkFalse(controlPlane.KCP, controlplanev1.MachinesSpecUpToDateCondition, controlplanev1.RollingUpdateInProgressReason, clusterv1.ConditionSeverityWarning, "Rolling %d replicas with outdated spec (%d replicas up to date)", len(needRollout), len(controlPlane.Machines)-len(needRollout))
+		if result, err := r.reconcilePreUpgradeSnapshot(ctx, controlPlane); err != nil || !result.IsZero() {
+			return result, err
+		}
 		return r.upgradeControlPlane(ctx, cluster, kcp, controlPlane, needRollout)
 	default:
 		// make sure last upgrade operation is marked as completed.
@@ -538,6 +747,516 @@ func (r *KThreesControlPlaneReconciler) reconcile(ctx context.Context, cluster *
 	return reconcile.Result{}, nil
 }
 
+// ensurePreTerminateHook adds the pre-terminate hook to the control plane machines that are missing it.
+func (r *KThreesControlPlaneReconciler) ensurePreTerminateHook(ctx context.Context, controlPlane *k3s.ControlPlane) error {
+	machines := controlPlane.Machines.Filter(
+		machinefilters.Not(machinefilters.HasDeletionTimestamp),
+		machinefilters.Not(machinefilters.HasAnnotationKey(controlplanev1.PreTerminateHookCleanupAnnotation)),
+	)
+	for _, machine := range machines {
+		patchHelper, err := patch.NewHelper(machine, r.Client)
+		if err != nil {
+			return err
+		}
+		annotations.AddAnnotations(machine, map[string]string{controlplanev1.PreTerminateHookCleanupAnnotation: ""})
+		if err := patchHelper.Patch(ctx, machine); err != nil {
+			return fmt.Errorf("failed to add pre-terminate hook to machine %s: %w", machine.Name, err)
+		}
+	}
+	return nil
+}
+
+// reconcileCertificatesExpiry reports the earliest expiry of the certificates served by the k3s servers, and whether
+// it falls within the configured threshold. This operation is best effort, failures are surfaced on the condition.
+func (r *KThreesControlPlaneReconciler) reconcileCertificatesExpiry(ctx context.Context, controlPlane *k3s.ControlPlane) {
+	kcp := controlPlane.KCP
+	if !kcp.Status.Initialized {
+		return
+	}
+
+	workloadCluster, err := r.managementCluster.GetWorkloadCluster(ctx, util.ObjectKey(controlPlane.Cluster))
+	if err != nil {
+		conditions.MarkUnknown(kcp, controlplanev1.CertificatesExpiringSoonCondition, controlplanev1.CertificatesInspectionFailedReason, "Failed to connect to the workload cluster: %v", err)
+		return
+	}
+
+	expiry, err := workloadCluster.CertificatesExpiry(ctx)
+	if err != nil {
+		conditions.MarkUnknown(kcp, controlplanev1.CertificatesExpiringSoonCondition, controlplanev1.CertificatesInspectionFailedReason, err.Error())
+		return
+	}
+	kcp.Status.CertificatesExpiryDate = &metav1.Time{Time: expiry}
+
+	if time.Until(expiry) > kcp.CertificatesExpiryThreshold() {
+		conditions.MarkFalse(kcp, controlplanev1.CertificatesExpiringSoonCondition, controlplanev1.CertificatesValidReason, clusterv1.ConditionSeverityInfo, "")
+		return
+	}
+	conditions.Set(kcp, &clusterv1.Condition{
+		Type:    controlplanev1.CertificatesExpiringSoonCondition,
+		Status:  corev1.ConditionTrue,
+		Message: fmt.Sprintf("Certificates expire on %s, restart the k3s servers or roll out the control plane to renew them", expiry.UTC().Format(time.RFC3339)),
+	})
+}
+
+// reconcileSecretsEncryption reports whether the k3s servers agree on a completed secrets encryption stage, which
+// tells users when a key rotation started with `k3s secrets-encrypt` is done. This operation is best effort, failures
+// are surfaced on the condition.
+func (r *KThreesControlPlaneReconciler) reconcileSecretsEncryption(ctx context.Context, controlPlane *k3s.ControlPlane) {
+	kcp := controlPlane.KCP
+	if !kcp.Spec.KThreesConfigSpec.ServerConfig.SecretsEncryptionEnabled() {
+		conditions.Delete(kcp, controlplanev1.SecretsEncryptionCondition)
+		return
+	}
+	if !kcp.Status.Initialized {
+		return
+	}
+
+	workloadCluster, err := r.managementCluster.GetWorkloadCluster(ctx, util.ObjectKey(controlPlane.Cluster))
+	if err != nil {
+		conditions.MarkUnknown(kcp, controlplanev1.SecretsEncryptionCondition, controlplanev1.SecretsEncryptionInspectionFailedReason, "Failed to connect to the workload cluster: %v", err)
+		return
+	}
+
+	stages, err := workloadCluster.SecretsEncryptionStages(ctx)
+	if err != nil {
+		conditions.MarkUnknown(kcp, controlplanev1.SecretsEncryptionCondition, controlplanev1.SecretsEncryptionInspectionFailedReason, err.Error())
+		return
+	}
+
+	reported := sets.NewString()
+	nodeStages := make([]string, 0, len(stages))
+	for node, stage := range stages {
+		if stage == "" {
+			stage = "unknown"
+		}
+		reported.Insert(stage)
+		nodeStages = append(nodeStages, fmt.Sprintf("%s=%s", node, stage))
+	}
+	sort.Strings(nodeStages)
+
+	if reported.Len() == 1 && reported.HasAny(k3s.SecretsEncryptionStageStart, k3s.SecretsEncryptionStageReencryptFinished) {
+		conditions.MarkTrue(kcp, controlplanev1.SecretsEncryptionCondition)
+		return
+	}
+	conditions.MarkFalse(kcp, controlplanev1.SecretsEncryptionCondition, controlplanev1.SecretsEncryptionInProgressReason, clusterv1.ConditionSeverityInfo,
+		"Secrets encryption stages: %s", strings.Join(nodeStages, ", "))
+}
+
+// reconcileCertificatesRotation stamps a new certificates rotation request with the current time, and removes the
+// request once every machine created before it is gone. The machines themselves are replaced by the regular rollout,
+// see ControlPlane.MachinesNeedingRollout, which removes the etcd members one at a time through the pre-terminate hook.
+func (r *KThreesControlPlaneReconciler) reconcileCertificatesRotation(controlPlane *k3s.ControlPlane) ctrl.Result {
+	kcp := controlPlane.KCP
+	logger := controlPlane.Logger()
+
+	value, ok := kcp.Annotations[controlplanev1.RotateCertificatesAnnotation]
+	if !ok {
+		return ctrl.Result{}
+	}
+
+	if value == "" {
+		kcp.Annotations[controlplanev1.RotateCertificatesAnnotation] = time.Now().UTC().Format(time.RFC3339)
+		logger.Info("Certificates rotation requested, rolling out control plane machines")
+		return ctrl.Result{Requeue: true}
+	}
+
+	rotationTime := kcp.CertificatesRotationTime()
+	if rotationTime == nil {
+		return ctrl.Result{}
+	}
+
+	outdated := controlPlane.Machines.Filter(func(machine *clusterv1.Machine) bool {
+		return machine.CreationTimestamp.Before(rotationTime)
+	})
+	if len(outdated) == 0 {
+		delete(kcp.Annotations, controlplanev1.RotateCertificatesAnnotation)
+		logger.Info("Certificates rotation completed")
+		r.recorder.Eventf(kcp, corev1.EventTypeNormal, "CertificatesRotated", "Rolled out every control plane machine created before %s", rotationTime.UTC().Format(time.RFC3339))
+	}
+	return ctrl.Result{}
+}
+
+// reconcileTokenRotation drives a server token rotation requested through the RotateTokenAnnotation. The cluster
+// only accepts one token at a time, so the rotation makes sure no node joins across the switch:
+//   - a new token is staged next to the current one. Workers get no bootstrap data while it is staged, see the
+//     bootstrap provider, and the rollout waits for the machines already joining with the current token;
+//   - the first server created afterwards joins with the current token and switches the cluster to the staged one
+//     with `k3s token rotate`;
+//   - once that server has a node, the staged token becomes the one joining nodes use;
+//   - the MachineDeployments of the cluster are then rolled out, so that no worker keeps the old token;
+//   - the request is removed once every control plane machine created before it, and every worker created before
+//     the switch, has been replaced.
+//
+// MachinePools can't be rolled out, a request made while the cluster has some is refused.
+func (r *KThreesControlPlaneReconciler) reconcileTokenRotation(ctx context.Context, controlPlane *k3s.ControlPlane) (ctrl.Result, error) {
+	kcp := controlPlane.KCP
+	logger := controlPlane.Logger()
+
+	value, ok := kcp.Annotations[controlplanev1.RotateTokenAnnotation]
+	if !ok {
+		return ctrl.Result{}, nil
+	}
+
+	if value == "" {
+		kcp.Annotations[controlplanev1.RotateTokenAnnotation] = time.Now().UTC().Format(time.RFC3339)
+		logger.Info("Token rotation requested")
+		return ctrl.Result{Requeue: true}, nil
+	}
+
+	rotationTime := kcp.TokenRotationTime()
+	if rotationTime == nil {
+		return ctrl.Result{}, nil
+	}
+
+	clusterKey := client.ObjectKeyFromObject(controlPlane.Cluster)
+	next, err := token.LookupNext(ctx, r.Client, clusterKey)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+
+	rotated := controlPlane.Machines.Filter(func(machine *clusterv1.Machine) bool {
+		return !machine.CreationTimestamp.Before(rotationTime)
+	})
+	outdated := controlPlane.Machines.Difference(rotated)
+
+	switch {
+	case next == nil && len(rotated) == 0:
+		// The machines of a MachinePool can't be rolled out from here, they would keep joining with the revoked
+		// token. The request is dropped rather than held, holding it would stall every other operation of the KCP.
+		machinePools, err := r.machinePoolNames(ctx, controlPlane)
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+		if len(machinePools) > 0 {
+			delete(kcp.Annotations, controlplanev1.RotateTokenAnnotation)
+			logger.Info("Token rotation refused, the cluster has MachinePools", "machinePools", machinePools)
+			r.recorder.Eventf(kcp, corev1.EventTypeWarning, "TokenRotationRefused",
+				"The server token can't be rotated while the cluster has MachinePools: %s", strings.Join(machinePools, ", "))
+			return ctrl.Result{}, nil
+		}
+		if err := token.StageRotation(ctx, r.Client, clusterKey); err != nil {
+			return ctrl.Result{}, err
+		}
+		logger.Info("Staged the new token, rolling out control plane machines")
+		return ctrl.Result{Requeue: true}, nil
+	case next != nil && len(rotated) == 0:
+		// The first new server invalidates the current token, the machines still joining with it would never join.
+		joining, err := r.joiningMachines(ctx, controlPlane)
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+		if len(joining) > 0 {
+			logger.Info("Waiting for joining machines before rotating the token", "machines", joining.Names())
+			return ctrl.Result{RequeueAfter: 20 * time.Second}, nil
+		}
+	case next != nil && len(rotated.Filter(machinefilters.HasNodeRef)) > 0:
+		if err := token.CompleteRotation(ctx, r.Client, clusterKey); err != nil {
+			return ctrl.Result{}, err
+		}
+		logger.Info("Switched joining nodes to the new token")
+		r.recorder.Event(kcp, corev1.EventTypeNormal, "TokenRotated", "Joining nodes now use the new server token")
+		return ctrl.Result{Requeue: true}, nil
+	case next == nil:
+		workersRotated, err := r.rolloutWorkers(ctx, controlPlane, rotationTime)
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+		if workersRotated && len(outdated) == 0 {
+			delete(kcp.Annotations, controlplanev1.RotateTokenAnnotation)
+			logger.Info("Token rotation completed")
+			r.recorder.Eventf(kcp, corev1.EventTypeNormal, "TokenRotationCompleted", "Rolled out every machine created before the server token was rotated")
+		}
+	}
+	return ctrl.Result{}, nil
+}
+
+// machinePoolNames returns the names of the MachinePools of the cluster.
+func (r *KThreesControlPlaneReconciler) machinePoolNames(ctx context.Context, controlPlane *k3s.ControlPlane) ([]string, error) {
+	machinePools := &expv1.MachinePoolList{}
+	if err := r.Client.List(ctx, machinePools, client.InNamespace(controlPlane.Cluster.Namespace),
+		client.MatchingLabels{clusterv1.ClusterNameLabel: controlPlane.Cluster.Name}); err != nil {
+		return nil, fmt.Errorf("failed to list machine pools: %w", err)
+	}
+
+	names := make([]string, 0, len(machinePools.Items))
+	for _, mp := range machinePools.Items {
+		names = append(names, mp.Name)
+	}
+	return names, nil
+}
+
+// joiningMachines returns the machines of the cluster that got their bootstrap data but have no node yet.
+func (r *KThreesControlPlaneReconciler) joiningMachines(ctx context.Context, controlPlane *k3s.ControlPlane) (k3s.FilterableMachineCollection, error) {
+	machines := &clusterv1.MachineList{}
+	if err := r.Client.List(ctx, machines, client.InNamespace(controlPlane.Cluster.Namespace),
+		client.MatchingLabels{clusterv1.ClusterNameLabel: controlPlane.Cluster.Name}); err != nil {
+		return nil, fmt.Errorf("failed to list machines: %w", err)
+	}
+
+	joining := k3s.NewFilterableMachineCollection()
+	for i := range machines.Items {
+		machine := &machines.Items[i]
+		// The control plane machines are read from the control plane, the list may lag behind.
+		if _, ok := machine.Labels[clusterv1.MachineControlPlaneLabel]; ok {
+			continue
+		}
+		if machine.Spec.Bootstrap.DataSecretName != nil && machine.Status.NodeRef == nil && machine.DeletionTimestamp.IsZero() {
+			joining.Insert(machine)
+		}
+	}
+	for _, machine := range controlPlane.Machines {
+		if machine.Status.NodeRef == nil && machine.DeletionTimestamp.IsZero() {
+			joining.Insert(machine)
+		}
+	}
+	return joining, nil
+}
+
+// rolloutWorkers rolls out the MachineDeployments of the cluster not rolled out since the token rotation was
+// requested, through their RolloutAfter, and tells whether every worker they own has been replaced since.
+func (r *KThreesControlPlaneReconciler) rolloutWorkers(ctx context.Context, controlPlane *k3s.ControlPlane, rotationTime *metav1.Time) (bool, error) {
+	logger := controlPlane.Logger()
+	inCluster := []client.ListOption{
+		client.InNamespace(controlPlane.Cluster.Namespace),
+		client.MatchingLabels{clusterv1.ClusterNameLabel: controlPlane.Cluster.Name},
+	}
+
+	deployments := &clusterv1.MachineDeploymentList{}
+	if err := r.Client.List(ctx, deployments, inCluster...); err != nil {
+		return false, fmt.Errorf("failed to list machine deployments: %w", err)
+	}
+
+	rolloutAfter := map[string]*metav1.Time{}
+	for i := range deployments.Items {
+		md := &deployments.Items[i]
+		if md.Spec.RolloutAfter == nil || md.Spec.RolloutAfter.Before(rotationTime) {
+			patchHelper, err := patch.NewHelper(md, r.Client)
+			if err != nil {
+				return false, err
+			}
+			now := metav1.Now()
+			md.Spec.RolloutAfter = &now
+			if err := patchHelper.Patch(ctx, md); err != nil {
+				return false, fmt.Errorf("failed to roll out machine deployment %s: %w", md.Name, err)
+			}
+			logger.Info("Rolling out workers for the new token", "machineDeployment", md.Name)
+		}
+		rolloutAfter[md.Name] = md.Spec.RolloutAfter
+	}
+
+	machines := &clusterv1.MachineList{}
+	if err := r.Client.List(ctx, machines, inCluster...); err != nil {
+		return false, fmt.Errorf("failed to list machines: %w", err)
+	}
+	for _, machine := range machines.Items {
+		after, ok := rolloutAfter[machine.Labels[clusterv1.MachineDeploymentNameLabel]]
+		if ok && machine.CreationTimestamp.Before(after) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// reconcilePreUpgradeSnapshot takes an etcd snapshot before the first machine is replaced for a new version, when
+// SnapshotBeforeUpgrade is enabled, and holds the rollout until the snapshot is saved. The version the snapshot was
+// taken for is recorded on the KCP, so the snapshot is taken once per version.
+func (r *KThreesControlPlaneReconciler) reconcilePreUpgradeSnapshot(ctx context.Context, controlPlane *k3s.ControlPlane) (ctrl.Result, error) {
+	kcp := controlPlane.KCP
+	logger := controlPlane.Logger()
+
+	if !kcp.Spec.SnapshotBeforeUpgrade || !controlPlane.IsEtcdManaged() || !kcp.Status.Initialized {
+		return ctrl.Result{}, nil
+	}
+	if kcp.Annotations[controlplanev1.PreUpgradeSnapshotAnnotation] == kcp.Spec.Version {
+		return ctrl.Result{}, nil
+	}
+	if len(controlPlane.Machines.Filter(machinefilters.Not(machinefilters.MatchesKubernetesVersion(kcp.Spec.Version)))) == 0 {
+		return ctrl.Result{}, nil
+	}
+
+	workloadCluster, err := r.managementCluster.GetWorkloadCluster(ctx, util.ObjectKey(controlPlane.Cluster))
+	if err != nil {
+		conditions.MarkFalse(kcp, controlplanev1.PreUpgradeSnapshotCondition, controlplanev1.PreUpgradeSnapshotFailedReason, clusterv1.ConditionSeverityError, "Failed to connect to the workload cluster: %v", err)
+		return ctrl.Result{}, err
+	}
+
+	name := preUpgradeSnapshotName(kcp.Spec.Version)
+	saved, err := workloadCluster.TakeEtcdSnapshot(ctx, name)
+	if err != nil {
+		conditions.MarkFalse(kcp, controlplanev1.PreUpgradeSnapshotCondition, controlplanev1.PreUpgradeSnapshotFailedReason, clusterv1.ConditionSeverityError, err.Error())
+		return ctrl.Result{}, err
+	}
+	if !saved {
+		logger.Info("Waiting for the etcd snapshot before upgrading", "snapshot", name, "version", kcp.Spec.Version)
+		conditions.MarkFalse(kcp, controlplanev1.PreUpgradeSnapshotCondition, controlplanev1.WaitingForPreUpgradeSnapshotReason, clusterv1.ConditionSeverityInfo, "Waiting for etcd snapshot %s before upgrading to %s", name, kcp.Spec.Version)
+		return ctrl.Result{RequeueAfter: preUpgradeSnapshotRequeueAfter}, nil
+	}
+
+	if kcp.Annotations == nil {
+		kcp.Annotations = map[string]string{}
+	}
+	kcp.Annotations[controlplanev1.PreUpgradeSnapshotAnnotation] = kcp.Spec.Version
+	conditions.MarkTrue(kcp, controlplanev1.PreUpgradeSnapshotCondition)
+	r.recorder.Eventf(kcp, corev1.EventTypeNormal, "PreUpgradeSnapshotSaved", "Saved etcd snapshot %s before upgrading to %s", name, kcp.Spec.Version)
+	return ctrl.Result{}, nil
+}
+
+// preUpgradeSnapshotName returns the name of the etcd snapshot taken before upgrading to the given version,
+// e.g. pre-upgrade-v1-28-5-k3s1 for v1.28.5+k3s1.
+func preUpgradeSnapshotName(version string) string {
+	return "pre-upgrade-" + strings.NewReplacer(".", "-", "+", "-").Replace(strings.ToLower(version))
+}
+
+// syncMachines updates the fields of the control plane machines that can be changed in place, so that they don't
+// require a rollout. The machine controller cordons and drains the node of a deleting machine, and reads the node
+// drain timeout from the machine, so this also applies to machines already being deleted and stuck draining.
+// The labels and annotations of the machine template are propagated to the machines and their infrastructure
+// machines, keys removed from the template are left in place.
+func (r *KThreesControlPlaneReconciler) syncMachines(ctx context.Context, controlPlane *k3s.ControlPlane) error {
+	template := controlPlane.KCP.Spec.MachineTemplate.ObjectMeta
+	for _, machine := range controlPlane.Machines {
+		if !durationEqual(machine.Spec.NodeDrainTimeout, controlPlane.KCP.Spec.NodeDrainTimeout) || !hasMetadata(machine, template) {
+			patchHelper, err := patch.NewHelper(machine, r.Client)
+			if err != nil {
+				return err
+			}
+			machine.Spec.NodeDrainTimeout = controlPlane.KCP.Spec.NodeDrainTimeout
+			setMetadata(machine, template)
+			if err := patchHelper.Patch(ctx, machine); err != nil {
+				return fmt.Errorf("failed to update machine %s: %w", machine.Name, err)
+			}
+		}
+
+		infraMachine, err := external.Get(ctx, r.Client, &machine.Spec.InfrastructureRef, machine.Namespace)
+		if err != nil {
+			if apierrors.IsNotFound(err) {
+				continue
+			}
+			return fmt.Errorf("failed to get infrastructure machine of machine %s: %w", machine.Name, err)
+		}
+		if hasMetadata(infraMachine, template) {
+			continue
+		}
+		patchHelper, err := patch.NewHelper(infraMachine, r.Client)
+		if err != nil {
+			return err
+		}
+		setMetadata(infraMachine, template)
+		if err := patchHelper.Patch(ctx, infraMachine); err != nil {
+			return fmt.Errorf("failed to update infrastructure machine of machine %s: %w", machine.Name, err)
+		}
+	}
+	return nil
+}
+
+// hasMetadata returns whether the object carries every label and annotation of the machine template.
+func hasMetadata(obj metav1.Object, template clusterv1.ObjectMeta) bool {
+	contains := func(have, want map[string]string) bool {
+		for key, value := range want {
+			if v, ok := have[key]; !ok || v != value {
+				return false
+			}
+		}
+		return true
+	}
+	return contains(obj.GetLabels(), template.Labels) && contains(obj.GetAnnotations(), template.Annotations)
+}
+
+// setMetadata adds the labels and annotations of the machine template to the object.
+func setMetadata(obj metav1.Object, template clusterv1.ObjectMeta) {
+	merge := func(into, from map[string]string) map[string]string {
+		if len(from) == 0 {
+			return into
+		}
+		if into == nil {
+			into = map[string]string{}
+		}
+		for key, value := range from {
+			into[key] = value
+		}
+		return into
+	}
+	obj.SetLabels(merge(obj.GetLabels(), template.Labels))
+	obj.SetAnnotations(merge(obj.GetAnnotations(), template.Annotations))
+}
+
+func durationEqual(a, b *metav1.Duration) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Duration == b.Duration
+}
+
+// reconcilePreTerminateHook removes the etcd member of a deleting control plane machine once the machine controller
+// has drained it and is waiting on the pre-terminate hook, then removes the hook so the infrastructure can be deleted.
+func (r *KThreesControlPlaneReconciler) reconcilePreTerminateHook(ctx context.Context, controlPlane *k3s.ControlPlane) (ctrl.Result, error) {
+	if !controlPlane.HasDeletingMachine() {
+		return ctrl.Result{}, nil
+	}
+
+	// Handle one machine at a time, so etcd members are removed one by one.
+	deletingMachine := controlPlane.Machines.Filter(machinefilters.HasDeletionTimestamp).Oldest()
+	if _, ok := deletingMachine.Annotations[controlplanev1.PreTerminateHookCleanupAnnotation]; !ok {
+		return ctrl.Result{}, nil
+	}
+	logger := ctrl.LoggerFrom(ctx).WithValues("machine", deletingMachine.Name)
+	if deletingMachine.Status.NodeRef != nil {
+		logger = logger.WithValues("node", deletingMachine.Status.NodeRef.Name)
+	}
+	ctx = ctrl.LoggerInto(ctx, logger)
+
+	// Wait for the machine controller to reach the pre-terminate hook, i.e. for the node to be drained.
+	if c := conditions.Get(deletingMachine, clusterv1.PreTerminateDeleteHookSucceededCondition); c == nil ||
+		c.Status != corev1.ConditionFalse || c.Reason != clusterv1.WaitingExternalHookReason {
+		return ctrl.Result{RequeueAfter: deleteRequeueAfter}, nil
+	}
+
+	// Let other pre-terminate hooks run first, while the etcd member is still there.
+	for key := range deletingMachine.Annotations {
+		if strings.HasPrefix(key, clusterv1.PreTerminateDeleteHookAnnotationPrefix) && key != controlplanev1.PreTerminateHookCleanupAnnotation {
+			logger.Info("Waiting for other pre-terminate hooks to complete", "hook", key)
+			return ctrl.Result{RequeueAfter: deleteRequeueAfter}, nil
+		}
+	}
+
+	if controlPlane.KCP.Spec.KThreesConfigSpec.IsEtcdEmbedded() {
+		workloadCluster, err := r.managementCluster.GetWorkloadCluster(ctx, util.ObjectKey(controlPlane.Cluster))
+		if err != nil {
+			logger.Error(err, "Failed to create client to workload cluster")
+			return ctrl.Result{}, fmt.Errorf("failed to create client to workload cluster: %w", err)
+		}
+
+		removed, err := workloadCluster.RemoveEtcdMemberForMachine(ctx, deletingMachine)
+		if err != nil {
+			logger.Error(err, "Failed to remove etcd member for machine")
+			return ctrl.Result{}, err
+		}
+		if !removed {
+			logger.Info("Waiting for etcd member to be removed")
+			return ctrl.Result{RequeueAfter: etcdMemberRemovalRequeueAfter}, nil
+		}
+	}
+
+	if err := r.removePreTerminateHook(ctx, deletingMachine); err != nil {
+		return ctrl.Result{}, err
+	}
+	logger.Info("Removed pre-terminate hook from control plane machine")
+
+	return ctrl.Result{RequeueAfter: deleteRequeueAfter}, nil
+}
+
+func (r *KThreesControlPlaneReconciler) removePreTerminateHook(ctx context.Context, machine *clusterv1.Machine) error {
+	patchHelper, err := patch.NewHelper(machine, r.Client)
+	if err != nil {
+		return err
+	}
+	delete(machine.Annotations, controlplanev1.PreTerminateHookCleanupAnnotation)
+	if err := patchHelper.Patch(ctx, machine); err != nil {
+		return fmt.Errorf("failed to remove pre-terminate hook from machine %s: %w", machine.Name, err)
+	}
+	return nil
+}
+
 func (r *KThreesControlPlaneReconciler) reconcileExternalReference(ctx context.Context, cluster *clusterv1.Cluster, ref corev1.ObjectReference) error {
 	if !strings.HasSuffix(ref.Kind, clusterv1.TemplateSuffix) {
 		return nil
@@ -570,15 +1289,20 @@ func (r *KThreesControlPlaneReconciler) reconcileKubeconfig(ctx context.Context,
 		return reconcile.Result{}, nil
 	}
 
+	server := kcp.Spec.KubeconfigServer
+	if server == "" {
+		server = fmt.Sprintf("https://%s", endpoint.String())
+	}
+
 	controllerOwnerRef := *metav1.NewControllerRef(kcp, controlplanev1.GroupVersion.WithKind("KThreesControlPlane"))
 	configSecret, err := secret.GetFromNamespacedName(ctx, r.Client, clusterName, secret.Kubeconfig)
 	switch {
 	case apierrors.IsNotFound(err):
-		createErr := kubeconfig.CreateSecretWithOwner(
+		createErr := kubeconfig.CreateSecretWithServer(
 			ctx,
 			r.Client,
 			clusterName,
-			endpoint.String(),
+			server,
 			controllerOwnerRef,
 		)
 		if errors.Is(createErr, kubeconfig.ErrDependentCertificateNotFound) {
@@ -596,6 +1320,11 @@ func (r *KThreesControlPlaneReconciler) reconcileKubeconfig(ctx context.Context,
 		return reconcile.Result{}, nil
 	}
 
+	// Follows changes to the control plane endpoint and to KubeconfigServer.
+	if err := kubeconfig.UpdateServer(ctx, r.Client, configSecret, server); err != nil {
+		return reconcile.Result{}, fmt.Errorf("failed to update the server of the kubeconfig Secret: %w", err)
+	}
+
 	/**
 	// TODO rotation
 	needsRotation, err := kubeconfig.NeedsClientCertRotation(configSecret, certs.ClientCertificateRenewalDuration)
@@ -684,7 +1413,10 @@ func (r *KThreesControlPlaneReconciler) upgradeControlPlane(
 	}
 	**/
 
-	if controlPlane.Machines.Len() <= int(*kcp.Spec.Replicas) {
+	// With a surge the new machine is created before an outdated one is removed, without it an outdated
+	// machine is removed first to make room for its replacement.
+	maxMachines := int(*kcp.Spec.Replicas) + int(kcp.RolloutMaxSurge())
+	if controlPlane.Machines.Len() < maxMachines {
 		// scaleUp ensures that we don't continue scaling up while waiting for Machines to have NodeRefs
 		return r.scaleUpControlPlane(ctx, cluster, kcp, controlPlane)
 	}
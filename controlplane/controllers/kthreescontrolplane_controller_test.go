@@ -0,0 +1,1585 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr/funcr"
+	. "github.com/onsi/gomega"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/tools/clientcmd"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
+	"k8s.io/utils/pointer"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1beta1"
+	"sigs.k8s.io/cluster-api/controllers/external"
+	expv1 "sigs.k8s.io/cluster-api/exp/api/v1beta1"
+	"sigs.k8s.io/cluster-api/util"
+	"sigs.k8s.io/cluster-api/util/conditions"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	bootstrapv1 "github.com/cluster-api-provider-k3s/cluster-api-k3s/bootstrap/api/v1beta1"
+	controlplanev1 "github.com/cluster-api-provider-k3s/cluster-api-k3s/controlplane/api/v1beta1"
+	k3s "github.com/cluster-api-provider-k3s/cluster-api-k3s/pkg/k3s"
+	"github.com/cluster-api-provider-k3s/cluster-api-k3s/pkg/secret"
+)
+
+func TestReconcilePreTerminateHook(t *testing.T) {
+	setup := func(g *WithT, ctx context.Context, machineAnnotations map[string]string) (*KThreesControlPlaneReconciler, *k3s.ControlPlane, client.Client) {
+		r, cluster, kcp := newTestControlPlane(g)
+
+		machine := newHealthyControlPlaneMachine(kcp, cluster, "m1")
+		machine.Finalizers = []string{clusterv1.MachineFinalizer}
+		machine.Annotations = machineAnnotations
+		machine.Status.NodeRef = &corev1.ObjectReference{Kind: "Node", Name: "node-1"}
+		g.Expect(r.Client.Create(ctx, machine)).To(Succeed())
+		g.Expect(r.Client.Delete(ctx, machine)).To(Succeed())
+		g.Expect(r.Client.Get(ctx, client.ObjectKeyFromObject(machine), machine)).To(Succeed())
+
+		workloadClient := fake.NewClientBuilder().WithScheme(newTestScheme(g)).
+			WithObjects(&corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node-1"}}).Build()
+		r.managementCluster = &fakeManagementCluster{
+			Management: &k3s.Management{Client: r.Client},
+			Workload:   &k3s.Workload{Client: workloadClient},
+		}
+
+		controlPlane, err := k3s.NewControlPlane(ctx, r.Client, cluster, kcp, k3s.NewFilterableMachineCollection(machine))
+		g.Expect(err).NotTo(HaveOccurred())
+		return r, controlPlane, workloadClient
+	}
+
+	hasHook := func(g *WithT, ctx context.Context, r *KThreesControlPlaneReconciler) bool {
+		machine := &clusterv1.Machine{}
+		g.Expect(r.Client.Get(ctx, client.ObjectKey{Name: "m1", Namespace: metav1.NamespaceDefault}, machine)).To(Succeed())
+		_, ok := machine.Annotations[controlplanev1.PreTerminateHookCleanupAnnotation]
+		return ok
+	}
+
+	markWaitingOnHook := func(controlPlane *k3s.ControlPlane) {
+		for _, m := range controlPlane.Machines {
+			conditions.MarkFalse(m, clusterv1.PreTerminateDeleteHookSucceededCondition, clusterv1.WaitingExternalHookReason, clusterv1.ConditionSeverityInfo, "")
+		}
+	}
+
+	t.Run("hook is kept until the machine is drained", func(t *testing.T) {
+		g := NewWithT(t)
+		ctx := context.Background()
+
+		r, controlPlane, _ := setup(g, ctx, map[string]string{controlplanev1.PreTerminateHookCleanupAnnotation: ""})
+
+		result, err := r.reconcilePreTerminateHook(ctx, controlPlane)
+		g.Expect(err).NotTo(HaveOccurred())
+		g.Expect(result.RequeueAfter).To(Equal(deleteRequeueAfter))
+		g.Expect(hasHook(g, ctx, r)).To(BeTrue())
+	})
+
+	t.Run("hook is kept while other pre-terminate hooks are pending", func(t *testing.T) {
+		g := NewWithT(t)
+		ctx := context.Background()
+
+		r, controlPlane, _ := setup(g, ctx, map[string]string{
+			controlplanev1.PreTerminateHookCleanupAnnotation:                 "",
+			clusterv1.PreTerminateDeleteHookAnnotationPrefix + "/other-hook": "",
+		})
+		markWaitingOnHook(controlPlane)
+
+		result, err := r.reconcilePreTerminateHook(ctx, controlPlane)
+		g.Expect(err).NotTo(HaveOccurred())
+		g.Expect(result.RequeueAfter).To(Equal(deleteRequeueAfter))
+		g.Expect(hasHook(g, ctx, r)).To(BeTrue())
+	})
+
+	t.Run("deletion blocks until the etcd member is removed", func(t *testing.T) {
+		g := NewWithT(t)
+		ctx := context.Background()
+
+		r, controlPlane, workloadClient := setup(g, ctx, map[string]string{controlplanev1.PreTerminateHookCleanupAnnotation: ""})
+		markWaitingOnHook(controlPlane)
+
+		result, err := r.reconcilePreTerminateHook(ctx, controlPlane)
+		g.Expect(err).NotTo(HaveOccurred())
+		g.Expect(result.RequeueAfter).To(Equal(etcdMemberRemovalRequeueAfter))
+		g.Expect(hasHook(g, ctx, r)).To(BeTrue())
+
+		node := &corev1.Node{}
+		g.Expect(workloadClient.Get(ctx, client.ObjectKey{Name: "node-1"}, node)).To(Succeed())
+		g.Expect(node.Annotations).To(HaveKeyWithValue("etcd.k3s.cattle.io/remove", "true"))
+
+		// The k3s etcd controller reports the member as removed.
+		node.Annotations["etcd.k3s.cattle.io/removed-node-name"] = node.Name
+		g.Expect(workloadClient.Update(ctx, node)).To(Succeed())
+
+		result, err = r.reconcilePreTerminateHook(ctx, controlPlane)
+		g.Expect(err).NotTo(HaveOccurred())
+		g.Expect(result.RequeueAfter).To(Equal(deleteRequeueAfter))
+		g.Expect(hasHook(g, ctx, r)).To(BeFalse())
+	})
+
+	t.Run("etcd member removal is skipped with an external datastore", func(t *testing.T) {
+		g := NewWithT(t)
+		ctx := context.Background()
+
+		r, controlPlane, workloadClient := setup(g, ctx, map[string]string{controlplanev1.PreTerminateHookCleanupAnnotation: ""})
+		controlPlane.KCP.Spec.KThreesConfigSpec.ServerConfig.Datastore = &bootstrapv1.DatastoreConfig{Type: bootstrapv1.DatastoreTypeExternal}
+		markWaitingOnHook(controlPlane)
+
+		result, err := r.reconcilePreTerminateHook(ctx, controlPlane)
+		g.Expect(err).NotTo(HaveOccurred())
+		g.Expect(result.RequeueAfter).To(Equal(deleteRequeueAfter))
+		g.Expect(hasHook(g, ctx, r)).To(BeFalse())
+
+		node := &corev1.Node{}
+		g.Expect(workloadClient.Get(ctx, client.ObjectKey{Name: "node-1"}, node)).To(Succeed())
+		g.Expect(node.Annotations).NotTo(HaveKey("etcd.k3s.cattle.io/remove"))
+	})
+
+	t.Run("etcd connection errors are logged with the machine context", func(t *testing.T) {
+		g := NewWithT(t)
+
+		var logs []string
+		logger := funcr.New(func(prefix, args string) { logs = append(logs, args) }, funcr.Options{}).
+			WithValues("namespace", metav1.NamespaceDefault, "kthreesControlPlane", "kcp", "cluster", "test")
+		ctx := ctrl.LoggerInto(context.Background(), logger)
+
+		r, controlPlane, _ := setup(g, ctx, map[string]string{controlplanev1.PreTerminateHookCleanupAnnotation: ""})
+		r.managementCluster.(*fakeManagementCluster).WorkloadErr = errors.New("connection refused")
+		markWaitingOnHook(controlPlane)
+
+		_, err := r.reconcilePreTerminateHook(ctx, controlPlane)
+		g.Expect(err).To(HaveOccurred())
+		g.Expect(hasHook(g, ctx, r)).To(BeTrue())
+
+		g.Expect(logs).To(ContainElement(And(
+			ContainSubstring(`"msg"="Failed to create client to workload cluster"`),
+			ContainSubstring(`"error"="connection refused"`),
+			ContainSubstring(`"kthreesControlPlane"="kcp"`),
+			ContainSubstring(`"cluster"="test"`),
+			ContainSubstring(`"machine"="m1"`),
+			ContainSubstring(`"node"="node-1"`),
+		)))
+	})
+}
+
+func TestEnsurePreTerminateHook(t *testing.T) {
+	g := NewWithT(t)
+	ctx := context.Background()
+
+	r, cluster, kcp := newTestControlPlane(g)
+	machine := newHealthyControlPlaneMachine(kcp, cluster, "m1")
+	g.Expect(r.Client.Create(ctx, machine)).To(Succeed())
+
+	controlPlane, err := k3s.NewControlPlane(ctx, r.Client, cluster, kcp, k3s.NewFilterableMachineCollection(machine))
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(r.ensurePreTerminateHook(ctx, controlPlane)).To(Succeed())
+
+	g.Expect(r.Client.Get(ctx, client.ObjectKeyFromObject(machine), machine)).To(Succeed())
+	g.Expect(machine.Annotations).To(HaveKey(controlplanev1.PreTerminateHookCleanupAnnotation))
+}
+
+func TestReconcileControlPlaneConditionsEtcdHealth(t *testing.T) {
+	g := NewWithT(t)
+	ctx := context.Background()
+
+	r, cluster, kcp := newTestControlPlane(g)
+	kcp.Status.Initialized = true
+
+	machines := k3s.NewFilterableMachineCollection()
+	nodes := []client.Object{}
+	for _, name := range []string{"m1", "m2", "m3"} {
+		machine := newHealthyControlPlaneMachine(kcp, cluster, name)
+		machine.Status.NodeRef = &corev1.ObjectReference{Kind: "Node", Name: "node-" + name}
+		g.Expect(r.Client.Create(ctx, machine)).To(Succeed())
+		machines.Insert(machine)
+
+		nodes = append(nodes, &corev1.Node{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:   "node-" + name,
+				Labels: map[string]string{"node-role.kubernetes.io/master": "true"},
+			},
+			Status: corev1.NodeStatus{Conditions: []corev1.NodeCondition{{Type: corev1.NodeReady, Status: corev1.ConditionTrue}}},
+		})
+	}
+
+	workloadClient := fake.NewClientBuilder().WithScheme(newTestScheme(g)).WithObjects(nodes...).Build()
+	r.managementCluster = &fakeManagementCluster{
+		Management: &k3s.Management{Client: r.Client},
+		Workload:   &k3s.Workload{Client: workloadClient},
+	}
+
+	controlPlane, err := k3s.NewControlPlane(ctx, r.Client, cluster, kcp, machines)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	setNodeNotReady := func(name string) {
+		node := &corev1.Node{}
+		g.Expect(workloadClient.Get(ctx, client.ObjectKey{Name: name}, node)).To(Succeed())
+		node.Status.Conditions = []corev1.NodeCondition{{Type: corev1.NodeReady, Status: corev1.ConditionFalse}}
+		g.Expect(workloadClient.Update(ctx, node)).To(Succeed())
+	}
+
+	g.Expect(r.reconcileControlPlaneConditions(ctx, controlPlane)).To(Succeed())
+	g.Expect(conditions.IsTrue(kcp, controlplanev1.EtcdClusterHealthyCondition)).To(BeTrue())
+	g.Expect(conditions.IsTrue(kcp, controlplanev1.ControlPlaneComponentsHealthyCondition)).To(BeTrue())
+
+	// Losing one member out of three is tolerated.
+	setNodeNotReady("node-m2")
+	g.Expect(r.reconcileControlPlaneConditions(ctx, controlPlane)).To(Succeed())
+	g.Expect(conditions.IsFalse(kcp, controlplanev1.EtcdClusterHealthyCondition)).To(BeTrue())
+	g.Expect(conditions.GetReason(kcp, controlplanev1.EtcdClusterHealthyCondition)).To(Equal(controlplanev1.EtcdMemberUnhealthyReason))
+	g.Expect(conditions.GetReason(controlPlane.Machines["m2"], controlplanev1.MachineEtcdMemberHealthyCondition)).To(Equal(controlplanev1.EtcdMemberUnhealthyReason))
+
+	// Losing a second member breaks quorum.
+	setNodeNotReady("node-m3")
+	g.Expect(r.reconcileControlPlaneConditions(ctx, controlPlane)).To(Succeed())
+	g.Expect(conditions.IsFalse(kcp, controlplanev1.EtcdClusterHealthyCondition)).To(BeTrue())
+	g.Expect(conditions.GetReason(kcp, controlplanev1.EtcdClusterHealthyCondition)).To(Equal(controlplanev1.EtcdQuorumLostReason))
+	g.Expect(conditions.GetSeverity(kcp, controlplanev1.EtcdClusterHealthyCondition)).To(HaveValue(Equal(clusterv1.ConditionSeverityError)))
+
+	// There are no etcd members to report on with an external datastore.
+	conditions.Delete(kcp, controlplanev1.EtcdClusterHealthyCondition)
+	kcp.Spec.KThreesConfigSpec.ServerConfig.Datastore = &bootstrapv1.DatastoreConfig{Type: bootstrapv1.DatastoreTypeExternal}
+	g.Expect(r.reconcileControlPlaneConditions(ctx, controlPlane)).To(Succeed())
+	g.Expect(conditions.Has(kcp, controlplanev1.EtcdClusterHealthyCondition)).To(BeFalse())
+}
+
+func TestUpdateStatusMachineVersions(t *testing.T) {
+	g := NewWithT(t)
+	ctx := context.Background()
+
+	r, cluster, kcp := newTestControlPlane(g)
+	kcp.SetGroupVersionKind(controlplanev1.GroupVersion.WithKind("KThreesControlPlane"))
+	kcp.Spec.Version = "v1.28.5+k3s1"
+
+	// An upgrade from v1.27.1+k3s1 half way through: m1 and m2 are replaced, m3 is still on the old version and the
+	// replacement m4 hasn't got a node yet.
+	machines := map[string]string{"m1": "v1.28.5+k3s1", "m2": "v1.28.5+k3s1", "m3": "v1.27.1+k3s1", "m4": "v1.28.5+k3s1"}
+	var nodes []client.Object
+	for name, version := range machines {
+		machine := newHealthyControlPlaneMachine(kcp, cluster, name)
+		machine.Spec.Version = pointer.String(version)
+		machine.OwnerReferences = []metav1.OwnerReference{*metav1.NewControllerRef(kcp, kcp.GroupVersionKind())}
+		if name != "m4" {
+			machine.Status.NodeRef = &corev1.ObjectReference{Kind: "Node", Name: "node-" + name}
+			nodes = append(nodes, &corev1.Node{
+				ObjectMeta: metav1.ObjectMeta{Name: "node-" + name, Labels: map[string]string{"node-role.kubernetes.io/master": "true"}},
+				Status:     corev1.NodeStatus{NodeInfo: corev1.NodeSystemInfo{KubeletVersion: version}},
+			})
+		}
+		g.Expect(r.Client.Create(ctx, machine)).To(Succeed())
+	}
+
+	r.managementCluster = &fakeManagementCluster{
+		Management: &k3s.Management{Client: r.Client},
+		Workload:   &k3s.Workload{Client: fake.NewClientBuilder().WithScheme(newTestScheme(g)).WithObjects(nodes...).Build()},
+	}
+
+	g.Expect(r.updateStatus(ctx, kcp, cluster)).To(Succeed())
+	g.Expect(kcp.Status.Replicas).To(BeEquivalentTo(4))
+	g.Expect(kcp.Status.UpdatedReplicas).To(BeEquivalentTo(3))
+	g.Expect(kcp.Status.MachineVersions).To(Equal([]controlplanev1.MachineVersionStatus{
+		{Machine: "m1", NodeName: "node-m1", Version: "v1.28.5+k3s1"},
+		{Machine: "m2", NodeName: "node-m2", Version: "v1.28.5+k3s1"},
+		{Machine: "m3", NodeName: "node-m3", Version: "v1.27.1+k3s1"},
+	}))
+}
+
+func TestUpdateStatusWaitsForEtcdMember(t *testing.T) {
+	g := NewWithT(t)
+	ctx := context.Background()
+
+	r, cluster, kcp := newTestControlPlane(g)
+	kcp.SetGroupVersionKind(controlplanev1.GroupVersion.WithKind("KThreesControlPlane"))
+
+	var nodes []client.Object
+	for _, name := range []string{"m1", "m2", "m3"} {
+		machine := newHealthyControlPlaneMachine(kcp, cluster, name)
+		machine.Spec.Version = pointer.String(kcp.Spec.Version)
+		machine.OwnerReferences = []metav1.OwnerReference{*metav1.NewControllerRef(kcp, kcp.GroupVersionKind())}
+		machine.Status.NodeRef = &corev1.ObjectReference{Kind: "Node", Name: "node-" + name}
+		conditions.MarkTrue(machine, clusterv1.ReadyCondition)
+		if name == "m3" {
+			// The new server is up, but its etcd member did not join the cluster yet.
+			conditions.MarkFalse(machine, controlplanev1.MachineEtcdMemberHealthyCondition, controlplanev1.EtcdMemberUnhealthyReason, clusterv1.ConditionSeverityError, "")
+		}
+		g.Expect(r.Client.Create(ctx, machine)).To(Succeed())
+
+		nodes = append(nodes, &corev1.Node{
+			ObjectMeta: metav1.ObjectMeta{Name: "node-" + name, Labels: map[string]string{"node-role.kubernetes.io/master": "true"}},
+			Status:     corev1.NodeStatus{Conditions: []corev1.NodeCondition{{Type: corev1.NodeReady, Status: corev1.ConditionTrue}}},
+		})
+	}
+
+	r.managementCluster = &fakeManagementCluster{
+		Management: &k3s.Management{Client: r.Client},
+		Workload:   &k3s.Workload{Client: fake.NewClientBuilder().WithScheme(newTestScheme(g)).WithObjects(nodes...).Build()},
+	}
+
+	g.Expect(r.updateStatus(ctx, kcp, cluster)).To(Succeed())
+	g.Expect(kcp.Status.UpdatedReplicas).To(BeEquivalentTo(2))
+	g.Expect(conditions.IsFalse(kcp, controlplanev1.ResizedCondition)).To(BeTrue())
+	g.Expect(conditions.GetReason(kcp, controlplanev1.ResizedCondition)).To(Equal(controlplanev1.WaitingForEtcdMemberReason))
+	g.Expect(conditions.GetMessage(kcp, controlplanev1.ResizedCondition)).To(ContainSubstring("m3"))
+
+	// The etcd member of the new server is now healthy.
+	machine := &clusterv1.Machine{}
+	g.Expect(r.Client.Get(ctx, client.ObjectKey{Name: "m3", Namespace: cluster.Namespace}, machine)).To(Succeed())
+	conditions.MarkTrue(machine, controlplanev1.MachineEtcdMemberHealthyCondition)
+	g.Expect(r.Client.Status().Update(ctx, machine)).To(Succeed())
+
+	g.Expect(r.updateStatus(ctx, kcp, cluster)).To(Succeed())
+	g.Expect(kcp.Status.UpdatedReplicas).To(BeEquivalentTo(3))
+	g.Expect(conditions.IsTrue(kcp, controlplanev1.ResizedCondition)).To(BeTrue())
+}
+
+func TestUpdateStatusWaitsForNodeReady(t *testing.T) {
+	g := NewWithT(t)
+	ctx := context.Background()
+
+	r, cluster, kcp := newTestControlPlane(g)
+	kcp.SetGroupVersionKind(controlplanev1.GroupVersion.WithKind("KThreesControlPlane"))
+
+	var nodes []client.Object
+	for _, name := range []string{"m1", "m2", "m3"} {
+		machine := newHealthyControlPlaneMachine(kcp, cluster, name)
+		machine.Spec.Version = pointer.String(kcp.Spec.Version)
+		machine.OwnerReferences = []metav1.OwnerReference{*metav1.NewControllerRef(kcp, kcp.GroupVersionKind())}
+		machine.Status.NodeRef = &corev1.ObjectReference{Kind: "Node", Name: "node-" + name}
+		conditions.MarkTrue(machine, clusterv1.ReadyCondition)
+		g.Expect(r.Client.Create(ctx, machine)).To(Succeed())
+
+		// The machine of m3 is provisioned, but its node is not Ready yet.
+		ready := corev1.ConditionTrue
+		if name == "m3" {
+			ready = corev1.ConditionFalse
+		}
+		nodes = append(nodes, &corev1.Node{
+			ObjectMeta: metav1.ObjectMeta{Name: "node-" + name, Labels: map[string]string{"node-role.kubernetes.io/master": "true"}},
+			Status:     corev1.NodeStatus{Conditions: []corev1.NodeCondition{{Type: corev1.NodeReady, Status: ready}}},
+		})
+	}
+	// A Ready control plane node left behind by a machine that is gone does not count.
+	nodes = append(nodes, &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: "node-m0", Labels: map[string]string{"node-role.kubernetes.io/master": "true"}},
+		Status:     corev1.NodeStatus{Conditions: []corev1.NodeCondition{{Type: corev1.NodeReady, Status: corev1.ConditionTrue}}},
+	})
+
+	workloadClient := fake.NewClientBuilder().WithScheme(newTestScheme(g)).WithObjects(nodes...).Build()
+	r.managementCluster = &fakeManagementCluster{
+		Management: &k3s.Management{Client: r.Client},
+		Workload:   &k3s.Workload{Client: workloadClient},
+	}
+
+	g.Expect(r.updateStatus(ctx, kcp, cluster)).To(Succeed())
+	g.Expect(kcp.Status.Replicas).To(BeEquivalentTo(3))
+	g.Expect(kcp.Status.ReadyReplicas).To(BeEquivalentTo(2))
+	g.Expect(kcp.Status.UnavailableReplicas).To(BeEquivalentTo(1))
+	g.Expect(conditions.IsFalse(kcp, controlplanev1.ResizedCondition)).To(BeTrue())
+	g.Expect(conditions.GetReason(kcp, controlplanev1.ResizedCondition)).To(Equal(controlplanev1.NodeNotReadyReason))
+	g.Expect(conditions.GetMessage(kcp, controlplanev1.ResizedCondition)).To(Equal("Waiting for the node of m3 to be Ready"))
+
+	// The node of m3 is now Ready.
+	node := &corev1.Node{}
+	g.Expect(workloadClient.Get(ctx, client.ObjectKey{Name: "node-m3"}, node)).To(Succeed())
+	node.Status.Conditions = []corev1.NodeCondition{{Type: corev1.NodeReady, Status: corev1.ConditionTrue}}
+	g.Expect(workloadClient.Update(ctx, node)).To(Succeed())
+
+	g.Expect(r.updateStatus(ctx, kcp, cluster)).To(Succeed())
+	g.Expect(kcp.Status.ReadyReplicas).To(BeEquivalentTo(3))
+	g.Expect(kcp.Status.UnavailableReplicas).To(BeEquivalentTo(0))
+	g.Expect(conditions.IsTrue(kcp, controlplanev1.ResizedCondition)).To(BeTrue())
+}
+
+func TestReconcileWaitsForControlPlaneEndpoint(t *testing.T) {
+	g := NewWithT(t)
+	ctx := context.Background()
+
+	r, cluster, kcp := newTestControlPlane(g)
+	kcp.SetGroupVersionKind(controlplanev1.GroupVersion.WithKind("KThreesControlPlane"))
+
+	// The load balancer in front of the servers is still being provisioned.
+	result, err := r.reconcile(ctx, cluster, kcp)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(result.RequeueAfter).To(Equal(controlPlaneEndpointRequeueAfter))
+	g.Expect(conditions.IsFalse(kcp, controlplanev1.AvailableCondition)).To(BeTrue())
+	g.Expect(conditions.GetReason(kcp, controlplanev1.AvailableCondition)).To(Equal(controlplanev1.WaitingForControlPlaneEndpointReason))
+
+	machines := &clusterv1.MachineList{}
+	g.Expect(r.Client.List(ctx, machines)).To(Succeed())
+	g.Expect(machines.Items).To(BeEmpty())
+}
+
+func TestReconcileDeleteOwnedSecrets(t *testing.T) {
+	g := NewWithT(t)
+	ctx := context.Background()
+
+	newSecret := func(name string, controlled bool) *corev1.Secret {
+		s := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: metav1.NamespaceDefault,
+			Labels:    map[string]string{clusterv1.ClusterNameLabel: "test"},
+		}}
+		if controlled {
+			s.OwnerReferences = []metav1.OwnerReference{{
+				APIVersion: controlplanev1.GroupVersion.String(),
+				Kind:       "KThreesControlPlane",
+				Name:       "test-kcp",
+				UID:        "kcp-uid",
+				Controller: pointer.Bool(true),
+			}}
+		}
+		return s
+	}
+
+	r, cluster, kcp := newTestControlPlane(g,
+		newSecret("test-kubeconfig", true),
+		newSecret("test-token", true),
+		newSecret("test-ca", true),
+		newSecret("join-token", false),
+		newSecret("cluster-cas", false),
+	)
+	kcp.Finalizers = []string{controlplanev1.KThreesControlPlaneFinalizer}
+	kcp.Spec.TokenRef = &corev1.LocalObjectReference{Name: "join-token"}
+	kcp.Spec.CACertificatesRef = &corev1.LocalObjectReference{Name: "cluster-cas"}
+
+	// No machines are left, the secrets are cleaned up along with the finalizer.
+	_, err := r.reconcileDelete(ctx, cluster, kcp)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(kcp.Finalizers).To(BeEmpty())
+
+	secrets := &corev1.SecretList{}
+	g.Expect(r.Client.List(ctx, secrets, client.InNamespace(cluster.Namespace))).To(Succeed())
+	var names []string
+	for _, s := range secrets.Items {
+		names = append(names, s.Name)
+	}
+	g.Expect(names).To(ConsistOf("join-token", "cluster-cas"))
+}
+
+func TestSyncMachines(t *testing.T) {
+	g := NewWithT(t)
+	ctx := context.Background()
+
+	r, cluster, kcp := newTestControlPlane(g)
+	kcp.Spec.NodeDrainTimeout = &metav1.Duration{Duration: 5 * time.Minute}
+
+	machine := newHealthyControlPlaneMachine(kcp, cluster, "m1")
+	g.Expect(r.Client.Create(ctx, machine)).To(Succeed())
+
+	// A machine already being deleted, e.g. with a drain blocked by a PodDisruptionBudget.
+	deletingMachine := newHealthyControlPlaneMachine(kcp, cluster, "m2")
+	deletingMachine.Finalizers = []string{clusterv1.MachineFinalizer}
+	g.Expect(r.Client.Create(ctx, deletingMachine)).To(Succeed())
+	g.Expect(r.Client.Delete(ctx, deletingMachine)).To(Succeed())
+	g.Expect(r.Client.Get(ctx, client.ObjectKeyFromObject(deletingMachine), deletingMachine)).To(Succeed())
+
+	controlPlane, err := k3s.NewControlPlane(ctx, r.Client, cluster, kcp, k3s.NewFilterableMachineCollection(machine, deletingMachine))
+	g.Expect(err).NotTo(HaveOccurred())
+
+	nodeDrainTimeout := func(name string) *metav1.Duration {
+		m := &clusterv1.Machine{}
+		g.Expect(r.Client.Get(ctx, client.ObjectKey{Name: name, Namespace: cluster.Namespace}, m)).To(Succeed())
+		return m.Spec.NodeDrainTimeout
+	}
+
+	g.Expect(r.syncMachines(ctx, controlPlane)).To(Succeed())
+	g.Expect(nodeDrainTimeout("m1")).To(Equal(kcp.Spec.NodeDrainTimeout))
+	g.Expect(nodeDrainTimeout("m2")).To(Equal(kcp.Spec.NodeDrainTimeout))
+
+	// Unsetting the timeout lets the nodes be drained without any time limitations again.
+	kcp.Spec.NodeDrainTimeout = nil
+	g.Expect(r.syncMachines(ctx, controlPlane)).To(Succeed())
+	g.Expect(nodeDrainTimeout("m1")).To(BeNil())
+	g.Expect(nodeDrainTimeout("m2")).To(BeNil())
+}
+
+func TestSyncMachinesMetadata(t *testing.T) {
+	g := NewWithT(t)
+	ctx := context.Background()
+
+	r, cluster, kcp := newTestControlPlane(g)
+	kcp.Spec.MachineTemplate.ObjectMeta = clusterv1.ObjectMeta{
+		Labels:      map[string]string{"env": "prod"},
+		Annotations: map[string]string{"owner": "team-a"},
+	}
+
+	controlPlane, err := k3s.NewControlPlane(ctx, r.Client, cluster, kcp, k3s.FilterableMachineCollection{})
+	g.Expect(err).NotTo(HaveOccurred())
+	_, err = r.initializeControlPlane(ctx, cluster, kcp, controlPlane)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	machines := &clusterv1.MachineList{}
+	g.Expect(r.Client.List(ctx, machines, client.InNamespace(cluster.Namespace))).To(Succeed())
+	g.Expect(machines.Items).To(HaveLen(1))
+	machine := &machines.Items[0]
+
+	infraMachine := func() *unstructured.Unstructured {
+		obj, err := external.Get(ctx, r.Client, &machine.Spec.InfrastructureRef, machine.Namespace)
+		g.Expect(err).NotTo(HaveOccurred())
+		return obj
+	}
+
+	// The metadata of the machine template is set on the machines and infrastructure machines being created.
+	g.Expect(machine.Labels).To(HaveKeyWithValue("env", "prod"))
+	g.Expect(machine.Annotations).To(HaveKeyWithValue("owner", "team-a"))
+	g.Expect(machine.Annotations).To(HaveKey(controlplanev1.KThreesServerConfigurationAnnotation))
+	g.Expect(infraMachine().GetLabels()).To(HaveKeyWithValue("env", "prod"))
+	g.Expect(infraMachine().GetAnnotations()).To(HaveKeyWithValue("owner", "team-a"))
+
+	// Changes to the machine template are applied to the existing machines in place.
+	kcp.Spec.MachineTemplate.ObjectMeta.Labels["env"] = "staging"
+	kcp.Spec.MachineTemplate.ObjectMeta.Annotations["contact"] = "oncall"
+	controlPlane, err = k3s.NewControlPlane(ctx, r.Client, cluster, kcp, k3s.NewFilterableMachineCollection(machine))
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(r.syncMachines(ctx, controlPlane)).To(Succeed())
+
+	g.Expect(r.Client.Get(ctx, client.ObjectKeyFromObject(machine), machine)).To(Succeed())
+	g.Expect(machine.Labels).To(HaveKeyWithValue("env", "staging"))
+	g.Expect(machine.Labels).To(HaveKey(clusterv1.MachineControlPlaneLabel))
+	g.Expect(machine.Annotations).To(HaveKeyWithValue("contact", "oncall"))
+	g.Expect(machine.Annotations).To(HaveKey(controlplanev1.KThreesServerConfigurationAnnotation))
+	g.Expect(infraMachine().GetLabels()).To(HaveKeyWithValue("env", "staging"))
+	g.Expect(infraMachine().GetAnnotations()).To(HaveKeyWithValue("contact", "oncall"))
+	g.Expect(infraMachine().GetAnnotations()).To(HaveKey(clusterv1.TemplateClonedFromNameAnnotation))
+
+	// Metadata-only changes do not require a rollout.
+	g.Expect(controlPlane.MachinesNeedingRollout()).To(BeEmpty())
+}
+
+func TestReconcileCertificatesExpiry(t *testing.T) {
+	newServingSecret := func(g *WithT, notAfter time.Time) *corev1.Secret {
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		g.Expect(err).NotTo(HaveOccurred())
+		template := &x509.Certificate{
+			SerialNumber: big.NewInt(1),
+			Subject:      pkix.Name{CommonName: "k3s"},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     notAfter,
+		}
+		der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+		g.Expect(err).NotTo(HaveOccurred())
+
+		return &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "k3s-serving", Namespace: metav1.NamespaceSystem},
+			Data:       map[string][]byte{corev1.TLSCertKey: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})},
+		}
+	}
+
+	setup := func(g *WithT, objs ...client.Object) (*KThreesControlPlaneReconciler, *k3s.ControlPlane) {
+		r, cluster, kcp := newTestControlPlane(g)
+		kcp.Status.Initialized = true
+
+		r.managementCluster = &fakeManagementCluster{
+			Management: &k3s.Management{Client: r.Client},
+			Workload:   &k3s.Workload{Client: fake.NewClientBuilder().WithScheme(newTestScheme(g)).WithObjects(objs...).Build()},
+		}
+
+		controlPlane, err := k3s.NewControlPlane(context.Background(), r.Client, cluster, kcp, k3s.NewFilterableMachineCollection())
+		g.Expect(err).NotTo(HaveOccurred())
+		return r, controlPlane
+	}
+
+	t.Run("certificates far from expiry", func(t *testing.T) {
+		g := NewWithT(t)
+
+		notAfter := time.Now().Add(365 * 24 * time.Hour).Truncate(time.Second)
+		r, controlPlane := setup(g, newServingSecret(g, notAfter))
+
+		r.reconcileCertificatesExpiry(context.Background(), controlPlane)
+		g.Expect(controlPlane.KCP.Status.CertificatesExpiryDate.Time).To(BeTemporally("==", notAfter))
+		g.Expect(conditions.IsFalse(controlPlane.KCP, controlplanev1.CertificatesExpiringSoonCondition)).To(BeTrue())
+		g.Expect(conditions.GetReason(controlPlane.KCP, controlplanev1.CertificatesExpiringSoonCondition)).To(Equal(controlplanev1.CertificatesValidReason))
+	})
+
+	t.Run("certificates near expiry", func(t *testing.T) {
+		g := NewWithT(t)
+
+		r, controlPlane := setup(g, newServingSecret(g, time.Now().Add(10*24*time.Hour)))
+
+		r.reconcileCertificatesExpiry(context.Background(), controlPlane)
+		g.Expect(controlPlane.KCP.Status.CertificatesExpiryDate).NotTo(BeNil())
+		g.Expect(conditions.IsTrue(controlPlane.KCP, controlplanev1.CertificatesExpiringSoonCondition)).To(BeTrue())
+	})
+
+	t.Run("certificates within a custom threshold", func(t *testing.T) {
+		g := NewWithT(t)
+
+		r, controlPlane := setup(g, newServingSecret(g, time.Now().Add(60*24*time.Hour)))
+		controlPlane.KCP.Spec.CertificatesExpiryThreshold = &metav1.Duration{Duration: 90 * 24 * time.Hour}
+
+		r.reconcileCertificatesExpiry(context.Background(), controlPlane)
+		g.Expect(conditions.IsTrue(controlPlane.KCP, controlplanev1.CertificatesExpiringSoonCondition)).To(BeTrue())
+	})
+
+	t.Run("missing serving certificate", func(t *testing.T) {
+		g := NewWithT(t)
+
+		r, controlPlane := setup(g)
+
+		r.reconcileCertificatesExpiry(context.Background(), controlPlane)
+		g.Expect(controlPlane.KCP.Status.CertificatesExpiryDate).To(BeNil())
+		g.Expect(conditions.IsUnknown(controlPlane.KCP, controlplanev1.CertificatesExpiringSoonCondition)).To(BeTrue())
+		g.Expect(conditions.GetReason(controlPlane.KCP, controlplanev1.CertificatesExpiringSoonCondition)).To(Equal(controlplanev1.CertificatesInspectionFailedReason))
+	})
+}
+
+func TestReconcileSecretsEncryption(t *testing.T) {
+	newServerNode := func(name, hash string) *corev1.Node {
+		node := &corev1.Node{ObjectMeta: metav1.ObjectMeta{
+			Name:   name,
+			Labels: map[string]string{"node-role.kubernetes.io/master": "true"},
+		}}
+		if hash != "" {
+			node.Annotations = map[string]string{"encryption.k3s.cattle.io/hash": hash}
+		}
+		return node
+	}
+
+	tests := []struct {
+		name          string
+		enabled       bool
+		nodes         []client.Object
+		expectStatus  corev1.ConditionStatus
+		expectReason  string
+		expectMessage string
+	}{
+		{
+			name:         "encryption enabled on every server",
+			enabled:      true,
+			nodes:        []client.Object{newServerNode("n1", "start-abc"), newServerNode("n2", "start-abc")},
+			expectStatus: corev1.ConditionTrue,
+		},
+		{
+			name:         "key rotation finished",
+			enabled:      true,
+			nodes:        []client.Object{newServerNode("n1", "reencrypt_finished-def"), newServerNode("n2", "reencrypt_finished-def")},
+			expectStatus: corev1.ConditionTrue,
+		},
+		{
+			name:          "key rotation in progress",
+			enabled:       true,
+			nodes:         []client.Object{newServerNode("n2", "prepare-def"), newServerNode("n1", "start-abc")},
+			expectStatus:  corev1.ConditionFalse,
+			expectReason:  controlplanev1.SecretsEncryptionInProgressReason,
+			expectMessage: "Secrets encryption stages: n1=start, n2=prepare",
+		},
+		{
+			name:          "server not reporting a stage yet",
+			enabled:       true,
+			nodes:         []client.Object{newServerNode("n1", "start-abc"), newServerNode("n2", "")},
+			expectStatus:  corev1.ConditionFalse,
+			expectReason:  controlplanev1.SecretsEncryptionInProgressReason,
+			expectMessage: "Secrets encryption stages: n1=start, n2=unknown",
+		},
+		{
+			name:  "encryption disabled",
+			nodes: []client.Object{newServerNode("n1", "start-abc")},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			r, cluster, kcp := newTestControlPlane(g)
+			kcp.Status.Initialized = true
+			kcp.Spec.KThreesConfigSpec.ServerConfig.SecretsEncryption = pointer.Bool(tt.enabled)
+
+			r.managementCluster = &fakeManagementCluster{
+				Management: &k3s.Management{Client: r.Client},
+				Workload:   &k3s.Workload{Client: fake.NewClientBuilder().WithScheme(newTestScheme(g)).WithObjects(tt.nodes...).Build()},
+			}
+
+			controlPlane, err := k3s.NewControlPlane(context.Background(), r.Client, cluster, kcp, k3s.NewFilterableMachineCollection())
+			g.Expect(err).NotTo(HaveOccurred())
+
+			r.reconcileSecretsEncryption(context.Background(), controlPlane)
+
+			if !tt.enabled {
+				g.Expect(conditions.Has(kcp, controlplanev1.SecretsEncryptionCondition)).To(BeFalse())
+				return
+			}
+			condition := conditions.Get(kcp, controlplanev1.SecretsEncryptionCondition)
+			g.Expect(condition).NotTo(BeNil())
+			g.Expect(condition.Status).To(Equal(tt.expectStatus))
+			g.Expect(condition.Reason).To(Equal(tt.expectReason))
+			g.Expect(condition.Message).To(Equal(tt.expectMessage))
+		})
+	}
+}
+
+func TestReconcileCertificatesRotation(t *testing.T) {
+	setup := func(g *WithT, rotation string, machinesCreated time.Time) (*KThreesControlPlaneReconciler, *k3s.ControlPlane) {
+		ctx := context.Background()
+		r, cluster, kcp := newTestControlPlane(g)
+		kcp.Annotations = map[string]string{controlplanev1.RotateCertificatesAnnotation: rotation}
+
+		machines := k3s.NewFilterableMachineCollection()
+		for _, name := range []string{"m1", "m2", "m3"} {
+			machine := newHealthyControlPlaneMachine(kcp, cluster, name)
+			machine.Spec.Version = &kcp.Spec.Version
+			g.Expect(r.Client.Create(ctx, machine)).To(Succeed())
+			machine.CreationTimestamp = metav1.NewTime(machinesCreated)
+			machines.Insert(machine)
+		}
+
+		controlPlane, err := k3s.NewControlPlane(ctx, r.Client, cluster, kcp, machines)
+		g.Expect(err).NotTo(HaveOccurred())
+		return r, controlPlane
+	}
+
+	t.Run("new request is stamped with the current time", func(t *testing.T) {
+		g := NewWithT(t)
+
+		r, controlPlane := setup(g, "", time.Now().Add(-time.Hour))
+
+		result := r.reconcileCertificatesRotation(controlPlane)
+		g.Expect(result.Requeue).To(BeTrue())
+		g.Expect(controlPlane.KCP.CertificatesRotationTime()).NotTo(BeNil())
+	})
+
+	t.Run("machines created before the request are rolled out", func(t *testing.T) {
+		g := NewWithT(t)
+
+		rotation := time.Now().Add(-time.Minute).UTC().Format(time.RFC3339)
+		r, controlPlane := setup(g, rotation, time.Now().Add(-time.Hour))
+
+		g.Expect(r.reconcileCertificatesRotation(controlPlane)).To(BeZero())
+		g.Expect(controlPlane.KCP.Annotations).To(HaveKeyWithValue(controlplanev1.RotateCertificatesAnnotation, rotation))
+		g.Expect(controlPlane.MachinesNeedingRollout().Names()).To(ConsistOf("m1", "m2", "m3"))
+	})
+
+	t.Run("annotation is removed once every machine has been replaced", func(t *testing.T) {
+		g := NewWithT(t)
+
+		rotation := time.Now().Add(-time.Hour).UTC().Format(time.RFC3339)
+		r, controlPlane := setup(g, rotation, time.Now().Add(-time.Minute))
+
+		g.Expect(controlPlane.MachinesNeedingRollout()).To(BeEmpty())
+		g.Expect(r.reconcileCertificatesRotation(controlPlane)).To(BeZero())
+		g.Expect(controlPlane.KCP.Annotations).NotTo(HaveKey(controlplanev1.RotateCertificatesAnnotation))
+	})
+}
+
+func TestReconcileCertificatesSupplied(t *testing.T) {
+	newKeyPair := func(g *WithT, isCA bool) ([]byte, []byte) {
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		g.Expect(err).NotTo(HaveOccurred())
+		template := &x509.Certificate{
+			SerialNumber:          big.NewInt(1),
+			Subject:               pkix.Name{CommonName: "enterprise-ca"},
+			NotBefore:             time.Now().Add(-time.Hour),
+			NotAfter:              time.Now().Add(time.Hour),
+			KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+			BasicConstraintsValid: true,
+			IsCA:                  isCA,
+		}
+		der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+		g.Expect(err).NotTo(HaveOccurred())
+		return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+			pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	}
+
+	newSupplied := func(g *WithT) *corev1.Secret {
+		data := map[string][]byte{}
+		for _, name := range []string{"server-ca", "client-ca", "etcd-server-ca"} {
+			data[name+".crt"], data[name+".key"] = newKeyPair(g, true)
+		}
+		return &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "cluster-cas", Namespace: metav1.NamespaceDefault},
+			Data:       data,
+		}
+	}
+
+	t.Run("supplied CAs are rendered for the servers", func(t *testing.T) {
+		g := NewWithT(t)
+		ctx := context.Background()
+
+		supplied := newSupplied(g)
+		r, cluster, kcp := newTestControlPlane(g, supplied)
+		kcp.Spec.CACertificatesRef = &corev1.LocalObjectReference{Name: "cluster-cas"}
+
+		g.Expect(r.reconcileCertificates(ctx, cluster, kcp)).To(Succeed())
+		g.Expect(conditions.IsTrue(kcp, controlplanev1.CertificatesAvailableCondition)).To(BeTrue())
+
+		s := &corev1.Secret{}
+		g.Expect(r.Client.Get(ctx, client.ObjectKey{Namespace: cluster.Namespace, Name: "test-ca"}, s)).To(Succeed())
+		g.Expect(metav1.IsControlledBy(s, kcp)).To(BeTrue())
+
+		// The bootstrap provider reads the cluster CA secrets and writes them to the initial server.
+		certificates := secret.NewCertificatesForInitialControlPlane(&kcp.Spec.KThreesConfigSpec)
+		g.Expect(certificates.Lookup(ctx, r.Client, util.ObjectKey(cluster))).To(Succeed())
+		files := map[string]string{}
+		for _, f := range certificates.AsFiles() {
+			files[f.Path] = f.Content
+		}
+		g.Expect(files).To(Equal(map[string]string{
+			"/var/lib/rancher/k3s/server/tls/server-ca.crt":      string(supplied.Data["server-ca.crt"]),
+			"/var/lib/rancher/k3s/server/tls/server-ca.key":      string(supplied.Data["server-ca.key"]),
+			"/var/lib/rancher/k3s/server/tls/client-ca.crt":      string(supplied.Data["client-ca.crt"]),
+			"/var/lib/rancher/k3s/server/tls/client-ca.key":      string(supplied.Data["client-ca.key"]),
+			"/var/lib/rancher/k3s/server/tls/etcd/server-ca.crt": string(supplied.Data["etcd-server-ca.crt"]),
+			"/var/lib/rancher/k3s/server/tls/etcd/server-ca.key": string(supplied.Data["etcd-server-ca.key"]),
+		}))
+
+		// Reconciling again is a no-op.
+		g.Expect(r.reconcileCertificates(ctx, cluster, kcp)).To(Succeed())
+	})
+
+	t.Run("etcd CA is not needed with an external datastore", func(t *testing.T) {
+		g := NewWithT(t)
+		ctx := context.Background()
+
+		supplied := newSupplied(g)
+		delete(supplied.Data, "etcd-server-ca.crt")
+		delete(supplied.Data, "etcd-server-ca.key")
+		r, cluster, kcp := newTestControlPlane(g, supplied)
+		kcp.Spec.CACertificatesRef = &corev1.LocalObjectReference{Name: "cluster-cas"}
+		kcp.Spec.KThreesConfigSpec.ServerConfig.Datastore = &bootstrapv1.DatastoreConfig{Type: bootstrapv1.DatastoreTypeExternal}
+
+		g.Expect(r.reconcileCertificates(ctx, cluster, kcp)).To(Succeed())
+	})
+
+	invalid := []struct {
+		name   string
+		mutate func(g *WithT, s *corev1.Secret)
+	}{
+		{
+			name:   "missing CA",
+			mutate: func(_ *WithT, s *corev1.Secret) { delete(s.Data, "etcd-server-ca.crt") },
+		},
+		{
+			name:   "missing key",
+			mutate: func(_ *WithT, s *corev1.Secret) { delete(s.Data, "client-ca.key") },
+		},
+		{
+			name:   "invalid PEM",
+			mutate: func(_ *WithT, s *corev1.Secret) { s.Data["server-ca.crt"] = []byte("not a certificate") },
+		},
+		{
+			name:   "key of another CA",
+			mutate: func(_ *WithT, s *corev1.Secret) { s.Data["server-ca.key"] = s.Data["client-ca.key"] },
+		},
+		{
+			name: "not a CA",
+			mutate: func(g *WithT, s *corev1.Secret) {
+				s.Data["server-ca.crt"], s.Data["server-ca.key"] = newKeyPair(g, false)
+			},
+		},
+	}
+	for _, tt := range invalid {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			supplied := newSupplied(g)
+			tt.mutate(g, supplied)
+			r, cluster, kcp := newTestControlPlane(g, supplied)
+			kcp.Spec.CACertificatesRef = &corev1.LocalObjectReference{Name: "cluster-cas"}
+
+			g.Expect(r.reconcileCertificates(context.Background(), cluster, kcp)).NotTo(Succeed())
+			g.Expect(conditions.GetReason(kcp, controlplanev1.CertificatesAvailableCondition)).To(Equal(controlplanev1.CACertificatesUnavailableReason))
+		})
+	}
+
+	t.Run("cluster already uses a different CA", func(t *testing.T) {
+		g := NewWithT(t)
+
+		cert, key := newKeyPair(g, true)
+		existing := &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "test-ca", Namespace: metav1.NamespaceDefault},
+			Data:       map[string][]byte{secret.TLSCrtDataName: cert, secret.TLSKeyDataName: key},
+		}
+		r, cluster, kcp := newTestControlPlane(g, newSupplied(g), existing)
+		kcp.Spec.CACertificatesRef = &corev1.LocalObjectReference{Name: "cluster-cas"}
+
+		g.Expect(r.reconcileCertificates(context.Background(), cluster, kcp)).NotTo(Succeed())
+		g.Expect(conditions.GetReason(kcp, controlplanev1.CertificatesAvailableCondition)).To(Equal(controlplanev1.CACertificatesUnavailableReason))
+	})
+}
+
+func TestReconcileToken(t *testing.T) {
+	supplied := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "join-token", Namespace: metav1.NamespaceDefault},
+		Data:       map[string][]byte{"value": []byte("supplied-token")},
+	}
+
+	t.Run("supplied token is stored for joining nodes", func(t *testing.T) {
+		g := NewWithT(t)
+		ctx := context.Background()
+
+		r, cluster, kcp := newTestControlPlane(g, supplied.DeepCopy())
+		kcp.Spec.TokenRef = &corev1.LocalObjectReference{Name: "join-token"}
+
+		g.Expect(r.reconcileToken(ctx, cluster, kcp)).To(Succeed())
+
+		s := &corev1.Secret{}
+		g.Expect(r.Client.Get(ctx, client.ObjectKey{Namespace: cluster.Namespace, Name: "test-token"}, s)).To(Succeed())
+		g.Expect(string(s.Data["value"])).To(Equal("supplied-token"))
+		g.Expect(metav1.IsControlledBy(s, kcp)).To(BeTrue())
+
+		// Reconciling again is a no-op.
+		g.Expect(r.reconcileToken(ctx, cluster, kcp)).To(Succeed())
+	})
+
+	t.Run("missing secret", func(t *testing.T) {
+		g := NewWithT(t)
+
+		r, cluster, kcp := newTestControlPlane(g)
+		kcp.Spec.TokenRef = &corev1.LocalObjectReference{Name: "join-token"}
+
+		g.Expect(r.reconcileToken(context.Background(), cluster, kcp)).NotTo(Succeed())
+		g.Expect(conditions.GetReason(kcp, controlplanev1.TokenAvailableCondition)).To(Equal(controlplanev1.TokenSecretUnavailableReason))
+	})
+
+	t.Run("secret without the value key", func(t *testing.T) {
+		g := NewWithT(t)
+
+		invalid := supplied.DeepCopy()
+		invalid.Data = map[string][]byte{"token": []byte("supplied-token")}
+		r, cluster, kcp := newTestControlPlane(g, invalid)
+		kcp.Spec.TokenRef = &corev1.LocalObjectReference{Name: "join-token"}
+
+		g.Expect(r.reconcileToken(context.Background(), cluster, kcp)).NotTo(Succeed())
+		g.Expect(conditions.GetReason(kcp, controlplanev1.TokenAvailableCondition)).To(Equal(controlplanev1.TokenSecretUnavailableReason))
+	})
+
+	t.Run("cluster already uses a different token", func(t *testing.T) {
+		g := NewWithT(t)
+
+		existing := &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "test-token", Namespace: metav1.NamespaceDefault},
+			Data:       map[string][]byte{"value": []byte("generated-token")},
+		}
+		r, cluster, kcp := newTestControlPlane(g, supplied.DeepCopy(), existing)
+		kcp.Spec.TokenRef = &corev1.LocalObjectReference{Name: "join-token"}
+
+		g.Expect(r.reconcileToken(context.Background(), cluster, kcp)).NotTo(Succeed())
+		g.Expect(conditions.GetReason(kcp, controlplanev1.TokenAvailableCondition)).To(Equal(controlplanev1.TokenSecretUnavailableReason))
+	})
+}
+
+func TestReconcileTokenRotation(t *testing.T) {
+	rotation := time.Now().Add(-10 * time.Minute)
+
+	setup := func(g *WithT, tokenData map[string][]byte, machinesCreated ...time.Time) (*KThreesControlPlaneReconciler, *k3s.ControlPlane) {
+		ctx := context.Background()
+		tokenSecret := &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "test-token", Namespace: metav1.NamespaceDefault},
+			Data:       tokenData,
+		}
+		r, cluster, kcp := newTestControlPlane(g, tokenSecret)
+		kcp.Annotations = map[string]string{controlplanev1.RotateTokenAnnotation: rotation.UTC().Format(time.RFC3339)}
+
+		machines := k3s.NewFilterableMachineCollection()
+		for i, created := range machinesCreated {
+			machine := newHealthyControlPlaneMachine(kcp, cluster, fmt.Sprintf("m%d", i))
+			machine.Spec.Version = &kcp.Spec.Version
+			g.Expect(r.Client.Create(ctx, machine)).To(Succeed())
+			machine.CreationTimestamp = metav1.NewTime(created)
+			machine.Status.NodeRef = &corev1.ObjectReference{Kind: "Node", Name: machine.Name}
+			machines.Insert(machine)
+		}
+
+		controlPlane, err := k3s.NewControlPlane(ctx, r.Client, cluster, kcp, machines)
+		g.Expect(err).NotTo(HaveOccurred())
+		return r, controlPlane
+	}
+
+	tokenSecret := func(g *WithT, r *KThreesControlPlaneReconciler) *corev1.Secret {
+		s := &corev1.Secret{}
+		g.Expect(r.Client.Get(context.Background(), client.ObjectKey{Namespace: metav1.NamespaceDefault, Name: "test-token"}, s)).To(Succeed())
+		return s
+	}
+
+	old := time.Now().Add(-time.Hour)
+	recent := time.Now()
+
+	t.Run("new request is stamped with the current time", func(t *testing.T) {
+		g := NewWithT(t)
+
+		r, controlPlane := setup(g, map[string][]byte{"value": []byte("old")}, old)
+		controlPlane.KCP.Annotations[controlplanev1.RotateTokenAnnotation] = ""
+
+		result, err := r.reconcileTokenRotation(context.Background(), controlPlane)
+		g.Expect(err).NotTo(HaveOccurred())
+		g.Expect(result.Requeue).To(BeTrue())
+		g.Expect(controlPlane.KCP.TokenRotationTime()).NotTo(BeNil())
+		g.Expect(tokenSecret(g, r).Data).NotTo(HaveKey("next"))
+	})
+
+	t.Run("new token is staged while nodes keep joining with the current one", func(t *testing.T) {
+		g := NewWithT(t)
+
+		r, controlPlane := setup(g, map[string][]byte{"value": []byte("old")}, old, old, old)
+
+		result, err := r.reconcileTokenRotation(context.Background(), controlPlane)
+		g.Expect(err).NotTo(HaveOccurred())
+		g.Expect(result.Requeue).To(BeTrue())
+
+		s := tokenSecret(g, r)
+		g.Expect(string(s.Data["value"])).To(Equal("old"))
+		g.Expect(s.Data).To(HaveKey("next"))
+		g.Expect(controlPlane.MachinesNeedingRollout()).To(HaveLen(3))
+	})
+
+	t.Run("the rotation is refused when the cluster has machine pools", func(t *testing.T) {
+		g := NewWithT(t)
+
+		r, controlPlane := setup(g, map[string][]byte{"value": []byte("old")}, old, old, old)
+		mp := &expv1.MachinePool{ObjectMeta: metav1.ObjectMeta{
+			Name:      "mp",
+			Namespace: metav1.NamespaceDefault,
+			Labels:    map[string]string{clusterv1.ClusterNameLabel: controlPlane.Cluster.Name},
+		}}
+		g.Expect(r.Client.Create(context.Background(), mp)).To(Succeed())
+
+		result, err := r.reconcileTokenRotation(context.Background(), controlPlane)
+		g.Expect(err).NotTo(HaveOccurred())
+		g.Expect(result.IsZero()).To(BeTrue())
+		g.Expect(controlPlane.KCP.Annotations).NotTo(HaveKey(controlplanev1.RotateTokenAnnotation))
+		g.Expect(tokenSecret(g, r).Data).NotTo(HaveKey("next"))
+		g.Expect(controlPlane.MachinesNeedingRollout()).To(BeEmpty())
+	})
+
+	t.Run("the token is not rotated while machines are joining with the current one", func(t *testing.T) {
+		g := NewWithT(t)
+
+		r, controlPlane := setup(g, map[string][]byte{"value": []byte("old"), "next": []byte("new")}, old, old, old)
+		joining := newWorkerMachine(controlPlane.Cluster, "joining", "md", recent)
+		joining.Spec.Bootstrap.DataSecretName = pointer.String("joining-bootstrap")
+		g.Expect(r.Client.Create(context.Background(), joining)).To(Succeed())
+
+		result, err := r.reconcileTokenRotation(context.Background(), controlPlane)
+		g.Expect(err).NotTo(HaveOccurred())
+		g.Expect(result.RequeueAfter).To(BeNumerically(">", 0))
+
+		// Workers waiting for the rotation to get their bootstrap data don't hold it.
+		joining.Spec.Bootstrap.DataSecretName = nil
+		g.Expect(r.Client.Update(context.Background(), joining)).To(Succeed())
+
+		result, err = r.reconcileTokenRotation(context.Background(), controlPlane)
+		g.Expect(err).NotTo(HaveOccurred())
+		g.Expect(result).To(BeZero())
+		g.Expect(string(tokenSecret(g, r).Data["value"])).To(Equal("old"))
+	})
+
+	t.Run("joining nodes switch to the new token once the first new server is up", func(t *testing.T) {
+		g := NewWithT(t)
+
+		r, controlPlane := setup(g, map[string][]byte{"value": []byte("old"), "next": []byte("new")}, old, old, old, recent)
+
+		result, err := r.reconcileTokenRotation(context.Background(), controlPlane)
+		g.Expect(err).NotTo(HaveOccurred())
+		g.Expect(result.Requeue).To(BeTrue())
+
+		s := tokenSecret(g, r)
+		g.Expect(string(s.Data["value"])).To(Equal("new"))
+		g.Expect(s.Data).NotTo(HaveKey("next"))
+		g.Expect(controlPlane.KCP.Annotations).To(HaveKey(controlplanev1.RotateTokenAnnotation))
+	})
+
+	t.Run("the current token is kept until the new server has a node", func(t *testing.T) {
+		g := NewWithT(t)
+
+		r, controlPlane := setup(g, map[string][]byte{"value": []byte("old"), "next": []byte("new")}, old, old, old, recent)
+		for _, machine := range controlPlane.Machines {
+			if !machine.CreationTimestamp.Before(&metav1.Time{Time: rotation}) {
+				machine.Status.NodeRef = nil
+			}
+		}
+
+		_, err := r.reconcileTokenRotation(context.Background(), controlPlane)
+		g.Expect(err).NotTo(HaveOccurred())
+		g.Expect(string(tokenSecret(g, r).Data["value"])).To(Equal("old"))
+	})
+
+	t.Run("workers are rolled out once joining nodes use the new token", func(t *testing.T) {
+		g := NewWithT(t)
+		ctx := context.Background()
+
+		r, controlPlane := setup(g, map[string][]byte{"value": []byte("new")}, recent, recent, recent)
+		md := &clusterv1.MachineDeployment{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "md",
+				Namespace: metav1.NamespaceDefault,
+				Labels:    map[string]string{clusterv1.ClusterNameLabel: controlPlane.Cluster.Name},
+			},
+			Spec: clusterv1.MachineDeploymentSpec{ClusterName: controlPlane.Cluster.Name},
+		}
+		g.Expect(r.Client.Create(ctx, md)).To(Succeed())
+		worker := newWorkerMachine(controlPlane.Cluster, "worker", md.Name, old)
+		g.Expect(r.Client.Create(ctx, worker)).To(Succeed())
+
+		result, err := r.reconcileTokenRotation(ctx, controlPlane)
+		g.Expect(err).NotTo(HaveOccurred())
+		g.Expect(result).To(BeZero())
+		g.Expect(controlPlane.KCP.Annotations).To(HaveKey(controlplanev1.RotateTokenAnnotation))
+
+		g.Expect(r.Client.Get(ctx, client.ObjectKeyFromObject(md), md)).To(Succeed())
+		g.Expect(md.Spec.RolloutAfter).NotTo(BeNil())
+		g.Expect(md.Spec.RolloutAfter.Time).To(BeTemporally(">", rotation))
+		rolloutAfter := md.Spec.RolloutAfter.DeepCopy()
+
+		// The MachineDeployment replaced the worker.
+		g.Expect(r.Client.Delete(ctx, worker)).To(Succeed())
+		g.Expect(r.Client.Create(ctx, newWorkerMachine(controlPlane.Cluster, "replacement", md.Name, time.Now().Add(time.Minute)))).To(Succeed())
+
+		_, err = r.reconcileTokenRotation(ctx, controlPlane)
+		g.Expect(err).NotTo(HaveOccurred())
+		g.Expect(controlPlane.KCP.Annotations).NotTo(HaveKey(controlplanev1.RotateTokenAnnotation))
+		g.Expect(r.Client.Get(ctx, client.ObjectKeyFromObject(md), md)).To(Succeed())
+		g.Expect(md.Spec.RolloutAfter.Equal(rolloutAfter)).To(BeTrue())
+	})
+
+	t.Run("annotation is removed once every machine has been replaced", func(t *testing.T) {
+		g := NewWithT(t)
+
+		r, controlPlane := setup(g, map[string][]byte{"value": []byte("new")}, recent, recent, recent)
+
+		result, err := r.reconcileTokenRotation(context.Background(), controlPlane)
+		g.Expect(err).NotTo(HaveOccurred())
+		g.Expect(result).To(BeZero())
+		g.Expect(controlPlane.KCP.Annotations).NotTo(HaveKey(controlplanev1.RotateTokenAnnotation))
+	})
+}
+
+// newWorkerMachine returns a worker machine of the given MachineDeployment, with a node.
+func newWorkerMachine(cluster *clusterv1.Cluster, name, machineDeployment string, created time.Time) *clusterv1.Machine {
+	return &clusterv1.Machine{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:              name,
+			Namespace:         cluster.Namespace,
+			CreationTimestamp: metav1.NewTime(created),
+			Labels: map[string]string{
+				clusterv1.ClusterNameLabel:           cluster.Name,
+				clusterv1.MachineDeploymentNameLabel: machineDeployment,
+			},
+		},
+		Spec: clusterv1.MachineSpec{ClusterName: cluster.Name},
+	}
+}
+
+func TestMachinesNeedingRolloutDisableComponents(t *testing.T) {
+	tests := []struct {
+		name            string
+		machineDisabled []bootstrapv1.DisabledComponent
+		kcpDisabled     []bootstrapv1.DisabledComponent
+		expectRollout   bool
+	}{
+		{
+			name:            "unchanged disable list",
+			machineDisabled: []bootstrapv1.DisabledComponent{bootstrapv1.DisabledComponentTraefik},
+			kcpDisabled:     []bootstrapv1.DisabledComponent{bootstrapv1.DisabledComponentTraefik},
+		},
+		{
+			name:            "reordered disable list",
+			machineDisabled: []bootstrapv1.DisabledComponent{bootstrapv1.DisabledComponentTraefik, bootstrapv1.DisabledComponentServiceLB},
+			kcpDisabled:     []bootstrapv1.DisabledComponent{bootstrapv1.DisabledComponentServiceLB, bootstrapv1.DisabledComponentTraefik},
+		},
+		{
+			name:            "component added to the disable list",
+			machineDisabled: []bootstrapv1.DisabledComponent{bootstrapv1.DisabledComponentTraefik},
+			kcpDisabled:     []bootstrapv1.DisabledComponent{bootstrapv1.DisabledComponentTraefik, bootstrapv1.DisabledComponentServiceLB},
+			expectRollout:   true,
+		},
+		{
+			name:            "component removed from the disable list",
+			machineDisabled: []bootstrapv1.DisabledComponent{bootstrapv1.DisabledComponentServiceLB},
+			expectRollout:   true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+			ctx := context.Background()
+
+			r, cluster, kcp := newTestControlPlane(g)
+			kcp.Spec.KThreesConfigSpec.ServerConfig.DisableComponents = tt.kcpDisabled
+
+			config := &bootstrapv1.KThreesConfig{
+				ObjectMeta: metav1.ObjectMeta{Name: "m1", Namespace: cluster.Namespace},
+				Spec: bootstrapv1.KThreesConfigSpec{
+					ServerConfig: bootstrapv1.KThreesServerConfig{DisableComponents: tt.machineDisabled},
+				},
+			}
+			g.Expect(r.Client.Create(ctx, config)).To(Succeed())
+
+			machine := newHealthyControlPlaneMachine(kcp, cluster, "m1")
+			machine.Spec.Version = pointer.String(kcp.Spec.Version)
+			machine.Spec.Bootstrap.ConfigRef = &corev1.ObjectReference{
+				Kind:       "KThreesConfig",
+				APIVersion: bootstrapv1.GroupVersion.String(),
+				Name:       config.Name,
+			}
+			g.Expect(r.Client.Create(ctx, machine)).To(Succeed())
+
+			controlPlane, err := k3s.NewControlPlane(ctx, r.Client, cluster, kcp, k3s.NewFilterableMachineCollection(machine))
+			g.Expect(err).NotTo(HaveOccurred())
+
+			if tt.expectRollout {
+				g.Expect(controlPlane.MachinesNeedingRollout().Names()).To(ConsistOf("m1"))
+			} else {
+				g.Expect(controlPlane.MachinesNeedingRollout()).To(BeEmpty())
+			}
+		})
+	}
+}
+
+func TestMachinesNeedingRolloutSecretsEncryption(t *testing.T) {
+	tests := []struct {
+		name           string
+		machineEnabled *bool
+		kcpEnabled     *bool
+		expectRollout  bool
+	}{
+		{
+			name: "encryption left unset",
+		},
+		{
+			name:           "encryption unchanged",
+			machineEnabled: pointer.Bool(true),
+			kcpEnabled:     pointer.Bool(true),
+		},
+		{
+			name:          "encryption enabled after creation",
+			kcpEnabled:    pointer.Bool(true),
+			expectRollout: true,
+		},
+		{
+			name:           "encryption disabled after creation",
+			machineEnabled: pointer.Bool(true),
+			kcpEnabled:     pointer.Bool(false),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+			ctx := context.Background()
+
+			r, cluster, kcp := newTestControlPlane(g)
+			kcp.Spec.KThreesConfigSpec.ServerConfig.SecretsEncryption = tt.kcpEnabled
+
+			config := &bootstrapv1.KThreesConfig{
+				ObjectMeta: metav1.ObjectMeta{Name: "m1", Namespace: cluster.Namespace},
+				Spec: bootstrapv1.KThreesConfigSpec{
+					ServerConfig: bootstrapv1.KThreesServerConfig{SecretsEncryption: tt.machineEnabled},
+				},
+			}
+			g.Expect(r.Client.Create(ctx, config)).To(Succeed())
+
+			machine := newHealthyControlPlaneMachine(kcp, cluster, "m1")
+			machine.Spec.Version = pointer.String(kcp.Spec.Version)
+			machine.Spec.Bootstrap.ConfigRef = &corev1.ObjectReference{
+				Kind:       "KThreesConfig",
+				APIVersion: bootstrapv1.GroupVersion.String(),
+				Name:       config.Name,
+			}
+			g.Expect(r.Client.Create(ctx, machine)).To(Succeed())
+
+			controlPlane, err := k3s.NewControlPlane(ctx, r.Client, cluster, kcp, k3s.NewFilterableMachineCollection(machine))
+			g.Expect(err).NotTo(HaveOccurred())
+
+			if tt.expectRollout {
+				g.Expect(controlPlane.MachinesNeedingRollout().Names()).To(ConsistOf("m1"))
+			} else {
+				g.Expect(controlPlane.MachinesNeedingRollout()).To(BeEmpty())
+			}
+		})
+	}
+}
+
+func TestReconcilePreUpgradeSnapshot(t *testing.T) {
+	// rolloutStep runs the snapshot gate and the rollout the way reconcile does, and returns the number of machines.
+	rolloutStep := func(g *WithT, r *KThreesControlPlaneReconciler, cluster *clusterv1.Cluster, kcp *controlplanev1.KThreesControlPlane) (ctrl.Result, int, error) {
+		ctx := context.Background()
+
+		machineList := &clusterv1.MachineList{}
+		g.Expect(r.Client.List(ctx, machineList, client.InNamespace(cluster.Namespace))).To(Succeed())
+		machines := k3s.FilterableMachineCollection{}
+		for i := range machineList.Items {
+			machines.Insert(&machineList.Items[i])
+		}
+
+		controlPlane, err := k3s.NewControlPlane(ctx, r.Client, cluster, kcp, machines)
+		g.Expect(err).NotTo(HaveOccurred())
+
+		result, err := r.reconcilePreUpgradeSnapshot(ctx, controlPlane)
+		if err == nil && result.IsZero() {
+			result, err = r.upgradeControlPlane(ctx, cluster, kcp, controlPlane, controlPlane.MachinesNeedingRollout())
+		}
+
+		g.Expect(r.Client.List(ctx, machineList, client.InNamespace(cluster.Namespace))).To(Succeed())
+		return result, len(machineList.Items), err
+	}
+
+	newUpgradingControlPlane := func(g *WithT) (*KThreesControlPlaneReconciler, *clusterv1.Cluster, *controlplanev1.KThreesControlPlane, client.Client) {
+		r, cluster, kcp := newTestControlPlane(g)
+		kcp.Status.Initialized = true
+		kcp.Spec.SnapshotBeforeUpgrade = true
+
+		// The machines run v1.27.1+k3s1, the KCP is upgraded to v1.28.5+k3s1.
+		for _, name := range []string{"m1", "m2", "m3"} {
+			g.Expect(r.Client.Create(context.Background(), newHealthyControlPlaneMachine(kcp, cluster, name))).To(Succeed())
+		}
+
+		workloadClient := fake.NewClientBuilder().WithScheme(newTestScheme(g)).Build()
+		r.managementCluster = &fakeManagementCluster{
+			Management: &k3s.Management{Client: r.Client},
+			Workload:   &k3s.Workload{Client: workloadClient},
+		}
+		return r, cluster, kcp, workloadClient
+	}
+
+	snapshotJobKey := client.ObjectKey{Namespace: metav1.NamespaceSystem, Name: "pre-upgrade-v1-28-5-k3s1"}
+
+	t.Run("no machine is replaced before the snapshot is saved", func(t *testing.T) {
+		g := NewWithT(t)
+		ctx := context.Background()
+
+		r, cluster, kcp, workloadClient := newUpgradingControlPlane(g)
+
+		result, machines, err := rolloutStep(g, r, cluster, kcp)
+		g.Expect(err).NotTo(HaveOccurred())
+		g.Expect(result.RequeueAfter).To(Equal(preUpgradeSnapshotRequeueAfter))
+		g.Expect(machines).To(Equal(3))
+
+		job := &batchv1.Job{}
+		g.Expect(workloadClient.Get(ctx, snapshotJobKey, job)).To(Succeed())
+		g.Expect(job.Spec.Template.Spec.Containers[0].Command).To(ContainElements("etcd-snapshot", "save", "pre-upgrade-v1-28-5-k3s1"))
+
+		condition := conditions.Get(kcp, controlplanev1.PreUpgradeSnapshotCondition)
+		g.Expect(condition).NotTo(BeNil())
+		g.Expect(condition.Status).To(Equal(corev1.ConditionFalse))
+		g.Expect(condition.Reason).To(Equal(controlplanev1.WaitingForPreUpgradeSnapshotReason))
+
+		// The job is still running, the rollout keeps waiting.
+		_, machines, err = rolloutStep(g, r, cluster, kcp)
+		g.Expect(err).NotTo(HaveOccurred())
+		g.Expect(machines).To(Equal(3))
+
+		job.Status.Succeeded = 1
+		g.Expect(workloadClient.Status().Update(ctx, job)).To(Succeed())
+
+		_, machines, err = rolloutStep(g, r, cluster, kcp)
+		g.Expect(err).NotTo(HaveOccurred())
+		g.Expect(machines).To(Equal(4))
+		g.Expect(kcp.Annotations).To(HaveKeyWithValue(controlplanev1.PreUpgradeSnapshotAnnotation, "v1.28.5+k3s1"))
+		g.Expect(conditions.IsTrue(kcp, controlplanev1.PreUpgradeSnapshotCondition)).To(BeTrue())
+	})
+
+	t.Run("a failed snapshot holds the rollout", func(t *testing.T) {
+		g := NewWithT(t)
+		ctx := context.Background()
+
+		r, cluster, kcp, workloadClient := newUpgradingControlPlane(g)
+		g.Expect(workloadClient.Create(ctx, &batchv1.Job{
+			ObjectMeta: metav1.ObjectMeta{Namespace: snapshotJobKey.Namespace, Name: snapshotJobKey.Name},
+			Status: batchv1.JobStatus{Conditions: []batchv1.JobCondition{{
+				Type:    batchv1.JobFailed,
+				Status:  corev1.ConditionTrue,
+				Message: "Job has reached the specified backoff limit",
+			}}},
+		})).To(Succeed())
+
+		_, machines, err := rolloutStep(g, r, cluster, kcp)
+		g.Expect(err).To(HaveOccurred())
+		g.Expect(machines).To(Equal(3))
+		g.Expect(conditions.GetReason(kcp, controlplanev1.PreUpgradeSnapshotCondition)).To(Equal(controlplanev1.PreUpgradeSnapshotFailedReason))
+	})
+
+	tests := []struct {
+		name   string
+		mutate func(kcp *controlplanev1.KThreesControlPlane)
+	}{
+		{
+			name:   "snapshot not requested",
+			mutate: func(kcp *controlplanev1.KThreesControlPlane) { kcp.Spec.SnapshotBeforeUpgrade = false },
+		},
+		{
+			name: "snapshot already taken for the version",
+			mutate: func(kcp *controlplanev1.KThreesControlPlane) {
+				kcp.Annotations = map[string]string{controlplanev1.PreUpgradeSnapshotAnnotation: kcp.Spec.Version}
+			},
+		},
+		{
+			name: "external datastore",
+			mutate: func(kcp *controlplanev1.KThreesControlPlane) {
+				kcp.Spec.KThreesConfigSpec.ServerConfig.Datastore = &bootstrapv1.DatastoreConfig{Type: bootstrapv1.DatastoreTypeExternal}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name+" rolls out without a snapshot", func(t *testing.T) {
+			g := NewWithT(t)
+
+			r, cluster, kcp, workloadClient := newUpgradingControlPlane(g)
+			tt.mutate(kcp)
+
+			_, machines, err := rolloutStep(g, r, cluster, kcp)
+			g.Expect(err).NotTo(HaveOccurred())
+			g.Expect(machines).To(Equal(4))
+
+			jobs := &batchv1.JobList{}
+			g.Expect(workloadClient.List(context.Background(), jobs)).To(Succeed())
+			g.Expect(jobs.Items).To(BeEmpty())
+		})
+	}
+}
+
+func TestMachinesNeedingRolloutEtcdQuotaBackendBytes(t *testing.T) {
+	tests := []struct {
+		name          string
+		machineArgs   []string
+		kcpQuota      *int64
+		expectRollout bool
+	}{
+		{
+			name: "quota left unset",
+		},
+		{
+			name:        "quota unchanged",
+			machineArgs: []string{"quota-backend-bytes=4294967296"},
+			kcpQuota:    pointer.Int64(4294967296),
+		},
+		{
+			name:          "quota set after creation",
+			kcpQuota:      pointer.Int64(4294967296),
+			expectRollout: true,
+		},
+		{
+			name:          "quota changed",
+			machineArgs:   []string{"quota-backend-bytes=4294967296"},
+			kcpQuota:      pointer.Int64(8589934592),
+			expectRollout: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+			ctx := context.Background()
+
+			r, cluster, kcp := newTestControlPlane(g)
+			kcp.Spec.EtcdQuotaBackendBytes = tt.kcpQuota
+
+			config := &bootstrapv1.KThreesConfig{
+				ObjectMeta: metav1.ObjectMeta{Name: "m1", Namespace: cluster.Namespace},
+				Spec: bootstrapv1.KThreesConfigSpec{
+					ServerConfig: bootstrapv1.KThreesServerConfig{EtcdArgs: tt.machineArgs},
+				},
+			}
+			g.Expect(r.Client.Create(ctx, config)).To(Succeed())
+
+			machine := newHealthyControlPlaneMachine(kcp, cluster, "m1")
+			machine.Spec.Version = pointer.String(kcp.Spec.Version)
+			machine.Spec.Bootstrap.ConfigRef = &corev1.ObjectReference{
+				Kind:       "KThreesConfig",
+				APIVersion: bootstrapv1.GroupVersion.String(),
+				Name:       config.Name,
+			}
+			g.Expect(r.Client.Create(ctx, machine)).To(Succeed())
+
+			controlPlane, err := k3s.NewControlPlane(ctx, r.Client, cluster, kcp, k3s.NewFilterableMachineCollection(machine))
+			g.Expect(err).NotTo(HaveOccurred())
+
+			if tt.expectRollout {
+				g.Expect(controlPlane.MachinesNeedingRollout().Names()).To(ConsistOf("m1"))
+			} else {
+				g.Expect(controlPlane.MachinesNeedingRollout()).To(BeEmpty())
+			}
+		})
+	}
+}
+
+func TestReconcileKubeconfig(t *testing.T) {
+	// reconcileKubeconfig reconciles the admin kubeconfig and returns it.
+	reconcileKubeconfig := func(g *WithT, r *KThreesControlPlaneReconciler, cluster *clusterv1.Cluster, kcp *controlplanev1.KThreesControlPlane) *clientcmdapi.Config {
+		ctx := context.Background()
+
+		_, err := r.reconcileKubeconfig(ctx, util.ObjectKey(cluster), cluster.Spec.ControlPlaneEndpoint, kcp)
+		g.Expect(err).NotTo(HaveOccurred())
+
+		s, err := secret.GetFromNamespacedName(ctx, r.Client, util.ObjectKey(cluster), secret.Kubeconfig)
+		g.Expect(err).NotTo(HaveOccurred())
+		config, err := clientcmd.Load(s.Data[secret.KubeconfigDataName])
+		g.Expect(err).NotTo(HaveOccurred())
+		g.Expect(config.Clusters).To(HaveKey(cluster.Name))
+		return config
+	}
+
+	newControlPlane := func(g *WithT) (*KThreesControlPlaneReconciler, *clusterv1.Cluster, *controlplanev1.KThreesControlPlane) {
+		r, cluster, kcp := newTestControlPlane(g)
+		cluster.Spec.ControlPlaneEndpoint = clusterv1.APIEndpoint{Host: "10.0.0.10", Port: 6443}
+		// The kubeconfig is only updated when owned by the KCP, which is matched by kind.
+		kcp.SetGroupVersionKind(controlplanev1.GroupVersion.WithKind("KThreesControlPlane"))
+		g.Expect(r.reconcileCertificates(context.Background(), cluster, kcp)).To(Succeed())
+		return r, cluster, kcp
+	}
+
+	t.Run("server is the control plane endpoint", func(t *testing.T) {
+		g := NewWithT(t)
+
+		r, cluster, kcp := newControlPlane(g)
+
+		config := reconcileKubeconfig(g, r, cluster, kcp)
+		g.Expect(config.Clusters[cluster.Name].Server).To(Equal("https://10.0.0.10:6443"))
+	})
+
+	t.Run("server is overridden", func(t *testing.T) {
+		g := NewWithT(t)
+
+		r, cluster, kcp := newControlPlane(g)
+		kcp.Spec.KubeconfigServer = "https://k8s.example.com"
+
+		config := reconcileKubeconfig(g, r, cluster, kcp)
+		g.Expect(config.Clusters[cluster.Name].Server).To(Equal("https://k8s.example.com"))
+	})
+
+	t.Run("existing kubeconfig follows the override", func(t *testing.T) {
+		g := NewWithT(t)
+
+		r, cluster, kcp := newControlPlane(g)
+		before := reconcileKubeconfig(g, r, cluster, kcp)
+
+		kcp.Spec.KubeconfigServer = "https://k8s.example.com:443"
+		after := reconcileKubeconfig(g, r, cluster, kcp)
+		g.Expect(after.Clusters[cluster.Name].Server).To(Equal("https://k8s.example.com:443"))
+		// The credentials are kept.
+		g.Expect(after.AuthInfos).To(Equal(before.AuthInfos))
+		g.Expect(after.Clusters[cluster.Name].CertificateAuthorityData).To(Equal(before.Clusters[cluster.Name].CertificateAuthorityData))
+
+		kcp.Spec.KubeconfigServer = ""
+		after = reconcileKubeconfig(g, r, cluster, kcp)
+		g.Expect(after.Clusters[cluster.Name].Server).To(Equal("https://10.0.0.10:6443"))
+	})
+}
@@ -35,6 +35,7 @@ import (
 
 	controlplanev1 "github.com/cluster-api-provider-k3s/cluster-api-k3s/controlplane/api/v1beta1"
 	k3s "github.com/cluster-api-provider-k3s/cluster-api-k3s/pkg/k3s"
+	"github.com/cluster-api-provider-k3s/cluster-api-k3s/pkg/machinefilters"
 )
 
 // reconcileUnhealthyMachines tries to remediate KThreesControlPlane unhealthy machines
@@ -44,6 +45,11 @@ func (r *KThreesControlPlaneReconciler) reconcileUnhealthyMachines(ctx context.C
 	log := ctrl.LoggerFrom(ctx)
 	reconciliationTime := time.Now().UTC()
 
+	// Machines explicitly marked for remediation are remediated the same way as machines reported unhealthy by MHC.
+	if err := r.markMachinesForRemediation(ctx, controlPlane); err != nil {
+		return ctrl.Result{}, err
+	}
+
 	// Cleanup pending remediation actions not completed for any reasons (e.g. number of current replicas is less or equal to 1)
 	// if the underlying machine is now back to healthy / not deleting.
 	errList := []error{}
@@ -166,50 +172,8 @@ func (r *KThreesControlPlaneReconciler) reconcileUnhealthyMachines(ctx context.C
 
 		// Start remediating the unhealthy control plane machine by deleting it.
 		// A new machine will come up completing the operation as part of the regular reconcile.
-
-		// TODO figure out etcd complexities
-		// If the control plane is initialized, before deleting the machine:
-		// - if the machine hosts the etcd leader, forward etcd leadership to another machine.
-		// - delete the etcd member hosted on the machine being deleted.
-		// - remove the etcd member from the kubeadm config map (only for kubernetes version older than v1.22.0)
-		/**
-		workloadCluster, err := controlPlane.GetWorkloadCluster(ctx)
-		if err != nil {
-			log.Error(err, "Failed to create client to workload cluster")
-			return ctrl.Result{}, errors.Wrapf(err, "failed to create client to workload cluster")
-		}
-
-		// If the machine that is about to be deleted is the etcd leader, move it to the newest member available.
-		if controlPlane.IsEtcdManaged() {
-			etcdLeaderCandidate := controlPlane.HealthyMachines().Newest()
-			if etcdLeaderCandidate == nil {
-				log.Info("A control plane machine needs remediation, but there is no healthy machine to forward etcd leadership to")
-				conditions.MarkFalse(machineToBeRemediated, clusterv1.MachineOwnerRemediatedCondition, clusterv1.RemediationFailedReason, clusterv1.ConditionSeverityWarning,
-					"A control plane machine needs remediation, but there is no healthy machine to forward etcd leadership to. Skipping remediation")
-				return ctrl.Result{}, nil
-			}
-			if err := workloadCluster.ForwardEtcdLeadership(ctx, machineToBeRemediated, etcdLeaderCandidate); err != nil {
-				log.Error(err, "Failed to move etcd leadership to candidate machine", "candidate", klog.KObj(etcdLeaderCandidate))
-				conditions.MarkFalse(machineToBeRemediated, clusterv1.MachineOwnerRemediatedCondition, clusterv1.RemediationFailedReason, clusterv1.ConditionSeverityError, err.Error())
-				return ctrl.Result{}, err
-			}
-			if err := workloadCluster.RemoveEtcdMemberForMachine(ctx, machineToBeRemediated); err != nil {
-				log.Error(err, "Failed to remove etcd member for machine")
-				conditions.MarkFalse(machineToBeRemediated, clusterv1.MachineOwnerRemediatedCondition, clusterv1.RemediationFailedReason, clusterv1.ConditionSeverityError, err.Error())
-				return ctrl.Result{}, err
-			}
-		}
-
-		parsedVersion, err := semver.ParseTolerant(controlPlane.KCP.Spec.Version)
-		if err != nil {
-			return ctrl.Result{}, errors.Wrapf(err, "failed to parse kubernetes version %q", controlPlane.KCP.Spec.Version)
-		}
-
-		if err := workloadCluster.RemoveMachineFromKubeadmConfigMap(ctx, machineToBeRemediated, parsedVersion); err != nil {
-			log.Error(err, "Failed to remove machine from kubeadm ConfigMap")
-			return ctrl.Result{}, err
-		}
-		**/
+		// NOTE: the etcd member hosted on the machine is removed by the pre-terminate hook once the node is drained,
+		// see reconcilePreTerminateHook.
 	}
 
 	// Delete the machine
@@ -237,6 +201,37 @@ func (r *KThreesControlPlaneReconciler) reconcileUnhealthyMachines(ctx context.C
 	return ctrl.Result{Requeue: true}, nil
 }
 
+// markMachinesForRemediation marks the control plane machines with the RemediateMachineAnnotation as unhealthy,
+// setting the same conditions a MachineHealthCheck sets when it detects a problem, so they are picked up by
+// reconcileUnhealthyMachines like any other unhealthy machine.
+func (r *KThreesControlPlaneReconciler) markMachinesForRemediation(ctx context.Context, controlPlane *k3s.ControlPlane) error {
+	errList := []error{}
+	for _, m := range controlPlane.Machines.Filter(machinefilters.HasAnnotationKey(controlplanev1.RemediateMachineAnnotation)) {
+		if !m.DeletionTimestamp.IsZero() || machinefilters.HasUnhealthyCondition(m) {
+			continue
+		}
+
+		patchHelper, err := patch.NewHelper(m, r.Client)
+		if err != nil {
+			errList = append(errList, errors.Wrapf(err, "failed to get PatchHelper for machine %s", m.Name))
+			continue
+		}
+
+		conditions.MarkFalse(m, clusterv1.MachineHealthCheckSucceededCondition, controlplanev1.HasRemediateMachineAnnotationReason, clusterv1.ConditionSeverityWarning, "Marked for remediation via the %s annotation", controlplanev1.RemediateMachineAnnotation)
+		if !conditions.IsFalse(m, clusterv1.MachineOwnerRemediatedCondition) {
+			conditions.MarkFalse(m, clusterv1.MachineOwnerRemediatedCondition, clusterv1.WaitingForRemediationReason, clusterv1.ConditionSeverityWarning, "")
+		}
+
+		if err := patchHelper.Patch(ctx, m, patch.WithOwnedConditions{Conditions: []clusterv1.ConditionType{
+			clusterv1.MachineHealthCheckSucceededCondition,
+			clusterv1.MachineOwnerRemediatedCondition,
+		}}); err != nil {
+			errList = append(errList, errors.Wrapf(err, "failed to patch machine %s", m.Name))
+		}
+	}
+	return kerrors.NewAggregate(errList)
+}
+
 // checkRetryLimits checks if KCP is allowed to remediate considering retry limits:
 // - Remediation cannot happen because retryPeriod is not yet expired.
 // - KCP already reached the maximum number of retries for a machine.
@@ -367,21 +362,26 @@ func (r *KThreesControlPlaneReconciler) canSafelyRemoveEtcdMember(ctx context.Co
 	unhealthyMembers := []string{}
 	for _, m := range controlPlane.Machines {
 		// Skip the machine to be deleted because it won't be part of the target etcd cluster.
-		if machineToBeRemediated.Status.NodeRef != nil && machineToBeRemediated.Status.NodeRef.Name == m.Status.NodeRef.Name {
+		if m.Name == machineToBeRemediated.Name {
 			continue
 		}
 
 		// Include the member in the target etcd cluster.
 		targetTotalMembers++
 
+		member := m.Name
+		if m.Status.NodeRef != nil {
+			member = fmt.Sprintf("%s (%s)", m.Status.NodeRef.Name, m.Name)
+		}
+
 		// Check member health as reported by machine's health conditions
 		if !conditions.IsTrue(m, controlplanev1.MachineEtcdMemberHealthyCondition) {
 			targetUnhealthyMembers++
-			unhealthyMembers = append(unhealthyMembers, fmt.Sprintf("%s (%s)", m.Status.NodeRef.Name, m.Name))
+			unhealthyMembers = append(unhealthyMembers, member)
 			continue
 		}
 
-		healthyMembers = append(healthyMembers, fmt.Sprintf("%s (%s)", m.Status.NodeRef.Name, m.Name))
+		healthyMembers = append(healthyMembers, member)
 	}
 
 	// See https://etcd.io/docs/v3.3/faq/#what-is-failure-tolerance for fault tolerance formula explanation.
@@ -0,0 +1,93 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1beta1"
+	"sigs.k8s.io/cluster-api/util/conditions"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	controlplanev1 "github.com/cluster-api-provider-k3s/cluster-api-k3s/controlplane/api/v1beta1"
+	k3s "github.com/cluster-api-provider-k3s/cluster-api-k3s/pkg/k3s"
+)
+
+func TestReconcileUnhealthyMachinesRemediateMachineAnnotation(t *testing.T) {
+	setup := func(g *WithT, ctx context.Context, unhealthyEtcdMember string) (*KThreesControlPlaneReconciler, *k3s.ControlPlane) {
+		r, cluster, kcp := newTestControlPlane(g)
+		kcp.Status.Initialized = true
+
+		machines := k3s.NewFilterableMachineCollection()
+		for _, name := range []string{"m1", "m2", "m3"} {
+			machine := newHealthyControlPlaneMachine(kcp, cluster, name)
+			machine.Finalizers = []string{clusterv1.MachineFinalizer}
+			machine.Status.NodeRef = &corev1.ObjectReference{Kind: "Node", Name: "node-" + name}
+			conditions.MarkTrue(machine, controlplanev1.MachineEtcdMemberHealthyCondition)
+			if name == "m1" {
+				machine.Annotations = map[string]string{controlplanev1.RemediateMachineAnnotation: ""}
+			}
+			if name == unhealthyEtcdMember {
+				conditions.MarkFalse(machine, controlplanev1.MachineEtcdMemberHealthyCondition, controlplanev1.EtcdMemberUnhealthyReason, clusterv1.ConditionSeverityError, "")
+			}
+			g.Expect(r.Client.Create(ctx, machine)).To(Succeed())
+			machines.Insert(machine)
+		}
+
+		controlPlane, err := k3s.NewControlPlane(ctx, r.Client, cluster, kcp, machines)
+		g.Expect(err).NotTo(HaveOccurred())
+		return r, controlPlane
+	}
+
+	t.Run("annotated machine is replaced", func(t *testing.T) {
+		g := NewWithT(t)
+		ctx := context.Background()
+
+		r, controlPlane := setup(g, ctx, "")
+
+		result, err := r.reconcileUnhealthyMachines(ctx, controlPlane)
+		g.Expect(err).NotTo(HaveOccurred())
+		g.Expect(result.Requeue).To(BeTrue())
+
+		machine := &clusterv1.Machine{}
+		g.Expect(r.Client.Get(ctx, client.ObjectKey{Name: "m1", Namespace: controlPlane.KCP.Namespace}, machine)).To(Succeed())
+		g.Expect(machine.DeletionTimestamp.IsZero()).To(BeFalse())
+		g.Expect(conditions.GetReason(machine, clusterv1.MachineOwnerRemediatedCondition)).To(Equal(clusterv1.RemediationInProgressReason))
+		g.Expect(controlPlane.KCP.Annotations).To(HaveKey(controlplanev1.RemediationInProgressAnnotation))
+	})
+
+	t.Run("remediation is refused if it would lose etcd quorum", func(t *testing.T) {
+		g := NewWithT(t)
+		ctx := context.Background()
+
+		r, controlPlane := setup(g, ctx, "m2")
+
+		result, err := r.reconcileUnhealthyMachines(ctx, controlPlane)
+		g.Expect(err).NotTo(HaveOccurred())
+		g.Expect(result.IsZero()).To(BeTrue())
+
+		machine := &clusterv1.Machine{}
+		g.Expect(r.Client.Get(ctx, client.ObjectKey{Name: "m1", Namespace: controlPlane.KCP.Namespace}, machine)).To(Succeed())
+		g.Expect(machine.DeletionTimestamp.IsZero()).To(BeTrue())
+		g.Expect(conditions.GetReason(machine, clusterv1.MachineHealthCheckSucceededCondition)).To(Equal(controlplanev1.HasRemediateMachineAnnotationReason))
+		g.Expect(conditions.GetReason(machine, clusterv1.MachineOwnerRemediatedCondition)).To(Equal(clusterv1.WaitingForRemediationReason))
+		g.Expect(controlPlane.KCP.Annotations).NotTo(HaveKey(controlplanev1.RemediationInProgressAnnotation))
+	})
+}
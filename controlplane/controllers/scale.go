@@ -22,11 +22,14 @@ import (
 	"errors"
 	"fmt"
 	"strings"
+	"sync"
+	"time"
 
 	corev1 "k8s.io/api/core/v1"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
 	kerrors "k8s.io/apimachinery/pkg/util/errors"
 	"k8s.io/apiserver/pkg/storage/names"
 	clusterv1 "sigs.k8s.io/cluster-api/api/v1beta1"
@@ -68,6 +71,12 @@ func (r *KThreesControlPlaneReconciler) initializeControlPlane(ctx context.Conte
 		return ctrl.Result{}, err
 	}
 
+	if path := bootstrapSpec.ServerConfig.ClusterResetRestorePath; path != "" {
+		// The restore is a one-shot operation, a later loss of the control plane must be requested again.
+		delete(kcp.Annotations, controlplanev1.RestoreSnapshotAnnotation)
+		r.recorder.Eventf(kcp, corev1.EventTypeNormal, "RestoringFromSnapshot", "Restoring control plane for cluster %s/%s from etcd snapshot %s", cluster.Namespace, cluster.Name, path)
+	}
+
 	// Requeue the control plane, in case there are additional operations to perform
 	return ctrl.Result{Requeue: true}, nil
 }
@@ -114,33 +123,12 @@ func (r *KThreesControlPlaneReconciler) scaleDownControlPlane(
 		return result, err
 	}
 
-	// workloadCluster, err := r.managementCluster.GetWorkloadCluster(ctx, util.ObjectKey(cluster))
-	// if err != nil {
-	//	logger.Error(err, "Failed to create client to workload cluster")
-	//	return ctrl.Result{}, fmt.Errorf(err, "failed to create client to workload cluster")
-	// }
-
 	if machineToDelete == nil {
 		logger.Info("Failed to pick control plane Machine to delete")
 		return ctrl.Result{}, fmt.Errorf("failed to pick control plane Machine to delete: %w", err)
 	}
 
-	// TODO figure out etcd complexities
-	// If KCP should manage etcd, If etcd leadership is on machine that is about to be deleted, move it to the newest member available.
-	/**
-	if controlPlane.IsEtcdManaged() {
-		etcdLeaderCandidate := controlPlane.Machines.Newest()
-		if err := workloadCluster.ForwardEtcdLeadership(ctx, machineToDelete, etcdLeaderCandidate); err != nil {
-			logger.Error(err, "Failed to move leadership to candidate machine", "candidate", etcdLeaderCandidate.Name)
-			return ctrl.Result{}, err
-		}
-		if err := workloadCluster.RemoveEtcdMemberForMachine(ctx, machineToDelete); err != nil {
-			logger.Error(err, "Failed to remove etcd member for machine")
-			return ctrl.Result{}, err
-		}
-	}
-	**/
-
+	// The etcd member of the machine is removed by the pre-terminate hook, once the node has been drained.
 	logger = logger.WithValues("machine", machineToDelete)
 	if err := r.Client.Delete(ctx, machineToDelete); err != nil && !apierrors.IsNotFound(err) {
 		logger.Error(err, "Failed to delete control plane machine")
@@ -158,11 +146,12 @@ func (r *KThreesControlPlaneReconciler) scaleDownControlPlane(
 // - There are no machine deletion in progress
 // - All the health conditions on KCP are true.
 // - All the health conditions on the control plane machines are true.
-// If the control plane is not passing preflight checks, it requeue.
+// If the control plane is not passing preflight checks, it requeue. While etcd members stay unhealthy the requeue
+// interval backs off exponentially, see etcdUnhealthyBackoff.
 //
 // NOTE: this func uses KCP conditions, it is required to call reconcileControlPlaneConditions before this.
-func (r *KThreesControlPlaneReconciler) preflightChecks(_ context.Context, controlPlane *k3s.ControlPlane, excludeFor ...*clusterv1.Machine) (ctrl.Result, error) { //nolint:unparam
-	logger := r.Log.WithValues("namespace", controlPlane.KCP.Namespace, "KThreesControlPlane", controlPlane.KCP.Name, "cluster", controlPlane.Cluster.Name)
+func (r *KThreesControlPlaneReconciler) preflightChecks(ctx context.Context, controlPlane *k3s.ControlPlane, excludeFor ...*clusterv1.Machine) (ctrl.Result, error) { //nolint:unparam
+	logger := ctrl.LoggerFrom(ctx)
 
 	// If there is no KCP-owned control-plane machines, then control-plane has not been initialized yet,
 	// so it is considered ok to proceed.
@@ -178,7 +167,11 @@ func (r *KThreesControlPlaneReconciler) preflightChecks(_ context.Context, contr
 
 	// Check machine health conditions; if there are conditions with False or Unknown, then wait.
 	allMachineHealthConditions := []clusterv1.ConditionType{controlplanev1.MachineAgentHealthyCondition}
+	if controlPlane.IsEtcdManaged() {
+		allMachineHealthConditions = append(allMachineHealthConditions, controlplanev1.MachineEtcdMemberHealthyCondition)
+	}
 	machineErrors := []error{}
+	etcdUnhealthy := false
 
 loopmachines:
 	for _, machine := range controlPlane.Machines {
@@ -193,6 +186,7 @@ loopmachines:
 		for _, condition := range allMachineHealthConditions {
 			if err := preflightCheckCondition("machine", machine, condition); err != nil {
 				machineErrors = append(machineErrors, err)
+				etcdUnhealthy = etcdUnhealthy || condition == controlplanev1.MachineEtcdMemberHealthyCondition
 			}
 		}
 	}
@@ -203,12 +197,69 @@ loopmachines:
 			"Waiting for control plane to pass preflight checks to continue reconciliation: %v", aggregatedError)
 		logger.Info("Waiting for control plane to pass preflight checks", "failures", aggregatedError.Error())
 
-		return ctrl.Result{RequeueAfter: preflightFailedRequeueAfter}, nil
+		if !etcdUnhealthy {
+			r.etcdUnhealthyBackoff.reset(controlPlane.KCP.UID)
+			return ctrl.Result{RequeueAfter: preflightFailedRequeueAfter}, nil
+		}
+
+		requeueAfter, extended := r.etcdUnhealthyBackoff.next(controlPlane.KCP.UID)
+		if extended {
+			r.recorder.Eventf(controlPlane.KCP, corev1.EventTypeWarning, "EtcdUnhealthyBackoff",
+				"etcd members are still unhealthy, checking again every %s", requeueAfter)
+		}
+		return ctrl.Result{RequeueAfter: requeueAfter}, nil
 	}
 
+	r.etcdUnhealthyBackoff.reset(controlPlane.KCP.UID)
 	return ctrl.Result{}, nil
 }
 
+// etcdUnhealthyBackoff counts the consecutive preflight checks failed because of unhealthy etcd members, per
+// control plane, so that a control plane stuck on etcd is checked less and less often instead of at a fixed rate.
+// The count is kept in memory, a restarted controller starts over from the shortest wait.
+type etcdUnhealthyBackoff struct {
+	mu       sync.Mutex
+	failures map[types.UID]int
+}
+
+// next records a failure and returns how long to wait before checking again. It also returns true on the
+// failure that first reaches etcdUnhealthyMaxRequeueAfter, when the control plane enters the extended backoff.
+func (b *etcdUnhealthyBackoff) next(uid types.UID) (time.Duration, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.failures == nil {
+		b.failures = map[types.UID]int{}
+	}
+	failures := b.failures[uid]
+	b.failures[uid] = failures + 1
+
+	wait := etcdUnhealthyRequeueAfter(failures)
+	extended := wait == etcdUnhealthyMaxRequeueAfter && (failures == 0 || etcdUnhealthyRequeueAfter(failures-1) < wait)
+	return wait, extended
+}
+
+// etcdUnhealthyRequeueAfter returns the wait after the given number of previous failures, starting from
+// preflightFailedRequeueAfter and doubling up to etcdUnhealthyMaxRequeueAfter.
+func etcdUnhealthyRequeueAfter(failures int) time.Duration {
+	wait := preflightFailedRequeueAfter
+	for i := 0; i < failures && wait < etcdUnhealthyMaxRequeueAfter; i++ {
+		wait *= 2
+	}
+	if wait > etcdUnhealthyMaxRequeueAfter {
+		return etcdUnhealthyMaxRequeueAfter
+	}
+	return wait
+}
+
+// reset forgets the failures of a control plane, once its etcd members are healthy or it is gone.
+func (b *etcdUnhealthyBackoff) reset(uid types.UID) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	delete(b.failures, uid)
+}
+
 func preflightCheckCondition(kind string, obj conditions.Getter, condition clusterv1.ConditionType) error {
 	c := conditions.Get(obj, condition)
 	if c == nil {
@@ -257,6 +308,7 @@ func (r *KThreesControlPlaneReconciler) cloneConfigsAndGenerateMachine(ctx conte
 		OwnerRef:    infraCloneOwner,
 		ClusterName: cluster.Name,
 		Labels:      k3s.ControlPlaneLabelsForCluster(cluster.Name, kcp.Spec.MachineTemplate),
+		Annotations: kcp.Spec.MachineTemplate.ObjectMeta.Annotations,
 	})
 	if err != nil {
 		// Safe to return early here since no resources have been created yet.
@@ -370,7 +422,13 @@ func (r *KThreesControlPlaneReconciler) generateMachine(ctx context.Context, kcp
 	if err != nil {
 		return fmt.Errorf("failed to marshal cluster configuration: %w", err)
 	}
-	machine.SetAnnotations(map[string]string{controlplanev1.KThreesServerConfigurationAnnotation: string(serverConfig)})
+	annotations := map[string]string{}
+	for key, value := range kcp.Spec.MachineTemplate.ObjectMeta.Annotations {
+		annotations[key] = value
+	}
+	annotations[controlplanev1.KThreesServerConfigurationAnnotation] = string(serverConfig)
+	annotations[controlplanev1.PreTerminateHookCleanupAnnotation] = ""
+	machine.SetAnnotations(annotations)
 
 	if err := r.Client.Create(ctx, machine); err != nil {
 		return fmt.Errorf("failed to create machine: %w", err)
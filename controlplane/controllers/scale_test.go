@@ -0,0 +1,383 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/utils/pointer"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1beta1"
+	expv1 "sigs.k8s.io/cluster-api/exp/api/v1beta1"
+	"sigs.k8s.io/cluster-api/util/conditions"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	bootstrapv1 "github.com/cluster-api-provider-k3s/cluster-api-k3s/bootstrap/api/v1beta1"
+	controlplanev1 "github.com/cluster-api-provider-k3s/cluster-api-k3s/controlplane/api/v1beta1"
+	k3s "github.com/cluster-api-provider-k3s/cluster-api-k3s/pkg/k3s"
+)
+
+func newTestScheme(g *WithT) *runtime.Scheme {
+	s := runtime.NewScheme()
+	g.Expect(scheme.AddToScheme(s)).To(Succeed())
+	g.Expect(clusterv1.AddToScheme(s)).To(Succeed())
+	g.Expect(expv1.AddToScheme(s)).To(Succeed())
+	g.Expect(bootstrapv1.AddToScheme(s)).To(Succeed())
+	g.Expect(controlplanev1.AddToScheme(s)).To(Succeed())
+	return s
+}
+
+func newTestControlPlane(g *WithT, objs ...client.Object) (*KThreesControlPlaneReconciler, *clusterv1.Cluster, *controlplanev1.KThreesControlPlane) {
+	cluster := &clusterv1.Cluster{
+		ObjectMeta: metav1.ObjectMeta{Name: "test", Namespace: metav1.NamespaceDefault},
+	}
+
+	infraTemplate := &unstructured.Unstructured{Object: map[string]interface{}{
+		"kind":       "GenericInfrastructureMachineTemplate",
+		"apiVersion": "infrastructure.cluster.x-k8s.io/v1beta1",
+		"metadata": map[string]interface{}{
+			"name":      "infra-foo",
+			"namespace": cluster.Namespace,
+		},
+		"spec": map[string]interface{}{
+			"template": map[string]interface{}{
+				"spec": map[string]interface{}{},
+			},
+		},
+	}}
+
+	kcp := &controlplanev1.KThreesControlPlane{
+		ObjectMeta: metav1.ObjectMeta{Name: "test-kcp", Namespace: cluster.Namespace, UID: "kcp-uid"},
+		Spec: controlplanev1.KThreesControlPlaneSpec{
+			Replicas: pointer.Int32(3),
+			Version:  "v1.28.5+k3s1",
+			InfrastructureTemplate: corev1.ObjectReference{
+				Kind:       infraTemplate.GetKind(),
+				APIVersion: infraTemplate.GetAPIVersion(),
+				Name:       infraTemplate.GetName(),
+				Namespace:  infraTemplate.GetNamespace(),
+			},
+		},
+	}
+
+	fakeClient := fake.NewClientBuilder().
+		WithScheme(newTestScheme(g)).
+		WithObjects(append([]client.Object{cluster, kcp.DeepCopy(), infraTemplate}, objs...)...).
+		Build()
+
+	r := &KThreesControlPlaneReconciler{
+		Client:                    fakeClient,
+		Log:                       ctrl.Log,
+		recorder:                  record.NewFakeRecorder(32),
+		managementCluster:         &k3s.Management{Client: fakeClient},
+		managementClusterUncached: &k3s.Management{Client: fakeClient},
+	}
+
+	return r, cluster, kcp
+}
+
+func TestInitializeControlPlaneRestoreFromSnapshot(t *testing.T) {
+	t.Run("total loss of an initialized control plane restores from the snapshot", func(t *testing.T) {
+		g := NewWithT(t)
+		ctx := context.Background()
+
+		r, cluster, kcp := newTestControlPlane(g)
+		kcp.Annotations = map[string]string{controlplanev1.RestoreSnapshotAnnotation: "on-demand-snapshot"}
+		kcp.Status.Initialized = true
+
+		controlPlane, err := k3s.NewControlPlane(ctx, r.Client, cluster, kcp, k3s.FilterableMachineCollection{})
+		g.Expect(err).NotTo(HaveOccurred())
+
+		result, err := r.initializeControlPlane(ctx, cluster, kcp, controlPlane)
+		g.Expect(err).NotTo(HaveOccurred())
+		g.Expect(result.Requeue).To(BeTrue())
+
+		configs := &bootstrapv1.KThreesConfigList{}
+		g.Expect(r.Client.List(ctx, configs, client.InNamespace(cluster.Namespace))).To(Succeed())
+		g.Expect(configs.Items).To(HaveLen(1))
+		g.Expect(configs.Items[0].Spec.ServerConfig.ClusterResetRestorePath).To(Equal("on-demand-snapshot"))
+
+		machines := &clusterv1.MachineList{}
+		g.Expect(r.Client.List(ctx, machines, client.InNamespace(cluster.Namespace))).To(Succeed())
+		g.Expect(machines.Items).To(HaveLen(1))
+		g.Expect(machines.Items[0].Annotations).To(HaveKey(controlplanev1.PreTerminateHookCleanupAnnotation))
+
+		// The restore is one-shot, so the annotation is removed once the replacement machine is created.
+		g.Expect(kcp.Annotations).NotTo(HaveKey(controlplanev1.RestoreSnapshotAnnotation))
+	})
+
+	t.Run("first initialization ignores the restore annotation", func(t *testing.T) {
+		g := NewWithT(t)
+		ctx := context.Background()
+
+		r, cluster, kcp := newTestControlPlane(g)
+		kcp.Annotations = map[string]string{controlplanev1.RestoreSnapshotAnnotation: "on-demand-snapshot"}
+
+		controlPlane, err := k3s.NewControlPlane(ctx, r.Client, cluster, kcp, k3s.FilterableMachineCollection{})
+		g.Expect(err).NotTo(HaveOccurred())
+
+		_, err = r.initializeControlPlane(ctx, cluster, kcp, controlPlane)
+		g.Expect(err).NotTo(HaveOccurred())
+
+		configs := &bootstrapv1.KThreesConfigList{}
+		g.Expect(r.Client.List(ctx, configs, client.InNamespace(cluster.Namespace))).To(Succeed())
+		g.Expect(configs.Items).To(HaveLen(1))
+		g.Expect(configs.Items[0].Spec.ServerConfig.ClusterResetRestorePath).To(BeEmpty())
+		g.Expect(kcp.Annotations).To(HaveKey(controlplanev1.RestoreSnapshotAnnotation))
+	})
+}
+
+// fakeManagementCluster returns a workload cluster backed by the given client instead of building a
+// remote client from the cluster kubeconfig.
+type fakeManagementCluster struct {
+	*k3s.Management
+	Workload    *k3s.Workload
+	WorkloadErr error
+}
+
+func (f *fakeManagementCluster) GetWorkloadCluster(_ context.Context, _ client.ObjectKey) (*k3s.Workload, error) {
+	return f.Workload, f.WorkloadErr
+}
+
+func newHealthyControlPlaneMachine(kcp *controlplanev1.KThreesControlPlane, cluster *clusterv1.Cluster, name string) *clusterv1.Machine {
+	machine := &clusterv1.Machine{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: cluster.Namespace,
+			Labels: map[string]string{
+				clusterv1.ClusterNameLabel:         cluster.Name,
+				clusterv1.MachineControlPlaneLabel: "",
+			},
+		},
+		Spec: clusterv1.MachineSpec{
+			ClusterName:       cluster.Name,
+			Version:           pointer.String("v1.27.1+k3s1"),
+			InfrastructureRef: kcp.Spec.InfrastructureTemplate,
+		},
+	}
+	conditions.MarkTrue(machine, controlplanev1.MachineAgentHealthyCondition)
+	conditions.MarkTrue(machine, controlplanev1.MachineEtcdMemberHealthyCondition)
+	return machine
+}
+
+func TestUpgradeControlPlaneRolloutStrategy(t *testing.T) {
+	tests := []struct {
+		name             string
+		maxSurge         *intstr.IntOrString
+		expectedMachines int
+	}{
+		{
+			name:             "default strategy surges by one",
+			expectedMachines: 4,
+		},
+		{
+			name:             "maxSurge 1 creates the new server before removing an old one",
+			maxSurge:         &intstr.IntOrString{Type: intstr.Int, IntVal: 1},
+			expectedMachines: 4,
+		},
+		{
+			name:             "maxSurge 0 removes an old server before creating a new one",
+			maxSurge:         &intstr.IntOrString{Type: intstr.Int, IntVal: 0},
+			expectedMachines: 2,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+			ctx := context.Background()
+
+			r, cluster, kcp := newTestControlPlane(g)
+			kcp.Status.Initialized = true
+			if tt.maxSurge != nil {
+				kcp.Spec.RolloutStrategy = &controlplanev1.RolloutStrategy{
+					Type:          controlplanev1.RollingUpdateStrategyType,
+					RollingUpdate: &controlplanev1.RollingUpdate{MaxSurge: tt.maxSurge},
+				}
+			}
+
+			machines := k3s.FilterableMachineCollection{}
+			for _, name := range []string{"m1", "m2", "m3"} {
+				machine := newHealthyControlPlaneMachine(kcp, cluster, name)
+				g.Expect(r.Client.Create(ctx, machine)).To(Succeed())
+				machines.Insert(machine)
+			}
+
+			controlPlane, err := k3s.NewControlPlane(ctx, r.Client, cluster, kcp, machines)
+			g.Expect(err).NotTo(HaveOccurred())
+
+			result, err := r.upgradeControlPlane(ctx, cluster, kcp, controlPlane, machines)
+			g.Expect(err).NotTo(HaveOccurred())
+			g.Expect(result.Requeue).To(BeTrue())
+
+			machineList := &clusterv1.MachineList{}
+			g.Expect(r.Client.List(ctx, machineList, client.InNamespace(cluster.Namespace))).To(Succeed())
+			g.Expect(machineList.Items).To(HaveLen(tt.expectedMachines))
+		})
+	}
+
+	t.Run("maxSurge 0 does not remove a second server before the replacement joins", func(t *testing.T) {
+		g := NewWithT(t)
+		ctx := context.Background()
+
+		r, cluster, kcp := newTestControlPlane(g)
+		kcp.Status.Initialized = true
+		kcp.Spec.RolloutStrategy = &controlplanev1.RolloutStrategy{
+			Type:          controlplanev1.RollingUpdateStrategyType,
+			RollingUpdate: &controlplanev1.RollingUpdate{MaxSurge: &intstr.IntOrString{Type: intstr.Int, IntVal: 0}},
+		}
+
+		// One outdated server was already removed, so the etcd cluster is down to two members.
+		machines := k3s.FilterableMachineCollection{}
+		for _, name := range []string{"m1", "m2"} {
+			machine := newHealthyControlPlaneMachine(kcp, cluster, name)
+			g.Expect(r.Client.Create(ctx, machine)).To(Succeed())
+			machines.Insert(machine)
+		}
+
+		controlPlane, err := k3s.NewControlPlane(ctx, r.Client, cluster, kcp, machines)
+		g.Expect(err).NotTo(HaveOccurred())
+
+		_, err = r.upgradeControlPlane(ctx, cluster, kcp, controlPlane, machines)
+		g.Expect(err).NotTo(HaveOccurred())
+
+		machineList := &clusterv1.MachineList{}
+		g.Expect(r.Client.List(ctx, machineList, client.InNamespace(cluster.Namespace))).To(Succeed())
+		g.Expect(machineList.Items).To(HaveLen(3))
+	})
+}
+
+func TestPreflightChecksEtcdMember(t *testing.T) {
+	tests := []struct {
+		name          string
+		datastore     *bootstrapv1.DatastoreConfig
+		expectRequeue bool
+	}{
+		{
+			name:          "scaling waits for the etcd member of the new server",
+			expectRequeue: true,
+		},
+		{
+			name:      "etcd members are not checked with an external datastore",
+			datastore: &bootstrapv1.DatastoreConfig{Type: bootstrapv1.DatastoreTypeExternal},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+			ctx := context.Background()
+
+			r, cluster, kcp := newTestControlPlane(g)
+			kcp.Spec.KThreesConfigSpec.ServerConfig.Datastore = tt.datastore
+
+			machines := k3s.FilterableMachineCollection{}
+			for _, name := range []string{"m1", "m2"} {
+				machine := newHealthyControlPlaneMachine(kcp, cluster, name)
+				g.Expect(r.Client.Create(ctx, machine)).To(Succeed())
+				machines.Insert(machine)
+			}
+			// The new server is up, but its etcd member did not join the cluster yet.
+			conditions.MarkFalse(machines["m2"], controlplanev1.MachineEtcdMemberHealthyCondition, controlplanev1.EtcdMemberUnhealthyReason, clusterv1.ConditionSeverityError, "")
+
+			controlPlane, err := k3s.NewControlPlane(ctx, r.Client, cluster, kcp, machines)
+			g.Expect(err).NotTo(HaveOccurred())
+
+			result, err := r.preflightChecks(ctx, controlPlane)
+			g.Expect(err).NotTo(HaveOccurred())
+			if tt.expectRequeue {
+				g.Expect(result.RequeueAfter).To(Equal(preflightFailedRequeueAfter))
+			} else {
+				g.Expect(result.IsZero()).To(BeTrue())
+			}
+		})
+	}
+}
+
+func TestPreflightChecksEtcdUnhealthyBackoff(t *testing.T) {
+	g := NewWithT(t)
+	ctx := context.Background()
+
+	r, cluster, kcp := newTestControlPlane(g)
+	recorder := record.NewFakeRecorder(64)
+	r.recorder = recorder
+
+	machines := k3s.FilterableMachineCollection{}
+	for _, name := range []string{"m1", "m2", "m3"} {
+		machine := newHealthyControlPlaneMachine(kcp, cluster, name)
+		g.Expect(r.Client.Create(ctx, machine)).To(Succeed())
+		machines.Insert(machine)
+	}
+	controlPlane, err := k3s.NewControlPlane(ctx, r.Client, cluster, kcp, machines)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	preflight := func() time.Duration {
+		result, err := r.preflightChecks(ctx, controlPlane)
+		g.Expect(err).NotTo(HaveOccurred())
+		return result.RequeueAfter
+	}
+	backoffEvents := func() int {
+		count := 0
+		for {
+			select {
+			case event := <-recorder.Events:
+				if strings.Contains(event, "EtcdUnhealthyBackoff") {
+					count++
+				}
+			default:
+				return count
+			}
+		}
+	}
+
+	// The etcd member of m2 keeps failing, the wait doubles on every check up to the cap.
+	conditions.MarkFalse(machines["m2"], controlplanev1.MachineEtcdMemberHealthyCondition, controlplanev1.EtcdMemberUnhealthyReason, clusterv1.ConditionSeverityError, "")
+	var waits []time.Duration
+	for i := 0; i < 7; i++ {
+		waits = append(waits, preflight())
+	}
+	g.Expect(waits).To(Equal([]time.Duration{
+		15 * time.Second, 30 * time.Second, time.Minute, 2 * time.Minute, 4 * time.Minute,
+		etcdUnhealthyMaxRequeueAfter, etcdUnhealthyMaxRequeueAfter,
+	}))
+	// The event is only emitted when entering the extended backoff.
+	g.Expect(backoffEvents()).To(Equal(1))
+
+	// Once etcd is healthy again the backoff starts over.
+	conditions.MarkTrue(machines["m2"], controlplanev1.MachineEtcdMemberHealthyCondition)
+	g.Expect(preflight()).To(BeZero())
+	conditions.MarkFalse(machines["m2"], controlplanev1.MachineEtcdMemberHealthyCondition, controlplanev1.EtcdMemberUnhealthyReason, clusterv1.ConditionSeverityError, "")
+	g.Expect(preflight()).To(Equal(preflightFailedRequeueAfter))
+
+	// Other failures keep the regular interval.
+	conditions.MarkTrue(machines["m2"], controlplanev1.MachineEtcdMemberHealthyCondition)
+	conditions.MarkFalse(machines["m3"], controlplanev1.MachineAgentHealthyCondition, controlplanev1.PodFailedReason, clusterv1.ConditionSeverityError, "")
+	g.Expect(preflight()).To(Equal(preflightFailedRequeueAfter))
+	g.Expect(preflight()).To(Equal(preflightFailedRequeueAfter))
+}
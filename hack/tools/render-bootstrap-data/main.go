@@ -0,0 +1,92 @@
+//go:build tools
+// +build tools
+
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// main prints the bootstrap data the provider would generate for a KThreesConfig, without a controller.
+//
+//	go run -tags tools ./hack/tools/render-bootstrap-data -config kthreesconfig.yaml -role worker
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	kubeyaml "sigs.k8s.io/yaml"
+
+	bootstrapv1 "github.com/cluster-api-provider-k3s/cluster-api-k3s/bootstrap/api/v1beta1"
+	"github.com/cluster-api-provider-k3s/cluster-api-k3s/pkg/userdata"
+)
+
+var (
+	configPath = flag.String("config", "", "path of the KThreesConfig manifest to render")
+	role       = flag.String("role", string(userdata.Worker), "role of the node: init-control-plane, join-control-plane or worker")
+	serverURL  = flag.String("server-url", "https://127.0.0.1:6443", "URL the node joins the cluster through")
+	endpoint   = flag.String("control-plane-endpoint", "127.0.0.1", "host of the cluster control plane endpoint")
+	token      = flag.String("token", "<token>", "token the node joins with")
+	machine    = flag.String("machine-name", "machine", "name of the Machine, referenced by nodeName and nodeLabels templates")
+	cluster    = flag.String("cluster-name", "cluster", "name of the Cluster, referenced by nodeName and nodeLabels templates")
+)
+
+func main() {
+	flag.Parse()
+
+	if err := run(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func run() error {
+	if *configPath == "" {
+		return fmt.Errorf("-config is required")
+	}
+
+	b, err := os.ReadFile(*configPath)
+	if err != nil {
+		return err
+	}
+
+	config := &bootstrapv1.KThreesConfig{}
+	if err := kubeyaml.UnmarshalStrict(b, config); err != nil {
+		return fmt.Errorf("failed to parse %s: %w", *configPath, err)
+	}
+
+	// Referenced secrets are not read, only files with inline content can be rendered.
+	for _, f := range config.Spec.Files {
+		if f.ContentFrom != nil {
+			return fmt.Errorf("file %s: contentFrom is not supported, inline the content", f.Path)
+		}
+	}
+
+	out, err := userdata.RenderBootstrapData(&config.Spec, userdata.JoinInfo{
+		Role:                 userdata.Role(*role),
+		ServerURL:            *serverURL,
+		ControlPlaneEndpoint: *endpoint,
+		Token:                *token,
+		Files:                config.Spec.Files,
+		SystemProxy:          config.Spec.SystemProxy,
+		TemplateInput:        bootstrapv1.TemplateInput{MachineName: *machine, ClusterName: *cluster},
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = os.Stdout.Write(out)
+	return err
+}
@@ -0,0 +1,130 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package cis holds the settings the CIS hardening profile adds to the nodes, following the k3s CIS hardening guide.
+// It does not depend on the API types, so the webhooks can check user settings against it.
+package cis
+
+import "path"
+
+// SysctlFile holds the kernel settings the kubelet expects when it protects the kernel defaults.
+const SysctlFile = "/etc/sysctl.d/90-kubelet.conf"
+
+// PodSecurityAdmissionFile returns the admission configuration of the servers under the given k3s data dir,
+// enforcing the restricted Pod Security Standard outside of kube-system.
+func PodSecurityAdmissionFile(dataDir string) string {
+	return path.Join(dataDir, "server/psa.yaml")
+}
+
+// AuditPolicyFile returns the audit policy of the servers under the given k3s data dir.
+func AuditPolicyFile(dataDir string) string {
+	return path.Join(dataDir, "server/audit.yaml")
+}
+
+// AuditLogDir returns where the servers write the audit log under the given k3s data dir.
+func AuditLogDir(dataDir string) string {
+	return path.Join(dataDir, "server/logs")
+}
+
+// File is a file the profile writes to the nodes, owned by root.
+type File struct {
+	Path        string
+	Content     string
+	Permissions string
+}
+
+const sysctls = `vm.panic_on_oom=0
+vm.overcommit_memory=1
+kernel.panic=10
+kernel.panic_on_oops=1
+`
+
+const podSecurityAdmission = `apiVersion: apiserver.config.k8s.io/v1
+kind: AdmissionConfiguration
+plugins:
+- name: PodSecurity
+  configuration:
+    apiVersion: pod-security.admission.config.k8s.io/v1beta1
+    kind: PodSecurityConfiguration
+    defaults:
+      enforce: restricted
+      enforce-version: latest
+      audit: restricted
+      audit-version: latest
+      warn: restricted
+      warn-version: latest
+    exemptions:
+      usernames: []
+      runtimeClasses: []
+      namespaces: [kube-system]
+`
+
+const auditPolicy = `apiVersion: audit.k8s.io/v1
+kind: Policy
+rules:
+- level: Metadata
+`
+
+// KubeAPIServerArgs returns the arguments added to the kube-apiserver of the servers, for the given k3s data dir.
+func KubeAPIServerArgs(dataDir string) []string {
+	return []string{
+		"admission-control-config-file=" + PodSecurityAdmissionFile(dataDir),
+		"audit-policy-file=" + AuditPolicyFile(dataDir),
+		"audit-log-path=" + AuditLogDir(dataDir) + "/audit.log",
+		"audit-log-maxage=30",
+		"audit-log-maxbackup=10",
+		"audit-log-maxsize=100",
+	}
+}
+
+// KubeControllerManagerArgs are added to the kube-controller-manager arguments of the servers.
+var KubeControllerManagerArgs = []string{
+	"terminated-pod-gc-threshold=10",
+}
+
+// KubeletArgs are added to the kubelet arguments of every node.
+var KubeletArgs = []string{
+	"streaming-connection-idle-timeout=5m",
+}
+
+// ServerFiles returns the files the profile writes to the servers, for the given k3s data dir.
+func ServerFiles(dataDir string) []File {
+	return []File{
+		{Path: SysctlFile, Content: sysctls, Permissions: "0644"},
+		{Path: PodSecurityAdmissionFile(dataDir), Content: podSecurityAdmission, Permissions: "0600"},
+		{Path: AuditPolicyFile(dataDir), Content: auditPolicy, Permissions: "0600"},
+	}
+}
+
+// AgentFiles returns the files the profile writes to the agents.
+func AgentFiles() []File {
+	return []File{
+		{Path: SysctlFile, Content: sysctls, Permissions: "0644"},
+	}
+}
+
+// ServerPreK3sCommands returns the commands run on the servers before k3s is installed, for the given k3s data dir.
+func ServerPreK3sCommands(dataDir string) []string {
+	return []string{
+		"sysctl -p " + SysctlFile,
+		"mkdir -p -m 700 " + AuditLogDir(dataDir),
+	}
+}
+
+// AgentPreK3sCommands are run on the agents before k3s is installed.
+var AgentPreK3sCommands = []string{
+	"sysctl -p " + SysctlFile,
+}
@@ -19,8 +19,12 @@ package cloudinit
 import (
 	"bytes"
 	"fmt"
+	"net/url"
+	"path"
+	"sort"
 	"strings"
 	"text/template"
+	"time"
 
 	bootstrapv1 "github.com/cluster-api-provider-k3s/cluster-api-k3s/bootstrap/api/v1beta1"
 )
@@ -29,6 +33,15 @@ var (
 	defaultTemplateFuncMap = template.FuncMap{
 		"Indent": templateYAMLIndent,
 	}
+
+	// envFileEscaper escapes a double quoted value of a systemd environment file.
+	envFileEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+
+	// doubleQuoteEscaper escapes a command run in a double quoted shell string.
+	doubleQuoteEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "$", `\$`, "`", "\\`")
+
+	// sedReplacementEscaper escapes the replacement of a sed s command delimited by slashes.
+	sedReplacementEscaper = strings.NewReplacer(`\`, `\\`, "/", `\/`, "&", `\&`)
 )
 
 func templateYAMLIndent(i int, input string) string {
@@ -38,6 +51,9 @@ func templateYAMLIndent(i int, input string) string {
 }
 
 const (
+	// DefaultInstallScriptURL is the location of the upstream k3s install script.
+	DefaultInstallScriptURL = "https://get.k3s.io"
+
 	k3sScriptName        = "/usr/local/bin/k3s"
 	k3sScriptOwner       = "root"
 	k3sScriptPermissions = "0755"
@@ -45,6 +61,22 @@ const (
 #cloud-config
 `
 
+	// bootstrapSuccessCommand writes the sentinel file Cluster API checks to know the bootstrap succeeded.
+	bootstrapSuccessCommand = "mkdir -p /run/cluster-api && echo success > /run/cluster-api/bootstrap-success.complete"
+
+	// JoinFailureFile is where the bootstrap writes why the node failed to join the cluster within the JoinTimeout.
+	JoinFailureFile = "/run/cluster-api/bootstrap-failure.log"
+
+	// defaultHTTPSListenPort is the port the k3s API server listens on when httpsListenPort is unset.
+	defaultHTTPSListenPort = "6443"
+
+	// airgapImagesDir is where k3s imports prestaged images tarballs from on start, under its data dir.
+	airgapImagesDir = "agent/images"
+
+	// k3sJoinedFile is the kubelet client certificate k3s only gets from the servers once it joined the cluster,
+	// under its data dir.
+	k3sJoinedFile = "agent/client-kubelet.crt"
+
 	filesTemplate = `{{ define "files" -}}
 write_files:{{ range . }}
 -   path: {{.Path}}
@@ -73,13 +105,250 @@ write_files:{{ range . }}
 
 // BaseUserData is shared across all the various types of files written to disk.
 type BaseUserData struct {
-	Header          string
-	PreK3sCommands  []string
-	PostK3sCommands []string
-	AdditionalFiles []bootstrapv1.File
-	WriteFiles      []bootstrapv1.File
-	ConfigFile      bootstrapv1.File
-	K3sVersion      string
+	Header           string
+	PreK3sCommands   []string
+	PostK3sCommands  []string
+	AdditionalFiles  []bootstrapv1.File
+	WriteFiles       []bootstrapv1.File
+	ConfigFile       bootstrapv1.File
+	K3sVersion       string
+	InstallScriptURL string
+	Channel          string
+
+	// SystemProxy is exported to the install script and, through the service config of InitSystem, to the k3s service.
+	SystemProxy *bootstrapv1.SystemProxy
+
+	// Environment is exported to the k3s service through the service config of InitSystem.
+	Environment map[string]string
+
+	// ClusterResetRestorePath restores the embedded etcd from a snapshot before k3s starts, initial server only.
+	ClusterResetRestorePath string
+
+	// AirgapImagesURL is downloaded to the airgap images directory of k3s before k3s is installed, and verified
+	// against the SHA-256 AirgapImagesChecksum when set.
+	AirgapImagesURL      string
+	AirgapImagesChecksum string
+
+	// Format is the format of the generated user data, cloud-config when empty.
+	Format bootstrapv1.Format
+
+	// InitSystem is the init system running the k3s service, systemd when empty.
+	InitSystem bootstrapv1.InitSystem
+
+	// DataDir is the directory k3s keeps its state in, the default one when empty.
+	DataDir string
+
+	// JoinTimeout is how long the bootstrap waits for a joining node to join the cluster, not at all when zero.
+	JoinTimeout time.Duration
+
+	// BootstrapCommand installs and starts k3s, it runs between PreK3sCommands and PostK3sCommands.
+	BootstrapCommand string
+}
+
+// dataDirPath returns the given path under the data dir of k3s.
+func (input *BaseUserData) dataDirPath(elem string) string {
+	if input.DataDir == "" {
+		return path.Join(bootstrapv1.DefaultDataDir, elem)
+	}
+	return path.Join(input.DataDir, elem)
+}
+
+// proxyEnv returns the proxy environment variables set by SystemProxy.
+func (input *BaseUserData) proxyEnv() []string {
+	if input.SystemProxy == nil {
+		return nil
+	}
+
+	var env []string
+	if input.SystemProxy.HTTPProxy != "" {
+		env = append(env, "HTTP_PROXY="+input.SystemProxy.HTTPProxy)
+	}
+	if input.SystemProxy.HTTPSProxy != "" {
+		env = append(env, "HTTPS_PROXY="+input.SystemProxy.HTTPSProxy)
+	}
+	if len(input.SystemProxy.NoProxy) > 0 {
+		env = append(env, "NO_PROXY="+strings.Join(input.SystemProxy.NoProxy, ","))
+	}
+	return env
+}
+
+// serviceFiles returns the files configuring the environment of the given k3s service for the init system.
+func (input *BaseUserData) serviceFiles(service string) []bootstrapv1.File {
+	if input.InitSystem == bootstrapv1.InitSystemOpenRC {
+		return input.openRCFiles(service)
+	}
+	return append(input.proxyFiles(service), input.environmentFiles(service)...)
+}
+
+// openRCFiles returns the OpenRC service config exporting the proxy environment and Environment to the given
+// k3s service, openrc-run sources /etc/conf.d/<service> before starting it.
+func (input *BaseUserData) openRCFiles(service string) []bootstrapv1.File {
+	env := input.proxyEnv()
+	if len(env) == 0 && len(input.Environment) == 0 {
+		return nil
+	}
+
+	var content strings.Builder
+	for _, e := range env {
+		name, value, _ := strings.Cut(e, "=")
+		fmt.Fprintf(&content, "export %s=\"%s\"\n", name, doubleQuoteEscaper.Replace(value))
+	}
+	for _, name := range input.environmentNames() {
+		fmt.Fprintf(&content, "export %s=\"%s\"\n", name, doubleQuoteEscaper.Replace(input.Environment[name]))
+	}
+
+	return []bootstrapv1.File{{
+		Path:        fmt.Sprintf("/etc/conf.d/%s", service),
+		Content:     content.String(),
+		Owner:       "root:root",
+		Permissions: "0600",
+	}}
+}
+
+// proxyFiles returns the systemd drop-in exporting the proxy environment to the given k3s service.
+func (input *BaseUserData) proxyFiles(service string) []bootstrapv1.File {
+	env := input.proxyEnv()
+	if len(env) == 0 {
+		return nil
+	}
+
+	var content strings.Builder
+	content.WriteString("[Service]\n")
+	for _, e := range env {
+		fmt.Fprintf(&content, "Environment=\"%s\"\n", e)
+	}
+
+	return []bootstrapv1.File{{
+		Path:        fmt.Sprintf("/etc/systemd/system/%s.service.d/http-proxy.conf", service),
+		Content:     content.String(),
+		Owner:       "root:root",
+		Permissions: "0644",
+	}}
+}
+
+// environmentNames returns the names of the Environment variables, sorted so the user data is stable.
+func (input *BaseUserData) environmentNames() []string {
+	names := make([]string, 0, len(input.Environment))
+	for name := range input.Environment {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// environmentFiles returns the environment file of the given k3s service and the systemd drop-in loading it.
+func (input *BaseUserData) environmentFiles(service string) []bootstrapv1.File {
+	if len(input.Environment) == 0 {
+		return nil
+	}
+
+	var content strings.Builder
+	for _, name := range input.environmentNames() {
+		fmt.Fprintf(&content, "%s=\"%s\"\n", name, envFileEscaper.Replace(input.Environment[name]))
+	}
+
+	envFile := fmt.Sprintf("/etc/systemd/system/%s.service.d/environment.env", service)
+	return []bootstrapv1.File{
+		{
+			Path:        envFile,
+			Content:     content.String(),
+			Owner:       "root:root",
+			Permissions: "0600",
+		},
+		{
+			Path:        fmt.Sprintf("/etc/systemd/system/%s.service.d/environment.conf", service),
+			Content:     fmt.Sprintf("[Service]\nEnvironmentFile=%s\n", envFile),
+			Owner:       "root:root",
+			Permissions: "0644",
+		},
+	}
+}
+
+// installCommand returns the command downloading and running the k3s install script for the given role,
+// extraEnv is passed to the install script on top of the version and channel.
+func (input *BaseUserData) installCommand(role string, extraEnv ...string) string {
+	scriptURL := input.InstallScriptURL
+	if scriptURL == "" {
+		scriptURL = DefaultInstallScriptURL
+	}
+
+	curl := fmt.Sprintf("curl -sfL %s", scriptURL)
+	env := fmt.Sprintf("INSTALL_K3S_VERSION=%s", input.K3sVersion)
+	if proxyEnv := strings.Join(input.proxyEnv(), " "); proxyEnv != "" {
+		curl = proxyEnv + " " + curl
+		env = proxyEnv + " " + env
+	}
+	if input.Channel != "" {
+		env += fmt.Sprintf(" INSTALL_K3S_CHANNEL=%s", input.Channel)
+	}
+	for _, e := range extraEnv {
+		env += " " + e
+	}
+
+	return fmt.Sprintf("%s | %s sh -s - %s", curl, env, role)
+}
+
+// airgapImagesCommand returns the command prestaging the airgap images tarball, empty if there is none.
+// The tarball is only moved in place once verified, so that k3s never imports a corrupted or tampered one.
+func (input *BaseUserData) airgapImagesCommand() string {
+	if input.AirgapImagesURL == "" {
+		return ""
+	}
+
+	name := path.Base(input.AirgapImagesURL)
+	if u, err := url.Parse(input.AirgapImagesURL); err == nil {
+		name = path.Base(u.Path)
+	}
+	imagesDir := input.dataDirPath(airgapImagesDir)
+	images := path.Join(imagesDir, name)
+	download := images + ".download"
+
+	curl := fmt.Sprintf("curl -sfL -o %s %s", download, input.AirgapImagesURL)
+	if proxyEnv := strings.Join(input.proxyEnv(), " "); proxyEnv != "" {
+		curl = proxyEnv + " " + curl
+	}
+
+	command := fmt.Sprintf("mkdir -p %s && %s", imagesDir, curl)
+	if input.AirgapImagesChecksum != "" {
+		command += fmt.Sprintf(" && echo \"%s  %s\" | sha256sum -c -", input.AirgapImagesChecksum, download)
+	}
+	return fmt.Sprintf("%s && mv %s %s", command, download, images)
+}
+
+// joinCommand returns the given install command of a joining node bounded by JoinTimeout, which then also waits for
+// k3s to have joined the cluster, as an agent is started before it joins. Past the timeout, it writes the reason to
+// JoinFailureFile, for the operator or a readiness check to find, and fails. Without a JoinTimeout the install command
+// is returned as is.
+func (input *BaseUserData) joinCommand(installCommand, service string) string {
+	if input.JoinTimeout <= 0 {
+		return installCommand
+	}
+
+	install := doubleQuoteEscaper.Replace(installCommand)
+	wait := fmt.Sprintf("timeout %d sh -c \"%s && until [ -f %s ]; do sleep 5; done\"", int(input.JoinTimeout.Seconds()), install, input.dataDirPath(k3sJoinedFile))
+	failure := fmt.Sprintf("k3s failed to install or to join the cluster within %s, check the %s service logs for a wrong token or an unreachable server",
+		input.JoinTimeout, service)
+	return fmt.Sprintf("(%s || (mkdir -p %s && echo \"%s\" > %s; exit 1))", wait, path.Dir(JoinFailureFile), failure, JoinFailureFile)
+}
+
+// bootstrapCommand chains the airgap images prestaging, the given install command and the bootstrap success
+// sentinel, so that the bootstrap fails if any of them does.
+func (input *BaseUserData) bootstrapCommand(installCommand string) string {
+	command := fmt.Sprintf("%s && %s", installCommand, bootstrapSuccessCommand)
+	if prestage := input.airgapImagesCommand(); prestage != "" {
+		command = prestage + " && " + command
+	}
+	return command
+}
+
+// render returns the user data in the requested format, tpl is the cloud-config template.
+func (input *BaseUserData) render(kind string, tpl string) ([]byte, error) {
+	if input.Format == bootstrapv1.Ignition {
+		return generateIgnition(input)
+	}
+
+	input.Header = cloudConfigHeader
+	return generate(kind, tpl, input)
 }
 
 func generate(kind string, tpl string, data interface{}) ([]byte, error) {
@@ -27,7 +27,7 @@ const (
 {{template "files" .WriteFiles}}
 runcmd:
 {{- template "commands" .PreK3sCommands }}
-  - 'curl -sfL https://get.k3s.io | INSTALL_K3S_VERSION=%s sh -s - server && mkdir -p /run/cluster-api && echo success > /run/cluster-api/bootstrap-success.complete'
+  - '{{.BootstrapCommand}}'
 {{- template "commands" .PostK3sCommands }}
 `
 )
@@ -36,17 +36,33 @@ runcmd:
 type ControlPlaneInput struct {
 	BaseUserData
 	secret.Certificates
+
+	// Token is the server token the node joins with, NewToken the one it switches the cluster to
+	// when a token rotation is in progress. Joining servers only.
+	Token    string
+	NewToken string
+
+	// HTTPSListenPort is the port the k3s API server of the node listens on, the k3s default one when empty.
+	// Joining servers only.
+	HTTPSListenPort string
 }
 
 // NewInitControlPlane returns the user data string to be used on a controlplane instance.
 func NewInitControlPlane(input *ControlPlaneInput) ([]byte, error) {
-	input.Header = cloudConfigHeader
 	input.WriteFiles = input.Certificates.AsFiles()
 	input.WriteFiles = append(input.WriteFiles, input.AdditionalFiles...)
+	input.WriteFiles = append(input.WriteFiles, input.serviceFiles("k3s")...)
 	input.WriteFiles = append(input.WriteFiles, input.ConfigFile)
 
-	controlPlaneCloudJoinWithVersion := fmt.Sprintf(controlPlaneCloudInit, input.K3sVersion)
-	userData, err := generate("InitControlplane", controlPlaneCloudJoinWithVersion, input)
+	installCommand := input.installCommand("server")
+	if input.ClusterResetRestorePath != "" {
+		// Install without starting, reset etcd from the snapshot, k3s exits once done, then start the service normally.
+		installCommand = fmt.Sprintf("%s && k3s server --cluster-reset --cluster-reset-restore-path=%s && %s",
+			input.installCommand("server", "INSTALL_K3S_SKIP_START=true"), input.ClusterResetRestorePath, installCommand)
+	}
+
+	input.BootstrapCommand = input.bootstrapCommand(installCommand)
+	userData, err := input.render("InitControlplane", controlPlaneCloudInit)
 	if err != nil {
 		return nil, err
 	}
@@ -17,6 +17,7 @@ limitations under the License.
 package cloudinit
 
 import (
+	"strings"
 	"testing"
 
 	. "github.com/onsi/gomega"
@@ -51,3 +52,228 @@ func TestControlPlaneInit(t *testing.T) {
 	g.Expect(err).NotTo(HaveOccurred())
 	t.Log(string(out))
 }
+
+func TestAdditionalFilesEncoding(t *testing.T) {
+	g := NewWithT(t)
+
+	winput := &WorkerInput{
+		BaseUserData: BaseUserData{
+			AdditionalFiles: []infrav1.File{
+				{Path: "/tmp/plain", Content: "hi", Owner: "root:root", Permissions: "0644"},
+				{Path: "/tmp/base64", Encoding: infrav1.Base64, Content: "aGk="},
+				{Path: "/tmp/gzip", Encoding: infrav1.Gzip, Content: "H4sIAAAAAAAA/8rIBAQAAP//rCoBWQIAAAA="},
+				{Path: "/tmp/gzip-base64", Encoding: infrav1.GzipBase64, Content: "H4sIAAAAAAAA/8rIBAQAAP//rCoBWQIAAAA="},
+			},
+		},
+	}
+
+	out, err := NewWorker(winput)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(string(out)).To(ContainSubstring("-   path: /tmp/plain\n    owner: root:root\n    permissions: '0644'\n    content: |\n      hi\n"))
+	g.Expect(string(out)).To(ContainSubstring("-   path: /tmp/base64\n    encoding: \"base64\"\n    content: |\n      aGk=\n"))
+	g.Expect(string(out)).To(ContainSubstring("-   path: /tmp/gzip\n    encoding: \"gzip\"\n"))
+	g.Expect(string(out)).To(ContainSubstring("-   path: /tmp/gzip-base64\n    encoding: \"gzip+base64\"\n"))
+}
+
+func TestPreAndPostK3sCommandsOrdering(t *testing.T) {
+	base := BaseUserData{
+		PreK3sCommands:  []string{"sysctl -w vm.max_map_count=262144", "mount /dev/sdb /var/lib/rancher"},
+		PostK3sCommands: []string{"kubectl apply -f /etc/manifests"},
+	}
+
+	generators := map[string]func() ([]byte, error){
+		"init":   func() ([]byte, error) { return NewInitControlPlane(&ControlPlaneInput{BaseUserData: base}) },
+		"join":   func() ([]byte, error) { return NewJoinControlPlane(&ControlPlaneInput{BaseUserData: base}) },
+		"worker": func() ([]byte, error) { return NewWorker(&WorkerInput{BaseUserData: base}) },
+	}
+
+	for name, generate := range generators {
+		t.Run(name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			out, err := generate()
+			g.Expect(err).NotTo(HaveOccurred())
+
+			userData := string(out)
+			sysctl := strings.Index(userData, `- "sysctl -w vm.max_map_count=262144"`)
+			mount := strings.Index(userData, `- "mount /dev/sdb /var/lib/rancher"`)
+			install := strings.Index(userData, "curl -sfL")
+			apply := strings.Index(userData, `- "kubectl apply -f /etc/manifests"`)
+
+			g.Expect(sysctl).To(BeNumerically(">", strings.Index(userData, "runcmd:")))
+			g.Expect(mount).To(BeNumerically(">", sysctl))
+			g.Expect(install).To(BeNumerically(">", mount))
+			g.Expect(apply).To(BeNumerically(">", install))
+		})
+	}
+}
+
+func TestInstallCommand(t *testing.T) {
+	g := NewWithT(t)
+
+	cpinput := &ControlPlaneInput{
+		BaseUserData: BaseUserData{K3sVersion: "v1.28.5+k3s1"},
+	}
+	out, err := NewInitControlPlane(cpinput)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(string(out)).To(ContainSubstring("'curl -sfL https://get.k3s.io | INSTALL_K3S_VERSION=v1.28.5+k3s1 sh -s - server && "))
+
+	cpinput = &ControlPlaneInput{
+		BaseUserData: BaseUserData{InstallScriptURL: "https://mirror.example.com/install.sh", Channel: "v1.29"},
+	}
+	out, err = NewJoinControlPlane(cpinput)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(string(out)).To(ContainSubstring("'curl -sfL https://mirror.example.com/install.sh | INSTALL_K3S_VERSION= INSTALL_K3S_CHANNEL=v1.29 sh -s - server && "))
+
+	winput := &WorkerInput{
+		BaseUserData: BaseUserData{InstallScriptURL: "https://mirror.example.com/install.sh", Channel: "stable"},
+	}
+	out, err = NewWorker(winput)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(string(out)).To(ContainSubstring("'curl -sfL https://mirror.example.com/install.sh | INSTALL_K3S_VERSION= INSTALL_K3S_CHANNEL=stable sh -s - agent && "))
+}
+
+func TestSystemProxy(t *testing.T) {
+	g := NewWithT(t)
+
+	base := BaseUserData{
+		K3sVersion: "v1.28.5+k3s1",
+		SystemProxy: &infrav1.SystemProxy{
+			HTTPProxy:  "http://proxy.example.com:3128",
+			HTTPSProxy: "http://proxy.example.com:3129",
+			NoProxy:    []string{"localhost", "10.42.0.0/16"},
+		},
+	}
+
+	out, err := NewInitControlPlane(&ControlPlaneInput{BaseUserData: base})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(string(out)).To(ContainSubstring("-   path: /etc/systemd/system/k3s.service.d/http-proxy.conf\n"))
+	g.Expect(string(out)).To(ContainSubstring("      [Service]\n" +
+		"      Environment=\"HTTP_PROXY=http://proxy.example.com:3128\"\n" +
+		"      Environment=\"HTTPS_PROXY=http://proxy.example.com:3129\"\n" +
+		"      Environment=\"NO_PROXY=localhost,10.42.0.0/16\"\n"))
+
+	proxyEnv := "HTTP_PROXY=http://proxy.example.com:3128 HTTPS_PROXY=http://proxy.example.com:3129 NO_PROXY=localhost,10.42.0.0/16"
+	g.Expect(string(out)).To(ContainSubstring("'" + proxyEnv + " curl -sfL https://get.k3s.io | " + proxyEnv + " INSTALL_K3S_VERSION=v1.28.5+k3s1 sh -s - server && "))
+
+	out, err = NewWorker(&WorkerInput{BaseUserData: base})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(string(out)).To(ContainSubstring("-   path: /etc/systemd/system/k3s-agent.service.d/http-proxy.conf\n"))
+
+	out, err = NewWorker(&WorkerInput{})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(string(out)).NotTo(ContainSubstring("http-proxy.conf"))
+}
+
+func TestSystemProxyOpenRC(t *testing.T) {
+	g := NewWithT(t)
+
+	base := BaseUserData{
+		K3sVersion: "v1.28.5+k3s1",
+		InitSystem: infrav1.InitSystemOpenRC,
+		SystemProxy: &infrav1.SystemProxy{
+			HTTPProxy: "http://proxy.example.com:3128",
+			NoProxy:   []string{"localhost", "10.42.0.0/16"},
+		},
+	}
+
+	out, err := NewInitControlPlane(&ControlPlaneInput{BaseUserData: base})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(string(out)).To(ContainSubstring("-   path: /etc/conf.d/k3s\n"))
+	g.Expect(string(out)).To(ContainSubstring("      export HTTP_PROXY=\"http://proxy.example.com:3128\"\n" +
+		"      export NO_PROXY=\"localhost,10.42.0.0/16\"\n"))
+	g.Expect(string(out)).NotTo(ContainSubstring("/etc/systemd/system/"))
+
+	out, err = NewWorker(&WorkerInput{BaseUserData: base})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(string(out)).To(ContainSubstring("-   path: /etc/conf.d/k3s-agent\n"))
+	g.Expect(string(out)).NotTo(ContainSubstring("http-proxy.conf"))
+}
+
+func TestAirgapImages(t *testing.T) {
+	const checksum = "3c3e4ae5c6ef6e1e3d2e6f1b1a4dbd9b8b39ba83b2b3a9e4e4e5d8a0b7ae3f10"
+
+	base := BaseUserData{
+		K3sVersion:           "v1.28.5+k3s1",
+		AirgapImagesURL:      "https://mirror.example.com/k3s-airgap-images-amd64.tar.zst?sig=abc",
+		AirgapImagesChecksum: checksum,
+	}
+
+	generators := map[string]func() ([]byte, error){
+		"init":   func() ([]byte, error) { return NewInitControlPlane(&ControlPlaneInput{BaseUserData: base}) },
+		"join":   func() ([]byte, error) { return NewJoinControlPlane(&ControlPlaneInput{BaseUserData: base}) },
+		"worker": func() ([]byte, error) { return NewWorker(&WorkerInput{BaseUserData: base}) },
+	}
+
+	for name, generate := range generators {
+		t.Run(name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			out, err := generate()
+			g.Expect(err).NotTo(HaveOccurred())
+			// The tarball is verified before it is moved in place, and the install only runs once it was.
+			g.Expect(string(out)).To(ContainSubstring("'mkdir -p /var/lib/rancher/k3s/agent/images" +
+				" && curl -sfL -o /var/lib/rancher/k3s/agent/images/k3s-airgap-images-amd64.tar.zst.download https://mirror.example.com/k3s-airgap-images-amd64.tar.zst?sig=abc" +
+				" && echo \"" + checksum + "  /var/lib/rancher/k3s/agent/images/k3s-airgap-images-amd64.tar.zst.download\" | sha256sum -c -" +
+				" && mv /var/lib/rancher/k3s/agent/images/k3s-airgap-images-amd64.tar.zst.download /var/lib/rancher/k3s/agent/images/k3s-airgap-images-amd64.tar.zst" +
+				" && curl -sfL https://get.k3s.io | "))
+		})
+	}
+
+	g := NewWithT(t)
+
+	withoutChecksum := base
+	withoutChecksum.AirgapImagesChecksum = ""
+	out, err := NewWorker(&WorkerInput{BaseUserData: withoutChecksum})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(string(out)).To(ContainSubstring("curl -sfL -o /var/lib/rancher/k3s/agent/images/k3s-airgap-images-amd64.tar.zst.download"))
+	g.Expect(string(out)).NotTo(ContainSubstring("sha256sum"))
+
+	out, err = NewWorker(&WorkerInput{BaseUserData: BaseUserData{K3sVersion: "v1.28.5+k3s1"}})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(string(out)).NotTo(ContainSubstring("/var/lib/rancher/k3s/agent/images"))
+}
+
+func TestControlPlaneInitRestoreFromSnapshot(t *testing.T) {
+	g := NewWithT(t)
+
+	cpinput := &ControlPlaneInput{
+		BaseUserData: BaseUserData{K3sVersion: "v1.28.5+k3s1", ClusterResetRestorePath: "/var/lib/etcd-snapshots/on-demand"},
+	}
+	out, err := NewInitControlPlane(cpinput)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(string(out)).To(ContainSubstring("'curl -sfL https://get.k3s.io | INSTALL_K3S_VERSION=v1.28.5+k3s1 INSTALL_K3S_SKIP_START=true sh -s - server" +
+		" && k3s server --cluster-reset --cluster-reset-restore-path=/var/lib/etcd-snapshots/on-demand" +
+		" && curl -sfL https://get.k3s.io | INSTALL_K3S_VERSION=v1.28.5+k3s1 sh -s - server && "))
+}
+
+func TestJoinControlPlaneTokenRotation(t *testing.T) {
+	g := NewWithT(t)
+
+	newInput := func() *ControlPlaneInput {
+		return &ControlPlaneInput{
+			BaseUserData: BaseUserData{ConfigFile: infrav1.File{Path: "/etc/rancher/k3s/config.yaml", Content: "token: old\n"}},
+			Token:        "old",
+		}
+	}
+
+	out, err := NewJoinControlPlane(newInput())
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(string(out)).NotTo(ContainSubstring("k3s token rotate"))
+
+	input := newInput()
+	input.NewToken = "new"
+	out, err = NewJoinControlPlane(input)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(string(out)).To(ContainSubstring(`sh -s - server && k3s token rotate --server https://127.0.0.1:6443 --token="old" --new-token="new"` +
+		` && sed -i "s/^token: .*/token: new/" /etc/rancher/k3s/config.yaml && mkdir -p /run/cluster-api`))
+
+	// The rotation goes through the API server port of the node, and the tokens are quoted and escaped.
+	input = newInput()
+	input.HTTPSListenPort = "7443"
+	input.NewToken = "a/b&c$d"
+	out, err = NewJoinControlPlane(input)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(string(out)).To(ContainSubstring(`k3s token rotate --server https://127.0.0.1:7443 --token="old" --new-token="a/b&c\$d"` +
+		` && sed -i "s/^token: .*/token: a\\/b\\&c\$d/" /etc/rancher/k3s/config.yaml`))
+}
@@ -23,22 +23,41 @@ const (
 {{template "files" .WriteFiles}}
 runcmd:
 {{- template "commands" .PreK3sCommands }}
-  - 'curl -sfL https://get.k3s.io | INSTALL_K3S_VERSION=%s sh -s - server && mkdir -p /run/cluster-api && echo success > /run/cluster-api/bootstrap-success.complete'
+  - '{{.BootstrapCommand}}'
 {{- template "commands" .PostK3sCommands }}
 `
 )
 
 // NewInitControlPlane returns the user data string to be used on a controlplane instance.
 func NewJoinControlPlane(input *ControlPlaneInput) ([]byte, error) {
-	input.Header = cloudConfigHeader
 	input.WriteFiles = append(input.WriteFiles, input.AdditionalFiles...)
+	input.WriteFiles = append(input.WriteFiles, input.serviceFiles("k3s")...)
 	input.WriteFiles = append(input.WriteFiles, input.ConfigFile)
 
-	controlPlaneCloudJoinWithVersion := fmt.Sprintf(controlPlaneCloudJoin, input.K3sVersion)
-	userData, err := generate("JoinControlplane", controlPlaneCloudJoinWithVersion, input)
+	installCommand := input.joinCommand(input.installCommand("server"), "k3s")
+	if input.NewToken != "" {
+		// Switch the cluster to the new token once this server has joined with the current one, and keep its own
+		// configuration in line with the cluster so it can be restarted.
+		installCommand = fmt.Sprintf("%s && %s && sed -i \"s/^token: .*/token: %s/\" %s",
+			installCommand, input.tokenRotateCommand(), doubleQuoteEscaper.Replace(sedReplacementEscaper.Replace(input.NewToken)),
+			input.ConfigFile.Path)
+	}
+
+	input.BootstrapCommand = input.bootstrapCommand(installCommand)
+	userData, err := input.render("JoinControlplane", controlPlaneCloudJoin)
 	if err != nil {
 		return nil, err
 	}
 
 	return userData, nil
 }
+
+// tokenRotateCommand returns the command switching the cluster from Token to NewToken through the local API server.
+func (input *ControlPlaneInput) tokenRotateCommand() string {
+	port := input.HTTPSListenPort
+	if port == "" {
+		port = defaultHTTPSListenPort
+	}
+	return fmt.Sprintf("k3s token rotate --server https://127.0.0.1:%s --token=\"%s\" --new-token=\"%s\"",
+		port, doubleQuoteEscaper.Replace(input.Token), doubleQuoteEscaper.Replace(input.NewToken))
+}
@@ -0,0 +1,84 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cloudinit
+
+import (
+	"encoding/json"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/onsi/gomega"
+
+	bootstrapv1 "github.com/cluster-api-provider-k3s/cluster-api-k3s/bootstrap/api/v1beta1"
+)
+
+var updateGolden = flag.Bool("update", false, "update the golden files in testdata")
+
+func TestJoinControlPlaneGolden(t *testing.T) {
+	newInput := func(format bootstrapv1.Format) *ControlPlaneInput {
+		return &ControlPlaneInput{
+			BaseUserData: BaseUserData{
+				PreK3sCommands:  []string{"sysctl -w vm.max_map_count=262144"},
+				PostK3sCommands: []string{"echo done > /tmp/post"},
+				AdditionalFiles: []bootstrapv1.File{
+					{Path: "/etc/motd", Content: "managed by cluster-api\n", Owner: "root:root", Permissions: "0644"},
+					{Path: "/etc/example/blob", Encoding: bootstrapv1.Base64, Content: "aGk="},
+				},
+				ConfigFile: bootstrapv1.File{
+					Path:        "/etc/rancher/k3s/config.yaml",
+					Content:     "server: https://cp.example.com:6443\ntoken: token\n",
+					Owner:       "root:root",
+					Permissions: "0640",
+				},
+				K3sVersion:  "v1.28.5+k3s1",
+				SystemProxy: &bootstrapv1.SystemProxy{HTTPSProxy: "http://proxy.example.com:3128"},
+				Format:      format,
+			},
+		}
+	}
+
+	tests := []struct {
+		format bootstrapv1.Format
+		golden string
+	}{
+		{format: bootstrapv1.CloudConfig, golden: "controlplane_join.cloud-config.golden"},
+		{format: bootstrapv1.Ignition, golden: "controlplane_join.ignition.golden"},
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.format), func(t *testing.T) {
+			g := NewWithT(t)
+
+			out, err := NewJoinControlPlane(newInput(tt.format))
+			g.Expect(err).NotTo(HaveOccurred())
+
+			if tt.format == bootstrapv1.Ignition {
+				g.Expect(json.Valid(out)).To(BeTrue())
+			}
+
+			golden := filepath.Join("testdata", tt.golden)
+			if *updateGolden {
+				g.Expect(os.WriteFile(golden, out, 0o600)).To(Succeed())
+			}
+			expected, err := os.ReadFile(golden)
+			g.Expect(err).NotTo(HaveOccurred())
+			g.Expect(string(out)).To(Equal(string(expected)))
+		})
+	}
+}
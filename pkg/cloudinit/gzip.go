@@ -0,0 +1,88 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cloudinit
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"fmt"
+	"mime/multipart"
+	"net/textproto"
+)
+
+const (
+	// UserDataSizeLimit is the smallest user-data size limit among the common cloud providers (AWS EC2),
+	// larger user-data is compressed unless compression is disabled.
+	UserDataSizeLimit = 16 * 1024
+
+	gzipMultipartBoundary = "MIMEBOUNDARY-KTHREES-GZIP"
+
+	// base64LineLength is the maximum encoded line length allowed by RFC 2045.
+	base64LineLength = 76
+)
+
+// GzipMultipart compresses the user-data and wraps it in a single part MIME multipart message.
+// cloud-init decodes and decompresses gzip parts on boot, then processes the original user-data.
+func GzipMultipart(userData []byte) ([]byte, error) {
+	var compressed bytes.Buffer
+	zw, err := gzip.NewWriterLevel(&compressed, gzip.BestCompression)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create gzip writer: %w", err)
+	}
+	if _, err := zw.Write(userData); err != nil {
+		return nil, fmt.Errorf("failed to compress user-data: %w", err)
+	}
+	if err := zw.Close(); err != nil {
+		return nil, fmt.Errorf("failed to compress user-data: %w", err)
+	}
+
+	var out bytes.Buffer
+	mw := multipart.NewWriter(&out)
+	if err := mw.SetBoundary(gzipMultipartBoundary); err != nil {
+		return nil, fmt.Errorf("failed to set multipart boundary: %w", err)
+	}
+
+	fmt.Fprintf(&out, "MIME-Version: 1.0\r\nContent-Type: multipart/mixed; boundary=%q\r\n\r\n", gzipMultipartBoundary)
+
+	part, err := mw.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {"application/x-gzip"},
+		"Content-Transfer-Encoding": {"base64"},
+		"Content-Disposition":       {`attachment; filename="user-data.gz"`},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create multipart part: %w", err)
+	}
+
+	encoded := base64.StdEncoding.EncodeToString(compressed.Bytes())
+	for len(encoded) > 0 {
+		n := base64LineLength
+		if len(encoded) < n {
+			n = len(encoded)
+		}
+		if _, err := fmt.Fprintf(part, "%s\r\n", encoded[:n]); err != nil {
+			return nil, fmt.Errorf("failed to write multipart part: %w", err)
+		}
+		encoded = encoded[n:]
+	}
+
+	if err := mw.Close(); err != nil {
+		return nil, fmt.Errorf("failed to close multipart message: %w", err)
+	}
+
+	return out.Bytes(), nil
+}
@@ -0,0 +1,75 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cloudinit
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"testing"
+
+	. "github.com/onsi/gomega"
+
+	bootstrapv1 "github.com/cluster-api-provider-k3s/cluster-api-k3s/bootstrap/api/v1beta1"
+)
+
+func TestGzipMultipart(t *testing.T) {
+	g := NewWithT(t)
+
+	files := make([]bootstrapv1.File, 0, 200)
+	for i := 0; i < 200; i++ {
+		files = append(files, bootstrapv1.File{
+			Path:    fmt.Sprintf("/etc/example/config-%d.yaml", i),
+			Content: fmt.Sprintf("apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: config-%d\n", i),
+		})
+	}
+	userData, err := NewWorker(&WorkerInput{BaseUserData: BaseUserData{AdditionalFiles: files}})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(len(userData)).To(BeNumerically(">", UserDataSizeLimit))
+
+	out, err := GzipMultipart(userData)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(len(out)).To(BeNumerically("<", len(userData)/4))
+
+	msg, err := mail.ReadMessage(bytes.NewReader(out))
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(msg.Header.Get("MIME-Version")).To(Equal("1.0"))
+
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(mediaType).To(Equal("multipart/mixed"))
+
+	mr := multipart.NewReader(msg.Body, params["boundary"])
+	part, err := mr.NextPart()
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(part.Header.Get("Content-Type")).To(Equal("application/x-gzip"))
+	g.Expect(part.Header.Get("Content-Transfer-Encoding")).To(Equal("base64"))
+
+	zr, err := gzip.NewReader(base64.NewDecoder(base64.StdEncoding, part))
+	g.Expect(err).NotTo(HaveOccurred())
+	decompressed, err := io.ReadAll(zr)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(decompressed).To(Equal(userData))
+
+	_, err = mr.NextPart()
+	g.Expect(err).To(Equal(io.EOF))
+}
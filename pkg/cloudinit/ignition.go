@@ -0,0 +1,182 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cloudinit
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+
+	bootstrapv1 "github.com/cluster-api-provider-k3s/cluster-api-k3s/bootstrap/api/v1beta1"
+)
+
+const (
+	ignitionVersion = "3.3.0"
+
+	bootstrapScriptPath    = "/etc/cluster-api/k3s-bootstrap.sh"
+	bootstrapCompletedPath = "/var/lib/cluster-api/k3s-bootstrap.complete"
+	bootstrapUnitName      = "k3s-bootstrap.service"
+
+	// bootstrapUnit runs the bootstrap script once, like cloud-init runs runcmd once per instance.
+	bootstrapUnit = `[Unit]
+Description=Bootstrap k3s with Cluster API
+Wants=network-online.target
+After=network-online.target
+ConditionPathExists=!` + bootstrapCompletedPath + `
+
+[Service]
+Type=oneshot
+RemainAfterExit=yes
+ExecStart=` + bootstrapScriptPath + `
+
+[Install]
+WantedBy=multi-user.target
+`
+)
+
+type ignitionConfig struct {
+	Ignition ignitionMetadata `json:"ignition"`
+	Storage  ignitionStorage  `json:"storage"`
+	Systemd  ignitionSystemd  `json:"systemd"`
+}
+
+type ignitionMetadata struct {
+	Version string `json:"version"`
+}
+
+type ignitionStorage struct {
+	Files []ignitionFile `json:"files"`
+}
+
+type ignitionFile struct {
+	Path      string           `json:"path"`
+	Overwrite bool             `json:"overwrite"`
+	Mode      *int             `json:"mode,omitempty"`
+	User      *ignitionName    `json:"user,omitempty"`
+	Group     *ignitionName    `json:"group,omitempty"`
+	Contents  ignitionContents `json:"contents"`
+}
+
+type ignitionName struct {
+	Name string `json:"name"`
+}
+
+type ignitionContents struct {
+	Source      string `json:"source"`
+	Compression string `json:"compression,omitempty"`
+}
+
+type ignitionSystemd struct {
+	Units []ignitionUnit `json:"units"`
+}
+
+type ignitionUnit struct {
+	Name     string `json:"name"`
+	Enabled  bool   `json:"enabled"`
+	Contents string `json:"contents"`
+}
+
+// generateIgnition renders the user data as an Ignition config. Ignition has no equivalent of runcmd,
+// the commands are written to a script run once by a systemd unit.
+func generateIgnition(input *BaseUserData) ([]byte, error) {
+	config := ignitionConfig{Ignition: ignitionMetadata{Version: ignitionVersion}}
+
+	for _, f := range input.WriteFiles {
+		file, err := toIgnitionFile(f)
+		if err != nil {
+			return nil, err
+		}
+		config.Storage.Files = append(config.Storage.Files, file)
+	}
+
+	script, err := toIgnitionFile(bootstrapv1.File{
+		Path:        bootstrapScriptPath,
+		Owner:       k3sScriptOwner,
+		Permissions: "0700",
+		Content:     input.bootstrapScript(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	config.Storage.Files = append(config.Storage.Files, script)
+
+	config.Systemd.Units = append(config.Systemd.Units, ignitionUnit{
+		Name:     bootstrapUnitName,
+		Enabled:  true,
+		Contents: bootstrapUnit,
+	})
+
+	out, err := json.MarshalIndent(config, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal ignition config: %w", err)
+	}
+	return out, nil
+}
+
+// bootstrapScript returns the commands cloud-init would run through runcmd, in the same order.
+func (input *BaseUserData) bootstrapScript() string {
+	var script strings.Builder
+	script.WriteString("#!/bin/sh\n")
+	for _, command := range input.PreK3sCommands {
+		script.WriteString(command + "\n")
+	}
+	script.WriteString(input.BootstrapCommand + "\n")
+	for _, command := range input.PostK3sCommands {
+		script.WriteString(command + "\n")
+	}
+	fmt.Fprintf(&script, "mkdir -p %s && touch %s\n", path.Dir(bootstrapCompletedPath), bootstrapCompletedPath)
+	return script.String()
+}
+
+// toIgnitionFile converts a cloud-init file, the content is always passed as a base64 data URL.
+func toIgnitionFile(f bootstrapv1.File) (ignitionFile, error) {
+	file := ignitionFile{Path: f.Path, Overwrite: true}
+
+	// Encoded content may be wrapped over several lines, which a data URL doesn't allow.
+	encoded := strings.Join(strings.Fields(f.Content), "")
+	switch f.Encoding {
+	case bootstrapv1.Base64:
+		file.Contents.Source = "data:;base64," + encoded
+	case bootstrapv1.Gzip, bootstrapv1.GzipBase64:
+		file.Contents.Source = "data:;base64," + encoded
+		file.Contents.Compression = "gzip"
+	default:
+		file.Contents.Source = "data:;base64," + base64.StdEncoding.EncodeToString([]byte(f.Content))
+	}
+
+	if f.Permissions != "" {
+		mode, err := strconv.ParseInt(f.Permissions, 8, 32)
+		if err != nil {
+			return ignitionFile{}, fmt.Errorf("invalid permissions %q for file %s: %w", f.Permissions, f.Path, err)
+		}
+		m := int(mode)
+		file.Mode = &m
+	}
+
+	if f.Owner != "" {
+		user, group, _ := strings.Cut(f.Owner, ":")
+		file.User = &ignitionName{Name: user}
+		if group != "" {
+			file.Group = &ignitionName{Name: group}
+		}
+	}
+
+	return file, nil
+}
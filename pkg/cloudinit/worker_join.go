@@ -16,14 +16,12 @@ limitations under the License.
 
 package cloudinit
 
-import "fmt"
-
 const (
 	workerCloudInit = `{{.Header}}
 {{template "files" .WriteFiles}}
 runcmd:
 {{- template "commands" .PreK3sCommands }}
-  - 'curl -sfL https://get.k3s.io |  INSTALL_K3S_VERSION=%s sh -s - agent && mkdir -p /run/cluster-api && echo success > /run/cluster-api/bootstrap-success.complete'
+  - '{{.BootstrapCommand}}'
 {{- template "commands" .PostK3sCommands }}
 `
 )
@@ -35,12 +33,12 @@ type WorkerInput struct {
 
 // NewInitControlPlane returns the user data string to be used on a controlplane instance.
 func NewWorker(input *WorkerInput) ([]byte, error) {
-	input.Header = cloudConfigHeader
 	input.WriteFiles = append(input.WriteFiles, input.AdditionalFiles...)
+	input.WriteFiles = append(input.WriteFiles, input.serviceFiles("k3s-agent")...)
 	input.WriteFiles = append(input.WriteFiles, input.ConfigFile)
 
-	workerCloudInitWithVersion := fmt.Sprintf(workerCloudInit, input.K3sVersion)
-	userData, err := generate("Worker", workerCloudInitWithVersion, input)
+	input.BootstrapCommand = input.bootstrapCommand(input.joinCommand(input.installCommand("agent"), "k3s-agent"))
+	userData, err := input.render("Worker", workerCloudInit)
 	if err != nil {
 		return nil, err
 	}
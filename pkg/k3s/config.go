@@ -2,6 +2,7 @@ package k3s
 
 import (
 	"fmt"
+	"path"
 	"strings"
 
 	bootstrapv1 "github.com/cluster-api-provider-k3s/cluster-api-k3s/bootstrap/api/v1beta1"
@@ -9,11 +10,24 @@ import (
 
 const DefaultK3sConfigLocation = "/etc/rancher/k3s/config.yaml"
 
+// DefaultK3sConfigDropInDir is where k3s reads the configuration fragments merged into its config file from.
+const DefaultK3sConfigDropInDir = "/etc/rancher/k3s/config.yaml.d"
+
+// DefaultK3sRegistriesLocation is where k3s reads its private registry configuration from by default.
+const DefaultK3sRegistriesLocation = "/etc/rancher/k3s/registries.yaml"
+
+// ContainerdConfigTemplateLocation returns where k3s reads the template it renders the containerd config from,
+// under the given data dir.
+func ContainerdConfigTemplateLocation(dataDir string) string {
+	return path.Join(dataDir, "agent", "etc", "containerd", "config.toml.tmpl")
+}
+
 type K3sServerConfig struct {
 	DisableCloudController    bool     `json:"disable-cloud-controller,omitempty"`
 	KubeAPIServerArgs         []string `json:"kube-apiserver-arg,omitempty"`
 	KubeControllerManagerArgs []string `json:"kube-controller-manager-arg,omitempty"`
 	KubeSchedulerArgs         []string `json:"kube-scheduler-arg,omitempty"`
+	EtcdArgs                  []string `json:"etcd-arg,omitempty"`
 	TLSSan                    []string `json:"tls-san,omitempty"`
 	BindAddress               string   `json:"bind-address,omitempty"`
 	HTTPSListenPort           string   `json:"https-listen-port,omitempty"`
@@ -24,39 +38,72 @@ type K3sServerConfig struct {
 	ClusterDNS                string   `json:"cluster-dns,omitempty"`
 	ClusterDomain             string   `json:"cluster-domain,omitempty"`
 	DisableComponents         []string `json:"disable,omitempty"`
+	FlannelBackend            string   `json:"flannel-backend,omitempty"`
+	DisableNetworkPolicy      bool     `json:"disable-network-policy,omitempty"`
+	DisableKubeProxy          bool     `json:"disable-kube-proxy,omitempty"`
 	ClusterInit               bool     `json:"cluster-init,omitempty"`
+	EmbeddedRegistry          bool     `json:"embedded-registry,omitempty"`
+	SecretsEncryption         bool     `json:"secrets-encryption,omitempty"`
+	DatastoreEndpoint         string   `json:"datastore-endpoint,omitempty"`
+	WriteKubeconfigMode       string   `json:"write-kubeconfig-mode,omitempty"`
+	K3sEtcdSnapshotConfig     `json:",inline"`
 	K3sAgentConfig            `json:",inline"`
 }
 
+type K3sEtcdSnapshotConfig struct {
+	EtcdSnapshotScheduleCron string `json:"etcd-snapshot-schedule-cron,omitempty"`
+	EtcdSnapshotRetention    *int32 `json:"etcd-snapshot-retention,omitempty"`
+	EtcdSnapshotDir          string `json:"etcd-snapshot-dir,omitempty"`
+	EtcdS3                   bool   `json:"etcd-s3,omitempty"`
+	EtcdS3Bucket             string `json:"etcd-s3-bucket,omitempty"`
+	EtcdS3Region             string `json:"etcd-s3-region,omitempty"`
+	EtcdS3Endpoint           string `json:"etcd-s3-endpoint,omitempty"`
+	EtcdS3Folder             string `json:"etcd-s3-folder,omitempty"`
+	EtcdS3AccessKey          string `json:"etcd-s3-access-key,omitempty"`
+	EtcdS3SecretKey          string `json:"etcd-s3-secret-key,omitempty"`
+}
+
 type K3sAgentConfig struct {
-	Token           string   `json:"token,omitempty"`
-	Server          string   `json:"server,omitempty"`
-	KubeletArgs     []string `json:"kubelet-arg,omitempty"`
-	NodeLabels      []string `json:"node-label,omitempty"`
-	NodeTaints      []string `json:"node-taint,omitempty"`
-	PrivateRegistry string   `json:"private-registry,omitempty"`
-	KubeProxyArgs   []string `json:"kube-proxy-arg,omitempty"`
-	NodeName        string   `json:"node-name,omitempty"`
+	Token                 string   `json:"token,omitempty"`
+	Server                string   `json:"server,omitempty"`
+	KubeletArgs           []string `json:"kubelet-arg,omitempty"`
+	NodeLabels            []string `json:"node-label,omitempty"`
+	NodeTaints            []string `json:"node-taint,omitempty"`
+	PrivateRegistry       string   `json:"private-registry,omitempty"`
+	KubeProxyArgs         []string `json:"kube-proxy-arg,omitempty"`
+	NodeName              string   `json:"node-name,omitempty"`
+	NodeIP                string   `json:"node-ip,omitempty"`
+	NodeExternalIP        string   `json:"node-external-ip,omitempty"`
+	ProtectKernelDefaults bool     `json:"protect-kernel-defaults,omitempty"`
+	DataDir               string   `json:"data-dir,omitempty"`
 }
 
 func GenerateInitControlPlaneConfig(controlPlaneEndpoint string, token string, serverConfig bootstrapv1.KThreesServerConfig, agentConfig bootstrapv1.KThreesAgentConfig) K3sServerConfig {
 	kubeletExtraArgs := getKubeletExtraArgs(serverConfig)
 	k3sServerConfig := K3sServerConfig{
 		DisableCloudController:    !serverConfig.DisableExternalCloudProvider,
-		ClusterInit:               true,
+		ClusterInit:               !serverConfig.Datastore.IsExternal(),
 		KubeAPIServerArgs:         append(serverConfig.KubeAPIServerArgs, "anonymous-auth=true", getTLSCipherSuiteArg()),
-		TLSSan:                    append(serverConfig.TLSSan, controlPlaneEndpoint),
+		TLSSan:                    getTLSSan(serverConfig.TLSSan, controlPlaneEndpoint),
 		KubeControllerManagerArgs: append(serverConfig.KubeControllerManagerArgs, kubeletExtraArgs...),
 		KubeSchedulerArgs:         serverConfig.KubeSchedulerArgs,
+		EtcdArgs:                  serverConfig.EtcdArgs,
 		BindAddress:               serverConfig.BindAddress,
 		HTTPSListenPort:           serverConfig.HTTPSListenPort,
 		AdvertiseAddress:          serverConfig.AdvertiseAddress,
 		AdvertisePort:             serverConfig.AdvertisePort,
-		ClusterCidr:               serverConfig.ClusterCidr,
-		ServiceCidr:               serverConfig.ServiceCidr,
+		ClusterCidr:               getDualStackList(serverConfig.ClusterCidr),
+		ServiceCidr:               getDualStackList(serverConfig.ServiceCidr),
 		ClusterDNS:                serverConfig.ClusterDNS,
 		ClusterDomain:             serverConfig.ClusterDomain,
-		DisableComponents:         serverConfig.DisableComponents,
+		DisableComponents:         getDisableComponents(serverConfig.DisableComponents),
+		FlannelBackend:            string(serverConfig.FlannelBackend),
+		DisableNetworkPolicy:      getDisableNetworkPolicy(serverConfig),
+		DisableKubeProxy:          serverConfig.KubeProxyDisabled(),
+		EmbeddedRegistry:          serverConfig.EmbeddedRegistryEnabled(),
+		SecretsEncryption:         serverConfig.SecretsEncryptionEnabled(),
+		WriteKubeconfigMode:       serverConfig.WriteKubeconfigMode,
+		K3sEtcdSnapshotConfig:     getEtcdSnapshotConfig(serverConfig.EtcdSnapshot),
 	}
 
 	k3sServerConfig.K3sAgentConfig = K3sAgentConfig{
@@ -67,6 +114,8 @@ func GenerateInitControlPlaneConfig(controlPlaneEndpoint string, token string, s
 		PrivateRegistry: agentConfig.PrivateRegistry,
 		KubeProxyArgs:   agentConfig.KubeProxyArgs,
 		NodeName:        agentConfig.NodeName,
+		NodeIP:          getDualStackList(agentConfig.NodeIP),
+		NodeExternalIP:  getDualStackList(agentConfig.NodeExternalIP),
 	}
 
 	return k3sServerConfig
@@ -77,18 +126,26 @@ func GenerateJoinControlPlaneConfig(serverURL string, token string, controlplane
 	k3sServerConfig := K3sServerConfig{
 		DisableCloudController:    !serverConfig.DisableExternalCloudProvider,
 		KubeAPIServerArgs:         append(serverConfig.KubeAPIServerArgs, "anonymous-auth=true", getTLSCipherSuiteArg()),
-		TLSSan:                    append(serverConfig.TLSSan, controlplaneendpoint),
+		TLSSan:                    getTLSSan(serverConfig.TLSSan, controlplaneendpoint),
 		KubeControllerManagerArgs: append(serverConfig.KubeControllerManagerArgs, kubeletExtraArgs...),
 		KubeSchedulerArgs:         serverConfig.KubeSchedulerArgs,
+		EtcdArgs:                  serverConfig.EtcdArgs,
 		BindAddress:               serverConfig.BindAddress,
 		HTTPSListenPort:           serverConfig.HTTPSListenPort,
 		AdvertiseAddress:          serverConfig.AdvertiseAddress,
 		AdvertisePort:             serverConfig.AdvertisePort,
-		ClusterCidr:               serverConfig.ClusterCidr,
-		ServiceCidr:               serverConfig.ServiceCidr,
+		ClusterCidr:               getDualStackList(serverConfig.ClusterCidr),
+		ServiceCidr:               getDualStackList(serverConfig.ServiceCidr),
 		ClusterDNS:                serverConfig.ClusterDNS,
 		ClusterDomain:             serverConfig.ClusterDomain,
-		DisableComponents:         serverConfig.DisableComponents,
+		DisableComponents:         getDisableComponents(serverConfig.DisableComponents),
+		FlannelBackend:            string(serverConfig.FlannelBackend),
+		DisableNetworkPolicy:      getDisableNetworkPolicy(serverConfig),
+		DisableKubeProxy:          serverConfig.KubeProxyDisabled(),
+		EmbeddedRegistry:          serverConfig.EmbeddedRegistryEnabled(),
+		SecretsEncryption:         serverConfig.SecretsEncryptionEnabled(),
+		WriteKubeconfigMode:       serverConfig.WriteKubeconfigMode,
+		K3sEtcdSnapshotConfig:     getEtcdSnapshotConfig(serverConfig.EtcdSnapshot),
 	}
 
 	k3sServerConfig.K3sAgentConfig = K3sAgentConfig{
@@ -100,6 +157,13 @@ func GenerateJoinControlPlaneConfig(serverURL string, token string, controlplane
 		PrivateRegistry: agentConfig.PrivateRegistry,
 		KubeProxyArgs:   agentConfig.KubeProxyArgs,
 		NodeName:        agentConfig.NodeName,
+		NodeIP:          getDualStackList(agentConfig.NodeIP),
+		NodeExternalIP:  getDualStackList(agentConfig.NodeExternalIP),
+	}
+
+	// With an external datastore the servers share their state through the datastore, they don't join an existing server.
+	if serverConfig.Datastore.IsExternal() {
+		k3sServerConfig.Server = ""
 	}
 
 	return k3sServerConfig
@@ -116,9 +180,34 @@ func GenerateWorkerConfig(serverURL string, token string, serverConfig bootstrap
 		PrivateRegistry: agentConfig.PrivateRegistry,
 		KubeProxyArgs:   agentConfig.KubeProxyArgs,
 		NodeName:        agentConfig.NodeName,
+		NodeIP:          getDualStackList(agentConfig.NodeIP),
+		NodeExternalIP:  getDualStackList(agentConfig.NodeExternalIP),
 	}
 }
 
+// getEtcdSnapshotConfig renders the etcd snapshot settings, S3 credentials are resolved from their secret by the caller.
+func getEtcdSnapshotConfig(snapshot *bootstrapv1.EtcdSnapshotConfig) K3sEtcdSnapshotConfig {
+	if snapshot == nil {
+		return K3sEtcdSnapshotConfig{}
+	}
+
+	config := K3sEtcdSnapshotConfig{
+		EtcdSnapshotScheduleCron: snapshot.ScheduleCron,
+		EtcdSnapshotRetention:    snapshot.Retention,
+		EtcdSnapshotDir:          snapshot.Dir,
+	}
+
+	if snapshot.S3 != nil {
+		config.EtcdS3 = true
+		config.EtcdS3Bucket = snapshot.S3.Bucket
+		config.EtcdS3Region = snapshot.S3.Region
+		config.EtcdS3Endpoint = snapshot.S3.Endpoint
+		config.EtcdS3Folder = snapshot.S3.Folder
+	}
+
+	return config
+}
+
 func getTLSCipherSuiteArg() string {
 	/**
 	Can't use this method because k3s is using older apiserver pkgs that hardcode a subset of ciphers.
@@ -156,6 +245,59 @@ func getTLSCipherSuiteArg() string {
 	return fmt.Sprintf("tls-cipher-suites=%s", ciphersList)
 }
 
+// getTLSSan returns the user provided SANs with the control plane endpoint host added, without duplicates.
+func getTLSSan(tlsSan []string, controlPlaneEndpoint string) []string {
+	sans := make([]string, 0, len(tlsSan)+1)
+	seen := map[string]bool{}
+	add := func(san string) {
+		if san != "" && !seen[san] {
+			seen[san] = true
+			sans = append(sans, san)
+		}
+	}
+
+	for _, san := range tlsSan {
+		add(san)
+	}
+	add(controlPlaneEndpoint)
+	return sans
+}
+
+// getDualStackList renders a comma-separated single or dual-stack list, such as CIDRs or node IPs, the way k3s
+// expects it, without spaces.
+func getDualStackList(values string) string {
+	if values == "" {
+		return ""
+	}
+
+	entries := strings.Split(values, ",")
+	for i := range entries {
+		entries[i] = strings.TrimSpace(entries[i])
+	}
+	return strings.Join(entries, ",")
+}
+
+// getDisableNetworkPolicy disables the network policy controller when asked to, or by default when flannel is
+// replaced by another CNI.
+func getDisableNetworkPolicy(serverConfig bootstrapv1.KThreesServerConfig) bool {
+	if serverConfig.DisableNetworkPolicy != nil {
+		return *serverConfig.DisableNetworkPolicy
+	}
+	return serverConfig.FlannelBackend == bootstrapv1.FlannelBackendNone
+}
+
+func getDisableComponents(components []bootstrapv1.DisabledComponent) []string {
+	if len(components) == 0 {
+		return nil
+	}
+
+	disable := make([]string, 0, len(components))
+	for _, component := range components {
+		disable = append(disable, string(component))
+	}
+	return disable
+}
+
 func getKubeletExtraArgs(serverConfig bootstrapv1.KThreesServerConfig) []string {
 	kubeletExtraArgs := []string{}
 	if !serverConfig.DisableExternalCloudProvider {
@@ -173,17 +173,33 @@ func (c *ControlPlane) NextFailureDomainForScaleUp() *string {
 }
 
 // InitialControlPlaneConfig returns a new KThreesConfigSpec that is to be used for an initializing control plane.
+// If a control plane that was initialized before lost all its machines, the config restores etcd from the snapshot
+// requested through the RestoreSnapshotAnnotation.
 func (c *ControlPlane) InitialControlPlaneConfig() *bootstrapv1.KThreesConfigSpec {
 	bootstrapSpec := c.KCP.Spec.KThreesConfigSpec.DeepCopy()
+	if path, ok := c.KCP.Annotations[controlplanev1.RestoreSnapshotAnnotation]; ok && c.KCP.Status.Initialized {
+		bootstrapSpec.ServerConfig.ClusterResetRestorePath = path
+	}
+	c.addSpecSettings(bootstrapSpec)
 	return bootstrapSpec
 }
 
 // JoinControlPlaneConfig returns a new KThreesConfigSpec that is to be used for joining control planes.
 func (c *ControlPlane) JoinControlPlaneConfig() *bootstrapv1.KThreesConfigSpec {
 	bootstrapSpec := c.KCP.Spec.KThreesConfigSpec.DeepCopy()
+	c.addSpecSettings(bootstrapSpec)
 	return bootstrapSpec
 }
 
+// addSpecSettings adds the settings of the KCP spec the servers get through their bootstrap config: the etcd
+// arguments, and the files of the manifests to auto-deploy.
+func (c *ControlPlane) addSpecSettings(bootstrapSpec *bootstrapv1.KThreesConfigSpec) {
+	if arg := c.KCP.EtcdQuotaBackendBytesArg(); arg != "" {
+		bootstrapSpec.ServerConfig.EtcdArgs = append(bootstrapSpec.ServerConfig.EtcdArgs, arg)
+	}
+	bootstrapSpec.Files = append(bootstrapSpec.Files, c.KCP.ManifestFiles()...)
+}
+
 // GenerateKThreesConfig generates a new KThreesConfig config for creating new control plane nodes.
 func (c *ControlPlane) GenerateKThreesConfig(spec *bootstrapv1.KThreesConfigSpec) *bootstrapv1.KThreesConfig {
 	// Create an owner reference without a controller reference because the owning controller is the machine controller
@@ -265,6 +281,10 @@ func (c *ControlPlane) MachinesNeedingRollout() FilterableMachineCollection {
 	return machines.AnyFilter(
 		// Machines that are scheduled for rollout (KCP.Spec.UpgradeAfter set, the UpgradeAfter deadline is expired, and the machine was created before the deadline).
 		machinefilters.ShouldRolloutAfter(&c.reconciliationTime, c.KCP.Spec.UpgradeAfter),
+		// Machines created before a certificates rotation was requested.
+		machinefilters.ShouldRolloutAfter(&c.reconciliationTime, c.KCP.CertificatesRotationTime()),
+		// Machines created before a token rotation was requested.
+		machinefilters.ShouldRolloutAfter(&c.reconciliationTime, c.KCP.TokenRotationTime()),
 		// Machines that do not match with KCP config.
 		machinefilters.Not(machinefilters.MatchesKCPConfiguration(c.infraResources, c.kthreesConfigs, c.KCP)),
 	)
@@ -312,9 +332,9 @@ func getKThreesConfigs(ctx context.Context, cl client.Client, machines Filterabl
 	return result, nil
 }
 
-// IsEtcdManaged returns true if the control plane relies on a managed etcd.
+// IsEtcdManaged returns true if the control plane relies on a managed etcd, i.e. the k3s embedded etcd.
 func (c *ControlPlane) IsEtcdManaged() bool {
-	return false
+	return c.KCP.Spec.KThreesConfigSpec.IsEtcdEmbedded()
 }
 
 // UnhealthyMachines returns the list of control plane machines marked as unhealthy by MHC.
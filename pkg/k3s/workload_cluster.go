@@ -4,11 +4,11 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"sort"
 	"strings"
+	"time"
 
 	corev1 "k8s.io/api/core/v1"
-	apierrors "k8s.io/apimachinery/pkg/api/errors"
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/util/sets"
 	clusterv1 "sigs.k8s.io/cluster-api/api/v1beta1"
 	"sigs.k8s.io/cluster-api/util"
@@ -35,9 +35,12 @@ type WorkloadCluster interface {
 	ClusterStatus(ctx context.Context) (ClusterStatus, error)
 	UpdateAgentConditions(ctx context.Context, controlPlane *ControlPlane)
 	UpdateEtcdConditions(ctx context.Context, controlPlane *ControlPlane)
+	CertificatesExpiry(ctx context.Context) (time.Time, error)
+	SecretsEncryptionStages(ctx context.Context) (map[string]string, error)
 	// Upgrade related tasks.
+	TakeEtcdSnapshot(ctx context.Context, name string) (bool, error)
 
-	//	RemoveEtcdMemberForMachine(ctx context.Context, machine *clusterv1.Machine) error
+	RemoveEtcdMemberForMachine(ctx context.Context, machine *clusterv1.Machine) (bool, error)
 
 	//	ForwardEtcdLeadership(ctx context.Context, machine *clusterv1.Machine, leaderCandidate *clusterv1.Machine) error
 	//	AllowBootstrapTokensToGetNodes(ctx context.Context) error
@@ -60,6 +63,10 @@ type ClusterStatus struct {
 	Nodes int32
 	// ReadyNodes are the count of nodes that are reporting ready
 	ReadyNodes int32
+	// NodeVersions are the kubelet versions reported by the nodes, by node name
+	NodeVersions map[string]string
+	// NodeReady is whether each node is reporting ready, by node name
+	NodeReady map[string]bool
 }
 
 func (w *Workload) getControlPlaneNodes(ctx context.Context) (*corev1.NodeList, error) {
@@ -75,7 +82,7 @@ func (w *Workload) getControlPlaneNodes(ctx context.Context) (*corev1.NodeList,
 
 // ClusterStatus returns the status of the cluster.
 func (w *Workload) ClusterStatus(ctx context.Context) (ClusterStatus, error) {
-	status := ClusterStatus{}
+	status := ClusterStatus{NodeVersions: map[string]string{}, NodeReady: map[string]bool{}}
 
 	// count the control plane nodes
 	nodes, err := w.getControlPlaneNodes(ctx)
@@ -86,9 +93,11 @@ func (w *Workload) ClusterStatus(ctx context.Context) (ClusterStatus, error) {
 	for _, node := range nodes.Items {
 		nodeCopy := node
 		status.Nodes++
-		if util.IsNodeReady(&nodeCopy) {
+		status.NodeReady[node.Name] = util.IsNodeReady(&nodeCopy)
+		if status.NodeReady[node.Name] {
 			status.ReadyNodes++
 		}
+		status.NodeVersions[node.Name] = node.Status.NodeInfo.KubeletVersion
 	}
 
 	return status, nil
@@ -182,28 +191,13 @@ func (w *Workload) UpdateAgentConditions(ctx context.Context, controlPlane *Cont
 			continue
 		}
 
-		targetnode := corev1.Node{}
-		nodeKey := ctrlclient.ObjectKey{
-			Namespace: metav1.NamespaceSystem,
-			Name:      node.Name,
-		}
-
-		if err := w.Client.Get(ctx, nodeKey, &targetnode); err != nil {
-			// If there is an error getting the Pod, do not set any conditions.
-			if apierrors.IsNotFound(err) {
-				conditions.MarkFalse(machine, controlplanev1.MachineAgentHealthyCondition, controlplanev1.PodMissingReason, clusterv1.ConditionSeverityError, "Node %s is missing", nodeKey.Name)
-
-				return
-			}
-			conditions.MarkUnknown(machine, controlplanev1.MachineAgentHealthyCondition, controlplanev1.PodInspectionFailedReason, "Failed to get node status")
-			return
-		}
-
-		for _, condition := range targetnode.Status.Conditions {
-			if condition.Type == corev1.NodeReady && condition.Status == corev1.ConditionTrue {
-				conditions.MarkTrue(machine, controlplanev1.MachineAgentHealthyCondition)
-			}
+		// The control plane components run within the k3s server process, so their health follows the node readiness.
+		nodeCopy := node
+		if !util.IsNodeReady(&nodeCopy) {
+			conditions.MarkFalse(machine, controlplanev1.MachineAgentHealthyCondition, controlplanev1.PodFailedReason, clusterv1.ConditionSeverityError, "Node %s is not ready", node.Name)
+			continue
 		}
+		conditions.MarkTrue(machine, controlplanev1.MachineAgentHealthyCondition)
 	}
 
 	// If there are provisioned machines without corresponding nodes, report this as a failing conditions with SeverityError.
@@ -324,7 +318,9 @@ func aggregateFromMachinesToKCP(input aggregateFromMachinesToKCPInput) {
 // This operation is best effort, in the sense that in case of problems in retrieving member status, it sets
 // the condition to Unknown state without returning any error.
 func (w *Workload) UpdateEtcdConditions(ctx context.Context, controlPlane *ControlPlane) {
-	w.updateManagedEtcdConditions(ctx, controlPlane)
+	if controlPlane.IsEtcdManaged() {
+		w.updateManagedEtcdConditions(ctx, controlPlane)
+	}
 }
 
 func (w *Workload) updateManagedEtcdConditions(ctx context.Context, controlPlane *ControlPlane) {
@@ -362,6 +358,77 @@ func (w *Workload) updateManagedEtcdConditions(ctx context.Context, controlPlane
 			continue
 		}
 
+		// If the node is Unreachable, the member status can't be determined.
+		if nodeHasUnreachableTaint(node) {
+			conditions.MarkUnknown(machine, controlplanev1.MachineEtcdMemberHealthyCondition, controlplanev1.EtcdMemberInspectionFailedReason, "Node is unreachable")
+			continue
+		}
+
+		// The embedded etcd runs within the k3s server process, so a server node that isn't ready is hosting an unhealthy member.
+		nodeCopy := node
+		if !util.IsNodeReady(&nodeCopy) {
+			conditions.MarkFalse(machine, controlplanev1.MachineEtcdMemberHealthyCondition, controlplanev1.EtcdMemberUnhealthyReason, clusterv1.ConditionSeverityError, "Node %s is not ready", node.Name)
+			continue
+		}
+
 		conditions.MarkTrue(machine, controlplanev1.MachineEtcdMemberHealthyCondition)
 	}
+
+	// If there are provisioned machines without corresponding nodes, their etcd member is not part of the cluster anymore.
+	for _, machine := range controlPlane.Machines {
+		if machine.Status.NodeRef == nil || !machine.ObjectMeta.DeletionTimestamp.IsZero() {
+			continue
+		}
+		found := false
+		for _, node := range controlPlaneNodes.Items {
+			if machine.Status.NodeRef.Name == node.Name {
+				found = true
+				break
+			}
+		}
+		if !found {
+			conditions.MarkFalse(machine, controlplanev1.MachineEtcdMemberHealthyCondition, controlplanev1.EtcdMemberUnhealthyReason, clusterv1.ConditionSeverityError, "Missing node")
+		}
+	}
+
+	updateEtcdClusterHealthyCondition(controlPlane)
+}
+
+// updateEtcdClusterHealthyCondition aggregates the health of the etcd members at KCP level, reporting whether the
+// etcd cluster lost quorum or is still able to tolerate the failure of its unhealthy members.
+func updateEtcdClusterHealthyCondition(controlPlane *ControlPlane) {
+	members := 0
+	unhealthyMembers := []string{}
+	for _, machine := range controlPlane.Machines {
+		if !machine.ObjectMeta.DeletionTimestamp.IsZero() || conditions.Get(machine, controlplanev1.MachineEtcdMemberHealthyCondition) == nil {
+			continue
+		}
+		members++
+		if !conditions.IsTrue(machine, controlplanev1.MachineEtcdMemberHealthyCondition) {
+			unhealthyMembers = append(unhealthyMembers, machine.Name)
+		}
+	}
+
+	// This should happen only if there are no provisioned machines, and thus no members to report on.
+	if members == 0 {
+		return
+	}
+
+	sort.Strings(unhealthyMembers)
+
+	// See https://etcd.io/docs/v3.3/faq/#what-is-failure-tolerance for the quorum formula.
+	quorum := members/2 + 1
+	if healthyMembers := members - len(unhealthyMembers); healthyMembers < quorum {
+		conditions.MarkFalse(controlPlane.KCP, controlplanev1.EtcdClusterHealthyCondition, controlplanev1.EtcdQuorumLostReason, clusterv1.ConditionSeverityError,
+			"Only %d of %d etcd members are healthy, %d are required for quorum; unhealthy members: %s", healthyMembers, members, quorum, strings.Join(unhealthyMembers, ", "))
+		return
+	}
+
+	if len(unhealthyMembers) > 0 {
+		conditions.MarkFalse(controlPlane.KCP, controlplanev1.EtcdClusterHealthyCondition, controlplanev1.EtcdMemberUnhealthyReason, clusterv1.ConditionSeverityWarning,
+			"Following machines are reporting unhealthy etcd members: %s", strings.Join(unhealthyMembers, ", "))
+		return
+	}
+
+	conditions.MarkTrue(controlPlane.KCP, controlplanev1.EtcdClusterHealthyCondition)
 }
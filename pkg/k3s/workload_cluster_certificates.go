@@ -0,0 +1,50 @@
+package k3s
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrlclient "sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// servingCertificateSecretName is the secret where the k3s servers store the certificate they all serve the apiserver with.
+const servingCertificateSecretName = "k3s-serving"
+
+// CertificatesExpiry returns the earliest expiry of the certificates served by the k3s servers.
+func (w *Workload) CertificatesExpiry(ctx context.Context) (time.Time, error) {
+	secret := &corev1.Secret{}
+	key := ctrlclient.ObjectKey{Namespace: metav1.NamespaceSystem, Name: servingCertificateSecretName}
+	if err := w.Client.Get(ctx, key, secret); err != nil {
+		return time.Time{}, fmt.Errorf("failed to get serving certificate secret %s: %w", key, err)
+	}
+
+	var expiry time.Time
+	rest := secret.Data[corev1.TLSCertKey]
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("failed to parse serving certificate from secret %s: %w", key, err)
+		}
+		if expiry.IsZero() || cert.NotAfter.Before(expiry) {
+			expiry = cert.NotAfter
+		}
+	}
+
+	if expiry.IsZero() {
+		return time.Time{}, fmt.Errorf("secret %s has no certificate under the %s key", key, corev1.TLSCertKey)
+	}
+	return expiry, nil
+}
@@ -0,0 +1,62 @@
+package k3s
+
+import (
+	"context"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1beta1"
+	"sigs.k8s.io/cluster-api/util/patch"
+	ctrl "sigs.k8s.io/controller-runtime"
+	ctrlclient "sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// etcdRemoveAnnotation asks the k3s etcd controller running on the servers to remove the node's etcd member.
+	etcdRemoveAnnotation = "etcd.k3s.cattle.io/remove"
+	// etcdRemovedNodeNameAnnotation is set by the k3s etcd controller once the node's etcd member has been removed.
+	etcdRemovedNodeNameAnnotation = "etcd.k3s.cattle.io/removed-node-name"
+)
+
+// RemoveEtcdMemberForMachine removes the etcd member of the given machine through the k3s etcd controller.
+// Removal is asynchronous, the returned bool reports whether the member is gone, in which case the machine can be
+// safely deleted. Machines without a node, or whose node no longer exists, have no member to remove.
+func (w *Workload) RemoveEtcdMemberForMachine(ctx context.Context, machine *clusterv1.Machine) (bool, error) {
+	if machine == nil || machine.Status.NodeRef == nil {
+		return true, nil
+	}
+
+	node := &corev1.Node{}
+	if err := w.Client.Get(ctx, ctrlclient.ObjectKey{Name: machine.Status.NodeRef.Name}, node); err != nil {
+		if apierrors.IsNotFound(err) {
+			return true, nil
+		}
+		return false, fmt.Errorf("failed to get node %s: %w", machine.Status.NodeRef.Name, err)
+	}
+
+	if _, ok := node.Annotations[etcdRemovedNodeNameAnnotation]; ok {
+		return true, nil
+	}
+
+	if node.Annotations[etcdRemoveAnnotation] == "true" {
+		return false, nil
+	}
+
+	patchHelper, err := patch.NewHelper(node, w.Client)
+	if err != nil {
+		return false, fmt.Errorf("failed to create patch helper for node %s: %w", node.Name, err)
+	}
+
+	if node.Annotations == nil {
+		node.Annotations = map[string]string{}
+	}
+	node.Annotations[etcdRemoveAnnotation] = "true"
+
+	if err := patchHelper.Patch(ctx, node); err != nil {
+		return false, fmt.Errorf("failed to request etcd member removal for node %s: %w", node.Name, err)
+	}
+	ctrl.LoggerFrom(ctx).Info("Requested etcd member removal", "node", node.Name)
+
+	return false, nil
+}
@@ -0,0 +1,78 @@
+package k3s
+
+import (
+	"context"
+	"fmt"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/utils/pointer"
+	ctrlclient "sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// etcdSnapshotImage runs the snapshot jobs, it is the busybox image k3s ships for its local storage
+// provisioner, so it is available wherever k3s images are, including air-gapped installs.
+const etcdSnapshotImage = "rancher/mirrored-library-busybox:1.36.1"
+
+// etcdSnapshotJobTTL is how long a completed snapshot job is kept around for inspection.
+const etcdSnapshotJobTTL = 24 * 60 * 60
+
+// TakeEtcdSnapshot takes an on-demand etcd snapshot with the given name, and returns true once it is saved.
+// The snapshot is taken by a job running `k3s etcd-snapshot save` on one of the servers, in the host namespaces,
+// so it is stored like the scheduled snapshots and uploaded to S3 when the servers are configured to.
+// The job is named after the snapshot, so calling this again checks on the snapshot already requested.
+func (w *Workload) TakeEtcdSnapshot(ctx context.Context, name string) (bool, error) {
+	job := &batchv1.Job{}
+	key := ctrlclient.ObjectKey{Namespace: metav1.NamespaceSystem, Name: name}
+	if err := w.Client.Get(ctx, key, job); err != nil {
+		if !apierrors.IsNotFound(err) {
+			return false, fmt.Errorf("failed to get etcd snapshot job %s: %w", key, err)
+		}
+		if err := w.Client.Create(ctx, newEtcdSnapshotJob(name)); err != nil {
+			return false, fmt.Errorf("failed to create etcd snapshot job %s: %w", key, err)
+		}
+		return false, nil
+	}
+
+	if job.Status.Succeeded > 0 {
+		return true, nil
+	}
+	for _, condition := range job.Status.Conditions {
+		if condition.Type == batchv1.JobFailed && condition.Status == corev1.ConditionTrue {
+			return false, fmt.Errorf("etcd snapshot job %s failed: %s, delete the job to retry", key, condition.Message)
+		}
+	}
+	return false, nil
+}
+
+func newEtcdSnapshotJob(name string) *batchv1.Job {
+	return &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: metav1.NamespaceSystem,
+		},
+		Spec: batchv1.JobSpec{
+			BackoffLimit:            pointer.Int32(3),
+			TTLSecondsAfterFinished: pointer.Int32(etcdSnapshotJobTTL),
+			Template: corev1.PodTemplateSpec{
+				Spec: corev1.PodSpec{
+					RestartPolicy: corev1.RestartPolicyNever,
+					HostPID:       true,
+					NodeSelector:  map[string]string{labelNodeRoleControlPlane: "true"},
+					Tolerations:   []corev1.Toleration{{Operator: corev1.TolerationOpExists}},
+					Containers: []corev1.Container{{
+						Name:  "etcd-snapshot",
+						Image: etcdSnapshotImage,
+						Command: []string{
+							"nsenter", "--target", "1", "--mount", "--uts", "--ipc", "--net", "--pid", "--",
+							"k3s", "etcd-snapshot", "save", "--name", name,
+						},
+						SecurityContext: &corev1.SecurityContext{Privileged: pointer.Bool(true)},
+					}},
+				},
+			},
+		},
+	}
+}
@@ -0,0 +1,69 @@
+package k3s
+
+import (
+	"context"
+	"testing"
+
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1beta1"
+	ctrlclient "sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func machineWithNode(nodeName string) *clusterv1.Machine {
+	machine := &clusterv1.Machine{ObjectMeta: metav1.ObjectMeta{Name: "machine"}}
+	if nodeName != "" {
+		machine.Status.NodeRef = &corev1.ObjectReference{Name: nodeName}
+	}
+	return machine
+}
+
+func TestRemoveEtcdMemberForMachine(t *testing.T) {
+	t.Run("removal is requested once and completes when k3s reports it", func(t *testing.T) {
+		g := NewWithT(t)
+		ctx := context.Background()
+
+		node := &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "cp-0"}}
+		w := &Workload{Client: fake.NewClientBuilder().WithObjects(node).Build()}
+
+		removed, err := w.RemoveEtcdMemberForMachine(ctx, machineWithNode("cp-0"))
+		g.Expect(err).NotTo(HaveOccurred())
+		g.Expect(removed).To(BeFalse())
+
+		g.Expect(w.Client.Get(ctx, ctrlclient.ObjectKey{Name: "cp-0"}, node)).To(Succeed())
+		g.Expect(node.Annotations).To(HaveKeyWithValue(etcdRemoveAnnotation, "true"))
+		resourceVersion := node.ResourceVersion
+
+		// Removal already requested, the node is not patched again.
+		removed, err = w.RemoveEtcdMemberForMachine(ctx, machineWithNode("cp-0"))
+		g.Expect(err).NotTo(HaveOccurred())
+		g.Expect(removed).To(BeFalse())
+		g.Expect(w.Client.Get(ctx, ctrlclient.ObjectKey{Name: "cp-0"}, node)).To(Succeed())
+		g.Expect(node.ResourceVersion).To(Equal(resourceVersion))
+
+		// k3s marks the node once the member is removed.
+		node.Annotations[etcdRemovedNodeNameAnnotation] = "cp-0"
+		g.Expect(w.Client.Update(ctx, node)).To(Succeed())
+
+		removed, err = w.RemoveEtcdMemberForMachine(ctx, machineWithNode("cp-0"))
+		g.Expect(err).NotTo(HaveOccurred())
+		g.Expect(removed).To(BeTrue())
+	})
+
+	t.Run("removal is skipped when there is no member", func(t *testing.T) {
+		g := NewWithT(t)
+		ctx := context.Background()
+
+		w := &Workload{Client: fake.NewClientBuilder().Build()}
+
+		removed, err := w.RemoveEtcdMemberForMachine(ctx, machineWithNode(""))
+		g.Expect(err).NotTo(HaveOccurred())
+		g.Expect(removed).To(BeTrue())
+
+		removed, err = w.RemoveEtcdMemberForMachine(ctx, machineWithNode("gone"))
+		g.Expect(err).NotTo(HaveOccurred())
+		g.Expect(removed).To(BeTrue())
+	})
+}
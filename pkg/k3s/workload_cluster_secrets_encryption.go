@@ -0,0 +1,33 @@
+package k3s
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// secretsEncryptionHashAnnotation is where every k3s server reports its secrets encryption state, as the current
+// stage followed by a hash of the encryption configuration, e.g. "reencrypt_finished-<hash>".
+const secretsEncryptionHashAnnotation = "encryption.k3s.cattle.io/hash"
+
+// Secrets encryption stages the k3s servers settle in once an operation completed.
+const (
+	SecretsEncryptionStageStart             = "start"
+	SecretsEncryptionStageReencryptFinished = "reencrypt_finished"
+)
+
+// SecretsEncryptionStages returns the secrets encryption stage reported by each control plane node, by node name.
+// Nodes that did not report a stage yet are returned with an empty one.
+func (w *Workload) SecretsEncryptionStages(ctx context.Context) (map[string]string, error) {
+	nodes, err := w.getControlPlaneNodes(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list control plane nodes: %w", err)
+	}
+
+	stages := make(map[string]string, len(nodes.Items))
+	for _, node := range nodes.Items {
+		stage, _, _ := strings.Cut(node.Annotations[secretsEncryptionHashAnnotation], "-")
+		stages[node.Name] = stage
+	}
+	return stages, nil
+}
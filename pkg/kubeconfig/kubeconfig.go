@@ -133,7 +133,12 @@ func CreateSecret(ctx context.Context, c client.Client, cluster *clusterv1.Clust
 
 // CreateSecretWithOwner creates the Kubeconfig secret for the given cluster name, namespace, endpoint, and owner reference.
 func CreateSecretWithOwner(ctx context.Context, c client.Client, clusterName client.ObjectKey, endpoint string, owner metav1.OwnerReference) error {
-	server := fmt.Sprintf("https://%s", endpoint)
+	return CreateSecretWithServer(ctx, c, clusterName, fmt.Sprintf("https://%s", endpoint), owner)
+}
+
+// CreateSecretWithServer creates the Kubeconfig secret for the given cluster name and namespace, pointing at the given
+// server URL, with the given owner reference.
+func CreateSecretWithServer(ctx context.Context, c client.Client, clusterName client.ObjectKey, server string, owner metav1.OwnerReference) error {
 	out, err := generateKubeconfig(ctx, c, clusterName, server)
 	if err != nil {
 		return err
@@ -142,6 +147,33 @@ func CreateSecretWithOwner(ctx context.Context, c client.Client, clusterName cli
 	return c.Create(ctx, GenerateSecretWithOwner(clusterName, out, owner))
 }
 
+// UpdateServer points the clusters of the kubeconfig stored in the given secret at the given server URL, keeping
+// the credentials. The secret is only updated if the server URL changed.
+func UpdateServer(ctx context.Context, c client.Client, configSecret *corev1.Secret, server string) error {
+	config, err := clientcmd.Load(configSecret.Data[secret.KubeconfigDataName])
+	if err != nil {
+		return fmt.Errorf("failed to parse kubeconfig: %w", err)
+	}
+
+	changed := false
+	for _, cluster := range config.Clusters {
+		if cluster.Server != server {
+			cluster.Server = server
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+
+	out, err := clientcmd.Write(*config)
+	if err != nil {
+		return fmt.Errorf("failed to serialize config to yaml: %w", err)
+	}
+	configSecret.Data[secret.KubeconfigDataName] = out
+	return c.Update(ctx, configSecret)
+}
+
 // GenerateSecret returns a Kubernetes secret for the given Cluster and kubeconfig data.
 func GenerateSecret(cluster *clusterv1.Cluster, data []byte) *corev1.Secret {
 	name := util.ObjectKey(cluster)
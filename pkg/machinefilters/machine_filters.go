@@ -17,10 +17,14 @@ limitations under the License.
 package machinefilters
 
 import (
+	"path"
+	"reflect"
+
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/selection"
+	"k8s.io/apimachinery/pkg/util/sets"
 	clusterv1 "sigs.k8s.io/cluster-api/api/v1beta1"
 	"sigs.k8s.io/cluster-api/util"
 	"sigs.k8s.io/cluster-api/util/conditions"
@@ -137,6 +141,14 @@ func HasDeletionTimestamp(machine *clusterv1.Machine) bool {
 	return !machine.DeletionTimestamp.IsZero()
 }
 
+// HasNodeRef returns a filter to find all machines that have a node.
+func HasNodeRef(machine *clusterv1.Machine) bool {
+	if machine == nil {
+		return false
+	}
+	return machine.Status.NodeRef != nil
+}
+
 // HasUnhealthyCondition returns a filter to find all machines that have a MachineHealthCheckSucceeded condition set to False,
 // indicating a problem was detected on the machine, and the MachineOwnerRemediated condition set, indicating that KCP is
 // responsible of performing remediation as owner of the machine.
@@ -157,6 +169,17 @@ func IsReady() Func {
 	}
 }
 
+// IsEtcdMemberHealthy returns a filter to find all machines with the EtcdMemberHealthy condition equals to True,
+// i.e. machines whose server joined the embedded etcd cluster.
+func IsEtcdMemberHealthy() Func {
+	return func(machine *clusterv1.Machine) bool {
+		if machine == nil {
+			return false
+		}
+		return conditions.IsTrue(machine, controlplanev1.MachineEtcdMemberHealthyCondition)
+	}
+}
+
 // ShouldRolloutAfter returns a filter to find all machines where
 // CreationTimestamp < rolloutAfter < reconciliationTIme.
 func ShouldRolloutAfter(reconciliationTime, rolloutAfter *metav1.Time) Func {
@@ -251,8 +274,55 @@ func MatchesKubernetesVersion(kubernetesVersion string) Func {
 }
 
 // MatchesKThreesBootstrapConfig checks if machine's KThreesConfigSpec is equivalent with KCP's KThreesConfigSpec.
+// Only the settings a running server does not pick up are compared, so changing them on the KCP rolls out the
+// machines: the packaged components disabled on the servers, the etcd quota, the auto-deployed manifests, and
+// enabling secrets encryption.
+// Disabling secrets encryption is left to `k3s secrets-encrypt disable`, since servers without the flag could not
+// read the secrets encrypted so far.
 func MatchesKThreesBootstrapConfig(machineConfigs map[string]*bootstrapv1.KThreesConfig, kcp *controlplanev1.KThreesControlPlane) Func {
 	return func(machine *clusterv1.Machine) bool {
-		return true
+		if machine == nil {
+			return false
+		}
+		machineConfig, found := machineConfigs[machine.Name]
+		if !found {
+			// Return true here because failing to get the bootstrap config should not be considered as unmatching.
+			return true
+		}
+
+		machineServerConfig := machineConfig.Spec.ServerConfig
+		kcpServerConfig := kcp.Spec.KThreesConfigSpec.ServerConfig
+		if kcpServerConfig.SecretsEncryptionEnabled() && !machineServerConfig.SecretsEncryptionEnabled() {
+			return false
+		}
+		if arg := kcp.EtcdQuotaBackendBytesArg(); arg != "" && !sets.NewString(machineServerConfig.EtcdArgs...).Has(arg) {
+			return false
+		}
+		manifestsDir := kcp.ManifestsDir()
+		if !reflect.DeepEqual(manifests(machineConfig.Spec.Files, manifestsDir), manifests(kcp.ManifestFiles(), manifestsDir)) {
+			return false
+		}
+
+		return disabledComponents(machineServerConfig.DisableComponents).Equal(disabledComponents(kcpServerConfig.DisableComponents))
+	}
+}
+
+// disabledComponents returns the given components as a set, their order does not matter to k3s.
+func disabledComponents(components []bootstrapv1.DisabledComponent) sets.String {
+	set := sets.NewString()
+	for _, c := range components {
+		set.Insert(string(c))
+	}
+	return set
+}
+
+// manifests returns the content of the given files written to the given auto-deploy directory, by path.
+func manifests(files []bootstrapv1.File, manifestsDir string) map[string]string {
+	manifests := map[string]string{}
+	for _, f := range files {
+		if path.Dir(f.Path) == manifestsDir {
+			manifests[f.Path] = f.Content
+		}
 	}
+	return manifests
 }
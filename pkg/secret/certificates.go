@@ -17,16 +17,19 @@ limitations under the License.
 package secret
 
 import (
+	"bytes"
 	"context"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha256"
+	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"encoding/hex"
 	"errors"
 	"fmt"
 	"math/big"
+	"path"
 	"path/filepath"
 	"strings"
 	"time"
@@ -45,7 +48,13 @@ import (
 const (
 	rootOwnerValue = "root:root"
 
-	DefaultCertificatesDir = "/var/lib/rancher/k3s/server/tls"
+	// certificatesSubdir is where k3s reads the cluster CAs from, under its data dir.
+	certificatesSubdir = "server/tls"
+
+	// DefaultCertificatesDir is where k3s reads the cluster CAs from with the default data dir.
+	//
+	// Deprecated: the CAs are written under the data dir of the config, see KThreesConfigSpec.K3sDataDir.
+	DefaultCertificatesDir = bootstrapv1.DefaultDataDir + "/" + certificatesSubdir
 )
 
 var (
@@ -66,7 +75,7 @@ type Certificates []*Certificate
 
 // NewCertificatesForInitialControlPlane returns a list of certificates configured for a control plane node.
 func NewCertificatesForInitialControlPlane(config *bootstrapv1.KThreesConfigSpec) Certificates {
-	certificatesDir := DefaultCertificatesDir
+	certificatesDir := filepath.Join(config.K3sDataDir(), certificatesSubdir)
 
 	certificates := Certificates{
 		&Certificate{
@@ -197,6 +206,84 @@ func (c Certificates) LookupOrGenerate(ctx context.Context, ctrlclient client.Cl
 	return nil
 }
 
+// LookupSupplied populates the certificates with the CAs users supplied in the given secret, each as a certificate
+// and key pair named after the files k3s reads, see SuppliedDataName. Every pair must be a valid CA with its key.
+func (c Certificates) LookupSupplied(ctx context.Context, ctrlclient client.Client, secretKey client.ObjectKey) error {
+	s := &corev1.Secret{}
+	if err := ctrlclient.Get(ctx, secretKey, s); err != nil {
+		return fmt.Errorf("failed to get CA certificates secret %s: %w", secretKey, err)
+	}
+
+	for _, certificate := range c {
+		certName, keyName := SuppliedDataName(certificate.CertFile), SuppliedDataName(certificate.KeyFile)
+		kp := &certs.KeyPair{Cert: s.Data[certName], Key: s.Data[keyName]}
+		if len(kp.Cert) == 0 {
+			return fmt.Errorf("CA certificates secret %s has no %s: %w", secretKey, certName, ErrMissingCrt)
+		}
+		if len(kp.Key) == 0 {
+			return fmt.Errorf("CA certificates secret %s has no %s: %w", secretKey, keyName, ErrMissingKey)
+		}
+		if err := validateCAKeyPair(kp); err != nil {
+			return fmt.Errorf("CA certificates secret %s holds an invalid %s: %w", secretKey, certName, err)
+		}
+		certificate.KeyPair = kp
+	}
+	return nil
+}
+
+// SaveSupplied stores the supplied certificates in the cluster certificate secrets read by the bootstrap provider,
+// it refuses to replace a different CA the cluster may already use.
+func (c Certificates) SaveSupplied(ctx context.Context, ctrlclient client.Client, clusterName client.ObjectKey, owner metav1.OwnerReference) error {
+	for _, certificate := range c {
+		s := &corev1.Secret{}
+		key := client.ObjectKey{Namespace: clusterName.Namespace, Name: Name(clusterName.Name, certificate.Purpose)}
+		if err := ctrlclient.Get(ctx, key, s); err != nil {
+			if !apierrors.IsNotFound(err) {
+				return err
+			}
+			s = certificate.AsSecret(clusterName, owner)
+			s.OwnerReferences = []metav1.OwnerReference{owner}
+			if err := ctrlclient.Create(ctx, s); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if !bytes.Equal(s.Data[TLSCrtDataName], certificate.KeyPair.Cert) || !bytes.Equal(s.Data[TLSKeyDataName], certificate.KeyPair.Key) {
+			return fmt.Errorf("certificate secret %s already holds a different CA", key.Name)
+		}
+	}
+	return nil
+}
+
+// SuppliedDataName returns the key under which a secret supplied by users holds the given certificate file, the
+// file path relative to the certificates directory of k3s with dashes for separators, e.g. etcd-server-ca.crt for
+// etcd/server-ca.crt. The key does not depend on the data dir of k3s.
+func SuppliedDataName(file string) string {
+	file = filepath.ToSlash(file)
+	rel := path.Base(file)
+	if i := strings.LastIndex(file, "/"+certificatesSubdir+"/"); i >= 0 {
+		rel = file[i+len(certificatesSubdir)+2:]
+	}
+	return strings.ReplaceAll(rel, "/", "-")
+}
+
+// validateCAKeyPair checks the key pair holds a PEM encoded CA certificate and its private key.
+func validateCAKeyPair(kp *certs.KeyPair) error {
+	if _, err := tls.X509KeyPair(kp.Cert, kp.Key); err != nil {
+		return err
+	}
+
+	certificates, err := cert.ParseCertsPEM(kp.Cert)
+	if err != nil {
+		return err
+	}
+	if !certificates[0].IsCA {
+		return errors.New("certificate is not a CA")
+	}
+	return nil
+}
+
 // Certificate represents a single certificate CA.
 type Certificate struct {
 	Generated         bool
@@ -14,6 +14,9 @@ import (
 	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
 )
 
+// nextKey holds the token a rotation in progress switches the cluster to.
+const nextKey = "next"
+
 func Lookup(ctx context.Context, ctrlclient client.Client, clusterKey client.ObjectKey) (*string, error) {
 	var s *corev1.Secret
 	var err error
@@ -29,6 +32,46 @@ func Lookup(ctx context.Context, ctrlclient client.Client, clusterKey client.Obj
 	return nil, fmt.Errorf("found token secret without value")
 }
 
+// LookupSupplied returns the token users supplied in the given secret, under the same value key as the
+// generated token secret.
+func LookupSupplied(ctx context.Context, ctrlclient client.Client, secretKey client.ObjectKey) (string, error) {
+	s := &corev1.Secret{}
+	if err := ctrlclient.Get(ctx, secretKey, s); err != nil {
+		return "", fmt.Errorf("failed to get token secret %s: %w", secretKey, err)
+	}
+
+	val, ok := s.Data["value"]
+	if !ok || len(val) == 0 {
+		return "", fmt.Errorf("token secret %s has no value", secretKey)
+	}
+	return string(val), nil
+}
+
+// ReconcileSupplied stores the supplied token in the cluster token secret read by joining nodes, it refuses to
+// replace a different token the cluster may already use.
+func ReconcileSupplied(ctx context.Context, ctrlclient client.Client, clusterKey client.ObjectKey, owner client.Object, tokn string) error {
+	s, err := getSecret(ctx, ctrlclient, clusterKey)
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return store(ctx, ctrlclient, clusterKey, owner, tokn)
+		}
+		return fmt.Errorf("failed to lookup token: %v", err)
+	}
+
+	if string(s.Data["value"]) != tokn {
+		return fmt.Errorf("token secret %s already holds a different token", name(clusterKey.Name))
+	}
+
+	if !metav1.IsControlledBy(s, owner) {
+		upsertControllerRef(s, owner)
+		if err := ctrlclient.Update(ctx, s); err != nil {
+			return fmt.Errorf("failed to update ownership of token: %v", err)
+		}
+	}
+
+	return nil
+}
+
 func Reconcile(ctx context.Context, ctrlclient client.Client, clusterKey client.ObjectKey, owner client.Object) error {
 	var s *corev1.Secret
 	var err error
@@ -54,6 +97,60 @@ func Reconcile(ctx context.Context, ctrlclient client.Client, clusterKey client.
 	return nil
 }
 
+// LookupNext returns the token a rotation in progress switches the cluster to, or nil if there is none.
+func LookupNext(ctx context.Context, ctrlclient client.Client, clusterKey client.ObjectKey) (*string, error) {
+	s, err := getSecret(ctx, ctrlclient, clusterKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to lookup token: %v", err)
+	}
+	if val, ok := s.Data[nextKey]; ok {
+		ret := string(val)
+		return &ret, nil
+	}
+	return nil, nil
+}
+
+// StageRotation generates the token the cluster is rotated to, next to the current one. Nodes keep joining with
+// the current token until CompleteRotation is called.
+func StageRotation(ctx context.Context, ctrlclient client.Client, clusterKey client.ObjectKey) error {
+	s, err := getSecret(ctx, ctrlclient, clusterKey)
+	if err != nil {
+		return fmt.Errorf("failed to lookup token: %v", err)
+	}
+	if _, ok := s.Data[nextKey]; ok {
+		return nil
+	}
+
+	next, err := randomB64(16)
+	if err != nil {
+		return fmt.Errorf("failed to generate token: %v", err)
+	}
+	s.Data[nextKey] = []byte(next)
+	if err := ctrlclient.Update(ctx, s); err != nil {
+		return fmt.Errorf("failed to stage token rotation: %v", err)
+	}
+	return nil
+}
+
+// CompleteRotation makes the staged token the one joining nodes use, once the cluster has been switched to it.
+func CompleteRotation(ctx context.Context, ctrlclient client.Client, clusterKey client.ObjectKey) error {
+	s, err := getSecret(ctx, ctrlclient, clusterKey)
+	if err != nil {
+		return fmt.Errorf("failed to lookup token: %v", err)
+	}
+	next, ok := s.Data[nextKey]
+	if !ok {
+		return nil
+	}
+
+	s.Data["value"] = next
+	delete(s.Data, nextKey)
+	if err := ctrlclient.Update(ctx, s); err != nil {
+		return fmt.Errorf("failed to complete token rotation: %v", err)
+	}
+	return nil
+}
+
 // randomB64 generates a cryptographically secure random byte slice of length size and returns its base64 encoding.
 func randomB64(size int) (string, error) {
 	token := make([]byte, size)
@@ -88,6 +185,14 @@ func generateAndStore(ctx context.Context, ctrlclient client.Client, clusterKey
 		return nil, fmt.Errorf("failed to generate token: %v", err)
 	}
 
+	if err := store(ctx, ctrlclient, clusterKey, owner, tokn); err != nil {
+		return nil, err
+	}
+
+	return &tokn, nil
+}
+
+func store(ctx context.Context, ctrlclient client.Client, clusterKey client.ObjectKey, owner client.Object, tokn string) error {
 	secret := &corev1.Secret{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      name(clusterKey.Name),
@@ -108,10 +213,10 @@ func generateAndStore(ctx context.Context, ctrlclient client.Client, clusterKey
 	// as secret creation and scope.Config status patch are not atomic operations
 	// it is possible that secret creation happens but the config.Status patches are not applied
 	if err := ctrlclient.Create(ctx, secret); err != nil {
-		return nil, fmt.Errorf("failed to store token: %v", err)
+		return fmt.Errorf("failed to store token: %v", err)
 	}
 
-	return &tokn, nil
+	return nil
 }
 
 // upsertControllerRef takes controllee and controller objects, either replaces the existing controller ref
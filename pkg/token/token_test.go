@@ -133,6 +133,52 @@ func TestReconcile(t *testing.T) {
 	}
 }
 
+func TestRotation(t *testing.T) {
+	ctx := context.Background()
+	clusterKey := client.ObjectKey{Name: "test-cluster", Namespace: "default"}
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: name(clusterKey.Name), Namespace: clusterKey.Namespace},
+		Data:       map[string][]byte{"value": []byte("current-token")},
+	}
+	ctrlClient := fake.NewClientBuilder().WithObjects(secret).Build()
+
+	// Test case: no rotation in progress
+	if next, err := LookupNext(ctx, ctrlClient, clusterKey); next != nil || err != nil {
+		t.Errorf("LookupNext() returned unexpected result. Expected: nil, Actual: %v, error: %v", next, err)
+	}
+
+	// Phase one: the new token is staged, joining nodes keep using the current one
+	if err := StageRotation(ctx, ctrlClient, clusterKey); err != nil {
+		t.Errorf("StageRotation() returned unexpected error: %v", err)
+	}
+	next, err := LookupNext(ctx, ctrlClient, clusterKey)
+	if next == nil || *next == "" || *next == "current-token" || err != nil {
+		t.Fatalf("LookupNext() returned unexpected result after staging: %v, error: %v", next, err)
+	}
+	if tokn, err := Lookup(ctx, ctrlClient, clusterKey); tokn == nil || *tokn != "current-token" || err != nil {
+		t.Errorf("Lookup() returned unexpected result while rotating. Expected: current-token, Actual: %v, error: %v", tokn, err)
+	}
+
+	// Staging again keeps the same new token
+	if err := StageRotation(ctx, ctrlClient, clusterKey); err != nil {
+		t.Errorf("StageRotation() returned unexpected error: %v", err)
+	}
+	if again, err := LookupNext(ctx, ctrlClient, clusterKey); again == nil || *again != *next || err != nil {
+		t.Errorf("StageRotation() replaced the staged token. Expected: %v, Actual: %v, error: %v", *next, again, err)
+	}
+
+	// Phase two: joining nodes switch to the new token
+	if err := CompleteRotation(ctx, ctrlClient, clusterKey); err != nil {
+		t.Errorf("CompleteRotation() returned unexpected error: %v", err)
+	}
+	if tokn, err := Lookup(ctx, ctrlClient, clusterKey); tokn == nil || *tokn != *next || err != nil {
+		t.Errorf("Lookup() returned unexpected result after rotating. Expected: %v, Actual: %v, error: %v", *next, tokn, err)
+	}
+	if staged, err := LookupNext(ctx, ctrlClient, clusterKey); staged != nil || err != nil {
+		t.Errorf("LookupNext() returned unexpected result after rotating. Expected: nil, Actual: %v, error: %v", staged, err)
+	}
+}
+
 func TestUpsertControllerRef(t *testing.T) {
 	// Helper function to create a new instance of TestObject
 	newPod := func(name string) *corev1.Pod {
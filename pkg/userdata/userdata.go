@@ -0,0 +1,272 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package userdata renders the bootstrap data of a KThreesConfig without talking to the API server, everything
+// the config references is resolved by the caller and passed in through JoinInfo.
+package userdata
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net"
+	"time"
+
+	"k8s.io/utils/pointer"
+	kubeyaml "sigs.k8s.io/yaml"
+
+	bootstrapv1 "github.com/cluster-api-provider-k3s/cluster-api-k3s/bootstrap/api/v1beta1"
+	"github.com/cluster-api-provider-k3s/cluster-api-k3s/pkg/cis"
+	"github.com/cluster-api-provider-k3s/cluster-api-k3s/pkg/cloudinit"
+	"github.com/cluster-api-provider-k3s/cluster-api-k3s/pkg/k3s"
+	"github.com/cluster-api-provider-k3s/cluster-api-k3s/pkg/secret"
+)
+
+// Role is the role of the node the bootstrap data is rendered for.
+type Role string
+
+const (
+	// InitControlPlane is the first server, initializing the cluster.
+	InitControlPlane Role = "init-control-plane"
+
+	// JoinControlPlane is a server joining an initialized cluster.
+	JoinControlPlane Role = "join-control-plane"
+
+	// Worker is an agent joining an initialized cluster.
+	Worker Role = "worker"
+)
+
+// JoinInfo holds what the bootstrap data needs on top of the KThreesConfigSpec: the cluster the node joins,
+// and the content of the objects the config references.
+type JoinInfo struct {
+	Role Role
+
+	// ServerURL is the URL nodes join the cluster through, unused by the initial server.
+	ServerURL string
+
+	// ControlPlaneEndpoint is the host of the cluster control plane endpoint, added to the tls-san of servers.
+	ControlPlaneEndpoint string
+
+	// Token is the token the node joins with, NewToken the one a joining server switches the cluster to
+	// when a token rotation is in progress.
+	Token    string
+	NewToken string
+
+	// Certificates are written to the initial server.
+	Certificates secret.Certificates
+
+	// Files are the files of the config with their content resolved, along with the files generated from
+	// references such as the registry configuration.
+	Files []bootstrapv1.File
+
+	// SystemProxy is the proxy of the config with the cluster networks added to NoProxy.
+	SystemProxy *bootstrapv1.SystemProxy
+
+	// EtcdS3AccessKey and EtcdS3SecretKey are the credentials of the etcd snapshot S3 bucket.
+	EtcdS3AccessKey string
+	EtcdS3SecretKey string
+
+	// DatastoreEndpoint is the endpoint of the external datastore.
+	DatastoreEndpoint string
+
+	// TemplateInput describes the Machine the node is bootstrapped for, which the NodeName and NodeLabels
+	// templates reference.
+	TemplateInput bootstrapv1.TemplateInput
+}
+
+// RenderBootstrapData returns the user data bootstrapping a node with the given config, in the format of the config.
+// The data is not compressed, that is left to the caller.
+func RenderBootstrapData(config *bootstrapv1.KThreesConfigSpec, joinInfo JoinInfo) ([]byte, error) {
+	switch {
+	case config.Role == bootstrapv1.NodeRoleAgent && joinInfo.Role != Worker:
+		return nil, fmt.Errorf("a config with the %s role cannot bootstrap a server", config.Role)
+	case config.Role == bootstrapv1.NodeRoleServer && joinInfo.Role == Worker:
+		return nil, fmt.Errorf("a config with the %s role cannot bootstrap an agent", config.Role)
+	case config.Role == bootstrapv1.NodeRoleAgent && config.ServerConfig.HasServerOnlySettings():
+		return nil, fmt.Errorf("a config with the %s role cannot hold server settings", config.Role)
+	}
+
+	if config.CISProfile != "" {
+		config, joinInfo = withCISProfile(config, joinInfo)
+	}
+
+	if config.AgentConfig.ContainerdConfigTemplate != "" {
+		joinInfo = withContainerdConfigTemplate(config, joinInfo)
+	}
+
+	agentConfig := config.AgentConfig
+	nodeName, err := agentConfig.ResolveNodeName(joinInfo.TemplateInput)
+	if err != nil {
+		return nil, err
+	}
+	agentConfig.NodeName = nodeName
+	nodeLabels, err := agentConfig.ResolveNodeLabels(joinInfo.TemplateInput)
+	if err != nil {
+		return nil, err
+	}
+	agentConfig.NodeLabels = nodeLabels
+
+	var k3sConfig interface{}
+	switch joinInfo.Role {
+	case InitControlPlane:
+		serverConfig := k3s.GenerateInitControlPlaneConfig(joinInfo.ControlPlaneEndpoint, joinInfo.Token,
+			serverConfigWithRegistrationSAN(config), agentConfig)
+		setResolvedServerConfig(&serverConfig, joinInfo)
+		serverConfig.ProtectKernelDefaults = config.CISProfile != ""
+		serverConfig.DataDir = config.DataDir
+		k3sConfig = serverConfig
+	case JoinControlPlane:
+		serverConfig := k3s.GenerateJoinControlPlaneConfig(joinInfo.ServerURL, joinInfo.Token, joinInfo.ControlPlaneEndpoint,
+			serverConfigWithRegistrationSAN(config), agentConfig)
+		setResolvedServerConfig(&serverConfig, joinInfo)
+		serverConfig.ProtectKernelDefaults = config.CISProfile != ""
+		serverConfig.DataDir = config.DataDir
+		k3sConfig = serverConfig
+	case Worker:
+		workerConfig := k3s.GenerateWorkerConfig(joinInfo.ServerURL, joinInfo.Token, config.ServerConfig, agentConfig)
+		workerConfig.ProtectKernelDefaults = config.CISProfile != ""
+		workerConfig.DataDir = config.DataDir
+		k3sConfig = workerConfig
+	default:
+		return nil, fmt.Errorf("unknown role %q", joinInfo.Role)
+	}
+
+	b, err := kubeyaml.Marshal(k3sConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	base := cloudinit.BaseUserData{
+		PreK3sCommands:  config.PreK3sCommands,
+		PostK3sCommands: config.PostK3sCommands,
+		AdditionalFiles: joinInfo.Files,
+		ConfigFile: bootstrapv1.File{
+			Path:        k3s.DefaultK3sConfigLocation,
+			Content:     string(b),
+			Owner:       "root:root",
+			Permissions: "0640",
+		},
+		K3sVersion:           config.Version,
+		InstallScriptURL:     config.InstallScriptURL,
+		Channel:              config.Channel,
+		SystemProxy:          joinInfo.SystemProxy,
+		AirgapImagesURL:      config.AirgapImagesURL,
+		AirgapImagesChecksum: config.AirgapImagesChecksum,
+		Format:               config.Format,
+		InitSystem:           config.InitSystem,
+		DataDir:              config.K3sDataDir(),
+	}
+
+	switch joinInfo.Role {
+	case InitControlPlane:
+		base.ClusterResetRestorePath = config.ServerConfig.ClusterResetRestorePath
+		base.Environment = config.ServerEnvironment
+		return cloudinit.NewInitControlPlane(&cloudinit.ControlPlaneInput{
+			BaseUserData: base,
+			Certificates: joinInfo.Certificates,
+		})
+	case JoinControlPlane:
+		base.JoinTimeout = joinTimeout(config)
+		base.Environment = config.ServerEnvironment
+		return cloudinit.NewJoinControlPlane(&cloudinit.ControlPlaneInput{
+			BaseUserData:    base,
+			Token:           joinInfo.Token,
+			NewToken:        joinInfo.NewToken,
+			HTTPSListenPort: config.ServerConfig.HTTPSListenPort,
+		})
+	default:
+		base.JoinTimeout = joinTimeout(config)
+		base.Environment = config.AgentEnvironment
+		return cloudinit.NewWorker(&cloudinit.WorkerInput{BaseUserData: base})
+	}
+}
+
+// joinTimeout returns the JoinTimeout of the config, zero when unset.
+func joinTimeout(config *bootstrapv1.KThreesConfigSpec) time.Duration {
+	if config.JoinTimeout == nil {
+		return 0
+	}
+	return config.JoinTimeout.Duration
+}
+
+// withCISProfile returns the config and join info with the settings of the CIS profile added, the caller's
+// config is left untouched. The webhook rejects user settings the profile conflicts with.
+func withCISProfile(config *bootstrapv1.KThreesConfigSpec, joinInfo JoinInfo) (*bootstrapv1.KThreesConfigSpec, JoinInfo) {
+	hardened := config.DeepCopy()
+
+	profileFiles := cis.AgentFiles()
+	preK3sCommands := cis.AgentPreK3sCommands
+	if joinInfo.Role != Worker {
+		profileFiles = cis.ServerFiles(config.K3sDataDir())
+		preK3sCommands = cis.ServerPreK3sCommands(config.K3sDataDir())
+
+		hardened.ServerConfig.KubeAPIServerArgs = append(hardened.ServerConfig.KubeAPIServerArgs, cis.KubeAPIServerArgs(config.K3sDataDir())...)
+		hardened.ServerConfig.KubeControllerManagerArgs = append(hardened.ServerConfig.KubeControllerManagerArgs, cis.KubeControllerManagerArgs...)
+		hardened.ServerConfig.SecretsEncryption = pointer.Bool(true)
+	}
+	hardened.AgentConfig.KubeletArgs = append(hardened.AgentConfig.KubeletArgs, cis.KubeletArgs...)
+	hardened.PreK3sCommands = append(append([]string{}, preK3sCommands...), hardened.PreK3sCommands...)
+
+	files := make([]bootstrapv1.File, 0, len(joinInfo.Files)+len(profileFiles))
+	files = append(files, joinInfo.Files...)
+	for _, f := range profileFiles {
+		files = append(files, bootstrapv1.File{Path: f.Path, Content: f.Content, Owner: "root:root", Permissions: f.Permissions})
+	}
+	joinInfo.Files = files
+
+	return hardened, joinInfo
+}
+
+// withContainerdConfigTemplate returns the join info with the containerd config template of the config added to
+// its files, the caller's files are left untouched. The template is base64 encoded, cloud-init would otherwise
+// render its Go template actions as Jinja ones.
+func withContainerdConfigTemplate(config *bootstrapv1.KThreesConfigSpec, joinInfo JoinInfo) JoinInfo {
+	files := make([]bootstrapv1.File, 0, len(joinInfo.Files)+1)
+	files = append(files, joinInfo.Files...)
+	joinInfo.Files = append(files, bootstrapv1.File{
+		Path:        k3s.ContainerdConfigTemplateLocation(config.K3sDataDir()),
+		Content:     base64.StdEncoding.EncodeToString([]byte(config.AgentConfig.ContainerdConfigTemplate)),
+		Encoding:    bootstrapv1.Base64,
+		Owner:       "root:root",
+		Permissions: "0600",
+	})
+	return joinInfo
+}
+
+// setResolvedServerConfig sets the server settings resolved from the objects referenced by the config.
+func setResolvedServerConfig(serverConfig *k3s.K3sServerConfig, joinInfo JoinInfo) {
+	serverConfig.EtcdS3AccessKey = joinInfo.EtcdS3AccessKey
+	serverConfig.EtcdS3SecretKey = joinInfo.EtcdS3SecretKey
+	serverConfig.DatastoreEndpoint = joinInfo.DatastoreEndpoint
+}
+
+// serverConfigWithRegistrationSAN returns the server config with the RegistrationAddress host added to the tls-san
+// list, so the certificate served behind the registration address is valid for it.
+func serverConfigWithRegistrationSAN(config *bootstrapv1.KThreesConfigSpec) bootstrapv1.KThreesServerConfig {
+	serverConfig := config.ServerConfig
+	if config.RegistrationAddress == "" {
+		return serverConfig
+	}
+
+	host, _, err := net.SplitHostPort(config.RegistrationAddress)
+	if err != nil {
+		return serverConfig
+	}
+
+	tlsSan := make([]string, 0, len(serverConfig.TLSSan)+1)
+	tlsSan = append(tlsSan, serverConfig.TLSSan...)
+	serverConfig.TLSSan = append(tlsSan, host)
+	return serverConfig
+}